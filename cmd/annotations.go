@@ -0,0 +1,74 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// version is the version of the runtime recorded by stamp-provenance. It is
+// set to LIB_VERSION by the Makefile.
+var version = "3.4.2"
+
+// The annotations set by stamp-annotations describe the GPU request processed
+// by the runtime. They are informational only.
+const (
+	visibleDevicesAnnotation = "nvidia.com/visible-devices"
+	hookStageAnnotation      = "nvidia.com/hook-stage"
+)
+
+// The annotations set by stamp-provenance record which runtime last modified
+// the spec and when.
+const (
+	runtimeVersionAnnotation = "nvidia.com/runtime-version"
+	processedAtAnnotation    = "nvidia.com/processed-at"
+)
+
+// stampAnnotations sets the annotations describing the GPU request of the
+// process in the specified spec. Specs without a request are left unchanged.
+// Existing values are replaced, so stamping a spec again has no effect.
+func stampAnnotations(spec *specs.Spec, cfg *config) {
+	name := cfg.getVisibleDevicesEnvvar()
+	if !requestsVisibleDevices(spec, name) {
+		return
+	}
+
+	hookStage := cfg.hookStage
+	if hookStage == "" {
+		hookStage = hookStagePrestart
+	}
+	visibleDevices, _ := getEnvValue(getProcessEnv(spec), name)
+
+	if spec.Annotations == nil {
+		spec.Annotations = make(map[string]string)
+	}
+	spec.Annotations[visibleDevicesAnnotation] = visibleDevices
+	spec.Annotations[hookStageAnnotation] = hookStage
+}
+
+// stampProvenance sets the annotations recording the version of the runtime
+// and the time at which it modified the specified spec. Existing values are
+// replaced.
+func stampProvenance(spec *specs.Spec, now time.Time) {
+	if spec.Annotations == nil {
+		spec.Annotations = make(map[string]string)
+	}
+	spec.Annotations[runtimeVersionAnnotation] = version
+	spec.Annotations[processedAtAnnotation] = now.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStampAnnotations(t *testing.T) {
+	spec := &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=0,1"}}}
+	cfg := &config{hookStage: hookStageCreateRuntime}
+
+	stampAnnotations(spec, cfg)
+	stampAnnotations(spec, cfg)
+	require.Equal(t, map[string]string{
+		visibleDevicesAnnotation: "0,1",
+		hookStageAnnotation:      hookStageCreateRuntime,
+	}, spec.Annotations)
+
+	spec = &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=void"}}}
+	stampAnnotations(spec, cfg)
+	require.Nil(t, spec.Annotations)
+}
+
+func TestStampAnnotationsRepeatedCreate(t *testing.T) {
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nstamp-annotations = true\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	require.NoError(t, generateNewRuntimeSpec())
+	spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	spec.Process.Env = append(spec.Process.Env, "NVIDIA_VISIBLE_DEVICES=all")
+	require.NoError(t, writeRuntimeSpec(filepath.Join(bundlePath, specFile), &spec))
+
+	for i := 0; i < 2; i++ {
+		cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+		cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+		require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+	}
+
+	spec, err = getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Equal(t, hookStagePrestart, spec.Annotations[hookStageAnnotation])
+	require.Equal(t, "all", spec.Annotations[visibleDevicesAnnotation])
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks))
+}
+
+func TestStampProvenance(t *testing.T) {
+	spec := &specs.Spec{Annotations: map[string]string{processedAtAnnotation: "2000-01-01T00:00:00Z"}}
+
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	stampProvenance(spec, now)
+	stampProvenance(spec, now)
+	require.Equal(t, map[string]string{
+		runtimeVersionAnnotation: version,
+		processedAtAnnotation:    "2021-06-01T12:00:00Z",
+	}, spec.Annotations)
+}
+
+func TestStampProvenanceCreate(t *testing.T) {
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nstamp-provenance = true\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	require.NoError(t, generateNewRuntimeSpec())
+	spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	spec.Annotations = map[string]string{
+		runtimeVersionAnnotation: "0.0.1",
+		processedAtAnnotation:    "2000-01-01T00:00:00Z",
+	}
+	require.NoError(t, writeRuntimeSpec(filepath.Join(bundlePath, specFile), &spec))
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	spec, err = getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Len(t, spec.Annotations, 2)
+	require.Equal(t, version, spec.Annotations[runtimeVersionAnnotation])
+	processedAt, err := time.Parse(time.RFC3339, spec.Annotations[processedAtAnnotation])
+	require.NoError(t, err)
+	require.True(t, processedAt.After(time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)))
+
+	// The spec of a repeated create is unchanged and is not stamped again.
+	cmdCreate = exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	repeated, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Equal(t, spec.Annotations, repeated.Annotations)
+	require.Equal(t, 1, nvidiaHookCount(repeated.Hooks))
+}
@@ -0,0 +1,46 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// setApparmorProfile sets the AppArmor profile of the process in the specified
+// spec. A profile already present in the spec is only replaced if force is set.
+func setApparmorProfile(spec *specs.Spec, profile string, force bool) {
+	if spec.Process == nil {
+		logger.Printf("No process in OCI specification, not setting AppArmor profile")
+		return
+	}
+	if !isLinuxSpec(spec) {
+		logger.Printf("OCI specification does not target Linux, not setting AppArmor profile")
+		return
+	}
+
+	current := spec.Process.ApparmorProfile
+	if current == profile {
+		return
+	}
+	if current != "" && !force {
+		logger.Printf("Keeping AppArmor profile %q specified in OCI specification", current)
+		return
+	}
+
+	logger.Printf("Setting AppArmor profile %q", profile)
+	spec.Process.ApparmorProfile = profile
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetApparmorProfile(t *testing.T) {
+	testCases := []struct {
+		description string
+		current     string
+		force       bool
+		expected    string
+	}{
+		{
+			description: "set when empty",
+			current:     "",
+			expected:    "nvidia-gpu",
+		},
+		{
+			description: "don't override explicit profile",
+			current:     "docker-default",
+			expected:    "docker-default",
+		},
+		{
+			description: "force override explicit profile",
+			current:     "docker-default",
+			force:       true,
+			expected:    "nvidia-gpu",
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{
+			Process: &specs.Process{
+				ApparmorProfile: tc.current,
+			},
+		}
+
+		setApparmorProfile(spec, "nvidia-gpu", tc.force)
+		require.Equal(t, tc.expected, spec.Process.ApparmorProfile, tc.description)
+	}
+}
+
+func TestSetApparmorProfileNoProcess(t *testing.T) {
+	spec := &specs.Spec{}
+
+	setApparmorProfile(spec, "nvidia-gpu", true)
+	require.Nil(t, spec.Process)
+}
+
+func TestSetApparmorProfileNonLinuxSpec(t *testing.T) {
+	spec := &specs.Spec{Process: &specs.Process{}, Windows: &specs.Windows{}}
+
+	setApparmorProfile(spec, "nvidia-gpu", true)
+	require.Empty(t, spec.Process.ApparmorProfile)
+}
@@ -0,0 +1,141 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// runCanonicalize implements the canonicalize command, which rewrites the OCI
+// specification of the bundle in a canonical form so that the specifications
+// of different hosts can be compared:
+//
+//	nvidia-container-runtime canonicalize [--modify] --bundle BUNDLE
+//
+// Without --modify the specification is only normalized, see
+// canonicalizeSpec. With --modify the modifications made on create are
+// applied first.
+func runCanonicalize(cfg *config, args *args, argv []string) error {
+	_, _, canonicalizeArgs := splitRuntimeArgs(getRuntimeArgs(argv))
+
+	modify := false
+	for i := 0; i < len(canonicalizeArgs); i++ {
+		arg := canonicalizeArgs[i]
+		parts := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)
+		switch {
+		case !strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unexpected argument %v: use --bundle to specify the bundle", arg)
+		case parts[0] == "modify" && len(parts) == 1:
+			modify = true
+		case parts[0] == "bundle" || parts[0] == "b":
+			// The bundle is taken from args.
+			if len(parts) == 1 {
+				i++
+			}
+		default:
+			return fmt.Errorf("unsupported canonicalize option %v", arg)
+		}
+	}
+
+	return canonicalizeBundle(cfg, args, modify)
+}
+
+// canonicalizeBundle rewrites the OCI specification of the bundle referenced
+// by the specified args in canonical form, applying the modifications made on
+// create first if modify is set. The file is only rewritten if it changes, so
+// canonicalizing a canonical specification leaves it untouched.
+func canonicalizeBundle(cfg *config, args *args, modify bool) error {
+	configFilePath, err := args.getConfigFilePath()
+	if err != nil {
+		return fmt.Errorf("error getting config file path: %v", err)
+	}
+
+	jsonOriginal, err := readSpecContent(configFilePath)
+	if err != nil {
+		return err
+	}
+	spec, err := readBundleSpec(cfg, configFilePath)
+	if err != nil {
+		return err
+	}
+
+	if modify {
+		bundleDir := filepath.Dir(configFilePath)
+		err = modifySpec(cfg.forBundle(bundleDir).forContainer(getBundleContainerID(bundleDir)), spec)
+		if err != nil {
+			return err
+		}
+	}
+
+	jsonOutput, err := canonicalizeSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(jsonOriginal, jsonOutput) {
+		logger.Printf("OCI specification %v already canonical, not rewriting file", configFilePath)
+		return nil
+	}
+
+	err = writeSpecFile(configFilePath, jsonOutput, cfg.tempDir, cfg.fileMode)
+	if err != nil {
+		return fmt.Errorf("error writing canonical OCI specification to file: %v", err)
+	}
+
+	logger.Printf("OCI specification %v canonicalized", configFilePath)
+	return nil
+}
+
+// canonicalizeSpec returns the canonical form of the specified spec. Only the
+// last definition of each variable in the process environment is kept, since
+// this is the one taking effect. The spec is marshalled with its fields in the
+// order of the OCI specification, map keys such as annotations sorted, and an
+// indentation of two spaces.
+func canonicalizeSpec(spec *specs.Spec) ([]byte, error) {
+	if spec.Process != nil {
+		spec.Process.Env = dedupEnv(spec.Process.Env)
+	}
+
+	jsonOutput, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling canonical OCI specification: %v", err)
+	}
+	return append(jsonOutput, '\n'), nil
+}
+
+// dedupEnv removes all but the last definition of each variable from the
+// specified environment, keeping the order of the remaining definitions.
+func dedupEnv(env []string) []string {
+	last := make(map[string]int)
+	for i, e := range env {
+		last[strings.SplitN(e, "=", 2)[0]] = i
+	}
+
+	var result []string
+	for i, e := range env {
+		if last[strings.SplitN(e, "=", 2)[0]] == i {
+			result = append(result, e)
+		}
+	}
+	return result
+}
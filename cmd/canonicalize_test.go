@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupEnv(t *testing.T) {
+	require.Equal(t, []string{"B=2", "A=3", "C"}, dedupEnv([]string{"A=1", "B=2", "A=2", "A=3", "C"}))
+	require.Empty(t, dedupEnv(nil))
+}
+
+func TestCanonicalize(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	messy := `{"process": {"env": ["PATH=/bin", "NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_VISIBLE_DEVICES=all"], "cwd": "/"},
+"annotations": {"z": "1", "a": "2"}, "ociVersion": "1.0.2", "root": {"path": "rootfs"}}`
+	specPath := filepath.Join(testDir, specFile)
+	require.NoError(t, ioutil.WriteFile(specPath, []byte(messy), 0644))
+
+	canonical := `{
+  "ociVersion": "1.0.2",
+  "process": {
+    "user": {
+      "uid": 0,
+      "gid": 0
+    },
+    "env": [
+      "PATH=/bin",
+      "NVIDIA_VISIBLE_DEVICES=all"
+    ],
+    "cwd": "/"
+  },
+  "root": {
+    "path": "rootfs"
+  },
+  "annotations": {
+    "a": "2",
+    "z": "1"
+  }
+}
+`
+
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command(nvidiaRuntime, "canonicalize", "--bundle", testDir)
+		output, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(output))
+
+		content, err := ioutil.ReadFile(specPath)
+		require.NoError(t, err)
+		require.Equal(t, canonical, string(content), "run %d", i)
+	}
+
+	// A canonical spec is not rewritten.
+	past := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(specPath, past, past))
+	require.NoError(t, exec.Command(nvidiaRuntime, "canonicalize", "--bundle", testDir).Run())
+	info, err := os.Stat(specPath)
+	require.NoError(t, err)
+	require.True(t, info.ModTime().Equal(past), "a canonical spec should not be rewritten")
+
+	spec, err := getRuntimeSpec(specPath)
+	require.NoError(t, err)
+	require.Equal(t, 0, nvidiaHookCount(spec.Hooks), "the spec should not be modified without --modify")
+
+	require.NoError(t, exec.Command(nvidiaRuntime, "canonicalize", "--modify", "--bundle", testDir).Run())
+	spec, err = getRuntimeSpec(specPath)
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks), "the spec should be modified with --modify")
+
+	require.Error(t, exec.Command(nvidiaRuntime, "canonicalize", "--bundle", testDir, "--unknown").Run())
+}
@@ -0,0 +1,514 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// modeLegacy inserts the NVIDIA hook into containers requesting GPUs.
+	// modeCDI applies the edits of the requested devices from CDI
+	// (Container Device Interface) specs instead.
+	modeLegacy = "legacy"
+	modeCDI    = "cdi"
+
+	// cdiAnnotationPrefix is the prefix of the annotations requesting CDI
+	// devices. Their values are comma-separated fully-qualified device names.
+	cdiAnnotationPrefix = "cdi.k8s.io/"
+
+	// defaultCDIKind is the kind of the CDI devices requested through
+	// NVIDIA_VISIBLE_DEVICES without a fully-qualified name.
+	defaultCDIKind = "nvidia.com/gpu"
+)
+
+// defaultCDISpecDirs are the directories CDI specs are loaded from, in order
+// of increasing priority.
+var defaultCDISpecDirs = []string{"/etc/cdi", "/var/run/cdi"}
+
+// cdiSpec is a CDI spec describing the devices of a single kind, e.g.
+// nvidia.com/gpu. Only the fields required to apply container edits are
+// decoded.
+type cdiSpec struct {
+	Version        string            `json:"cdiVersion" yaml:"cdiVersion"`
+	Kind           string            `json:"kind" yaml:"kind"`
+	Devices        []cdiDevice       `json:"devices" yaml:"devices"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits,omitempty" yaml:"containerEdits,omitempty"`
+}
+
+// cdiDevice is a device of a CDI spec. The name of the device is qualified by
+// the kind of its spec, e.g. nvidia.com/gpu=0.
+type cdiDevice struct {
+	Name           string            `json:"name" yaml:"name"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits" yaml:"containerEdits"`
+}
+
+// cdiContainerEdits are the changes made to the OCI specification of a
+// container using a CDI device.
+type cdiContainerEdits struct {
+	Env         []string        `json:"env,omitempty" yaml:"env,omitempty"`
+	DeviceNodes []cdiDeviceNode `json:"deviceNodes,omitempty" yaml:"deviceNodes,omitempty"`
+	Mounts      []cdiMount      `json:"mounts,omitempty" yaml:"mounts,omitempty"`
+	Hooks       []cdiHook       `json:"hooks,omitempty" yaml:"hooks,omitempty"`
+}
+
+type cdiDeviceNode struct {
+	Path        string       `json:"path" yaml:"path"`
+	HostPath    string       `json:"hostPath,omitempty" yaml:"hostPath,omitempty"`
+	Type        string       `json:"type,omitempty" yaml:"type,omitempty"`
+	Major       int64        `json:"major,omitempty" yaml:"major,omitempty"`
+	Minor       int64        `json:"minor,omitempty" yaml:"minor,omitempty"`
+	FileMode    *os.FileMode `json:"fileMode,omitempty" yaml:"fileMode,omitempty"`
+	Permissions string       `json:"permissions,omitempty" yaml:"permissions,omitempty"`
+	UID         *uint32      `json:"uid,omitempty" yaml:"uid,omitempty"`
+	GID         *uint32      `json:"gid,omitempty" yaml:"gid,omitempty"`
+}
+
+type cdiMount struct {
+	HostPath      string   `json:"hostPath" yaml:"hostPath"`
+	ContainerPath string   `json:"containerPath" yaml:"containerPath"`
+	Type          string   `json:"type,omitempty" yaml:"type,omitempty"`
+	Options       []string `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+type cdiHook struct {
+	HookName string   `json:"hookName" yaml:"hookName"`
+	Path     string   `json:"path" yaml:"path"`
+	Args     []string `json:"args,omitempty" yaml:"args,omitempty"`
+	Env      []string `json:"env,omitempty" yaml:"env,omitempty"`
+	Timeout  *int     `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// cdiRegistry maps fully-qualified device names to their device along with
+// the spec defining them.
+type cdiRegistry map[string]cdiRegistryEntry
+
+type cdiRegistryEntry struct {
+	spec   *cdiSpec
+	device *cdiDevice
+}
+
+// applyCDIDevices applies the container edits of the CDI devices requested by
+// the specified spec, using the CDI specs in the specified directories. The
+// edits common to all devices of a CDI spec are applied once, ahead of those
+// of its devices.
+func applyCDIDevices(spec *specs.Spec, envvar string, dirs []string, defaultKind string) error {
+	requested, err := getCDIDeviceRequests(spec, envvar, defaultKind)
+	if err != nil {
+		return err
+	}
+	if len(requested) == 0 {
+		logger.Printf("No CDI devices requested")
+		return nil
+	}
+
+	registry, err := loadCDISpecs(dirs)
+	if err != nil {
+		return err
+	}
+
+	resolved, err := registry.resolve(requested)
+	if err != nil {
+		return err
+	}
+
+	var edits []cdiContainerEdits
+	applied := make(map[*cdiSpec]bool)
+	for _, name := range resolved {
+		entry := registry[name]
+		if !applied[entry.spec] {
+			edits = append(edits, entry.spec.ContainerEdits)
+			applied[entry.spec] = true
+		}
+		edits = append(edits, entry.device.ContainerEdits)
+	}
+
+	logger.Printf("Applying edits of CDI devices %v", resolved)
+	for _, e := range edits {
+		err := applyCDIContainerEdits(spec, e)
+		if err != nil {
+			return fmt.Errorf("error applying CDI edits: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// getCDIDeviceRequests returns the fully-qualified names of the CDI devices
+// requested by the specified spec. Devices are requested through cdi.k8s.io/
+// annotations, whose values are lists of fully-qualified names, or through the
+// specified visible devices environment variable. Entries of the latter that
+// are not fully qualified, e.g. 0 or all, refer to devices of the specified
+// default kind.
+func getCDIDeviceRequests(spec *specs.Spec, envvar string, defaultKind string) ([]string, error) {
+	var keys []string
+	for key := range spec.Annotations {
+		if strings.HasPrefix(key, cdiAnnotationPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var names []string
+	for _, key := range keys {
+		for _, name := range splitDeviceList(spec.Annotations[key]) {
+			if _, _, err := parseCDIDeviceName(name); err != nil {
+				return nil, fmt.Errorf("invalid CDI device request in annotation %v: %v", key, err)
+			}
+			names = append(names, name)
+		}
+	}
+
+	if value, _ := getEnvValue(getProcessEnv(spec), envvar); value != visibleDevicesVoid && value != "none" {
+		for _, name := range splitDeviceList(value) {
+			if !strings.Contains(name, "=") {
+				name = defaultKind + "=" + name
+			}
+			if _, _, err := parseCDIDeviceName(name); err != nil {
+				return nil, fmt.Errorf("invalid CDI device request in %v: %v", envvar, err)
+			}
+			names = append(names, name)
+		}
+	}
+
+	var requested []string
+	for _, name := range names {
+		if !containsString(requested, name) {
+			requested = append(requested, name)
+		}
+	}
+	return requested, nil
+}
+
+// splitDeviceList splits the specified comma-separated list of devices.
+func splitDeviceList(value string) []string {
+	var devices []string
+	for _, device := range strings.Split(value, ",") {
+		device = strings.TrimSpace(device)
+		if device != "" {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+// parseCDIDeviceName splits the specified fully-qualified CDI device name,
+// e.g. nvidia.com/gpu=0, into its kind and the name of the device.
+func parseCDIDeviceName(name string) (string, string, error) {
+	parts := strings.SplitN(name, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid CDI device name %q: expected VENDOR/CLASS=NAME", name)
+	}
+	kind := strings.SplitN(parts[0], "/", 2)
+	if len(kind) != 2 || kind[0] == "" || kind[1] == "" {
+		return "", "", fmt.Errorf("invalid CDI device name %q: expected VENDOR/CLASS=NAME", name)
+	}
+	return parts[0], parts[1], nil
+}
+
+// resolve returns the names of the devices in the registry for the specified
+// requested names. A request for KIND=all resolves to the device named all if
+// the CDI spec of the kind defines one, and to all devices of the kind
+// otherwise. Unknown devices are an error.
+func (r cdiRegistry) resolve(requested []string) ([]string, error) {
+	var resolved []string
+	for _, name := range requested {
+		kind, device, err := parseCDIDeviceName(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, exists := r[name]; exists {
+			resolved = append(resolved, name)
+			continue
+		}
+		if device != "all" {
+			return nil, fmt.Errorf("unknown CDI device %v: not defined by any CDI spec", name)
+		}
+
+		all := r.getKindDevices(kind)
+		if len(all) == 0 {
+			return nil, fmt.Errorf("unknown CDI device %v: no CDI spec defines devices of kind %v", name, kind)
+		}
+		resolved = append(resolved, all...)
+	}
+	return resolved, nil
+}
+
+// getKindDevices returns the sorted names of the devices of the specified kind.
+func (r cdiRegistry) getKindDevices(kind string) []string {
+	var names []string
+	for name := range r {
+		if strings.HasPrefix(name, kind+"=") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadCDISpecs loads the .json, .yaml and .yml CDI specs in the specified
+// directories. A device defined in a later directory replaces one with the
+// same name in an earlier directory. Missing directories are ignored.
+func loadCDISpecs(dirs []string) (cdiRegistry, error) {
+	registry := make(cdiRegistry)
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CDI spec directory: %v", err)
+		}
+
+		for _, file := range files {
+			path := filepath.Join(dir, file.Name())
+			if file.IsDir() {
+				continue
+			}
+			spec, err := readCDISpec(path)
+			if err != nil {
+				return nil, err
+			}
+			if spec == nil {
+				continue
+			}
+			for i := range spec.Devices {
+				device := &spec.Devices[i]
+				registry[spec.Kind+"="+device.Name] = cdiRegistryEntry{spec: spec, device: device}
+			}
+		}
+	}
+	return registry, nil
+}
+
+// readCDISpec reads the CDI spec at the specified path. Files without a JSON
+// or YAML extension are skipped and result in a nil spec.
+func readCDISpec(path string) (*cdiSpec, error) {
+	var unmarshal func([]byte, interface{}) error
+	switch filepath.Ext(path) {
+	case ".json":
+		unmarshal = json.Unmarshal
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	default:
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CDI spec: %v", err)
+	}
+
+	spec := &cdiSpec{}
+	err = unmarshal(content, spec)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CDI spec %v: %v", path, err)
+	}
+	if spec.Kind == "" || !strings.Contains(spec.Kind, "/") {
+		return nil, fmt.Errorf("invalid CDI spec %v: invalid kind %q", path, spec.Kind)
+	}
+
+	return spec, nil
+}
+
+// applyCDIContainerEdits applies the specified CDI container edits to the
+// specified spec. Device nodes without a type or device number take these
+// from the device node on the host, and access to them is allowed in the
+// device cgroup.
+// The edits are merged into the spec, so that applying them again leaves the
+// spec unchanged: an environment variable replaces the value of an existing
+// variable of the same name, while device nodes, cgroup rules and mounts
+// already present at the same path are not added again. Hooks follow the rules
+// of the NVIDIA hook, i.e. a hook is not added to a list already containing
+// the same hook, or an NVIDIA hook in the case of an NVIDIA hook. Device nodes
+// are not added to specs targeting another platform than Linux.
+func applyCDIContainerEdits(spec *specs.Spec, edits cdiContainerEdits) error {
+	if len(edits.Env) > 0 {
+		if spec.Process == nil {
+			spec.Process = &specs.Process{}
+		}
+		for _, env := range edits.Env {
+			spec.Process.Env = mergeEnv(spec.Process.Env, env)
+		}
+	}
+
+	if len(edits.DeviceNodes) > 0 && !isLinuxSpec(spec) {
+		logger.Printf("OCI specification does not target Linux, not adding CDI device nodes")
+		edits.DeviceNodes = nil
+	}
+	for _, node := range edits.DeviceNodes {
+		device, err := getCDIDevice(node)
+		if err != nil {
+			return err
+		}
+		if spec.Linux == nil {
+			spec.Linux = &specs.Linux{}
+		}
+		if spec.Linux.Resources == nil {
+			spec.Linux.Resources = &specs.LinuxResources{}
+		}
+		if !containsDevice(spec.Linux.Devices, device.Path) {
+			spec.Linux.Devices = append(spec.Linux.Devices, device)
+		}
+
+		rule := getDeviceCgroupRule(device, deviceCgroupRulesDevice)
+		if node.Permissions != "" {
+			rule.Access = node.Permissions
+		}
+		if !containsDeviceCgroupRule(spec.Linux.Resources.Devices, rule) {
+			spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, rule)
+		}
+	}
+
+	for _, m := range edits.Mounts {
+		if containsMount(spec.Mounts, m.ContainerPath) {
+			logger.Printf("Not adding CDI mount %v: mount already present", m.ContainerPath)
+			continue
+		}
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: m.ContainerPath,
+			Type:        m.Type,
+			Source:      m.HostPath,
+			Options:     m.Options,
+		})
+	}
+
+	for _, h := range edits.Hooks {
+		if spec.Hooks == nil {
+			spec.Hooks = &specs.Hooks{}
+		}
+		hooks, err := getCDIHookList(spec.Hooks, h.HookName)
+		if err != nil {
+			return err
+		}
+		hook := specs.Hook{
+			Path:    h.Path,
+			Args:    h.Args,
+			Env:     h.Env,
+			Timeout: h.Timeout,
+		}
+		if containsHook(*hooks, hook) {
+			logger.Printf("Not adding CDI %v hook %v: hook already present", h.HookName, h.Path)
+			continue
+		}
+		*hooks = append(*hooks, hook)
+	}
+
+	return nil
+}
+
+// mergeEnv sets the specified NAME=VALUE entry in the specified environment,
+// replacing the first entry with the same name.
+func mergeEnv(env []string, entry string) []string {
+	name := strings.SplitN(entry, "=", 2)[0]
+	for i, e := range env {
+		if strings.SplitN(e, "=", 2)[0] == name {
+			env[i] = entry
+			return env
+		}
+	}
+	return append(env, entry)
+}
+
+// containsMount checks whether the specified mounts include a mount at the
+// specified destination.
+func containsMount(mounts []specs.Mount, destination string) bool {
+	for _, m := range mounts {
+		if filepath.Clean(m.Destination) == filepath.Clean(destination) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsHook checks whether the specified hooks include the specified hook,
+// or any NVIDIA hook if the specified hook is an NVIDIA hook.
+func containsHook(hooks []specs.Hook, hook specs.Hook) bool {
+	if isNVIDIAHook(hook) {
+		return containsNVIDIAHook(hooks)
+	}
+	for _, h := range hooks {
+		if h.Path == hook.Path && reflect.DeepEqual(h.Args, hook.Args) {
+			return true
+		}
+	}
+	return false
+}
+
+// getCDIDevice returns the OCI device for the specified CDI device node.
+func getCDIDevice(node cdiDeviceNode) (specs.LinuxDevice, error) {
+	device := specs.LinuxDevice{
+		Path:     node.Path,
+		Type:     node.Type,
+		Major:    node.Major,
+		Minor:    node.Minor,
+		FileMode: node.FileMode,
+		UID:      node.UID,
+		GID:      node.GID,
+	}
+	if device.Type != "" && device.Major != 0 {
+		return device, nil
+	}
+
+	hostPath := node.HostPath
+	if hostPath == "" {
+		hostPath = node.Path
+	}
+	host, err := getDevice(hostPath)
+	if err != nil {
+		return specs.LinuxDevice{}, fmt.Errorf("error getting CDI device node %v: %v", node.Path, err)
+	}
+
+	device.Type = host.Type
+	device.Major = host.Major
+	device.Minor = host.Minor
+	if device.FileMode == nil {
+		device.FileMode = host.FileMode
+	}
+	return device, nil
+}
+
+// getCDIHookList returns the hook list of the specified spec hooks for the
+// specified CDI hook name.
+func getCDIHookList(hooks *specs.Hooks, name string) (*[]specs.Hook, error) {
+	switch name {
+	case "prestart":
+		return &hooks.Prestart, nil
+	case "createRuntime":
+		return &hooks.CreateRuntime, nil
+	case "createContainer":
+		return &hooks.CreateContainer, nil
+	case "startContainer":
+		return &hooks.StartContainer, nil
+	case "poststart":
+		return &hooks.Poststart, nil
+	case "poststop":
+		return &hooks.Poststop, nil
+	}
+	return nil, fmt.Errorf("invalid CDI hook name %q", name)
+}
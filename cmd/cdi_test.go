@@ -0,0 +1,269 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+const testCDISpecYAML = `cdiVersion: "0.5.0"
+kind: nvidia.com/gpu
+containerEdits:
+  env:
+  - NVIDIA_CDI=1
+  hooks:
+  - hookName: createContainer
+    path: /usr/bin/nvidia-ctk
+    args: [nvidia-ctk, hook, update-ldcache]
+devices:
+- name: "0"
+  containerEdits:
+    deviceNodes:
+    - path: /dev/nvidia0
+      hostPath: /dev/null
+- name: "1"
+  containerEdits:
+    deviceNodes:
+    - path: /dev/nvidia1
+      type: c
+      major: 195
+      minor: 1
+      permissions: rw
+`
+
+const testCDISpecJSON = `{
+	"cdiVersion": "0.5.0",
+	"kind": "example.com/net",
+	"devices": [
+		{
+			"name": "eth",
+			"containerEdits": {
+				"mounts": [{"hostPath": "/opt/net", "containerPath": "/net", "options": ["ro", "bind"]}]
+			}
+		}
+	]
+}`
+
+func writeTestCDISpecs(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "nvidia-container-runtime-cdi")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "nvidia.yaml"), []byte(testCDISpecYAML), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "net.json"), []byte(testCDISpecJSON), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a spec"), 0644))
+	return dir
+}
+
+func TestApplyCDIDevices(t *testing.T) {
+	dir := writeTestCDISpecs(t)
+	defer os.RemoveAll(dir)
+
+	spec := &specs.Spec{
+		Process:     &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=nvidia.com/gpu=0,nvidia.com/gpu=1"}},
+		Annotations: map[string]string{cdiAnnotationPrefix + "net": "example.com/net=eth"},
+	}
+	require.NoError(t, applyCDIDevices(spec, visibleDevicesEnvvar, []string{filepath.Join(dir, "missing"), dir}, defaultCDIKind))
+
+	require.Equal(t, []string{"NVIDIA_VISIBLE_DEVICES=nvidia.com/gpu=0,nvidia.com/gpu=1", "NVIDIA_CDI=1"}, spec.Process.Env)
+
+	require.Len(t, spec.Linux.Devices, 2)
+	require.Equal(t, "/dev/nvidia0", spec.Linux.Devices[0].Path)
+	require.Equal(t, "c", spec.Linux.Devices[0].Type)
+	require.Equal(t, int64(1), spec.Linux.Devices[0].Major, "device number of the host path /dev/null")
+	require.Equal(t, int64(3), spec.Linux.Devices[0].Minor, "device number of the host path /dev/null")
+	require.Equal(t, "/dev/nvidia1", spec.Linux.Devices[1].Path)
+	require.Equal(t, int64(195), spec.Linux.Devices[1].Major)
+
+	require.Len(t, spec.Linux.Resources.Devices, 2)
+	require.Equal(t, "rwm", spec.Linux.Resources.Devices[0].Access)
+	require.Equal(t, "rw", spec.Linux.Resources.Devices[1].Access)
+
+	require.Equal(t, []specs.Mount{{Destination: "/net", Source: "/opt/net", Options: []string{"ro", "bind"}}}, spec.Mounts)
+
+	require.Len(t, spec.Hooks.CreateContainer, 1, "the edits common to the devices of a spec are applied once")
+	require.Equal(t, "/usr/bin/nvidia-ctk", spec.Hooks.CreateContainer[0].Path)
+	require.Empty(t, spec.Hooks.Prestart)
+}
+
+func TestApplyCDIDevicesErrors(t *testing.T) {
+	dir := writeTestCDISpecs(t)
+	defer os.RemoveAll(dir)
+
+	spec := &specs.Spec{Annotations: map[string]string{cdiAnnotationPrefix + "gpu": "nvidia.com/gpu=7"}}
+	err := applyCDIDevices(spec, visibleDevicesEnvvar, []string{dir}, defaultCDIKind)
+	require.EqualError(t, err, "unknown CDI device nvidia.com/gpu=7: not defined by any CDI spec")
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "invalid.yaml"), []byte("kind: gpu\n"), 0644))
+	spec = &specs.Spec{Annotations: map[string]string{cdiAnnotationPrefix + "gpu": "nvidia.com/gpu=0"}}
+	require.Error(t, applyCDIDevices(spec, visibleDevicesEnvvar, []string{dir}, defaultCDIKind))
+
+	// Specs without a request are left unchanged, without loading any specs.
+	spec = &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=void"}}}
+	require.NoError(t, applyCDIDevices(spec, visibleDevicesEnvvar, []string{filepath.Join(dir, "invalid.yaml")}, defaultCDIKind))
+	require.Equal(t, &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=void"}}}, spec)
+}
+
+func TestCDIModeModifiers(t *testing.T) {
+	dir := writeTestCDISpecs(t)
+	defer os.RemoveAll(dir)
+
+	cfg := &config{mode: modeCDI, cdiSpecDirs: []string{dir}}
+	spec := &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=nvidia.com/gpu=1"}}}
+	for _, modify := range getSpecModifiers(cfg) {
+		require.NoError(t, modify(spec))
+	}
+	require.Empty(t, spec.Hooks.Prestart, "the NVIDIA hook is not inserted in cdi mode")
+	require.Len(t, spec.Hooks.CreateContainer, 1)
+}
+
+func TestGetConfigMode(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nmode = \"cdi\"\ncdi-spec-dirs = [\"/opt/cdi\"]\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Equal(t, modeCDI, cfg.mode)
+	require.Equal(t, []string{"/opt/cdi"}, cfg.cdiSpecDirs)
+
+	testDir, err = writeTestConfig("[nvidia-container-runtime]\nmode = \"csv\"\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	_, err = getConfig()
+	require.Error(t, err)
+}
+
+func TestApplyCDIDevicesRepeatedly(t *testing.T) {
+	dir := writeTestCDISpecs(t)
+	defer os.RemoveAll(dir)
+
+	spec, err := getRuntimeSpec(unmodifiedSpecFile)
+	require.NoError(t, err)
+	spec.Process.Env = append(spec.Process.Env, "NVIDIA_CDI=0")
+	spec.Annotations = map[string]string{cdiAnnotationPrefix + "devices": "nvidia.com/gpu=0,nvidia.com/gpu=1,example.com/net=eth"}
+
+	require.NoError(t, applyCDIDevices(&spec, visibleDevicesEnvvar, []string{dir}, defaultCDIKind))
+	first, err := toGenericJSON(spec)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, applyCDIDevices(&spec, visibleDevicesEnvvar, []string{dir}, defaultCDIKind))
+		again, err := toGenericJSON(spec)
+		require.NoError(t, err)
+		require.Empty(t, diffJSON(first, again), "applying CDI edits again should not change the spec")
+	}
+
+	value, _ := getEnvValue(spec.Process.Env, "NVIDIA_CDI")
+	require.Equal(t, "1", value)
+	count := 0
+	for _, env := range spec.Process.Env {
+		if strings.HasPrefix(env, "NVIDIA_CDI=") {
+			count++
+		}
+	}
+	require.Equal(t, 1, count, "an existing variable is replaced")
+}
+
+func TestContainsHook(t *testing.T) {
+	hooks := []specs.Hook{
+		{Path: "/usr/bin/nvidia-container-runtime-hook", Args: []string{"nvidia-container-runtime-hook", "prestart"}},
+		{Path: "/usr/bin/ldconfig", Args: []string{"ldconfig"}},
+	}
+
+	require.True(t, containsHook(hooks, specs.Hook{Path: "/usr/bin/ldconfig", Args: []string{"ldconfig"}}))
+	require.False(t, containsHook(hooks, specs.Hook{Path: "/usr/bin/ldconfig", Args: []string{"ldconfig", "-v"}}))
+	require.True(t, containsHook(hooks, specs.Hook{Path: "/opt/nvidia/nvidia-container-runtime-hook", Args: []string{"nvidia-container-runtime-hook", "createContainer"}}))
+}
+
+func TestGetCDIDeviceRequests(t *testing.T) {
+	testCases := []struct {
+		description string
+		env         []string
+		annotations map[string]string
+		expected    []string
+		isError     bool
+	}{
+		{
+			description: "device indices",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=0, 1"},
+			expected:    []string{"nvidia.com/gpu=0", "nvidia.com/gpu=1"},
+		},
+		{
+			description: "all devices",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=all"},
+			expected:    []string{"nvidia.com/gpu=all"},
+		},
+		{
+			description: "fully-qualified names in env and annotations",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=example.com/net=eth,0"},
+			annotations: map[string]string{cdiAnnotationPrefix + "b": "nvidia.com/gpu=1", cdiAnnotationPrefix + "a": "nvidia.com/gpu=0", "other": "x=y"},
+			expected:    []string{"nvidia.com/gpu=0", "nvidia.com/gpu=1", "example.com/net=eth"},
+		},
+		{
+			description: "no request",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=none"},
+		},
+		{
+			description: "invalid name in annotation",
+			annotations: map[string]string{cdiAnnotationPrefix + "a": "gpu0"},
+			isError:     true,
+		},
+		{
+			description: "invalid kind in env",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=gpu=0"},
+			isError:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{Process: &specs.Process{Env: tc.env}, Annotations: tc.annotations}
+		requested, err := getCDIDeviceRequests(spec, visibleDevicesEnvvar, defaultCDIKind)
+		if tc.isError {
+			require.Error(t, err, tc.description)
+			continue
+		}
+		require.NoError(t, err, tc.description)
+		require.Equal(t, tc.expected, requested, tc.description)
+	}
+}
+
+func TestApplyCDIDevicesAll(t *testing.T) {
+	dir := writeTestCDISpecs(t)
+	defer os.RemoveAll(dir)
+
+	spec := &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}}}
+	require.NoError(t, applyCDIDevices(spec, visibleDevicesEnvvar, []string{dir}, defaultCDIKind))
+	require.Len(t, spec.Linux.Devices, 2)
+
+	spec = &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}}}
+	err := applyCDIDevices(spec, visibleDevicesEnvvar, []string{dir}, "example.com/gpu")
+	require.EqualError(t, err, "unknown CDI device example.com/gpu=all: no CDI spec defines devices of kind example.com/gpu")
+
+	spec = &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=GPU-0f3b"}}}
+	err = applyCDIDevices(spec, visibleDevicesEnvvar, []string{dir}, defaultCDIKind)
+	require.EqualError(t, err, "unknown CDI device nvidia.com/gpu=GPU-0f3b: not defined by any CDI spec")
+}
+
+func TestApplyCDIContainerEditsNilLinux(t *testing.T) {
+	edits := cdiContainerEdits{
+		Env:         []string{"NVIDIA_CDI=1"},
+		DeviceNodes: []cdiDeviceNode{{Path: "/dev/nvidia0", HostPath: "/dev/null"}},
+	}
+
+	spec := &specs.Spec{}
+	require.NoError(t, applyCDIContainerEdits(spec, edits))
+	require.Len(t, spec.Linux.Devices, 1)
+	require.Len(t, spec.Linux.Resources.Devices, 1)
+
+	spec = &specs.Spec{Windows: &specs.Windows{}}
+	require.NoError(t, applyCDIContainerEdits(spec, edits))
+	require.Nil(t, spec.Linux, "device nodes should not be added to a Windows spec")
+	require.Equal(t, []string{"NVIDIA_CDI=1"}, spec.Process.Env)
+}
@@ -0,0 +1,97 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	cleanupBefore = "before"
+	cleanupAfter  = "after"
+
+	// cleanupHookArg is the argument of the NVIDIA hook requesting the cleanup
+	// of the GPU state of a container.
+	cleanupHookArg = "cleanup"
+)
+
+// runDelete delegates runc delete to the low-level runtime, running the
+// configured cleanup of the GPU state of the container before or after it.
+// Cleanup failures are logged but do not prevent the container from being
+// deleted. If the cleanup runs after the delete, the delete is run as a child
+// process and the cleanup is only run if it succeeds.
+func runDelete(cfg *config, args *args) error {
+	globalArgs, _, deleteArgs := splitRuntimeArgs(getRuntimeArgs(os.Args[1:]))
+
+	id := getContainerID(deleteArgs)
+	if id == "" {
+		return fmt.Errorf("container id cannot be empty")
+	}
+
+	if cfg.cleanupOrder == cleanupBefore {
+		runCleanup(cfg, args, id)
+		return execRunc(cfg, args)
+	}
+
+	err := runRuntime(cfg, args, globalArgs, "delete", deleteArgs...)
+	if err != nil {
+		return err
+	}
+	runCleanup(cfg, args, id)
+	return nil
+}
+
+// runCleanup runs the cleanup of the GPU state of the specified container. This
+// is the cleanup-command if set, or the NVIDIA hook with the cleanup argument
+// otherwise. In both cases the container id is passed as the last argument.
+func runCleanup(cfg *config, args *args, id string) {
+	argv, err := getCleanupCommand(cfg.cleanupCommand, id)
+	if err != nil {
+		logger.Warnf("Error running cleanup of container %v: %v", id, err)
+		return
+	}
+
+	if args.printExec {
+		logger.Printf("Not running cleanup %v with --print-exec", formatCommandLine(argv))
+		return
+	}
+
+	logger.Printf("Running cleanup %v", formatCommandLine(argv))
+	output, err := exec.CommandContext(invocationCtx, argv[0], argv[1:]...).CombinedOutput()
+	if len(output) > 0 {
+		logger.Printf("Cleanup output: %v", strings.TrimSpace(string(output)))
+	}
+	if err != nil {
+		logger.Warnf("Error running cleanup of container %v: %v", id, err)
+	}
+}
+
+// getCleanupCommand returns the argv of the cleanup of the specified container.
+func getCleanupCommand(command string, id string) ([]string, error) {
+	if command != "" {
+		return []string{command, id}, nil
+	}
+
+	path, err := getHookPath()
+	if err != nil {
+		return nil, fmt.Errorf("error finding hook: %v", err)
+	}
+	return []string{path, cleanupHookArg, id}, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanupOnDelete(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	logFile := filepath.Join(testDir, "calls")
+	_, err = writeTestScript(testDir, "runc", `echo "runc $@" >> `+logFile)
+	require.NoError(t, err)
+	cleanup, err := writeTestScript(testDir, "cleanup", `echo "cleanup $@" >> `+logFile)
+	require.NoError(t, err)
+	failingCleanup, err := writeTestScript(testDir, "failing-cleanup", `echo "failing-cleanup $@" >> `+logFile+`; exit 1`)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		description string
+		config      string
+		expected    string
+	}{
+		{
+			description: "cleanup disabled",
+			config:      fmt.Sprintf("cleanup-command = %q\n", cleanup),
+			expected:    "runc delete testcontainer\n",
+		},
+		{
+			description: "cleanup after delete",
+			config:      fmt.Sprintf("cleanup-on-delete = true\ncleanup-command = %q\n", cleanup),
+			expected:    "runc delete testcontainer\ncleanup testcontainer\n",
+		},
+		{
+			description: "cleanup before delete",
+			config:      fmt.Sprintf("cleanup-on-delete = true\ncleanup-command = %q\ncleanup-order = \"before\"\n", cleanup),
+			expected:    "cleanup testcontainer\nrunc delete testcontainer\n",
+		},
+		{
+			description: "failing cleanup does not block the delete",
+			config:      fmt.Sprintf("cleanup-on-delete = true\ncleanup-command = %q\ncleanup-order = \"before\"\n", failingCleanup),
+			expected:    "failing-cleanup testcontainer\nrunc delete testcontainer\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		os.Remove(logFile)
+
+		configDir, err := writeTestConfig("[nvidia-container-runtime]\n" + tc.config)
+		require.NoError(t, err)
+		defer os.RemoveAll(configDir)
+
+		cmd := exec.Command(nvidiaRuntime, "delete", "testcontainer")
+		cmd.Env = append(os.Environ(), configOverride+"="+configDir, "PATH="+testDir+":"+os.Getenv("PATH"))
+		require.NoError(t, cmd.Run(), tc.description)
+
+		calls, err := ioutil.ReadFile(logFile)
+		require.NoError(t, err, tc.description)
+		require.Equal(t, tc.expected, string(calls), tc.description)
+	}
+}
+
+func TestGetCleanupCommand(t *testing.T) {
+	argv, err := getCleanupCommand("/usr/local/bin/gpu-cleanup", "id")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/usr/local/bin/gpu-cleanup", "id"}, argv)
+
+	argv, err = getCleanupCommand("", "id")
+	require.NoError(t, err)
+	require.Equal(t, []string{cleanupHookArg, "id"}, argv[1:])
+}
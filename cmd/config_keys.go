@@ -0,0 +1,483 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+// configKey describes a key of the nvidia-container-runtime config table. The
+// default value is the value used by getConfig if the key is not set, or nil
+// if the key has no default, in which case example holds an example value in
+// TOML syntax.
+type configKey struct {
+	name         string
+	defaultValue interface{}
+	example      string
+	description  string
+}
+
+// configKeys lists the keys of the nvidia-container-runtime config table that
+// are supported by getConfig.
+var configKeys = []configKey{
+	{
+		name:         "debug",
+		defaultValue: "/dev/null",
+		description:  "Path of the debug log file.",
+	},
+	{
+		name:         "log-destination",
+		defaultValue: logDestinationFile,
+		description:  "Destination of the log: \"file\" for the debug log file, \"stderr\" or \"syslog\". The debug log file is used if syslog is unavailable.",
+	},
+	{
+		name:         "syslog-facility",
+		defaultValue: defaultSyslogFacility,
+		description:  "Syslog facility of the log with log-destination = \"syslog\".",
+	},
+	{
+		name:         "syslog-tag",
+		defaultValue: defaultSyslogTag,
+		description:  "Syslog tag of the log with log-destination = \"syslog\".",
+	},
+	{
+		name:         "otel",
+		defaultValue: false,
+		description:  "Log the config load, the modification of the bundle and the delegation to the low-level runtime as OpenTelemetry span events sharing the trace id of the invocation. The trace of the caller is joined if TRACEPARENT is set.",
+	},
+	{
+		name:        "result-file",
+		example:     `"/run/nvidia-container-runtime/result.json"`,
+		description: "File the result of each invocation is written to as JSON: the exit code, the error category and message if any, and the timing. The low-level runtime is run as a child process to record its exit code. Overridden by the --result-file flag.",
+	},
+	{
+		name:         "verbose-errors",
+		defaultValue: false,
+		description:  "Log the command line, the bundle, the SHA-256 checksum of its OCI specification and the end of the stderr of the low-level runtime if it fails. Only applies to create and start, for which the low-level runtime is run as a child process to capture its stderr unless stderr is a terminal.",
+	},
+	{
+		name:         "verbose-errors-in-error",
+		defaultValue: false,
+		description:  "Also include the diagnostics of verbose-errors in the error returned by the invocation.",
+	},
+	{
+		name:        "file-mode",
+		example:     `"0644"`,
+		description: "Octal permissions of the files written: config.json, the debug log, the result file, the --trace file and the specs in the dump-spec-dir. By default these depend on the umask, except for the specs, which are only readable by their owner.",
+	},
+	{
+		name:        "allowed-bundle-prefixes",
+		example:     `["/run/containerd", "/run/docker"]`,
+		description: "Directories that bundles must be located under. Commands operating on other bundles are rejected. If empty, bundles are not restricted.",
+	},
+	{
+		name:        "temp-dir",
+		example:     `"/run/nvidia-container-runtime"`,
+		description: "Directory of the temporary file written before the OCI specification is replaced. Must be on the filesystem of the bundle for the replacement to be atomic, otherwise the bundle directory is used. Defaults to the bundle directory.",
+	},
+	{
+		name:         "runtime",
+		defaultValue: "",
+		description:  "Low-level runtime to forward commands to. This may be another shim that forwards them in turn, but not the nvidia-container-runtime itself. If empty, docker-runc and runc are looked up in PATH.",
+	},
+	{
+		name:         "sandbox-annotation-key",
+		defaultValue: defaultSandboxAnnotationKey,
+		description:  "Annotation identifying pod sandbox containers, which are not modified. An empty key disables the detection.",
+	},
+	{
+		name:         "mode",
+		defaultValue: modeLegacy,
+		description:  "\"legacy\" to insert the hook, or \"cdi\" to apply the edits of the requested devices from CDI specs instead.",
+	},
+	{
+		name:         "cdi-spec-dirs",
+		defaultValue: defaultCDISpecDirs,
+		description:  "Directories the CDI specs are loaded from in cdi mode. Specs in later directories take precedence.",
+	},
+	{
+		name:         "cdi-default-kind",
+		defaultValue: defaultCDIKind,
+		description:  "Kind of the CDI devices requested by NVIDIA_VISIBLE_DEVICES entries that are not fully-qualified names, e.g. 0 or all.",
+	},
+	{
+		name:         "env-allowlist",
+		defaultValue: []string{},
+		description:  "NVIDIA_* environment variables passed to the hook. If empty, all are passed. A trailing * matches a prefix.",
+	},
+	{
+		name:         "env-denylist",
+		defaultValue: []string{},
+		description:  "Environment variables removed from the container. These take precedence over env-allowlist.",
+	},
+	{
+		name:         "max-env-count",
+		defaultValue: int64(defaultMaxEnvCount),
+		description:  "Maximum number of environment variables of the container process. Specs with more variables are rejected. 0 disables the limit.",
+	},
+	{
+		name:         "max-env-bytes",
+		defaultValue: int64(defaultMaxEnvBytes),
+		description:  "Maximum total size in bytes of the environment variables of the container process. Specs with a larger environment are rejected. 0 disables the limit.",
+	},
+	{
+		name:         "runtime-env-allowlist",
+		defaultValue: []string{},
+		description:  "Environment variables passed to the low-level runtime in addition to PATH, HOME, TMPDIR, XDG_RUNTIME_DIR and NOTIFY_SOCKET. If empty, all are passed. A trailing * matches a prefix.",
+	},
+	{
+		name:         "visible-devices-env",
+		defaultValue: visibleDevicesEnvvar,
+		description:  "Environment variable through which containers request GPUs. The decisions based on NVIDIA_VISIBLE_DEVICES, such as device injection, CDI requests and visible-devices-policy, use this variable instead. The NVIDIA hook itself still reads NVIDIA_VISIBLE_DEVICES.",
+	},
+	{
+		name:        "force-visible-devices",
+		example:     `"all"`,
+		description: "Value NVIDIA_VISIBLE_DEVICES is forced to. An empty value or \"void\" removes the variable.",
+	},
+	{
+		name:         "visible-devices-policy",
+		defaultValue: visibleDevicesPolicyAllow,
+		description:  "Handling of NVIDIA_VISIBLE_DEVICES=all: \"allow\" passes it through, \"deny\" rejects the container and \"rewrite\" replaces it with visible-devices-rewrite.",
+	},
+	{
+		name:        "visible-devices-rewrite",
+		example:     `["0", "1"]`,
+		description: "Devices NVIDIA_VISIBLE_DEVICES=all is replaced with when visible-devices-policy = \"rewrite\".",
+	},
+	{
+		name:        "annotation-capabilities",
+		example:     `{ "workload=video" = ["utility", "video"] }`,
+		description: "NVIDIA_DRIVER_CAPABILITIES set for containers with the annotation, or annotation=value, unless set explicitly.",
+	},
+	{
+		name:        "resolved-devices-env",
+		example:     `"NVIDIA_RESOLVED_DEVICES"`,
+		description: "Environment variable of the hook set to the canonical list of devices requested by the container after visible-devices-policy is applied: the entries of NVIDIA_VISIBLE_DEVICES without blanks and duplicates.",
+	},
+	{
+		name:         "resolved-devices-env-container",
+		defaultValue: false,
+		description:  "Also set resolved-devices-env in the environment of the container process.",
+	},
+	{
+		name:        "hook-path",
+		example:     `"/usr/local/bin/nvidia-container-runtime-hook"`,
+		description: "Path of the hook. By default the hook is looked up in the PATH.",
+	},
+	{
+		name:         "allow-relative-hook-path",
+		defaultValue: false,
+		description:  "Allow a relative hook-path, which is resolved against the bundle directory. OCI requires absolute hook paths.",
+	},
+	{
+		name:         "hook-workdir",
+		defaultValue: "",
+		description:  "Directory the hook is run from.",
+	},
+	{
+		name:         "hook-stage",
+		defaultValue: hookStagePrestart,
+		description:  "Hook list the hook is inserted into: \"prestart\", \"createRuntime\", \"createContainer\" or \"both\". For createContainer the hook is bind-mounted into the container.",
+	},
+	{
+		name:         "hook-stage-fallback",
+		defaultValue: hookStageFallbackPrestart,
+		description:  "Handling of a hook-stage that the OCI specification predates (createRuntime and createContainer require version 1.0.2): \"prestart\" inserts the hook as a prestart hook instead, \"error\" rejects the specification.",
+	},
+	{
+		name:         "hook-args",
+		defaultValue: hookArgsPrestart,
+		description:  "Argument passed to the hook: \"prestart\", or \"stage\" for the name of the hook stage.",
+	},
+	{
+		name:        "hook-arg-templates",
+		example:     `["--container-id={{.ContainerID}}", "--rootfs={{.RootFS}}"]`,
+		description: "Arguments passed to the hook ahead of the hook-args argument. The placeholders {{.ContainerID}}, {{.RootFS}} and {{.Bundle}} are replaced with the id, the absolute root filesystem and the bundle directory of the container.",
+	},
+	{
+		name:         "hook-position",
+		defaultValue: hookPositionLast,
+		description:  "Position of the hook in the hook lists: \"first\", \"last\", or \"after:<name>\" for after the first hook whose path contains name. hook-after and the nvidia.com/hook-order annotation override it.",
+	},
+	{
+		name:        "hook-after",
+		example:     `"/usr/local/bin/mount-hook"`,
+		description: "Insert the hook right after the first existing hook whose path contains this value. The hook is appended if there is no match.",
+	},
+	{
+		name:         "hook-sha256",
+		defaultValue: "",
+		description:  "Expected SHA-256 checksum of the hook, checked by nvidia-container-runtime verify-hook.",
+	},
+	{
+		name:        "hook-env",
+		example:     `{ NAME = "value" }`,
+		description: "Environment of the hook.",
+	},
+	{
+		name:        "hook-env-file",
+		example:     `"/etc/nvidia-container-runtime/hook.env"`,
+		description: "File of KEY=VALUE lines added to the environment of the hook. Entries of hook-env take precedence.",
+	},
+	{
+		name:         "propagate-proxy-env",
+		defaultValue: false,
+		description:  "Copy HTTP_PROXY, HTTPS_PROXY and NO_PROXY from the environment of the runtime to the environment of the hook.",
+	},
+	{
+		name:        "cli-env",
+		example:     `{ LD_LIBRARY_PATH = "${LD_LIBRARY_PATH}" }`,
+		description: "Environment of the hook for tuning nvidia-container-cli. ${VAR} references are expanded.",
+	},
+	{
+		name:         "max-hooks",
+		defaultValue: int64(defaultMaxHooks),
+		description:  "Maximum number of hooks in an OCI specification. Specs with more hooks are rejected. 0 disables the limit.",
+	},
+	{
+		name:         "hook-resolve-retries",
+		defaultValue: int64(0),
+		description:  "Number of times finding the hook is retried before failing to create a container, e.g. while the hook is being installed.",
+	},
+	{
+		name:         "hook-resolve-backoff",
+		defaultValue: int64(defaultHookResolveBackoff),
+		description:  "Delay before the first retry of finding the hook in milliseconds. The delay doubles with each retry.",
+	},
+	{
+		name:         "skip-privileged",
+		defaultValue: false,
+		description:  "Do not insert the hook into privileged containers, which are allowed access to all devices.",
+	},
+	{
+		name:        "skip-if-entrypoint-matches",
+		example:     `["/fluent-bit", "/usr/bin/*-agent"]`,
+		description: "Entrypoints of containers that are not modified even if they request GPUs, e.g. sidecars inheriting the environment of a pod. An entry containing any of *?[ matches the first process arg as a glob, otherwise as a prefix.",
+	},
+	{
+		name:         "stamp-annotations",
+		defaultValue: false,
+		description:  "Annotate containers requesting GPUs with nvidia.com/visible-devices and nvidia.com/hook-stage.",
+	},
+	{
+		name:         "stamp-provenance",
+		defaultValue: false,
+		description:  "Annotate modified specs with nvidia.com/runtime-version and nvidia.com/processed-at.",
+	},
+	{
+		name:         "inject-devices",
+		defaultValue: []string{},
+		description:  "Device nodes added to containers requesting GPUs.",
+	},
+	{
+		name:         "device-cgroup-rules",
+		defaultValue: deviceCgroupRulesDevice,
+		description:  "Cgroup rules added for injected devices: \"device\" per device, or \"wildcard\" per major number.",
+	},
+	{
+		name:         "device-cgroup-conflicts",
+		defaultValue: deviceCgroupConflictsReorder,
+		description:  "Handling of deny rules shadowing the cgroup rules of injected devices: \"reorder\" moves the rules after them, \"error\" rejects the spec.",
+	},
+	{
+		name:        "device-uuid-map",
+		example:     `"/etc/nvidia-container-runtime/gpu-uuids"`,
+		description: "File of UUID=INDEX lines mapping GPU UUIDs to the index N of their /dev/nvidiaN node. If NVIDIA_VISIBLE_DEVICES lists UUIDs, the /dev/nvidiaN entries of inject-devices are replaced by the nodes of the requested GPUs.",
+	},
+	{
+		name:         "apparmor-profile",
+		defaultValue: "",
+		description:  "AppArmor profile of containers.",
+	},
+	{
+		name:         "force-apparmor",
+		defaultValue: false,
+		description:  "Replace an AppArmor profile already set in the OCI specification.",
+	},
+	{
+		name:        "inject-init",
+		example:     `"/usr/bin/tini"`,
+		description: "Init bind-mounted into containers and run as PID 1 to reap orphaned processes, unless the entrypoint is an init.",
+	},
+	{
+		name:         "require-process-args",
+		defaultValue: false,
+		description:  "Reject containers requesting GPUs without process args if they need to be rewritten, e.g. by inject-init. By default the rewrite is skipped.",
+	},
+	{
+		name:         "external-modifier",
+		defaultValue: "",
+		description:  "Executable reading the OCI specification on stdin and writing the modified specification to stdout.",
+	},
+	{
+		name:         "external-modifier-order",
+		defaultValue: externalModifierAfter,
+		description:  "Whether the external modifier runs \"before\" or \"after\" the hook is inserted.",
+	},
+	{
+		name:         "external-modifier-timeout",
+		defaultValue: int64(defaultExternalModifierTimeout),
+		description:  "Timeout of the external modifier in seconds.",
+	},
+	{
+		name:        "spec-patches",
+		example:     `[{ op = "add", path = "/annotations/example", value = "value" }]`,
+		description: "JSON Patch (RFC 6902) operations applied to the OCI specification after all other modifications.",
+	},
+	{
+		name:        "spec-schema",
+		example:     `"/etc/nvidia-container-runtime/spec-schema.json"`,
+		description: "JSON Schema the OCI specification must conform to before it is modified. Supports type, enum, const, required, properties, additionalProperties, items, length, size and range limits, pattern, allOf, anyOf, not and local $ref.",
+	},
+	{
+		name:         "warn-duplicate-keys",
+		defaultValue: false,
+		description:  "Log top-level keys occurring more than once in the OCI specification of the bundle. The last value of such a key is used either way.",
+	},
+	{
+		name:        "post-processors",
+		example:     `["/usr/local/bin/check-spec"]`,
+		description: "Executables run in order with the final OCI specification on stdin. A non-zero exit aborts the create with its exit code, a specification written to stdout replaces the specification.",
+	},
+	{
+		name:         "post-processor-timeout",
+		defaultValue: int64(defaultPostProcessorTimeout),
+		description:  "Timeout of each post-processor in seconds.",
+	},
+	{
+		name:         "run-as-create-start",
+		defaultValue: false,
+		description:  "Run containers as a create followed by a start so that the hook is inserted.",
+	},
+	{
+		name:        "runtime-oom-score-adj",
+		example:     "-500",
+		description: "oom_score_adj of the low-level runtime when it is run as a child process, e.g. with run-as-create-start. Not applied to exec. The container process inherits it unless its OCI specification sets oomScoreAdj, so this is pinned to the oom_score_adj of the caller on create.",
+	},
+	{
+		name:        "runtime-user",
+		example:     `"nobody"`,
+		description: "User name or id the low-level runtime is run as when it is run as a child process, e.g. with run-as-create-start. Linux only.",
+	},
+	{
+		name:        "runtime-group",
+		example:     "65534",
+		description: "Group name or id the low-level runtime is run as when it is run as a child process. Defaults to the primary group of runtime-user.",
+	},
+	{
+		name:        "runtime-rlimit-as",
+		example:     "4294967296",
+		description: "Soft limit of the address space of the low-level runtime in bytes (RLIMIT_AS). Must not exceed the hard limit. Not applied to exec. The container process inherits this limit unless its OCI specification sets it, so it is pinned to the limit of the caller on create. Linux only.",
+	},
+	{
+		name:        "runtime-rlimit-data",
+		example:     "2147483648",
+		description: "Soft limit of the data segment of the low-level runtime in bytes (RLIMIT_DATA). Applied like runtime-rlimit-as. Linux only.",
+	},
+	{
+		name:        "runtime-rlimit-nofile",
+		example:     "1024",
+		description: "Soft limit of the number of open files of the low-level runtime (RLIMIT_NOFILE). Applied like runtime-rlimit-as. Linux only.",
+	},
+	{
+		name:        "runtime-args",
+		example:     `{ create = ["--systemd-cgroup"] }`,
+		description: "Flags added ahead of the subcommand of the runtime command line, per subcommand. Flags already specified are not added again.",
+	},
+	{
+		name:         "modify-on-restore",
+		defaultValue: false,
+		description:  "Modify the OCI specification on restore. By default the modifications made on create are assumed to be present.",
+	},
+	{
+		name:         "mutate-on",
+		defaultValue: defaultMutateOn,
+		description:  "Runtime subcommands for which the OCI specification is modified. Other subcommands are passed to the runtime unchanged.",
+	},
+	{
+		name:         "strict-subcommands",
+		defaultValue: false,
+		description:  "Reject subcommands unknown to runc instead of passing them to the runtime unchanged.",
+	},
+	{
+		name:         "on-existing",
+		defaultValue: onExistingError,
+		description:  "Handling of a create for the id of an existing container, as reported by the state command of the runtime: \"error\" passes it to the runtime, \"ignore\" treats it as successful and \"recreate\" deletes the container first.",
+	},
+	{
+		name:        "dump-spec-dir",
+		example:     `"/var/log/nvidia-container-runtime/specs"`,
+		description: "Directory to which a copy of the modified OCI specification is written as <container-id>.json on create.",
+	},
+	{
+		name:         "dump-spec-max-files",
+		defaultValue: int64(defaultDumpSpecMaxFiles),
+		description:  "Number of specs kept in the dump-spec-dir, of which the oldest are removed. 0 keeps all specs.",
+	},
+	{
+		name:         "cleanup-on-delete",
+		defaultValue: false,
+		description:  "Clean up the GPU state of containers on delete. Cleanup failures are logged but do not prevent the delete.",
+	},
+	{
+		name:        "cleanup-command",
+		example:     `"/usr/local/bin/gpu-cleanup"`,
+		description: "Command run with the container id to clean up its GPU state. By default the hook is run with the cleanup argument.",
+	},
+	{
+		name:         "cleanup-order",
+		defaultValue: cleanupAfter,
+		description:  "Whether the cleanup runs \"before\" or \"after\" the delete.",
+	},
+	{
+		name:        "min-runtime-version",
+		example:     `"1.0.0"`,
+		description: "Lowest known-good version of the low-level runtime. Other versions are logged on create.",
+	},
+	{
+		name:        "max-runtime-version",
+		example:     `"1.1.99"`,
+		description: "Highest known-good version of the low-level runtime. Other versions are logged on create.",
+	},
+	{
+		name:         "strict-runtime-version",
+		defaultValue: false,
+		description:  "Fail to create containers if the low-level runtime is outside of the known-good versions.",
+	},
+	{
+		name:        "config-url",
+		example:     `"https://config.example.com/nvidia-container-runtime/config.toml"`,
+		description: "URL of a config replacing this one. Only https is supported unless config-url-allow-insecure is set.",
+	},
+	{
+		name:         "config-url-allow-insecure",
+		defaultValue: false,
+		description:  "Also allow the config-url to be fetched over plain http. The fetched config selects the commands run for each container, such as the external-modifier, so this lets anyone on the network path run code as root. Only intended for testing.",
+	},
+	{
+		name:         "config-url-timeout",
+		defaultValue: int64(defaultConfigURLTimeout),
+		description:  "Timeout for fetching the config-url in seconds.",
+	},
+	{
+		name:         "config-url-cache",
+		defaultValue: defaultConfigURLCache,
+		description:  "Path of the cached copy of the config-url.",
+	},
+	{
+		name:         "config-url-cache-ttl",
+		defaultValue: int64(defaultConfigURLCacheTTL),
+		description:  "Time in seconds for which the cached copy of the config-url is used without fetching it.",
+	},
+}
@@ -0,0 +1,64 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	configTable = "nvidia-container-runtime"
+
+	configSourceDefault = "default"
+	configSourceFile    = "file"
+	configSourceURL     = "url"
+)
+
+// configSources maps each supported config key to the source its value was
+// taken from. A source is either "default", "file:<path>" or "url:<url>".
+type configSources map[string]string
+
+// getConfigSources determines the source of each supported config key. The
+// local config is read from the specified file. If a config-url is set, the
+// remote config replaces the local one, except for the config-url keys that
+// are always read from the local config.
+func getConfigSources(local *toml.Tree, localPath string, remote *toml.Tree) configSources {
+	sources := make(configSources)
+	for _, configKey := range configKeys {
+		key := configKey.name
+		switch {
+		case remote != nil && !isRemoteConfigKey(key):
+			sources[key] = getConfigSource(remote, key, configSourceURL+":"+local.Get(configTable+".config-url").(string))
+		default:
+			sources[key] = getConfigSource(local, key, configSourceFile+":"+localPath)
+		}
+	}
+	return sources
+}
+
+func getConfigSource(tree *toml.Tree, key string, source string) string {
+	if tree.Has(configTable + "." + key) {
+		return source
+	}
+	return configSourceDefault
+}
+
+func isRemoteConfigKey(key string) bool {
+	return strings.HasPrefix(key, "config-url")
+}
@@ -0,0 +1,346 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	// deviceCgroupRulesDevice adds a cgroup rule for the major and minor
+	// number of each injected device.
+	deviceCgroupRulesDevice = "device"
+	// deviceCgroupRulesWildcard adds a cgroup rule allowing all minor
+	// numbers of the major number of each injected device.
+	deviceCgroupRulesWildcard = "wildcard"
+
+	deviceCgroupAccess = "rwm"
+
+	// deviceCgroupConflictsReorder moves the cgroup rule of an injected
+	// device after the deny rules shadowing it. deviceCgroupConflictsError
+	// rejects the spec instead.
+	deviceCgroupConflictsReorder = "reorder"
+	deviceCgroupConflictsError   = "error"
+
+	// gpuUUIDPrefix is the prefix of the UUID of a GPU, as listed by
+	// "nvidia-smi -L".
+	gpuUUIDPrefix = "GPU-"
+)
+
+// gpuDevicePathPattern matches the device node of a single GPU.
+var gpuDevicePathPattern = regexp.MustCompile(`^/dev/nvidia[0-9]+$`)
+
+// injectDevices adds the device nodes at the specified host paths to the
+// specified spec, along with the cgroup rules allowing access to them. Devices
+// and rules that are already present are not added again. Existing deny rules
+// shadowing the rule of a device are handled according to conflicts. Specs
+// targeting another platform than Linux are left unchanged.
+func injectDevices(spec *specs.Spec, paths []string, cgroupRules string, conflicts string) error {
+	if !isLinuxSpec(spec) {
+		logger.Printf("OCI specification does not target Linux, not injecting devices")
+		return nil
+	}
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	if spec.Linux.Resources == nil {
+		spec.Linux.Resources = &specs.LinuxResources{}
+	}
+
+	for _, path := range paths {
+		device, err := getDevice(path)
+		if err != nil {
+			return err
+		}
+
+		if !containsDevice(spec.Linux.Devices, device.Path) {
+			logger.Printf("Injecting device %v (%v %d:%d)", device.Path, device.Type, device.Major, device.Minor)
+			spec.Linux.Devices = append(spec.Linux.Devices, device)
+		}
+
+		rule := getDeviceCgroupRule(device, cgroupRules)
+		if !containsDeviceCgroupRule(spec.Linux.Resources.Devices, rule) {
+			spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, rule)
+		}
+
+		rules, err := resolveDeviceCgroupConflicts(spec.Linux.Resources.Devices, rule, conflicts)
+		if err != nil {
+			return fmt.Errorf("error injecting device %v: %v", device.Path, err)
+		}
+		spec.Linux.Resources.Devices = rules
+	}
+
+	return nil
+}
+
+// selectGPUDevices returns the device nodes to inject for the specified value
+// of the visible devices environment variable. If the value lists GPU UUIDs,
+// these are mapped to the index of the GPU using the device-uuid-map file at
+// the specified path, and the device nodes of single GPUs in paths are
+// replaced by those of the requested GPUs. Indices may be listed along with
+// UUIDs. An unknown UUID is an error. Other values, e.g. "all", leave paths
+// unchanged, since the GPUs cannot be enumerated without the hook.
+func selectGPUDevices(paths []string, visibleDevices string, uuidMapPath string) ([]string, error) {
+	devices := strings.Split(visibleDevices, ",")
+	hasUUID := false
+	for _, device := range devices {
+		if strings.HasPrefix(strings.TrimSpace(device), gpuUUIDPrefix) {
+			hasUUID = true
+		}
+	}
+	if !hasUUID {
+		return paths, nil
+	}
+
+	uuidMap, err := readEnvFile(uuidMapPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading device-uuid-map: %v", err)
+	}
+
+	var selected []string
+	for _, device := range devices {
+		device = strings.TrimSpace(device)
+		index := device
+		if strings.HasPrefix(device, gpuUUIDPrefix) {
+			var ok bool
+			index, ok = uuidMap[device]
+			if !ok {
+				return nil, fmt.Errorf("unknown GPU %v: not listed in device-uuid-map %v", device, uuidMapPath)
+			}
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(index), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GPU %q: expected a UUID or an index", device)
+		}
+		path := fmt.Sprintf("/dev/nvidia%d", n)
+		if !containsString(selected, path) {
+			selected = append(selected, path)
+		}
+	}
+
+	var result []string
+	for _, path := range paths {
+		if !gpuDevicePathPattern.MatchString(path) {
+			result = append(result, path)
+		}
+	}
+	logger.Printf("Injecting the device nodes %v of the requested GPUs", strings.Join(selected, ", "))
+	return append(result, selected...), nil
+}
+
+// resolveDeviceCgroupConflicts checks whether the specified allow rule is
+// shadowed by a deny rule. Since the last matching rule takes effect, this is
+// the case for an overlapping deny rule following the last instance of the
+// allow rule. Depending on conflicts, the allow rule is either moved to the end
+// of the rules or an error is returned.
+func resolveDeviceCgroupConflicts(rules []specs.LinuxDeviceCgroup, rule specs.LinuxDeviceCgroup, conflicts string) ([]specs.LinuxDeviceCgroup, error) {
+	index := -1
+	for i, r := range rules {
+		if containsDeviceCgroupRule([]specs.LinuxDeviceCgroup{r}, rule) {
+			index = i
+		}
+	}
+
+	var shadowing *specs.LinuxDeviceCgroup
+	for i := index + 1; i < len(rules); i++ {
+		if !rules[i].Allow && deviceCgroupRulesOverlap(rules[i], rule) {
+			shadowing = &rules[i]
+		}
+	}
+	if shadowing == nil {
+		return rules, nil
+	}
+
+	if conflicts == deviceCgroupConflictsError {
+		return nil, fmt.Errorf("cgroup rule allowing %v is shadowed by the deny rule %v that follows it", formatDeviceCgroupRule(rule), formatDeviceCgroupRule(*shadowing))
+	}
+
+	logger.Printf("Moving cgroup rule allowing %v after the deny rule %v shadowing it", formatDeviceCgroupRule(rule), formatDeviceCgroupRule(*shadowing))
+	var result []specs.LinuxDeviceCgroup
+	result = append(result, rules[:index]...)
+	result = append(result, rules[index+1:]...)
+	return append(result, rule), nil
+}
+
+// deviceCgroupRulesOverlap checks whether the specified cgroup rules apply to
+// a common device and access type. An empty or "a" type and an unset or
+// negative number match any device.
+func deviceCgroupRulesOverlap(a specs.LinuxDeviceCgroup, b specs.LinuxDeviceCgroup) bool {
+	isAnyType := func(t string) bool { return t == "" || t == "a" }
+	if !isAnyType(a.Type) && !isAnyType(b.Type) && a.Type != b.Type {
+		return false
+	}
+	if !deviceNumbersOverlap(a.Major, b.Major) || !deviceNumbersOverlap(a.Minor, b.Minor) {
+		return false
+	}
+	return a.Access == "" || b.Access == "" || strings.ContainsAny(a.Access, b.Access)
+}
+
+func deviceNumbersOverlap(a *int64, b *int64) bool {
+	if a == nil || b == nil || *a < 0 || *b < 0 {
+		return true
+	}
+	return *a == *b
+}
+
+// formatDeviceCgroupRule renders the specified cgroup rule in the format of the
+// devices.allow file of the cgroup, e.g. "c 195:* rwm".
+func formatDeviceCgroupRule(rule specs.LinuxDeviceCgroup) string {
+	number := func(n *int64) string {
+		if n == nil || *n < 0 {
+			return "*"
+		}
+		return fmt.Sprint(*n)
+	}
+	deviceType := rule.Type
+	if deviceType == "" {
+		deviceType = "a"
+	}
+	return fmt.Sprintf("%v %v:%v %v", deviceType, number(rule.Major), number(rule.Minor), rule.Access)
+}
+
+// getDevice returns the OCI device describing the device node at the
+// specified path.
+func getDevice(path string) (specs.LinuxDevice, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return specs.LinuxDevice{}, err
+	}
+
+	var deviceType string
+	switch {
+	case info.Mode()&os.ModeDevice == 0:
+		return specs.LinuxDevice{}, fmt.Errorf("%v is not a device node", path)
+	case info.Mode()&os.ModeCharDevice != 0:
+		deviceType = "c"
+	default:
+		deviceType = "b"
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return specs.LinuxDevice{}, fmt.Errorf("unable to determine device number of %v", path)
+	}
+	rdev := uint64(stat.Rdev)
+
+	fileMode := info.Mode().Perm()
+	uid := stat.Uid
+	gid := stat.Gid
+
+	return specs.LinuxDevice{
+		Path:     path,
+		Type:     deviceType,
+		Major:    int64(deviceMajor(rdev)),
+		Minor:    int64(deviceMinor(rdev)),
+		FileMode: &fileMode,
+		UID:      &uid,
+		GID:      &gid,
+	}, nil
+}
+
+// deviceMajor returns the major number of the specified Linux device number.
+func deviceMajor(rdev uint64) uint64 {
+	return ((rdev >> 8) & 0xfff) | ((rdev >> 32) &^ 0xfff)
+}
+
+// deviceMinor returns the minor number of the specified Linux device number.
+func deviceMinor(rdev uint64) uint64 {
+	return (rdev & 0xff) | ((rdev >> 12) &^ 0xff)
+}
+
+// getDeviceCgroupRule returns the cgroup rule allowing access to the specified
+// device.
+func getDeviceCgroupRule(device specs.LinuxDevice, cgroupRules string) specs.LinuxDeviceCgroup {
+	major := device.Major
+	rule := specs.LinuxDeviceCgroup{
+		Allow:  true,
+		Type:   device.Type,
+		Major:  &major,
+		Access: deviceCgroupAccess,
+	}
+	if cgroupRules != deviceCgroupRulesWildcard {
+		minor := device.Minor
+		rule.Minor = &minor
+	}
+	return rule
+}
+
+// containsDevice checks whether the specified devices include a device at the
+// specified path.
+func containsDevice(devices []specs.LinuxDevice, path string) bool {
+	for _, device := range devices {
+		if device.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// containsDeviceCgroupRule checks whether the specified rules include the
+// specified rule.
+func containsDeviceCgroupRule(rules []specs.LinuxDeviceCgroup, rule specs.LinuxDeviceCgroup) bool {
+	for _, r := range rules {
+		if r.Allow == rule.Allow && r.Type == rule.Type && r.Access == rule.Access &&
+			equalInt64Ptr(r.Major, rule.Major) && equalInt64Ptr(r.Minor, rule.Minor) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalInt64Ptr(a *int64, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// isPrivilegedContainer checks whether the specified spec describes a
+// privileged container. An OCI spec has no explicit notion of privilege, so
+// the following heuristic is used: a container is considered privileged if its
+// device cgroup rules allow full access to all devices. This is the case if the
+// last rule matching all devices (no type, or type "a", and no major or minor
+// number) is an allow rule granting read, write and mknod access, as produced
+// by "docker run --privileged" or "podman run --privileged". Rules for
+// specific devices are ignored since they do not lift a preceding deny-all
+// rule.
+func isPrivilegedContainer(spec *specs.Spec) bool {
+	if spec.Linux == nil || spec.Linux.Resources == nil {
+		return false
+	}
+
+	privileged := false
+	for _, rule := range spec.Linux.Resources.Devices {
+		if (rule.Type != "" && rule.Type != "a") || rule.Major != nil || rule.Minor != nil {
+			continue
+		}
+		if !rule.Allow {
+			privileged = false
+			continue
+		}
+		privileged = rule.Access == "" || (strings.Contains(rule.Access, "r") &&
+			strings.Contains(rule.Access, "w") && strings.Contains(rule.Access, "m"))
+	}
+	return privileged
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInjectDevices(t *testing.T) {
+	int64Ptr := func(i int64) *int64 { return &i }
+
+	testCases := []struct {
+		description   string
+		cgroupRules   string
+		expectedRules []specs.LinuxDeviceCgroup
+	}{
+		{
+			description: "device rules",
+			cgroupRules: deviceCgroupRulesDevice,
+			expectedRules: []specs.LinuxDeviceCgroup{
+				{Allow: true, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3), Access: "rwm"},
+				{Allow: true, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(5), Access: "rwm"},
+			},
+		},
+		{
+			description: "wildcard rules",
+			cgroupRules: deviceCgroupRulesWildcard,
+			expectedRules: []specs.LinuxDeviceCgroup{
+				{Allow: true, Type: "c", Major: int64Ptr(1), Access: "rwm"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{}
+
+		// Repeated injection must not duplicate devices or rules.
+		for i := 0; i < 3; i++ {
+			require.NoError(t, injectDevices(spec, []string{"/dev/null", "/dev/zero"}, tc.cgroupRules, deviceCgroupConflictsReorder), tc.description)
+		}
+
+		require.Len(t, spec.Linux.Devices, 2, tc.description)
+		require.Equal(t, "/dev/null", spec.Linux.Devices[0].Path, tc.description)
+		require.Equal(t, "c", spec.Linux.Devices[0].Type, tc.description)
+		require.Equal(t, int64(1), spec.Linux.Devices[0].Major, tc.description)
+		require.Equal(t, int64(3), spec.Linux.Devices[0].Minor, tc.description)
+		require.Equal(t, "/dev/zero", spec.Linux.Devices[1].Path, tc.description)
+		require.Equal(t, int64(5), spec.Linux.Devices[1].Minor, tc.description)
+
+		require.Equal(t, tc.expectedRules, spec.Linux.Resources.Devices, tc.description)
+	}
+}
+
+func TestInjectDevicesExistingResources(t *testing.T) {
+	spec := &specs.Spec{
+		Linux: &specs.Linux{
+			Resources: &specs.LinuxResources{
+				Devices: []specs.LinuxDeviceCgroup{
+					{Allow: false, Access: "rwm"},
+				},
+			},
+		},
+	}
+
+	require.NoError(t, injectDevices(spec, []string{"/dev/null"}, deviceCgroupRulesDevice, deviceCgroupConflictsReorder))
+	require.Len(t, spec.Linux.Devices, 1)
+	require.Len(t, spec.Linux.Resources.Devices, 2)
+	require.False(t, spec.Linux.Resources.Devices[0].Allow)
+	require.True(t, spec.Linux.Resources.Devices[1].Allow)
+}
+
+func TestInjectDevicesConflictingDenyRule(t *testing.T) {
+	int64Ptr := func(i int64) *int64 { return &i }
+	allowNull := specs.LinuxDeviceCgroup{Allow: true, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3), Access: "rwm"}
+	denyMajor := specs.LinuxDeviceCgroup{Allow: false, Type: "c", Major: int64Ptr(1), Access: "rw"}
+	newSpec := func() *specs.Spec {
+		return &specs.Spec{
+			Linux: &specs.Linux{
+				Resources: &specs.LinuxResources{
+					Devices: []specs.LinuxDeviceCgroup{
+						{Allow: false, Access: "rwm"},
+						allowNull,
+						denyMajor,
+						{Allow: false, Type: "b", Major: int64Ptr(1), Access: "rwm"},
+					},
+				},
+			},
+		}
+	}
+
+	spec := newSpec()
+	require.NoError(t, injectDevices(spec, []string{"/dev/null"}, deviceCgroupRulesDevice, deviceCgroupConflictsReorder))
+	require.Equal(t, []specs.LinuxDeviceCgroup{
+		{Allow: false, Access: "rwm"},
+		denyMajor,
+		{Allow: false, Type: "b", Major: int64Ptr(1), Access: "rwm"},
+		allowNull,
+	}, spec.Linux.Resources.Devices)
+
+	// Reordering again does not change the result.
+	require.NoError(t, injectDevices(spec, []string{"/dev/null"}, deviceCgroupRulesDevice, deviceCgroupConflictsReorder))
+	require.Len(t, spec.Linux.Resources.Devices, 4)
+
+	spec = newSpec()
+	err := injectDevices(spec, []string{"/dev/null"}, deviceCgroupRulesDevice, deviceCgroupConflictsError)
+	require.EqualError(t, err, "error injecting device /dev/null: cgroup rule allowing c 1:3 rwm is shadowed by the deny rule c 1:* rw that follows it")
+}
+
+func TestDeviceCgroupRulesOverlap(t *testing.T) {
+	int64Ptr := func(i int64) *int64 { return &i }
+	rule := specs.LinuxDeviceCgroup{Allow: true, Type: "c", Major: int64Ptr(195), Minor: int64Ptr(0), Access: "rwm"}
+
+	testCases := []struct {
+		description string
+		deny        specs.LinuxDeviceCgroup
+		expected    bool
+	}{
+		{"all devices", specs.LinuxDeviceCgroup{Access: "rwm"}, true},
+		{"same major", specs.LinuxDeviceCgroup{Type: "c", Major: int64Ptr(195), Access: "w"}, true},
+		{"wildcard major", specs.LinuxDeviceCgroup{Type: "a", Major: int64Ptr(-1), Minor: int64Ptr(0)}, true},
+		{"other minor", specs.LinuxDeviceCgroup{Type: "c", Major: int64Ptr(195), Minor: int64Ptr(1), Access: "rwm"}, false},
+		{"block devices", specs.LinuxDeviceCgroup{Type: "b", Access: "rwm"}, false},
+		{"other access", specs.LinuxDeviceCgroup{Type: "c", Major: int64Ptr(195), Access: "m"}, true},
+	}
+
+	for _, tc := range testCases {
+		require.Equal(t, tc.expected, deviceCgroupRulesOverlap(tc.deny, rule), tc.description)
+	}
+
+	readOnly := specs.LinuxDeviceCgroup{Allow: true, Type: "c", Access: "r"}
+	require.False(t, deviceCgroupRulesOverlap(specs.LinuxDeviceCgroup{Type: "c", Access: "wm"}, readOnly))
+}
+
+func TestInjectDevicesNotADevice(t *testing.T) {
+	file, err := ioutil.TempFile("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	spec := &specs.Spec{}
+	require.Error(t, injectDevices(spec, []string{file.Name()}, deviceCgroupRulesDevice, deviceCgroupConflictsReorder))
+	require.Error(t, injectDevices(spec, []string{"/dev/does-not-exist"}, deviceCgroupRulesDevice, deviceCgroupConflictsReorder))
+}
+
+func TestInjectDevicesNonLinuxSpec(t *testing.T) {
+	spec := &specs.Spec{Windows: &specs.Windows{}}
+	require.NoError(t, injectDevices(spec, []string{"/dev/null"}, deviceCgroupRulesDevice, deviceCgroupConflictsReorder))
+	require.Nil(t, spec.Linux, "devices should not be injected into a Windows spec")
+
+	spec = &specs.Spec{Linux: &specs.Linux{}}
+	require.NoError(t, injectDevices(spec, []string{"/dev/null"}, deviceCgroupRulesDevice, deviceCgroupConflictsReorder))
+	require.Len(t, spec.Linux.Devices, 1)
+	require.Len(t, spec.Linux.Resources.Devices, 1)
+}
+
+func TestInjectDevicesModifier(t *testing.T) {
+	cfg := &config{
+		injectDevices:     []string{"/dev/null"},
+		deviceCgroupRules: deviceCgroupRulesDevice,
+	}
+
+	testCases := []struct {
+		visibleDevicesEnv string
+		env               []string
+		expectedDevices   int
+	}{
+		{
+			env:             []string{"NVIDIA_VISIBLE_DEVICES=all"},
+			expectedDevices: 1,
+		},
+		{
+			env:             []string{"NVIDIA_VISIBLE_DEVICES=void"},
+			expectedDevices: 0,
+		},
+		{
+			env:             []string{"PATH=/usr/bin"},
+			expectedDevices: 0,
+		},
+		{
+			visibleDevicesEnv: "GPU_REQUEST",
+			env:               []string{"GPU_REQUEST=0"},
+			expectedDevices:   1,
+		},
+		{
+			visibleDevicesEnv: "GPU_REQUEST",
+			env:               []string{"GPU_REQUEST=void", "NVIDIA_VISIBLE_DEVICES=all"},
+			expectedDevices:   0,
+		},
+		{
+			visibleDevicesEnv: "GPU_REQUEST",
+			env:               []string{"NVIDIA_VISIBLE_DEVICES=all"},
+			expectedDevices:   0,
+		},
+	}
+
+	for _, tc := range testCases {
+		cfg.visibleDevicesEnv = tc.visibleDevicesEnv
+		spec := &specs.Spec{Process: &specs.Process{Env: tc.env}}
+		for i := 0; i < 2; i++ {
+			for _, modify := range getSpecModifiers(cfg) {
+				require.NoError(t, modify(spec))
+			}
+		}
+
+		var devices []specs.LinuxDevice
+		if spec.Linux != nil {
+			devices = spec.Linux.Devices
+		}
+		require.Len(t, devices, tc.expectedDevices, "%v", tc.env)
+	}
+}
+
+func TestSelectGPUDevices(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	uuidMap := filepath.Join(testDir, "gpu-uuids")
+	require.NoError(t, ioutil.WriteFile(uuidMap, []byte("# nvidia-smi -L\nGPU-aaaa=0\nGPU-bbbb=1\nGPU-cccc=3\n"), 0644))
+	paths := []string{"/dev/nvidiactl", "/dev/nvidia0", "/dev/nvidia1", "/dev/nvidia-uvm"}
+
+	testCases := []struct {
+		visibleDevices string
+		expectedPaths  []string
+		expectedError  bool
+	}{
+		{
+			visibleDevices: "all",
+			expectedPaths:  paths,
+		},
+		{
+			visibleDevices: "0,1",
+			expectedPaths:  paths,
+		},
+		{
+			visibleDevices: "GPU-bbbb",
+			expectedPaths:  []string{"/dev/nvidiactl", "/dev/nvidia-uvm", "/dev/nvidia1"},
+		},
+		{
+			visibleDevices: "GPU-cccc, 0,GPU-aaaa",
+			expectedPaths:  []string{"/dev/nvidiactl", "/dev/nvidia-uvm", "/dev/nvidia3", "/dev/nvidia0"},
+		},
+		{
+			visibleDevices: "GPU-aaaa,GPU-dddd",
+			expectedError:  true,
+		},
+		{
+			visibleDevices: "GPU-aaaa,MIG-1",
+			expectedError:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		selected, err := selectGPUDevices(paths, tc.visibleDevices, uuidMap)
+		if tc.expectedError {
+			require.Error(t, err, tc.visibleDevices)
+			continue
+		}
+		require.NoError(t, err, tc.visibleDevices)
+		require.Equal(t, tc.expectedPaths, selected, tc.visibleDevices)
+	}
+
+	_, err = selectGPUDevices(paths, "GPU-aaaa", filepath.Join(testDir, "missing"))
+	require.Error(t, err, "a missing device-uuid-map should be an error")
+}
+
+func TestInjectDevicesModifierUnknownUUID(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	uuidMap := filepath.Join(testDir, "gpu-uuids")
+	require.NoError(t, ioutil.WriteFile(uuidMap, []byte("GPU-aaaa=0\n"), 0644))
+	cfg := &config{
+		injectDevices:     []string{"/dev/null", "/dev/nvidia0"},
+		deviceCgroupRules: deviceCgroupRulesDevice,
+		deviceUUIDMap:     uuidMap,
+	}
+
+	spec := &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=GPU-ffff"}}}
+	var modifyErr error
+	for _, modify := range getSpecModifiers(cfg) {
+		if modifyErr = modify(spec); modifyErr != nil {
+			break
+		}
+	}
+	require.Error(t, modifyErr)
+	require.Contains(t, modifyErr.Error(), "unknown GPU GPU-ffff")
+	require.Nil(t, spec.Linux, "no devices should be injected")
+}
+
+func TestSpecModifiersNilLinux(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	hookPath, err := writeTestScript(testDir, hookBinary, "exit 0")
+	require.NoError(t, err)
+
+	cfg := &config{
+		hookPath:          hookPath,
+		hookStage:         hookStageCreateContainer,
+		injectDevices:     []string{"/dev/null"},
+		deviceCgroupRules: deviceCgroupRulesDevice,
+		apparmorProfile:   "nvidia-gpu",
+		skipPrivileged:    true,
+		stampAnnotations:  true,
+	}
+
+	for _, spec := range []*specs.Spec{
+		{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}}},
+		{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}}, Windows: &specs.Windows{}},
+		{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}}, Solaris: &specs.Solaris{}},
+	} {
+		require.NoError(t, modifySpec(cfg, spec))
+		require.Len(t, spec.Hooks.CreateContainer, 1)
+		if isLinuxSpec(spec) {
+			require.Len(t, spec.Linux.Devices, 1)
+			require.Equal(t, "nvidia-gpu", spec.Process.ApparmorProfile)
+		} else {
+			require.Nil(t, spec.Linux)
+			require.Empty(t, spec.Process.ApparmorProfile)
+		}
+	}
+}
+
+func TestIsPrivilegedContainer(t *testing.T) {
+	major := int64(195)
+	withRules := func(rules ...specs.LinuxDeviceCgroup) *specs.Spec {
+		return &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{Devices: rules}}}
+	}
+
+	testCases := []struct {
+		description string
+		spec        *specs.Spec
+		expected    bool
+	}{
+		{
+			description: "no linux section",
+			spec:        &specs.Spec{},
+		},
+		{
+			description: "no device rules",
+			spec:        withRules(),
+		},
+		{
+			description: "privileged",
+			spec:        withRules(specs.LinuxDeviceCgroup{Allow: true, Access: "rwm"}),
+			expected:    true,
+		},
+		{
+			description: "privileged with type a",
+			spec:        withRules(specs.LinuxDeviceCgroup{Allow: false, Access: "rwm"}, specs.LinuxDeviceCgroup{Allow: true, Type: "a"}),
+			expected:    true,
+		},
+		{
+			description: "deny all with device allow rules",
+			spec:        withRules(specs.LinuxDeviceCgroup{Allow: false, Access: "rwm"}, specs.LinuxDeviceCgroup{Allow: true, Type: "c", Major: &major, Access: "rwm"}),
+		},
+		{
+			description: "allow all followed by deny all",
+			spec:        withRules(specs.LinuxDeviceCgroup{Allow: true, Access: "rwm"}, specs.LinuxDeviceCgroup{Allow: false, Access: "rwm"}),
+		},
+		{
+			description: "read-only access to all devices",
+			spec:        withRules(specs.LinuxDeviceCgroup{Allow: true, Access: "r"}),
+		},
+	}
+
+	for _, tc := range testCases {
+		require.Equal(t, tc.expected, isPrivilegedContainer(tc.spec), tc.description)
+	}
+}
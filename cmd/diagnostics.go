@@ -0,0 +1,144 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxDiagnosticsStderr is the number of bytes at the end of the stderr of the
+// low-level runtime that are kept for the diagnostics of verbose-errors.
+const maxDiagnosticsStderr = 4096
+
+// invocationDiagnostics collects the context of the delegation to the
+// low-level runtime reported if it fails. It is only set if verbose-errors is
+// set.
+var invocationDiagnostics *delegationDiagnostics
+
+// delegationDiagnostics describes a delegation to the low-level runtime.
+type delegationDiagnostics struct {
+	configFilePath string
+	includeInError bool
+	stderr         tailBuffer
+}
+
+// collectsDiagnostics checks whether verbose-errors collects the diagnostics of
+// the delegation of the specified subcommand. Collecting them runs the
+// low-level runtime as a child process with its stderr piped, which is only
+// done for the commands setting up a container and if stderr is not a
+// terminal: exec, or run with a TTY, keep replacing the current process.
+func collectsDiagnostics(cfg *config, subcommand string) bool {
+	switch subcommand {
+	case "create", "start":
+	case "run":
+		if !cfg.runAsCreateStart {
+			return false
+		}
+	default:
+		return false
+	}
+	return !isTerminal(os.Stderr)
+}
+
+// newDelegationDiagnostics returns the diagnostics of a delegation for the
+// bundle of the specified args. The bundle is resolved up front, since a
+// relative bundle refers to the --cwd directory, which the current process
+// changes to before delegating. Commands without a bundle have none.
+func newDelegationDiagnostics(cfg *config, a *args) *delegationDiagnostics {
+	d := &delegationDiagnostics{
+		includeInError: cfg.verboseErrorsInError,
+		stderr:         tailBuffer{max: maxDiagnosticsStderr},
+	}
+	if a.bundleDirPath == "" && !bundleSubcommands[getRuntimeSubcommand(os.Args[1:])] {
+		return d
+	}
+
+	configFilePath, err := a.getConfigFilePath()
+	if err != nil {
+		logger.Warnf("Not including the bundle in the diagnostics: %v", err)
+		return d
+	}
+	d.configFilePath, err = filepath.Abs(configFilePath)
+	if err != nil {
+		logger.Warnf("Not including the bundle in the diagnostics: %v", err)
+		d.configFilePath = ""
+	}
+	return d
+}
+
+// getStderr returns the stderr of a delegation: the stderr of the current
+// process, which is also captured if diagnostics are collected.
+func (d *delegationDiagnostics) getStderr() io.Writer {
+	if d == nil {
+		return os.Stderr
+	}
+	return io.MultiWriter(os.Stderr, &d.stderr)
+}
+
+// report logs the diagnostics of the delegation with the specified argv that
+// failed with the specified error. The returned error includes them if
+// verbose-errors-in-error is set, and wraps the specified error either way.
+func (d *delegationDiagnostics) report(argv []string, err error) error {
+	if d == nil {
+		return err
+	}
+
+	diagnostics := d.format(argv)
+	logger.Errorf("Low-level runtime failed: %v", diagnostics)
+	if !d.includeInError {
+		return err
+	}
+	return fmt.Errorf("%w (%v)", err, diagnostics)
+}
+
+// format returns the diagnostics of the delegation with the specified argv as
+// a single line.
+func (d *delegationDiagnostics) format(argv []string) string {
+	parts := []string{"command: " + formatCommandLine(argv)}
+	if d.configFilePath != "" {
+		parts = append(parts, "bundle: "+filepath.Dir(d.configFilePath))
+		checksum, err := getFileSHA256(d.configFilePath)
+		if err != nil {
+			checksum = fmt.Sprintf("unavailable (%v)", err)
+		}
+		parts = append(parts, "spec sha256: "+checksum)
+	}
+	parts = append(parts, fmt.Sprintf("stderr: %q", strings.TrimSpace(d.stderr.String())))
+	return strings.Join(parts, "; ")
+}
+
+// tailBuffer is a writer keeping the last max bytes written to it.
+type tailBuffer struct {
+	max  int
+	data []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	if len(b.data) > b.max {
+		b.data = append([]byte{}, b.data[len(b.data)-b.max:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.data)
+}
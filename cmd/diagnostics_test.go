@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTailBuffer(t *testing.T) {
+	b := tailBuffer{max: 8}
+	n, err := b.Write([]byte("abcdef"))
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+	require.Equal(t, "abcdef", b.String())
+
+	_, err = b.Write([]byte("ghijkl"))
+	require.NoError(t, err)
+	require.Equal(t, "efghijkl", b.String())
+}
+
+func TestDelegationDiagnosticsReport(t *testing.T) {
+	failure := errors.New("exit status 1")
+	argv := []string{"/usr/bin/runc", "create", "id"}
+
+	var d *delegationDiagnostics
+	require.Equal(t, failure, d.report(argv, failure), "no diagnostics without verbose-errors")
+
+	d = &delegationDiagnostics{stderr: tailBuffer{max: maxDiagnosticsStderr}}
+	d.stderr.Write([]byte("container_linux.go: starting container process caused: exec format error\n"))
+	require.Equal(t, failure, d.report(argv, failure))
+
+	d.includeInError = true
+	err := d.report(argv, failure)
+	require.True(t, errors.Is(err, failure), "the diagnostics should wrap the error")
+	require.Equal(t, `exit status 1 (command: /usr/bin/runc create id; stderr: "container_linux.go: starting container process caused: exec format error")`, err.Error())
+}
+
+func TestVerboseErrors(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	failingRuntime, err := writeTestScript(testDir, "failing-runc", `echo "runc failure details" >&2; exit 7`)
+	require.NoError(t, err)
+
+	absBundle, err := filepath.Abs(bundlePath)
+	require.NoError(t, err)
+	absBundle, err = filepath.EvalSymlinks(absBundle)
+	require.NoError(t, err)
+
+	checksum := func() string {
+		checksum, err := getFileSHA256(filepath.Join(absBundle, specFile))
+		require.NoError(t, err)
+		return checksum
+	}
+
+	testCases := []struct {
+		description     string
+		config          string
+		expectedLogged  bool
+		expectedInError bool
+	}{
+		{
+			description: "default",
+		},
+		{
+			description:    "verbose errors",
+			config:         "verbose-errors = true\n",
+			expectedLogged: true,
+		},
+		{
+			description:     "verbose errors in error",
+			config:          "verbose-errors = true\nverbose-errors-in-error = true\n",
+			expectedLogged:  true,
+			expectedInError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		require.NoError(t, generateNewRuntimeSpec())
+
+		configDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\nlog-destination = \"stderr\"\nruntime = %q\n%v", failingRuntime, tc.config))
+		require.NoError(t, err)
+		defer os.RemoveAll(configDir)
+
+		cmdCreate := exec.Command(nvidiaRuntime, "--log-format", "json", "create", "--bundle", bundlePath, "testcontainer")
+		cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+		output, err := cmdCreate.CombinedOutput()
+		require.Error(t, err, tc.description)
+		require.Equal(t, 7, cmdCreate.ProcessState.ExitCode(), "%v: the exit code of runc should be preserved", tc.description)
+		require.Contains(t, string(output), "runc failure details", "%v: the stderr of runc should be passed through", tc.description)
+
+		// The diagnostics are logged, and the error written in JSON log mode
+		// carries the error returned by the invocation.
+		var logged, errorLine string
+		for _, line := range strings.Split(string(output), "\n") {
+			switch {
+			case strings.Contains(line, "Low-level runtime failed"):
+				logged = line
+			case strings.Contains(line, `"category":"runtime"`):
+				errorLine = line
+			}
+		}
+
+		require.Equal(t, tc.expectedLogged, logged != "", "%v: %s", tc.description, output)
+		if tc.expectedLogged {
+			require.Contains(t, logged, "command: "+failingRuntime+" --log-format json create --bundle "+bundlePath+" testcontainer", tc.description)
+			require.Contains(t, logged, "bundle: "+absBundle, tc.description)
+			require.Contains(t, logged, "spec sha256: "+checksum(), tc.description)
+			require.Contains(t, logged, "runc failure details", tc.description)
+		}
+		require.Equal(t, tc.expectedInError, strings.Contains(errorLine, "spec sha256: "+checksum()), "%v: %s", tc.description, output)
+	}
+}
+
+func TestVerboseErrorsExec(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	pidFile := filepath.Join(testDir, "pid")
+	failingRuntime, err := writeTestScript(testDir, "failing-runc", `echo $$ > `+pidFile+`; echo "runc failure details" >&2; exit 7`)
+	require.NoError(t, err)
+
+	configDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\nlog-destination = \"stderr\"\nruntime = %q\nverbose-errors = true\n", failingRuntime))
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	// The diagnostics are not collected for exec, for which the low-level
+	// runtime still replaces the current process.
+	cmdExec := exec.Command(nvidiaRuntime, "exec", "testcontainer", "true")
+	cmdExec.Env = append(os.Environ(), configOverride+"="+configDir)
+	output, err := cmdExec.CombinedOutput()
+	require.Error(t, err)
+	require.Equal(t, 7, cmdExec.ProcessState.ExitCode())
+	require.Contains(t, string(output), "runc failure details")
+	require.NotContains(t, string(output), "Low-level runtime failed")
+
+	pid, err := ioutil.ReadFile(pidFile)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprint(cmdExec.Process.Pid), strings.TrimSpace(string(pid)), "runc should replace the runtime process")
+}
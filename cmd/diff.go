@@ -0,0 +1,469 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	specChangeAdd     = "add"
+	specChangeRemove  = "remove"
+	specChangeReplace = "replace"
+)
+
+// The output formats of the diff command. diffFormatText lists the changed
+// values, diffFormatUnified is a unified diff of the indented JSON of the
+// specs and diffFormatJSONPatch is a JSON Patch (RFC 6902) applying the
+// changes.
+const (
+	diffFormatText      = "text"
+	diffFormatUnified   = "unified"
+	diffFormatJSONPatch = "jsonpatch"
+
+	// diffContextLines is the number of unchanged lines around each hunk of
+	// a unified diff.
+	diffContextLines = 3
+)
+
+// specChange describes a single difference between two OCI specifications.
+// The path is a JSON pointer (RFC 6901) to the changed value.
+type specChange struct {
+	op       string
+	path     string
+	oldValue interface{}
+	newValue interface{}
+}
+
+// runDiff prints the changes that would be made to the OCI specification of
+// the bundle without modifying the config.json file:
+//
+//	nvidia-container-runtime diff [--format text|unified|jsonpatch] --bundle BUNDLE
+func runDiff(cfg *config, args *args, argv []string) error {
+	_, _, diffArgs := splitRuntimeArgs(getRuntimeArgs(argv))
+
+	format, err := getDiffFormat(diffArgs)
+	if err != nil {
+		return err
+	}
+
+	before, after, err := modifyBundleSpec(cfg, args, "")
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case diffFormatUnified:
+		return writeUnifiedDiff(os.Stdout, before, after)
+	case diffFormatJSONPatch:
+		return writeJSONPatch(os.Stdout, diffJSON(before, after))
+	}
+	return writeSpecChanges(os.Stdout, diffJSON(before, after))
+}
+
+// getDiffFormat returns the value of the --format option of the diff command.
+// Other arguments, such as the bundle, are processed by getArgs.
+func getDiffFormat(diffArgs []string) (string, error) {
+	format := diffFormatText
+	for i := 0; i < len(diffArgs); i++ {
+		parts := strings.SplitN(strings.TrimLeft(diffArgs[i], "-"), "=", 2)
+		if !strings.HasPrefix(diffArgs[i], "-") || parts[0] != "format" {
+			continue
+		}
+		if len(parts) == 2 {
+			format = parts[1]
+		} else if i+1 < len(diffArgs) {
+			format = diffArgs[i+1]
+			i++
+		} else {
+			return "", fmt.Errorf("format option needs an argument")
+		}
+	}
+
+	switch format {
+	case diffFormatText, diffFormatUnified, diffFormatJSONPatch:
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid format %q: expected %q, %q or %q", format, diffFormatText, diffFormatUnified, diffFormatJSONPatch)
+}
+
+// diffBundle returns the changes that would be made to the OCI specification
+// of the bundle referenced by the specified args for the container with the
+// specified id.
+func diffBundle(cfg *config, args *args, id string) ([]specChange, error) {
+	before, after, err := modifyBundleSpec(cfg, args, id)
+	if err != nil {
+		return nil, err
+	}
+	return diffJSON(before, after), nil
+}
+
+// modifyBundleSpec returns the generic JSON of the OCI specification of the
+// bundle referenced by the specified args before and after the modifications
+// made on create of the container with the specified id, without writing the
+// result.
+func modifyBundleSpec(cfg *config, args *args, id string) (interface{}, interface{}, error) {
+	configFilePath, err := args.getConfigFilePath()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting config file path: %v", err)
+	}
+
+	logger.Printf("Using OCI specification file path: %v", configFilePath)
+
+	spec, err := readBundleSpec(cfg, configFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	before, err := toGenericJSON(spec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshalling OCI specification: %v", err)
+	}
+
+	err = modifySpec(cfg.forBundle(filepath.Dir(configFilePath)).forContainer(id), spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	after, err := toGenericJSON(spec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshalling modified OCI specification: %v", err)
+	}
+
+	return before, after, nil
+}
+
+// toGenericJSON converts the specified value to its generic JSON
+// representation so that it can be compared independently of its Go type.
+func toGenericJSON(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	err = json.Unmarshal(data, &generic)
+	if err != nil {
+		return nil, err
+	}
+	return generic, nil
+}
+
+// diffJSON returns the changes required to transform before into after. Both
+// values are expected to be generic JSON values as produced by
+// json.Unmarshal. Arrays are compared element by element.
+func diffJSON(before, after interface{}) []specChange {
+	return appendJSONChanges(nil, "", before, after)
+}
+
+func appendJSONChanges(changes []specChange, path string, before, after interface{}) []specChange {
+	switch b := before.(type) {
+	case map[string]interface{}:
+		a, ok := after.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(b)+len(a))
+		for k := range b {
+			keys = append(keys, k)
+		}
+		for k := range a {
+			if _, exists := b[k]; !exists {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			p := path + "/" + escapeJSONPointer(k)
+			bv, inBefore := b[k]
+			av, inAfter := a[k]
+			switch {
+			case !inAfter:
+				changes = append(changes, specChange{op: specChangeRemove, path: p, oldValue: bv})
+			case !inBefore:
+				changes = append(changes, specChange{op: specChangeAdd, path: p, newValue: av})
+			default:
+				changes = appendJSONChanges(changes, p, bv, av)
+			}
+		}
+		return changes
+	case []interface{}:
+		a, ok := after.([]interface{})
+		if !ok {
+			break
+		}
+		common := len(b)
+		if len(a) < common {
+			common = len(a)
+		}
+		for i := 0; i < common; i++ {
+			changes = appendJSONChanges(changes, path+"/"+strconv.Itoa(i), b[i], a[i])
+		}
+		for i := common; i < len(a); i++ {
+			changes = append(changes, specChange{op: specChangeAdd, path: path + "/" + strconv.Itoa(i), newValue: a[i]})
+		}
+		// Removals are listed from the highest index so that applying them in
+		// order does not shift the remaining elements.
+		for i := len(b) - 1; i >= common; i-- {
+			changes = append(changes, specChange{op: specChangeRemove, path: path + "/" + strconv.Itoa(i), oldValue: b[i]})
+		}
+		return changes
+	}
+
+	if !reflect.DeepEqual(before, after) {
+		changes = append(changes, specChange{op: specChangeReplace, path: path, oldValue: before, newValue: after})
+	}
+	return changes
+}
+
+// escapeJSONPointer escapes a reference token as described in RFC 6901.
+func escapeJSONPointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
+
+// writeSpecChanges writes a human-readable representation of the specified
+// changes to w.
+func writeSpecChanges(w io.Writer, changes []specChange) error {
+	if len(changes) == 0 {
+		_, err := fmt.Fprintln(w, "No changes to OCI specification")
+		return err
+	}
+
+	for _, c := range changes {
+		var line string
+		switch c.op {
+		case specChangeAdd:
+			line = fmt.Sprintf("+ %v: %v", c.path, formatJSONValue(c.newValue))
+		case specChangeRemove:
+			line = fmt.Sprintf("- %v: %v", c.path, formatJSONValue(c.oldValue))
+		default:
+			line = fmt.Sprintf("~ %v: %v -> %v", c.path, formatJSONValue(c.oldValue), formatJSONValue(c.newValue))
+		}
+		_, err := fmt.Fprintln(w, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatJSONValue(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(data)
+}
+
+// writeJSONPatch writes the specified changes to w as a JSON Patch (RFC 6902),
+// which can be applied to the original spec, e.g. with spec-patches.
+func writeJSONPatch(w io.Writer, changes []specChange) error {
+	// The value of add and replace operations is always included, unlike with
+	// specPatch, since it may be a zero value such as false or null.
+	patch := make([]map[string]interface{}, 0, len(changes))
+	for _, c := range changes {
+		operation := map[string]interface{}{"op": c.op, "path": c.path}
+		if c.op != specChangeRemove {
+			operation["value"] = c.newValue
+		}
+		patch = append(patch, operation)
+	}
+
+	data, err := json.MarshalIndent(patch, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// writeUnifiedDiff writes a unified diff of the indented JSON of the specified
+// specs to w. Nothing is written if the specs are equal.
+func writeUnifiedDiff(w io.Writer, before, after interface{}) error {
+	beforeLines, err := getIndentedJSONLines(before)
+	if err != nil {
+		return err
+	}
+	afterLines, err := getIndentedJSONLines(after)
+	if err != nil {
+		return err
+	}
+
+	edits := diffLines(beforeLines, afterLines)
+	hunks := getDiffHunks(edits, diffContextLines)
+	if len(hunks) == 0 {
+		return nil
+	}
+
+	_, err = fmt.Fprintf(w, "--- a/%v\n+++ b/%v\n", defaultSpecFile, defaultSpecFile)
+	if err != nil {
+		return err
+	}
+	for _, hunk := range hunks {
+		_, err = fmt.Fprint(w, hunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getIndentedJSONLines(v interface{}) ([]string, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(data), "\n"), nil
+}
+
+// lineEdit is a line of a line-based diff. The op is ' ' for a line present in
+// both inputs, '-' for a removed line and '+' for an added line.
+type lineEdit struct {
+	op   byte
+	line string
+}
+
+// diffLines returns the edits transforming the lines of a into the lines of b,
+// based on their longest common subsequence.
+func diffLines(a, b []string) []lineEdit {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and
+	// b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var edits []lineEdit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, lineEdit{' ', a[i]})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, lineEdit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, lineEdit{'+', b[j]})
+			j++
+		}
+	}
+	return edits
+}
+
+// getDiffHunks groups the specified edits into the hunks of a unified diff,
+// each including up to the specified number of unchanged lines of context.
+func getDiffHunks(edits []lineEdit, context int) []string {
+	var hunks []string
+	for start := 0; start < len(edits); {
+		// Find the next change.
+		first := start
+		for first < len(edits) && edits[first].op == ' ' {
+			first++
+		}
+		if first == len(edits) {
+			break
+		}
+
+		// Extend the hunk while the unchanged lines between changes fit in
+		// the context of both.
+		last := first
+		for next := first + 1; next < len(edits); next++ {
+			if edits[next].op == ' ' {
+				continue
+			}
+			if next-last-1 > 2*context {
+				break
+			}
+			last = next
+		}
+
+		from := first - context
+		if from < start {
+			from = start
+		}
+		if from < 0 {
+			from = 0
+		}
+		to := last + context + 1
+		if to > len(edits) {
+			to = len(edits)
+		}
+
+		hunks = append(hunks, formatDiffHunk(edits, from, to))
+		start = to
+	}
+	return hunks
+}
+
+// formatDiffHunk formats the edits in [from, to) as a hunk of a unified diff.
+func formatDiffHunk(edits []lineEdit, from, to int) string {
+	// The line numbers of the hunk are those of the first line in each input.
+	aLine, bLine := 1, 1
+	for _, e := range edits[:from] {
+		if e.op != '+' {
+			aLine++
+		}
+		if e.op != '-' {
+			bLine++
+		}
+	}
+
+	var aCount, bCount int
+	var body strings.Builder
+	for _, e := range edits[from:to] {
+		if e.op != '+' {
+			aCount++
+		}
+		if e.op != '-' {
+			bCount++
+		}
+		body.WriteByte(e.op)
+		body.WriteString(e.line)
+		body.WriteByte('\n')
+	}
+
+	// An empty range is numbered after the line preceding it.
+	if aCount == 0 {
+		aLine--
+	}
+	if bCount == 0 {
+		bLine--
+	}
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@\n%s", aLine, aCount, bLine, bCount, body.String())
+}
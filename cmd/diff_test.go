@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffJSON(t *testing.T) {
+	before := map[string]interface{}{
+		"ociVersion": "1.0.1",
+		"env":        []interface{}{"A=1", "B=2", "C=3"},
+		"a/b":        "x",
+		"removed":    true,
+	}
+	after := map[string]interface{}{
+		"ociVersion": "1.0.2",
+		"env":        []interface{}{"A=1"},
+		"a/b":        "x",
+		"hooks":      map[string]interface{}{"prestart": []interface{}{"hook"}},
+	}
+
+	expected := []specChange{
+		{op: specChangeRemove, path: "/env/2", oldValue: "C=3"},
+		{op: specChangeRemove, path: "/env/1", oldValue: "B=2"},
+		{op: specChangeAdd, path: "/hooks", newValue: map[string]interface{}{"prestart": []interface{}{"hook"}}},
+		{op: specChangeReplace, path: "/ociVersion", oldValue: "1.0.1", newValue: "1.0.2"},
+		{op: specChangeRemove, path: "/removed", oldValue: true},
+	}
+	require.Equal(t, expected, diffJSON(before, after))
+	require.Empty(t, diffJSON(before, before))
+}
+
+func TestWriteSpecChanges(t *testing.T) {
+	changes := []specChange{
+		{op: specChangeAdd, path: "/hooks", newValue: map[string]interface{}{"prestart": []interface{}{}}},
+		{op: specChangeRemove, path: "/env/1", oldValue: "B=2"},
+		{op: specChangeReplace, path: "/ociVersion", oldValue: "1.0.1", newValue: "1.0.2"},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, writeSpecChanges(&out, changes))
+	require.Equal(t, "+ /hooks: {\"prestart\":[]}\n- /env/1: \"B=2\"\n~ /ociVersion: \"1.0.1\" -> \"1.0.2\"\n", out.String())
+
+	out.Reset()
+	require.NoError(t, writeSpecChanges(&out, nil))
+	require.Equal(t, "No changes to OCI specification\n", out.String())
+}
+
+func TestGetDiffFormat(t *testing.T) {
+	format, err := getDiffFormat([]string{"--bundle", "/b"})
+	require.NoError(t, err)
+	require.Equal(t, diffFormatText, format)
+
+	format, err = getDiffFormat([]string{"--format", "unified", "--bundle", "/b"})
+	require.NoError(t, err)
+	require.Equal(t, diffFormatUnified, format)
+
+	format, err = getDiffFormat([]string{"-b", "/b", "--format=jsonpatch"})
+	require.NoError(t, err)
+	require.Equal(t, diffFormatJSONPatch, format)
+
+	_, err = getDiffFormat([]string{"--format", "yaml"})
+	require.Error(t, err)
+	_, err = getDiffFormat([]string{"--format"})
+	require.Error(t, err)
+}
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	before := map[string]interface{}{
+		"a": 1, "b": 2, "c": 3, "d": 4, "e": 5, "f": 6, "g": 7, "h": 8, "i": 9, "j": 10,
+	}
+	after := map[string]interface{}{
+		"a": 1, "b": 20, "c": 3, "d": 4, "e": 5, "f": 6, "g": 7, "h": 8, "i": 9, "j": 10, "k": 11,
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, writeUnifiedDiff(&out, before, after))
+	require.Equal(t, `--- a/config.json
++++ b/config.json
+@@ -1,6 +1,6 @@
+ {
+   "a": 1,
+-  "b": 2,
++  "b": 20,
+   "c": 3,
+   "d": 4,
+   "e": 5,
+@@ -8,5 +8,6 @@
+   "g": 7,
+   "h": 8,
+   "i": 9,
+-  "j": 10
++  "j": 10,
++  "k": 11
+ }
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, writeUnifiedDiff(&out, before, before))
+	require.Empty(t, out.String())
+}
+
+func TestDiffJSONPatch(t *testing.T) {
+	require.NoError(t, generateNewRuntimeSpec())
+	original, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	cmdDiff := exec.Command(nvidiaRuntime, "diff", "--format", "jsonpatch", "--bundle", bundlePath)
+	cmdDiff.Stdout = &out
+	require.NoError(t, cmdDiff.Run(), "runtime should not return an error")
+
+	var patches []specPatch
+	require.NoError(t, json.Unmarshal(out.Bytes(), &patches), out.String())
+	require.NotEmpty(t, patches)
+
+	// Applying the patch reproduces the spec modified on create.
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+	modified, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+
+	require.NoError(t, applySpecPatches(&original, patches))
+	require.Equal(t, modified, original)
+
+	// The unified diff of an unmodified spec is empty.
+	out.Reset()
+	cmdDiff = exec.Command(nvidiaRuntime, "diff", "--format=unified", "--bundle", bundlePath)
+	cmdDiff.Stdout = &out
+	require.NoError(t, cmdDiff.Run(), "runtime should not return an error")
+	require.Empty(t, out.String())
+}
@@ -0,0 +1,117 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	// dumpSpecMaxSize is the size in bytes above which a spec is not dumped.
+	dumpSpecMaxSize = 1 << 20
+
+	// defaultDumpSpecMaxFiles is the default number of dumped specs that are
+	// kept in the dump-spec-dir.
+	defaultDumpSpecMaxFiles = 100
+)
+
+// dumpSpec writes a copy of the specified spec to <dir>/<id>.json, so that the
+// spec received by the low-level runtime can be inspected after the fact.
+// Only the newest maxFiles dumps are kept. The dump is only readable by its
+// owner unless a mode is specified. This is best-effort: errors are logged and
+// do not affect the invocation.
+func dumpSpec(spec *specs.Spec, dir string, id string, maxFiles int, mode *os.FileMode) {
+	err := writeSpecDump(spec, dir, id, mode)
+	if err != nil {
+		logger.Warnf("Error dumping OCI specification of container %v: %v", id, err)
+		return
+	}
+
+	err = removeOldSpecDumps(dir, maxFiles)
+	if err != nil {
+		logger.Warnf("Error removing old OCI specification dumps: %v", err)
+	}
+}
+
+func writeSpecDump(spec *specs.Spec, dir string, id string, mode *os.FileMode) error {
+	if id == "" || id == "." || id == ".." || filepath.Base(id) != id {
+		return fmt.Errorf("invalid container id %q", id)
+	}
+
+	output, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if len(output) > dumpSpecMaxSize {
+		return fmt.Errorf("size of %d bytes exceeds the limit of %d bytes", len(output), dumpSpecMaxSize)
+	}
+
+	// The spec may contain secrets in the environment of the process.
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, id+".json")
+	logger.Printf("Dumping OCI specification to %v", path)
+	err = ioutil.WriteFile(path, output, 0600)
+	if err != nil {
+		return err
+	}
+	return applyFileMode(path, mode)
+}
+
+// removeOldSpecDumps removes all but the newest maxFiles dumps in the specified
+// directory. A maxFiles of 0 keeps all dumps.
+func removeOldSpecDumps(dir string, maxFiles int) error {
+	if maxFiles == 0 {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var dumps []os.FileInfo
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && strings.HasSuffix(entry.Name(), ".json") {
+			dumps = append(dumps, entry)
+		}
+	}
+	if len(dumps) <= maxFiles {
+		return nil
+	}
+
+	sort.Slice(dumps, func(i, j int) bool {
+		return dumps[i].ModTime().After(dumps[j].ModTime())
+	})
+	for _, dump := range dumps[maxFiles:] {
+		err := os.Remove(filepath.Join(dir, dump.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
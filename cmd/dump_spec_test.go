@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpSpec(t *testing.T) {
+	err := generateNewRuntimeSpec()
+	require.NoError(t, err)
+
+	dumpDir, err := ioutil.TempDir("", "nvidia-container-runtime-dump")
+	require.NoError(t, err)
+	defer os.RemoveAll(dumpDir)
+
+	configDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\ndump-spec-dir = %q\nstamp-provenance = true\n", dumpDir))
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	// The dump matches the spec received by runc.
+	expected, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(expected.Hooks))
+	require.Contains(t, expected.Annotations, processedAtAnnotation)
+
+	dumped, err := getRuntimeSpec(filepath.Join(dumpDir, "testcontainer.json"))
+	require.NoError(t, err)
+	require.Equal(t, expected, dumped)
+
+	info, err := os.Stat(filepath.Join(dumpDir, "testcontainer.json"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestDumpSpecRotation(t *testing.T) {
+	dumpDir, err := ioutil.TempDir("", "nvidia-container-runtime-dump")
+	require.NoError(t, err)
+	defer os.RemoveAll(dumpDir)
+
+	spec := &specs.Spec{Version: specs.Version}
+	for i, id := range []string{"a", "b", "c"} {
+		dumpSpec(spec, dumpDir, id, 2, nil)
+		// Dumps are ordered by their modification time.
+		modTime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		require.NoError(t, os.Chtimes(filepath.Join(dumpDir, id+".json"), modTime, modTime))
+	}
+	dumpSpec(spec, dumpDir, "d", 2, nil)
+
+	entries, err := ioutil.ReadDir(dumpDir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.Equal(t, []string{"c.json", "d.json"}, names)
+
+	var dumped specs.Spec
+	contents, err := ioutil.ReadFile(filepath.Join(dumpDir, "d.json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(contents, &dumped))
+	require.Equal(t, *spec, dumped)
+}
+
+func TestDumpSpecInvalidID(t *testing.T) {
+	dumpDir, err := ioutil.TempDir("", "nvidia-container-runtime-dump")
+	require.NoError(t, err)
+	defer os.RemoveAll(dumpDir)
+
+	for _, id := range []string{"", "..", "../escape"} {
+		require.Error(t, writeSpecDump(&specs.Spec{}, dumpDir, id, nil), id)
+	}
+	_, err = os.Stat(filepath.Join(filepath.Dir(dumpDir), "escape.json"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,359 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	nvidiaEnvPrefix      = "NVIDIA_"
+	visibleDevicesEnvvar = "NVIDIA_VISIBLE_DEVICES"
+	visibleDevicesVoid   = "void"
+
+	driverCapabilitiesEnvvar = "NVIDIA_DRIVER_CAPABILITIES"
+
+	// defaultMaxEnvCount and defaultMaxEnvBytes are the default limits on
+	// the number of variables and the total size of the process environment
+	// in an incoming spec, above which the spec is rejected.
+	defaultMaxEnvCount = 4096
+	defaultMaxEnvBytes = 1024 * 1024
+
+	visibleDevicesAll = "all"
+
+	// visibleDevicesPolicyAllow passes NVIDIA_VISIBLE_DEVICES=all through,
+	// visibleDevicesPolicyDeny rejects it and visibleDevicesPolicyRewrite
+	// replaces it with the devices in visible-devices-rewrite.
+	visibleDevicesPolicyAllow   = "allow"
+	visibleDevicesPolicyDeny    = "deny"
+	visibleDevicesPolicyRewrite = "rewrite"
+)
+
+// runtimeEnvBaseline are the environment variables passed to the low-level
+// runtime in addition to those in runtime-env-allowlist. runc relies on these
+// to locate executables, temporary files and the systemd notify socket.
+var runtimeEnvBaseline = []string{
+	"PATH",
+	"HOME",
+	"TMPDIR",
+	"XDG_RUNTIME_DIR",
+	"NOTIFY_SOCKET",
+}
+
+// filterEnv removes environment variables from the process in the specified
+// spec according to the configured policy. If the allowlist is not empty, only
+// the NVIDIA_* variables matching one of its entries are kept; other variables
+// are not affected. Any variable matching an entry in the denylist is removed,
+// with the denylist taking precedence over the allowlist.
+// Entries match a variable name exactly, or by prefix if they end in '*'.
+func filterEnv(spec *specs.Spec, allowlist []string, denylist []string) {
+	if len(allowlist) == 0 && len(denylist) == 0 {
+		return
+	}
+	if spec.Process == nil {
+		return
+	}
+
+	var filtered []string
+	for _, env := range spec.Process.Env {
+		name := strings.SplitN(env, "=", 2)[0]
+		if matchesAnyEnvPattern(name, denylist) {
+			logger.Printf("Removing denylisted environment variable %v", name)
+			continue
+		}
+		if len(allowlist) > 0 && strings.HasPrefix(name, nvidiaEnvPrefix) && !matchesAnyEnvPattern(name, allowlist) {
+			logger.Printf("Removing environment variable %v not in allowlist", name)
+			continue
+		}
+		filtered = append(filtered, env)
+	}
+
+	spec.Process.Env = filtered
+}
+
+// matchesAnyEnvPattern checks whether the specified variable name matches any
+// of the specified patterns.
+func matchesAnyEnvPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+			continue
+		}
+		if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEnvLimits returns an error if the process environment of the specified
+// spec contains more than maxCount variables, or more than maxBytes bytes
+// across all its entries. A limit of 0 disables the corresponding check.
+func checkEnvLimits(spec *specs.Spec, maxCount int, maxBytes int) error {
+	env := getProcessEnv(spec)
+	if maxCount > 0 && len(env) > maxCount {
+		return fmt.Errorf("OCI specification contains %v environment variables, exceeding the limit of %v set by max-env-count", len(env), maxCount)
+	}
+
+	if maxBytes == 0 {
+		return nil
+	}
+	size := 0
+	for _, e := range env {
+		size += len(e)
+	}
+	if size > maxBytes {
+		return fmt.Errorf("OCI specification contains %v bytes of environment variables, exceeding the limit of %v set by max-env-bytes", size, maxBytes)
+	}
+	return nil
+}
+
+// forceVisibleDevices overrides the specified visible devices environment
+// variable of the process in the specified spec with the specified value,
+// regardless of the value requested by the container. An empty or 'void' value
+// removes the variable entirely. Applying the same value more than once has no
+// effect.
+func forceVisibleDevices(spec *specs.Spec, name string, value string) {
+	if spec.Process == nil {
+		logger.Printf("No process in OCI specification, not forcing %v", name)
+		return
+	}
+
+	var env []string
+	for _, e := range spec.Process.Env {
+		if strings.SplitN(e, "=", 2)[0] == name {
+			continue
+		}
+		env = append(env, e)
+	}
+
+	if value == "" || value == visibleDevicesVoid {
+		logger.Printf("Removing %v as required by policy", name)
+	} else {
+		logger.Printf("Forcing %v=%v as required by policy", name, value)
+		env = append(env, name+"="+value)
+	}
+
+	spec.Process.Env = env
+}
+
+// applyVisibleDevicesPolicy applies the specified policy to a process in the
+// specified spec requesting all devices through the specified visible devices
+// environment variable. Explicit lists of devices are left unchanged. With the
+// rewrite policy, the value is replaced with the specified devices.
+func applyVisibleDevicesPolicy(spec *specs.Spec, name string, policy string, rewrite []string) error {
+	value, _ := getEnvValue(getProcessEnv(spec), name)
+	if value != visibleDevicesAll {
+		return nil
+	}
+
+	switch policy {
+	case visibleDevicesPolicyDeny:
+		return fmt.Errorf("%v=%v is denied by visible-devices-policy", name, visibleDevicesAll)
+	case visibleDevicesPolicyRewrite:
+	default:
+		return nil
+	}
+
+	devices := strings.Join(rewrite, ",")
+	logger.Printf("Rewriting %v=%v to %v", name, visibleDevicesAll, devices)
+	for i, e := range spec.Process.Env {
+		if strings.SplitN(e, "=", 2)[0] == name {
+			spec.Process.Env[i] = name + "=" + devices
+		}
+	}
+	return nil
+}
+
+// getResolvedDevices returns the canonical form of the devices requested by
+// the process in the specified spec through the specified visible devices
+// environment variable: its comma-separated entries without blanks and
+// duplicates, in the order requested. An empty string is returned if no
+// devices are requested.
+func getResolvedDevices(spec *specs.Spec, name string) string {
+	if !requestsVisibleDevices(spec, name) {
+		return ""
+	}
+
+	value, _ := getEnvValue(getProcessEnv(spec), name)
+	var devices []string
+	for _, device := range splitDeviceList(value) {
+		if !containsString(devices, device) {
+			devices = append(devices, device)
+		}
+	}
+	return strings.Join(devices, ",")
+}
+
+// setResolvedDevicesEnv sets the specified resolved devices environment
+// variable of the process in the specified spec to the canonical list of the
+// devices it requests. Processes that do not request devices are left
+// unchanged.
+func setResolvedDevicesEnv(spec *specs.Spec, visibleDevicesName string, name string) {
+	devices := getResolvedDevices(spec, visibleDevicesName)
+	if devices == "" {
+		return
+	}
+
+	logger.Printf("Setting %v=%v in the container environment", name, devices)
+	spec.Process.Env = mergeEnv(spec.Process.Env, name+"="+devices)
+}
+
+// applyAnnotationCapabilities sets NVIDIA_DRIVER_CAPABILITIES in the process
+// environment of the specified spec to the capabilities mapped to its
+// annotations. A mapping matches if the annotation is present, or for a
+// mapping of the form NAME=VALUE, if the annotation has the specified value.
+// The capabilities of all matching mappings are combined. An explicit
+// NVIDIA_DRIVER_CAPABILITIES in the environment takes precedence.
+func applyAnnotationCapabilities(spec *specs.Spec, mapping map[string][]string) {
+	if spec.Process == nil {
+		return
+	}
+	if _, ok := getEnvValue(spec.Process.Env, driverCapabilitiesEnvvar); ok {
+		return
+	}
+
+	seen := make(map[string]bool)
+	var capabilities []string
+	for match, mapped := range mapping {
+		parts := strings.SplitN(match, "=", 2)
+		value, ok := spec.Annotations[parts[0]]
+		if !ok || (len(parts) == 2 && value != parts[1]) {
+			continue
+		}
+		for _, capability := range mapped {
+			if !seen[capability] {
+				seen[capability] = true
+				capabilities = append(capabilities, capability)
+			}
+		}
+	}
+	if len(capabilities) == 0 {
+		return
+	}
+	sort.Strings(capabilities)
+
+	value := strings.Join(capabilities, ",")
+	logger.Printf("Setting %v=%v as mapped from the annotations", driverCapabilitiesEnvvar, value)
+	spec.Process.Env = append(spec.Process.Env, driverCapabilitiesEnvvar+"="+value)
+}
+
+// readEnvFile reads the environment variables in the specified file, in the
+// format of the --env-file of docker: each line is a KEY=VALUE pair. Blank
+// lines and lines starting with '#' are ignored. Values are taken verbatim.
+func readEnvFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], " \t") {
+			return nil, fmt.Errorf("%v:%d: invalid line %q: expected KEY=VALUE", path, lineNumber, line)
+		}
+		env[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// getProcessEnv returns the environment of the process in the specified spec.
+// A spec without a process is treated as having an empty environment.
+func getProcessEnv(spec *specs.Spec) []string {
+	if spec.Process == nil {
+		return nil
+	}
+	return spec.Process.Env
+}
+
+// getEnvValue returns the value of the last occurrence of the specified
+// variable in the specified environment.
+func getEnvValue(env []string, name string) (string, bool) {
+	var value string
+	var exists bool
+	for _, e := range env {
+		parts := strings.SplitN(e, "=", 2)
+		if parts[0] != name {
+			continue
+		}
+		exists = true
+		value = ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+	}
+	return value, exists
+}
+
+// requestsVisibleDevices checks whether the process in the specified spec
+// requests access to GPUs through the specified visible devices environment
+// variable.
+func requestsVisibleDevices(spec *specs.Spec, name string) bool {
+	value, _ := getEnvValue(getProcessEnv(spec), name)
+	return value != "" && value != visibleDevicesVoid
+}
+
+// getVisibleDevicesEnvvar returns the environment variable through which
+// containers request GPUs, NVIDIA_VISIBLE_DEVICES unless configured otherwise
+// by visible-devices-env.
+func (c *config) getVisibleDevicesEnvvar() string {
+	if c.visibleDevicesEnv == "" {
+		return visibleDevicesEnvvar
+	}
+	return c.visibleDevicesEnv
+}
+
+// getRuntimeEnv returns the environment of the low-level runtime. If the
+// allowlist is not empty, only the variables of the specified environment that
+// match one of its entries or the baseline are kept; otherwise the environment
+// is returned unchanged.
+func getRuntimeEnv(environ []string, allowlist []string) []string {
+	if len(allowlist) == 0 {
+		return environ
+	}
+
+	var filtered []string
+	for _, env := range environ {
+		name := strings.SplitN(env, "=", 2)[0]
+		if !matchesAnyEnvPattern(name, runtimeEnvBaseline) && !matchesAnyEnvPattern(name, allowlist) {
+			logger.Printf("Not passing environment variable %v to runtime", name)
+			continue
+		}
+		filtered = append(filtered, env)
+	}
+	return filtered
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterEnv(t *testing.T) {
+	env := []string{
+		"PATH=/usr/bin",
+		"NVIDIA_VISIBLE_DEVICES=all",
+		"NVIDIA_DRIVER_CAPABILITIES=compute,utility",
+		"NVIDIA_REQUIRE_CUDA=cuda>=11.0",
+	}
+
+	testCases := []struct {
+		description string
+		allowlist   []string
+		denylist    []string
+		expected    []string
+	}{
+		{
+			description: "no policy",
+			expected:    env,
+		},
+		{
+			description: "allowlist only",
+			allowlist:   []string{"NVIDIA_VISIBLE_DEVICES", "NVIDIA_REQUIRE_*"},
+			expected: []string{
+				"PATH=/usr/bin",
+				"NVIDIA_VISIBLE_DEVICES=all",
+				"NVIDIA_REQUIRE_CUDA=cuda>=11.0",
+			},
+		},
+		{
+			description: "denylist only",
+			denylist:    []string{"NVIDIA_VISIBLE_DEVICES", "PATH"},
+			expected: []string{
+				"NVIDIA_DRIVER_CAPABILITIES=compute,utility",
+				"NVIDIA_REQUIRE_CUDA=cuda>=11.0",
+			},
+		},
+		{
+			description: "denylist wins over allowlist",
+			allowlist:   []string{"NVIDIA_*"},
+			denylist:    []string{"NVIDIA_VISIBLE_DEVICES"},
+			expected: []string{
+				"PATH=/usr/bin",
+				"NVIDIA_DRIVER_CAPABILITIES=compute,utility",
+				"NVIDIA_REQUIRE_CUDA=cuda>=11.0",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{
+			Process: &specs.Process{
+				Env: append([]string{}, env...),
+			},
+		}
+
+		filterEnv(spec, tc.allowlist, tc.denylist)
+		require.Equal(t, tc.expected, spec.Process.Env, tc.description)
+	}
+}
+
+func TestForceVisibleDevices(t *testing.T) {
+	testCases := []struct {
+		description string
+		env         []string
+		value       string
+		expected    []string
+	}{
+		{
+			description: "override to specific devices",
+			env:         []string{"PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=all"},
+			value:       "0,1",
+			expected:    []string{"PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=0,1"},
+		},
+		{
+			description: "override when unset",
+			env:         []string{"PATH=/usr/bin"},
+			value:       "GPU-fef8089b",
+			expected:    []string{"PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=GPU-fef8089b"},
+		},
+		{
+			description: "override duplicated variable",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=all", "PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=1"},
+			value:       "0",
+			expected:    []string{"PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=0"},
+		},
+		{
+			description: "override to void",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=all", "PATH=/usr/bin"},
+			value:       "void",
+			expected:    []string{"PATH=/usr/bin"},
+		},
+		{
+			description: "override to empty",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=all", "PATH=/usr/bin"},
+			value:       "",
+			expected:    []string{"PATH=/usr/bin"},
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{
+			Process: &specs.Process{
+				Env: tc.env,
+			},
+		}
+
+		forceVisibleDevices(spec, visibleDevicesEnvvar, tc.value)
+		require.Equal(t, tc.expected, spec.Process.Env, tc.description)
+
+		// Applying the policy again must not change the result.
+		forceVisibleDevices(spec, visibleDevicesEnvvar, tc.value)
+		require.Equal(t, tc.expected, spec.Process.Env, tc.description)
+	}
+}
+
+func TestCheckEnvLimits(t *testing.T) {
+	spec := &specs.Spec{
+		Process: &specs.Process{
+			Env: []string{"PATH=/usr/bin", "TERM=xterm"},
+		},
+	}
+
+	require.NoError(t, checkEnvLimits(&specs.Spec{}, 1, 1))
+	require.NoError(t, checkEnvLimits(spec, 2, 23))
+	require.NoError(t, checkEnvLimits(spec, 0, 0))
+	require.Error(t, checkEnvLimits(spec, 1, 0))
+	require.Error(t, checkEnvLimits(spec, 0, 22))
+}
+
+func TestMaxEnv(t *testing.T) {
+	require.NoError(t, generateNewRuntimeSpec())
+
+	configFilePath := filepath.Join(bundlePath, specFile)
+	spec, err := getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	for i := 0; i < defaultMaxEnvCount; i++ {
+		spec.Process.Env = append(spec.Process.Env, fmt.Sprintf("VAR_%v=1", i))
+	}
+	require.NoError(t, writeRuntimeSpec(configFilePath, &spec))
+
+	cmdCreate := exec.Command(nvidiaRuntime, "--log-to-stderr", "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"=/etc/")
+	output, err := cmdCreate.CombinedOutput()
+	require.Error(t, err, "runtime should reject a spec exceeding max-env-count")
+	require.Contains(t, string(output), "exceeding the limit of 4096 set by max-env-count")
+
+	spec, err = getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	require.Nil(t, spec.Hooks, "the rejected spec should not be modified")
+
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nmax-env-count = 0\nmax-env-bytes = 1024\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	cmdCreate = exec.Command(nvidiaRuntime, "--log-to-stderr", "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+testDir)
+	output, err = cmdCreate.CombinedOutput()
+	require.Error(t, err, "runtime should reject a spec exceeding max-env-bytes")
+	require.Contains(t, string(output), "set by max-env-bytes")
+
+	testDir, err = writeTestConfig("[nvidia-container-runtime]\nmax-env-count = 0\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	cmdCreate = exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+testDir)
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+}
+
+func TestApplyVisibleDevicesPolicy(t *testing.T) {
+	testCases := []struct {
+		description string
+		policy      string
+		env         []string
+		isError     bool
+		expected    []string
+	}{
+		{
+			description: "allow all",
+			policy:      visibleDevicesPolicyAllow,
+			env:         []string{"PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=all"},
+			expected:    []string{"PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=all"},
+		},
+		{
+			description: "deny all",
+			policy:      visibleDevicesPolicyDeny,
+			env:         []string{"PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=all"},
+			isError:     true,
+			expected:    []string{"PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=all"},
+		},
+		{
+			description: "deny explicit list",
+			policy:      visibleDevicesPolicyDeny,
+			env:         []string{"PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=0,1"},
+			expected:    []string{"PATH=/usr/bin", "NVIDIA_VISIBLE_DEVICES=0,1"},
+		},
+		{
+			description: "rewrite all",
+			policy:      visibleDevicesPolicyRewrite,
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=all", "PATH=/usr/bin"},
+			expected:    []string{"NVIDIA_VISIBLE_DEVICES=2,3", "PATH=/usr/bin"},
+		},
+		{
+			description: "rewrite explicit list",
+			policy:      visibleDevicesPolicyRewrite,
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=GPU-fef8089b", "PATH=/usr/bin"},
+			expected:    []string{"NVIDIA_VISIBLE_DEVICES=GPU-fef8089b", "PATH=/usr/bin"},
+		},
+		{
+			description: "rewrite unset",
+			policy:      visibleDevicesPolicyRewrite,
+			env:         []string{"PATH=/usr/bin"},
+			expected:    []string{"PATH=/usr/bin"},
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{
+			Process: &specs.Process{
+				Env: tc.env,
+			},
+		}
+
+		err := applyVisibleDevicesPolicy(spec, visibleDevicesEnvvar, tc.policy, []string{"2", "3"})
+		if tc.isError {
+			require.Error(t, err, tc.description)
+		} else {
+			require.NoError(t, err, tc.description)
+		}
+		require.Equal(t, tc.expected, spec.Process.Env, tc.description)
+	}
+
+	require.NoError(t, applyVisibleDevicesPolicy(&specs.Spec{}, visibleDevicesEnvvar, visibleDevicesPolicyDeny, nil))
+}
+
+func TestVisibleDevicesPolicy(t *testing.T) {
+	testCases := []struct {
+		description    string
+		config         string
+		visibleDevices string
+		isError        bool
+		expected       string
+	}{
+		{
+			description:    "allow all",
+			config:         "visible-devices-policy = \"allow\"\n",
+			visibleDevices: "all",
+			expected:       "all",
+		},
+		{
+			description:    "deny all",
+			config:         "visible-devices-policy = \"deny\"\n",
+			visibleDevices: "all",
+			isError:        true,
+		},
+		{
+			description:    "deny explicit list",
+			config:         "visible-devices-policy = \"deny\"\n",
+			visibleDevices: "0,1",
+			expected:       "0,1",
+		},
+		{
+			description:    "rewrite all",
+			config:         "visible-devices-policy = \"rewrite\"\nvisible-devices-rewrite = [\"0\", \"1\"]\n",
+			visibleDevices: "all",
+			expected:       "0,1",
+		},
+		{
+			description:    "rewrite explicit list",
+			config:         "visible-devices-policy = \"rewrite\"\nvisible-devices-rewrite = [\"0\", \"1\"]\n",
+			visibleDevices: "2",
+			expected:       "2",
+		},
+	}
+
+	for _, tc := range testCases {
+		configDir, err := writeTestConfig("[nvidia-container-runtime]\n" + tc.config)
+		require.NoError(t, err)
+		defer os.RemoveAll(configDir)
+
+		require.NoError(t, generateNewRuntimeSpec())
+		specPath := filepath.Join(bundlePath, specFile)
+		spec, err := getRuntimeSpec(specPath)
+		require.NoError(t, err)
+		spec.Process.Env = append(spec.Process.Env, visibleDevicesEnvvar+"="+tc.visibleDevices)
+		require.NoError(t, writeRuntimeSpec(specPath, &spec))
+
+		cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+		cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+		output, err := cmdCreate.CombinedOutput()
+
+		spec, specErr := getRuntimeSpec(specPath)
+		require.NoError(t, specErr)
+		visibleDevices, _ := getEnvValue(spec.Process.Env, visibleDevicesEnvvar)
+		if tc.isError {
+			require.Error(t, err, tc.description)
+			require.Nil(t, spec.Hooks, "a denied spec should not be modified")
+			require.Equal(t, tc.visibleDevices, visibleDevices, tc.description)
+			continue
+		}
+		require.NoError(t, err, "%v: %s", tc.description, output)
+		require.Equal(t, 1, nvidiaHookCount(spec.Hooks), tc.description)
+		require.Equal(t, tc.expected, visibleDevices, tc.description)
+	}
+
+	for _, config := range []string{
+		"visible-devices-policy = \"rewrite-all\"\n",
+		"visible-devices-policy = \"rewrite\"\n",
+		"visible-devices-policy = \"rewrite\"\nvisible-devices-rewrite = [\"0,1\"]\n",
+		"visible-devices-policy = \"rewrite\"\nvisible-devices-rewrite = [\"all\"]\n",
+	} {
+		configDir, err := writeTestConfig("[nvidia-container-runtime]\n" + config)
+		require.NoError(t, err)
+		defer os.RemoveAll(configDir)
+
+		os.Setenv(configOverride, configDir)
+		_, err = getConfig()
+		os.Unsetenv(configOverride)
+		require.Error(t, err, config)
+	}
+}
+
+func TestVisibleDevicesEnv(t *testing.T) {
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nvisible-devices-env = \"GPU_REQUEST\"\ninject-devices = [\"/dev/null\"]\nvisible-devices-policy = \"deny\"\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	testCases := []struct {
+		description     string
+		env             []string
+		isError         bool
+		expectedDevices int
+	}{
+		{
+			description:     "custom variable requests devices",
+			env:             []string{"GPU_REQUEST=0"},
+			expectedDevices: 1,
+		},
+		{
+			description: "custom variable set to void",
+			env:         []string{"GPU_REQUEST=void", "NVIDIA_VISIBLE_DEVICES=0"},
+		},
+		{
+			description: "default variable is ignored",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=all"},
+		},
+		{
+			description: "policy applies to the custom variable",
+			env:         []string{"GPU_REQUEST=all"},
+			isError:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		require.NoError(t, generateNewRuntimeSpec())
+		specPath := filepath.Join(bundlePath, specFile)
+		spec, err := getRuntimeSpec(specPath)
+		require.NoError(t, err)
+		spec.Process.Env = append(spec.Process.Env, tc.env...)
+		require.NoError(t, writeRuntimeSpec(specPath, &spec))
+
+		cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+		cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+		output, err := cmdCreate.CombinedOutput()
+		if tc.isError {
+			require.Error(t, err, tc.description)
+			continue
+		}
+		require.NoError(t, err, "%v: %s", tc.description, output)
+
+		spec, err = getRuntimeSpec(specPath)
+		require.NoError(t, err)
+		var devices []specs.LinuxDevice
+		if spec.Linux != nil {
+			devices = spec.Linux.Devices
+		}
+		require.Len(t, devices, tc.expectedDevices, tc.description)
+	}
+
+	// A void request through the custom variable is not overridden by the
+	// hook defaulting to all GPUs if NVIDIA_VISIBLE_DEVICES is unset.
+	require.NoError(t, generateNewRuntimeSpec())
+	specPath := filepath.Join(bundlePath, specFile)
+	spec, err := getRuntimeSpec(specPath)
+	require.NoError(t, err)
+	spec.Process.Env = append(spec.Process.Env, "GPU_REQUEST=void")
+	require.NoError(t, writeRuntimeSpec(specPath, &spec))
+
+	voidDir, err := writeTestConfig("[nvidia-container-runtime]\nvisible-devices-env = \"GPU_REQUEST\"\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(voidDir)
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+voidDir)
+	output, err := cmdCreate.CombinedOutput()
+	require.NoError(t, err, "%s", output)
+
+	spec, err = getRuntimeSpec(specPath)
+	require.NoError(t, err)
+	require.Equal(t, 0, nvidiaHookCount(spec.Hooks), "no hook should be inserted for a void request")
+
+	for _, name := range []string{"", "GPU=REQUEST"} {
+		configDir, err := writeTestConfig("[nvidia-container-runtime]\nvisible-devices-env = \"" + name + "\"\n")
+		require.NoError(t, err)
+		defer os.RemoveAll(configDir)
+
+		os.Setenv(configOverride, configDir)
+		_, err = getConfig()
+		os.Unsetenv(configOverride)
+		require.Error(t, err, name)
+	}
+}
+
+func TestGetResolvedDevices(t *testing.T) {
+	testCases := []struct {
+		description string
+		env         []string
+		expected    string
+	}{
+		{
+			description: "single device",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=0"},
+			expected:    "0",
+		},
+		{
+			description: "blanks and duplicates removed",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES= 1, 0,,1 ,GPU-fef8089b"},
+			expected:    "1,0,GPU-fef8089b",
+		},
+		{
+			description: "last occurrence used",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_VISIBLE_DEVICES=2"},
+			expected:    "2",
+		},
+		{
+			description: "void",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=void"},
+		},
+		{
+			description: "unset",
+			env:         []string{"PATH=/usr/bin"},
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{Process: &specs.Process{Env: tc.env}}
+		require.Equal(t, tc.expected, getResolvedDevices(spec, visibleDevicesEnvvar), tc.description)
+	}
+
+	require.Empty(t, getResolvedDevices(&specs.Spec{}, visibleDevicesEnvvar))
+}
+
+func TestResolvedDevicesEnv(t *testing.T) {
+	testCases := []struct {
+		description       string
+		config            string
+		visibleDevices    string
+		expectedHook      string
+		expectedContainer string
+	}{
+		{
+			description:    "hook only",
+			config:         "resolved-devices-env = \"NVIDIA_RESOLVED_DEVICES\"\n",
+			visibleDevices: "1, 0,1",
+			expectedHook:   "1,0",
+		},
+		{
+			description:       "rewritten by policy",
+			config:            "resolved-devices-env = \"NVIDIA_RESOLVED_DEVICES\"\nresolved-devices-env-container = true\nvisible-devices-policy = \"rewrite\"\nvisible-devices-rewrite = [\"2\", \"3\"]\n",
+			visibleDevices:    "all",
+			expectedHook:      "2,3",
+			expectedContainer: "2,3",
+		},
+		{
+			description:    "no devices requested",
+			config:         "resolved-devices-env = \"NVIDIA_RESOLVED_DEVICES\"\nresolved-devices-env-container = true\n",
+			visibleDevices: "void",
+		},
+	}
+
+	for _, tc := range testCases {
+		configDir, err := writeTestConfig("[nvidia-container-runtime]\n" + tc.config)
+		require.NoError(t, err)
+		defer os.RemoveAll(configDir)
+
+		require.NoError(t, generateNewRuntimeSpec())
+		specPath := filepath.Join(bundlePath, specFile)
+		spec, err := getRuntimeSpec(specPath)
+		require.NoError(t, err)
+		spec.Process.Env = append(spec.Process.Env, visibleDevicesEnvvar+"="+tc.visibleDevices)
+		require.NoError(t, writeRuntimeSpec(specPath, &spec))
+
+		cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+		cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+		output, err := cmdCreate.CombinedOutput()
+		require.NoError(t, err, "%v: %s", tc.description, output)
+
+		spec, err = getRuntimeSpec(specPath)
+		require.NoError(t, err)
+		require.Equal(t, 1, nvidiaHookCount(spec.Hooks), tc.description)
+		hookDevices, hookOK := getEnvValue(spec.Hooks.Prestart[0].Env, "NVIDIA_RESOLVED_DEVICES")
+		require.Equal(t, tc.expectedHook != "", hookOK, tc.description)
+		require.Equal(t, tc.expectedHook, hookDevices, tc.description)
+		containerDevices, containerOK := getEnvValue(spec.Process.Env, "NVIDIA_RESOLVED_DEVICES")
+		require.Equal(t, tc.expectedContainer != "", containerOK, tc.description)
+		require.Equal(t, tc.expectedContainer, containerDevices, tc.description)
+	}
+
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nresolved-devices-env = \"RESOLVED=DEVICES\"\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	os.Setenv(configOverride, configDir)
+	_, err = getConfig()
+	os.Unsetenv(configOverride)
+	require.Error(t, err)
+}
+
+func TestApplyAnnotationCapabilities(t *testing.T) {
+	mapping := map[string][]string{
+		"example.com/workload=video": {"video", "utility"},
+		"example.com/display":        {"display", "utility"},
+	}
+
+	testCases := []struct {
+		description string
+		annotations map[string]string
+		env         []string
+		expected    []string
+	}{
+		{
+			description: "matching annotation value",
+			annotations: map[string]string{"example.com/workload": "video"},
+			env:         []string{"PATH=/usr/bin"},
+			expected:    []string{"PATH=/usr/bin", "NVIDIA_DRIVER_CAPABILITIES=utility,video"},
+		},
+		{
+			description: "matching annotations are combined",
+			annotations: map[string]string{"example.com/workload": "video", "example.com/display": ""},
+			expected:    []string{"NVIDIA_DRIVER_CAPABILITIES=display,utility,video"},
+		},
+		{
+			description: "non-matching annotation value",
+			annotations: map[string]string{"example.com/workload": "training"},
+			env:         []string{"PATH=/usr/bin"},
+			expected:    []string{"PATH=/usr/bin"},
+		},
+		{
+			description: "explicit env takes precedence",
+			annotations: map[string]string{"example.com/workload": "video"},
+			env:         []string{"NVIDIA_DRIVER_CAPABILITIES=compute"},
+			expected:    []string{"NVIDIA_DRIVER_CAPABILITIES=compute"},
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{
+			Annotations: tc.annotations,
+			Process:     &specs.Process{Env: tc.env},
+		}
+		applyAnnotationCapabilities(spec, mapping)
+		require.Equal(t, tc.expected, spec.Process.Env, tc.description)
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	envFile := filepath.Join(testDir, "hook.env")
+	contents := "# Settings of the hook\n\nFOO=bar\n  BAZ=a=b\nEMPTY=\n\t# indented comment\nSPACES= value \n"
+	require.NoError(t, ioutil.WriteFile(envFile, []byte(contents), 0644))
+
+	env, err := readEnvFile(envFile)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"FOO": "bar", "BAZ": "a=b", "EMPTY": "", "SPACES": " value "}, env)
+
+	for _, line := range []string{"FOO", "=bar", "FOO BAR=baz"} {
+		require.NoError(t, ioutil.WriteFile(envFile, []byte("VALID=1\n"+line+"\n"), 0644))
+		_, err = readEnvFile(envFile)
+		require.EqualError(t, err, fmt.Sprintf("%v:2: invalid line %q: expected KEY=VALUE", envFile, line))
+	}
+
+	_, err = readEnvFile(filepath.Join(testDir, "missing.env"))
+	require.Error(t, err)
+}
+
+func TestGetRuntimeEnv(t *testing.T) {
+	environ := []string{"PATH=/usr/bin", "HOME=/root", "SECRET_TOKEN=abc", "HTTP_PROXY=http://proxy", "LANG=C"}
+
+	require.Equal(t, environ, getRuntimeEnv(environ, nil))
+	require.Equal(t, []string{"PATH=/usr/bin", "HOME=/root", "HTTP_PROXY=http://proxy"}, getRuntimeEnv(environ, []string{"HTTP_*"}))
+	require.Equal(t, []string{"PATH=/usr/bin", "HOME=/root", "LANG=C"}, getRuntimeEnv(environ, []string{"LANG"}))
+}
+
+func TestRuntimeEnvAllowlist(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	envFile := filepath.Join(testDir, "env")
+	_, err = writeTestScript(testDir, "runc", "env > "+envFile)
+	require.NoError(t, err)
+
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nruntime-env-allowlist = [\"ALLOWED_*\"]\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	cmd := exec.Command(nvidiaRuntime, "state", "testcontainer")
+	cmd.Env = []string{
+		configOverride + "=" + configDir,
+		"PATH=" + testDir + ":" + os.Getenv("PATH"),
+		"ALLOWED_VAR=1",
+		"SECRET_TOKEN=abc",
+	}
+	require.NoError(t, cmd.Run())
+
+	env, err := ioutil.ReadFile(envFile)
+	require.NoError(t, err)
+	require.Contains(t, string(env), "ALLOWED_VAR=1\n")
+	require.Contains(t, string(env), "PATH="+testDir)
+	require.NotContains(t, string(env), "SECRET_TOKEN")
+	require.NotContains(t, string(env), configOverride)
+}
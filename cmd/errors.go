@@ -0,0 +1,150 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The categories of the errors returned by an invocation of the runtime,
+// which are included in the structured error output.
+const (
+	errorCategoryConfig  = "config"
+	errorCategoryArgs    = "args"
+	errorCategorySpec    = "spec"
+	errorCategoryRuntime = "runtime"
+	errorCategoryTimeout = "timeout"
+)
+
+// exitCodeError is the exit code of an invocation that fails before or
+// instead of delegating to the low-level runtime.
+const exitCodeError = 1
+
+// logFormatJSON is the value of the --log-format runtime flag selecting
+// structured logs.
+const logFormatJSON = "json"
+
+// categorizedError is an error of a known category.
+type categorizedError struct {
+	category string
+	err      error
+}
+
+func (e *categorizedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categorizedError) Unwrap() error {
+	return e.err
+}
+
+// withCategory returns the specified error with the specified category. A nil
+// error is returned unchanged.
+func withCategory(category string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &categorizedError{category: category, err: err}
+}
+
+// getErrorCategory returns the category of the specified error, or an empty
+// string if it is unknown.
+func getErrorCategory(err error) string {
+	var categorized *categorizedError
+	if errors.As(err, &categorized) {
+		return categorized.category
+	}
+	return ""
+}
+
+// getExitCode returns the exit code of an invocation of the runtime that
+// returned the specified error:
+//
+//   - commands implemented by the runtime itself, such as modify, diff and
+//     modify --dry-run, exit with 0 on success and exitCodeError otherwise;
+//   - commands delegated to the low-level runtime by replacing the current
+//     process, including create and all passthrough commands, exit with the
+//     exit code of the low-level runtime, or exitCodeError if the delegation
+//     fails;
+//   - commands that run the low-level runtime as a child process, such as run
+//     with run-as-create-start and delete with cleanup-on-delete, exit with
+//     the exit code of the failed child process, or 128 plus the number of the
+//     signal that terminated it.
+//
+// A post-processor vetoing the spec is treated as a failed child process.
+func getExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return exitCodeError
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	if code := exitErr.ExitCode(); code > 0 {
+		return code
+	}
+	return exitCodeError
+}
+
+// getLogFormat returns the value of the --log-format flag in the specified
+// argv, which is forwarded to the low-level runtime as is.
+func getLogFormat(argv []string) string {
+	for i, arg := range argv {
+		parts := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)
+		if !strings.HasPrefix(arg, "-") || parts[0] != "log-format" {
+			continue
+		}
+		if len(parts) == 2 {
+			return parts[1]
+		}
+		if i+1 < len(argv) {
+			return argv[i+1]
+		}
+	}
+	return ""
+}
+
+// writeJSONError writes the specified error to w as a single JSON object in
+// the format of the JSON logs of runc.
+func writeJSONError(w io.Writer, err error) error {
+	entry := map[string]string{
+		"level": "error",
+		"msg":   err.Error(),
+		"time":  time.Now().Format(time.RFC3339),
+	}
+	if category := getErrorCategory(err); category != "" {
+		entry["category"] = category
+	}
+
+	output, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", output)
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetLogFormat(t *testing.T) {
+	require.Equal(t, "json", getLogFormat([]string{"--log-format", "json", "create"}))
+	require.Equal(t, "json", getLogFormat([]string{"--root", "/run/runc", "--log-format=json", "create"}))
+	require.Equal(t, "text", getLogFormat([]string{"-log-format", "text"}))
+	require.Equal(t, "", getLogFormat([]string{"create", "--bundle", "log-format"}))
+	require.Equal(t, "", getLogFormat([]string{"--log-format"}))
+}
+
+func TestWriteJSONError(t *testing.T) {
+	err := fmt.Errorf("error running hook: %w", withCategory(errorCategorySpec, errors.New("invalid spec")))
+	require.Equal(t, errorCategorySpec, getErrorCategory(err))
+
+	var buf bytes.Buffer
+	require.NoError(t, writeJSONError(&buf, err))
+
+	var entry map[string]string
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "error", entry["level"])
+	require.Equal(t, "error running hook: invalid spec", entry["msg"])
+	require.Equal(t, errorCategorySpec, entry["category"])
+	require.NotEmpty(t, entry["time"])
+
+	buf.Reset()
+	require.NoError(t, writeJSONError(&buf, errors.New("failed")))
+	entry = nil
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.NotContains(t, entry, "category")
+}
+
+func TestJSONErrorOutput(t *testing.T) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(nvidiaRuntime, "--log-format", "json", "create", "--bundle")
+	cmd.Stderr = &stderr
+	require.Error(t, cmd.Run(), "runtime should return an error")
+
+	// The error is the last line of stderr, following any other log output.
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	var entry map[string]string
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &entry), stderr.String())
+	require.Equal(t, "error", entry["level"])
+	require.Equal(t, errorCategoryArgs, entry["category"])
+	require.Contains(t, entry["msg"], "error getting processing command line arguments")
+
+	stderr.Reset()
+	cmd = exec.Command(nvidiaRuntime, "create", "--bundle")
+	cmd.Stderr = &stderr
+	require.Error(t, cmd.Run(), "runtime should return an error")
+	require.NotContains(t, stderr.String(), `"level":"error"`)
+}
+
+func TestGetExitCode(t *testing.T) {
+	require.Equal(t, 0, getExitCode(nil))
+	require.Equal(t, exitCodeError, getExitCode(errors.New("failed")))
+
+	err := exec.Command("sh", "-c", "exit 3").Run()
+	require.Error(t, err)
+	wrapped := withCategory(errorCategoryRuntime, fmt.Errorf("error creating container: %w", err))
+	require.Equal(t, 3, getExitCode(wrapped))
+	require.Equal(t, exitCodeError, getExitCode(fmt.Errorf("error creating container: %v", err)))
+
+	err = exec.Command("sh", "-c", "kill -9 $$").Run()
+	require.Error(t, err)
+	require.Equal(t, 128+9, getExitCode(err))
+}
+
+func TestExitCodes(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	runtime, err := writeTestScript(testDir, "failing-runc", "exit 7")
+	require.NoError(t, err)
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nruntime = \"" + runtime + "\"\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+	env := append(os.Environ(), configOverride+"="+configDir)
+
+	exitCode := func(argv ...string) int {
+		cmd := exec.Command(nvidiaRuntime, argv...)
+		cmd.Env = env
+		err := cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		require.NoError(t, err)
+		return 0
+	}
+
+	require.NoError(t, generateNewRuntimeSpec())
+	require.Equal(t, 0, exitCode("modify", "--dry-run", bundlePath), "dry-run should succeed without running the runtime")
+	require.Equal(t, 0, exitCode("modify", bundlePath), "modify should succeed without running the runtime")
+	spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks))
+
+	require.Equal(t, 7, exitCode("state", "testcontainer"), "passthrough should exit with the code of the runtime")
+	require.Equal(t, 7, exitCode("create", "--bundle", bundlePath, "testcontainer"), "create should exit with the code of the runtime")
+	require.Equal(t, exitCodeError, exitCode("modify", filepath.Join(testDir, "missing")), "a failed modify should exit with the error code")
+
+	// The exit code of the runtime run as a child process is preserved.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(configDir, configFilePath),
+		[]byte("[nvidia-container-runtime]\nrun-as-create-start = true\nruntime = \""+runtime+"\"\n"), 0644))
+	require.Equal(t, 7, exitCode("run", "--bundle", bundlePath, "testcontainer"), "run should exit with the code of the failed create")
+}
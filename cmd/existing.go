@@ -0,0 +1,110 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// The values of on-existing, which selects how a create for the id of an
+// existing container is handled. onExistingError passes the create to the
+// low-level runtime, which rejects it. onExistingIgnore treats the create as
+// successful without running it, and onExistingRecreate deletes the existing
+// container before creating it again.
+const (
+	onExistingError    = "error"
+	onExistingIgnore   = "ignore"
+	onExistingRecreate = "recreate"
+)
+
+// handleExistingContainer applies the on-existing config to the container
+// created by the current invocation. The returned bool is true if the create
+// is complete, i.e. it is ignored for an existing container.
+func handleExistingContainer(cfg *config, args *args) (bool, error) {
+	if cfg.onExisting == onExistingError {
+		return false, nil
+	}
+
+	globalArgs, _, createArgs := splitRuntimeArgs(getRuntimeArgs(os.Args[1:]))
+	id := getContainerID(createArgs)
+	if id == "" {
+		return false, nil
+	}
+
+	if args.printExec {
+		logger.Printf("Not checking for existing container %v with --print-exec", id)
+		return false, nil
+	}
+
+	exists, err := containerExists(cfg, globalArgs, id)
+	if err != nil {
+		return false, fmt.Errorf("error checking for existing container %v: %v", id, err)
+	}
+	if !exists {
+		return false, nil
+	}
+
+	if cfg.onExisting == onExistingIgnore {
+		logger.Printf("Container %v already exists, ignoring create", id)
+		return true, nil
+	}
+
+	logger.Printf("Container %v already exists, deleting it before create", id)
+	err = runRuntime(cfg, args, globalArgs, "delete", "--force", id)
+	if err != nil {
+		return false, fmt.Errorf("error deleting existing container %v: %w", id, err)
+	}
+	return false, nil
+}
+
+// containerExists checks whether the low-level runtime has state for the
+// specified container by running its state command. A state command that
+// fails is taken to mean that the container does not exist.
+func containerExists(cfg *config, globalArgs []string, id string) (bool, error) {
+	var runtimeArgs []string
+	runtimeArgs = append(runtimeArgs, globalArgs...)
+	runtimeArgs = append(runtimeArgs, "state", id)
+
+	argv, err := getRuncCommand(cfg.runtime, runtimeArgs)
+	if err != nil {
+		return false, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(invocationCtx, argv[0], argv[1:]...)
+	cmd.Stderr = &stderr
+	cmd.Env = getRuntimeEnv(os.Environ(), cfg.runtimeEnvAllowlist)
+	if cfg.runtimeCredential != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cfg.runtimeCredential}
+	}
+
+	logger.Printf("Running %v", formatCommandLine(argv))
+	err = cmd.Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		logger.Printf("No state for container %v: %v", id, strings.TrimSpace(stderr.String()))
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeStatefulRuntime writes a mock runtime recording its invocations, which
+// keeps the state of a single container in a marker file.
+func writeStatefulRuntime(t *testing.T, dir string) (string, string, string) {
+	invocations := filepath.Join(dir, "invocations")
+	marker := filepath.Join(dir, "state")
+	runtime, err := writeTestScript(dir, "stateful-runc", `echo "$@" >> `+invocations+`
+for arg in "$@"; do
+	case "$arg" in
+	state)
+		[ -e `+marker+` ] && { echo '{"status": "created"}'; exit 0; }
+		echo "container does not exist" >&2; exit 1;;
+	delete)
+		rm -f `+marker+`; exit 0;;
+	create)
+		[ -e `+marker+` ] && { echo "container already exists" >&2; exit 1; }
+		touch `+marker+`; exit 0;;
+	esac
+done`)
+	require.NoError(t, err)
+	return runtime, invocations, marker
+}
+
+func TestOnExisting(t *testing.T) {
+	testCases := []struct {
+		onExisting          string
+		isError             bool
+		expectedInvocations []string
+		expectedHookCount   int
+	}{
+		{
+			onExisting:          onExistingError,
+			isError:             true,
+			expectedInvocations: []string{"create"},
+			expectedHookCount:   1,
+		},
+		{
+			onExisting:          onExistingIgnore,
+			expectedInvocations: []string{"state"},
+			expectedHookCount:   0,
+		},
+		{
+			onExisting:          onExistingRecreate,
+			expectedInvocations: []string{"state", "delete --force", "create"},
+			expectedHookCount:   1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.onExisting, func(t *testing.T) {
+			testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(testDir)
+
+			runtime, invocations, marker := writeStatefulRuntime(t, testDir)
+			require.NoError(t, ioutil.WriteFile(marker, nil, 0644))
+			configDir, err := writeTestConfig("[nvidia-container-runtime]\nruntime = \"" + runtime + "\"\non-existing = \"" + tc.onExisting + "\"\n")
+			require.NoError(t, err)
+			defer os.RemoveAll(configDir)
+
+			require.NoError(t, generateNewRuntimeSpec())
+			cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+			cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+			err = cmdCreate.Run()
+			if tc.isError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			content, err := ioutil.ReadFile(invocations)
+			require.NoError(t, err)
+			lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+			require.Len(t, lines, len(tc.expectedInvocations), string(content))
+			for i, expected := range tc.expectedInvocations {
+				require.Contains(t, lines[i], expected+" ")
+				require.True(t, strings.HasSuffix(lines[i], "testcontainer"), lines[i])
+			}
+
+			spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+			require.NoError(t, err)
+			hookCount := 0
+			if spec.Hooks != nil {
+				hookCount = nvidiaHookCount(spec.Hooks)
+			}
+			require.Equal(t, tc.expectedHookCount, hookCount)
+		})
+	}
+}
+
+func TestOnExistingNewContainer(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	runtime, invocations, marker := writeStatefulRuntime(t, testDir)
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nruntime = \"" + runtime + "\"\non-existing = \"recreate\"\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	require.NoError(t, generateNewRuntimeSpec())
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+	require.NoError(t, cmdCreate.Run())
+
+	content, err := ioutil.ReadFile(invocations)
+	require.NoError(t, err)
+	require.NotContains(t, string(content), "delete", "a new container should not be deleted")
+	_, err = os.Stat(marker)
+	require.NoError(t, err, "the container should be created")
+}
@@ -0,0 +1,166 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// runExplain implements the explain command, which prints whether the NVIDIA
+// hook would be inserted into the OCI specification of the bundle and why,
+// without modifying the config.json file:
+//
+//	nvidia-container-runtime explain --bundle BUNDLE
+func runExplain(cfg *config, args *args) error {
+	return explainBundle(os.Stdout, cfg, args)
+}
+
+// explainBundle writes the decision made for the NVIDIA hook on create of the
+// bundle referenced by the specified args to w. The decision predicates of
+// create are evaluated on the spec without running the modifier chain, so that
+// no external modifier or post-processor is run and the hook is looked up
+// without retries. The environment decisions are applied first, so that the
+// explanation reflects the environment of the container as it will be run.
+func explainBundle(w io.Writer, cfg *config, args *args) error {
+	configFilePath, err := args.getConfigFilePath()
+	if err != nil {
+		return fmt.Errorf("error getting config file path: %v", err)
+	}
+	cfg = cfg.forBundle(filepath.Dir(configFilePath))
+
+	spec, err := readSpec(configFilePath)
+	if err != nil {
+		return err
+	}
+
+	policyErr := applyExplainEnvDecisions(spec, cfg)
+
+	name := cfg.getVisibleDevicesEnvvar()
+	visibleDevices, ok := getEnvValue(getProcessEnv(spec), name)
+	if !ok {
+		visibleDevices = "unset"
+	}
+	_, err = fmt.Fprintf(w, "%v: %v\n", name, visibleDevices)
+	if err != nil {
+		return err
+	}
+
+	if policyErr != nil {
+		_, err = fmt.Fprintf(w, "rejected: %v\n", policyErr)
+		return err
+	}
+	if reason := getExplainSkipReason(spec, cfg); reason != "" {
+		_, err = fmt.Fprintf(w, "skipped: %v\n", reason)
+		return err
+	}
+
+	stages, err := getSupportedHookStages(spec, cfg)
+	if err != nil {
+		return err
+	}
+	position, err := getHookPosition(spec, cfg)
+	if err != nil {
+		return err
+	}
+
+	other := getOtherNVIDIAHookStage(spec, stages)
+	var missing []string
+	for _, stage := range stages {
+		if other != "" || (spec.Hooks != nil && containsNVIDIAHook(*getHookList(spec.Hooks, stage))) {
+			_, err = fmt.Fprintf(w, "skipped %v: NVIDIA hook already present\n", stage)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		missing = append(missing, stage)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	path, err := getNVIDIAHookLookup(cfg)()
+	if err != nil {
+		return fmt.Errorf("error finding hook: %v", err)
+	}
+	env, err := getNVIDIAHookEnv(spec, cfg)
+	if err != nil {
+		return err
+	}
+	templateArgs, err := expandHookArgTemplates(cfg.hookArgTemplates, spec, cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, stage := range missing {
+		hookPath := path
+		if stage == hookStageCreateContainer {
+			hookPath = hookContainerPath
+		}
+		hook := newNVIDIAHook(hookPath, stage, templateArgs, env, cfg)
+		_, err = fmt.Fprintf(w, "inserted %v: position %v\n  path: %v\n  args: %v\n  env: %v\n",
+			stage, position, hook.Path, strings.Join(hook.Args, " "), strings.Join(hook.Env, " "))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyExplainEnvDecisions applies the environment filters and the visible
+// devices decisions of create to the specified spec, in the order of the
+// modifier chain. An error is returned if the visible-devices-policy rejects
+// the spec.
+func applyExplainEnvDecisions(spec *specs.Spec, cfg *config) error {
+	filterEnv(spec, cfg.envAllowlist, cfg.envDenylist)
+	if cfg.forceVisibleDevices != nil {
+		forceVisibleDevices(spec, cfg.getVisibleDevicesEnvvar(), *cfg.forceVisibleDevices)
+	}
+	return applyVisibleDevicesPolicy(spec, cfg.getVisibleDevicesEnvvar(), cfg.visibleDevicesPolicy, cfg.visibleDevicesRewrite)
+}
+
+// getExplainSkipReason returns the reason for the NVIDIA hook not being
+// inserted into the specified spec, or an empty string if it is.
+func getExplainSkipReason(spec *specs.Spec, cfg *config) string {
+	if isSandboxContainer(spec, cfg.sandboxAnnotationKey) {
+		return fmt.Sprintf("sandbox container detected using annotation %q", cfg.sandboxAnnotationKey)
+	}
+	if pattern := getMatchingEntrypointPattern(spec, cfg.skipIfEntrypointMatches); pattern != "" {
+		return fmt.Sprintf("entrypoint %v matches skip-if-entrypoint-matches entry %q", spec.Process.Args[0], pattern)
+	}
+	if cfg.mode == modeCDI {
+		return fmt.Sprintf("mode is %q, devices are injected from CDI specifications", modeCDI)
+	}
+	return getHookSkipReason(spec, cfg)
+}
+
+// findNVIDIAHook returns the first NVIDIA hook of the specified hooks.
+func findNVIDIAHook(hooks []specs.Hook) (specs.Hook, bool) {
+	for _, hook := range hooks {
+		if isNVIDIAHook(hook) {
+			return hook, true
+		}
+	}
+	return specs.Hook{}, false
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplainBundle(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	hookPath, err := writeTestScript(testDir, hookBinary, "exit 0")
+	require.NoError(t, err)
+
+	allowAll := specs.LinuxDeviceCgroup{Allow: true, Access: "rwm"}
+
+	testCases := []struct {
+		description string
+		spec        *specs.Spec
+		cfg         *config
+		expected    string
+	}{
+		{
+			description: "hook inserted",
+			spec:        &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=0"}}},
+			cfg:         &config{hookPath: hookPath, hookEnv: map[string]string{"FOO": "bar"}},
+			expected: "NVIDIA_VISIBLE_DEVICES: 0\n" +
+				"inserted prestart: position last\n" +
+				"  path: " + hookPath + "\n" +
+				"  args: " + hookPath + " prestart\n" +
+				"  env: FOO=bar\n",
+		},
+		{
+			description: "hook inserted into both stages",
+			spec:        &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}}},
+			cfg:         &config{hookPath: hookPath, hookStage: hookStageBoth, hookArgs: hookArgsStage, hookPosition: hookPositionFirst},
+			expected: "NVIDIA_VISIBLE_DEVICES: all\n" +
+				"inserted prestart: position first\n" +
+				"  path: " + hookPath + "\n" +
+				"  args: " + hookPath + " prestart\n" +
+				"  env: \n" +
+				"inserted createRuntime: position first\n" +
+				"  path: " + hookPath + "\n" +
+				"  args: " + hookPath + " createRuntime\n" +
+				"  env: \n",
+		},
+		{
+			description: "no process environment",
+			spec:        &specs.Spec{},
+			cfg:         &config{hookPath: hookPath},
+			expected:    "NVIDIA_VISIBLE_DEVICES: unset\nskipped: no process environment in OCI specification\n",
+		},
+		{
+			description: "privileged container",
+			spec: &specs.Spec{
+				Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}},
+				Linux:   &specs.Linux{Resources: &specs.LinuxResources{Devices: []specs.LinuxDeviceCgroup{allowAll}}},
+			},
+			cfg:      &config{hookPath: hookPath, skipPrivileged: true},
+			expected: "NVIDIA_VISIBLE_DEVICES: all\nskipped: privileged container detected and skip-privileged is set\n",
+		},
+		{
+			description: "sandbox container",
+			spec: &specs.Spec{
+				Process:     &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}},
+				Annotations: map[string]string{defaultSandboxAnnotationKey: sandboxContainerType},
+			},
+			cfg:      &config{hookPath: hookPath, sandboxAnnotationKey: defaultSandboxAnnotationKey},
+			expected: "NVIDIA_VISIBLE_DEVICES: all\nskipped: sandbox container detected using annotation \"" + defaultSandboxAnnotationKey + "\"\n",
+		},
+		{
+			description: "environment filtered",
+			spec:        &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}}},
+			cfg:         &config{hookPath: hookPath, envDenylist: []string{"NVIDIA_*"}},
+			expected:    "NVIDIA_VISIBLE_DEVICES: unset\nskipped: no process environment in OCI specification\n",
+		},
+		{
+			description: "visible devices rewritten by policy",
+			spec:        &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}}},
+			cfg:         &config{hookPath: hookPath, visibleDevicesPolicy: visibleDevicesPolicyRewrite, visibleDevicesRewrite: []string{"0", "1"}},
+			expected: "NVIDIA_VISIBLE_DEVICES: 0,1\n" +
+				"inserted prestart: position last\n" +
+				"  path: " + hookPath + "\n" +
+				"  args: " + hookPath + " prestart\n" +
+				"  env: \n",
+		},
+		{
+			description: "visible devices denied by policy",
+			spec:        &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}}},
+			cfg:         &config{hookPath: hookPath, visibleDevicesPolicy: visibleDevicesPolicyDeny},
+			expected:    "NVIDIA_VISIBLE_DEVICES: all\nrejected: NVIDIA_VISIBLE_DEVICES=all is denied by visible-devices-policy\n",
+		},
+		{
+			description: "hook already present",
+			spec: &specs.Spec{
+				Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}},
+				Hooks:   &specs.Hooks{Prestart: []specs.Hook{{Path: hookDefaultFilePath}}},
+			},
+			cfg:      &config{hookPath: hookPath},
+			expected: "NVIDIA_VISIBLE_DEVICES: all\nskipped prestart: NVIDIA hook already present\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			bundle, err := ioutil.TempDir(testDir, "bundle")
+			require.NoError(t, err)
+			require.NoError(t, writeRuntimeSpec(filepath.Join(bundle, specFile), tc.spec))
+
+			var out bytes.Buffer
+			require.NoError(t, explainBundle(&out, tc.cfg, &args{bundleDirPath: bundle}))
+			require.Equal(t, tc.expected, out.String())
+
+			unmodified, err := getRuntimeSpec(filepath.Join(bundle, specFile))
+			require.NoError(t, err)
+			require.Equal(t, tc.spec.Hooks, unmodified.Hooks, "the spec should not be modified")
+		})
+	}
+}
+
+// explain evaluates the decisions without running the external modifier, the
+// post-processors or the retries of the hook lookup.
+func TestExplainBundleRunsNothing(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	marker := filepath.Join(testDir, "ran")
+	touch, err := writeTestScript(testDir, "touch-marker", "touch "+marker+"; cat")
+	require.NoError(t, err)
+	hookPath, err := writeTestScript(testDir, hookBinary, "exit 0")
+	require.NoError(t, err)
+
+	bundle := filepath.Join(testDir, "bundle")
+	require.NoError(t, os.Mkdir(bundle, 0755))
+	spec := &specs.Spec{Version: "1.0.2", Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=0"}}}
+	require.NoError(t, writeRuntimeSpec(filepath.Join(bundle, specFile), spec))
+
+	cfg := &config{
+		hookPath:                hookPath,
+		externalModifier:        touch,
+		externalModifierTimeout: 10 * time.Second,
+		postProcessors:          []string{touch},
+		postProcessorTimeout:    10 * time.Second,
+	}
+	var out bytes.Buffer
+	require.NoError(t, explainBundle(&out, cfg, &args{bundleDirPath: bundle}))
+	require.Contains(t, out.String(), "inserted prestart: position last\n")
+	_, err = os.Stat(marker)
+	require.True(t, os.IsNotExist(err), "explain should not run the external modifier or post-processors")
+
+	cfg = &config{
+		hookPath:           filepath.Join(testDir, "missing"),
+		hookResolveRetries: 5,
+		hookResolveBackoff: time.Second,
+	}
+	start := time.Now()
+	require.Error(t, explainBundle(&out, cfg, &args{bundleDirPath: bundle}))
+	require.Less(t, int64(time.Since(start)), int64(time.Second), "explain should not retry the hook lookup")
+}
+
+func TestExplainCommand(t *testing.T) {
+	require.NoError(t, generateNewRuntimeSpec())
+
+	cmdExplain := exec.Command(nvidiaRuntime, "explain", "--bundle", bundlePath)
+	cmdExplain.Env = append(os.Environ(), configOverride+"=/etc/")
+	output, err := cmdExplain.Output()
+	require.NoError(t, err, "runtime should not return an error")
+	require.Contains(t, string(output), "inserted prestart: position last\n")
+
+	spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Nil(t, spec.Hooks, "explain should not modify config.json")
+}
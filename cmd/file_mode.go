@@ -0,0 +1,73 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/pelletier/go-toml"
+)
+
+// getFileMode returns the permission bits stored at the specified key of the
+// config, either as an octal string such as "0640" or as a TOML integer such
+// as 0o640. A missing key results in a nil mode.
+func getFileMode(tree *toml.Tree, key string) (*os.FileMode, error) {
+	value := tree.Get(key)
+	if value == nil {
+		return nil, nil
+	}
+
+	var mode uint64
+	switch v := value.(type) {
+	case string:
+		var err error
+		mode, err = strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %v: %q is not an octal number", key, v)
+		}
+	case int64:
+		if v < 0 {
+			return nil, fmt.Errorf("invalid value for %v: %v is negative", key, v)
+		}
+		mode = uint64(v)
+	default:
+		return nil, fmt.Errorf("invalid value for %v: expected an octal string or integer", key)
+	}
+
+	if mode > uint64(os.ModePerm) {
+		return nil, fmt.Errorf("invalid value for %v: %#o is not a permission mode", key, mode)
+	}
+
+	fileMode := os.FileMode(mode)
+	return &fileMode, nil
+}
+
+// applyFileMode sets the permissions of the specified file to the specified
+// mode, if any. The mode is set explicitly so that it does not depend on the
+// umask of the caller or on the mode of an existing file.
+func applyFileMode(path string, mode *os.FileMode) error {
+	if mode == nil {
+		return nil
+	}
+	err := os.Chmod(path, *mode)
+	if err != nil {
+		return fmt.Errorf("error setting mode of %v: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/pelletier/go-toml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetFileMode(t *testing.T) {
+	testCases := []struct {
+		contents string
+		expected os.FileMode
+		isError  bool
+	}{
+		{contents: `file-mode = "0640"`, expected: 0640},
+		{contents: `file-mode = "600"`, expected: 0600},
+		{contents: `file-mode = 0o644`, expected: 0644},
+		{contents: `file-mode = "0648"`, isError: true},
+		{contents: `file-mode = "01777"`, isError: true},
+		{contents: `file-mode = -1`, isError: true},
+		{contents: `file-mode = true`, isError: true},
+	}
+
+	for _, tc := range testCases {
+		tree, err := toml.Load(tc.contents)
+		require.NoError(t, err, tc.contents)
+
+		mode, err := getFileMode(tree, "file-mode")
+		if tc.isError {
+			require.Error(t, err, tc.contents)
+			continue
+		}
+		require.NoError(t, err, tc.contents)
+		require.Equal(t, tc.expected, *mode, tc.contents)
+	}
+
+	mode, err := getFileMode(&toml.Tree{}, "file-mode")
+	require.NoError(t, err)
+	require.Nil(t, mode)
+}
+
+func TestFileMode(t *testing.T) {
+	require.NoError(t, generateNewRuntimeSpec())
+
+	configFilePath := filepath.Join(bundlePath, specFile)
+	defer os.Chmod(configFilePath, 0644)
+
+	logDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(logDir)
+	logFile := filepath.Join(logDir, "debug.log")
+	resultFile := filepath.Join(logDir, "result.json")
+	traceFile := filepath.Join(logDir, "trace.out")
+	dumpDir := filepath.Join(logDir, "specs")
+
+	testDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\nfile-mode = \"0640\"\ndebug = %q\nresult-file = %q\ndump-spec-dir = %q\n", logFile, resultFile, dumpDir))
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	cmdCreate := exec.Command(nvidiaRuntime, "--trace", traceFile, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+testDir)
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	for _, path := range []string{configFilePath, logFile, resultFile, traceFile, filepath.Join(dumpDir, "testcontainer.json")} {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0640), info.Mode().Perm(), path)
+	}
+}
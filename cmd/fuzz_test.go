@@ -0,0 +1,120 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// fuzzArgsSeparator separates the elements of argv in the string inputs of
+// FuzzGetArgs.
+const fuzzArgsSeparator = "\x00"
+
+func FuzzGetArgs(f *testing.F) {
+	seeds := [][]string{
+		{"create", "--bundle", "/foo/bar", "id"},
+		{"--root", "/run/runc", "create", "-b=/foo/bar", "id"},
+		{"--bundle", "create", "create", "id"},
+		{"-b", "--print-exec"},
+		{"--cwd", "/tmp", "exec", "--cwd", "/work", "id", "ls"},
+		{"--log-level=debug", "--log-to-stderr", "run", "--bundle", "a", "--bundle", "b", "id"},
+		{"--spec-file", "spec.json", "modify", "--dry-run", "/bundles/a"},
+		{"create", "--console-socket", "create", "id", "extra"},
+		{"-", "--", "---", "-b="},
+	}
+	for _, seed := range seeds {
+		f.Add(strings.Join(seed, fuzzArgsSeparator))
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		argv := strings.Split(input, fuzzArgsSeparator)
+		args, err := getArgs(argv)
+		if err != nil && args != nil {
+			t.Fatalf("getArgs(%q) returned both args and an error: %v", argv, err)
+		}
+		if err == nil && args == nil {
+			t.Fatalf("getArgs(%q) returned neither args nor an error", argv)
+		}
+
+		runtimeArgs := getRuntimeArgs(argv)
+		for _, arg := range runtimeArgs {
+			if arg == "--print-exec" || arg == "--log-to-stderr" {
+				t.Fatalf("getRuntimeArgs(%q) forwarded shim flag %v", argv, arg)
+			}
+		}
+		splitRuntimeArgs(runtimeArgs)
+	})
+}
+
+func FuzzGetRuntimeSpec(f *testing.F) {
+	original, err := ioutil.ReadFile(unmodifiedSpecFile)
+	if err != nil {
+		f.Fatal(err)
+	}
+	seeds := []string{
+		string(original),
+		`{"ociVersion":"1.0.0"}`,
+		`{"ociVersion":"1.0.0","process":null,"hooks":null,"linux":null}`,
+		`{"ociVersion":"1.0.0","process":{"env":["NVIDIA_VISIBLE_DEVICES=all"]},"hooks":{"prestart":null}}`,
+		`{"ociVersion":"1.0.0","process":{"args":[],"env":[]},"hooks":{"prestart":[{"path":""}]}}`,
+		`{"ociVersion":"1.0.0","process":{"env":["NVIDIA_VISIBLE_DEVICES"]},"linux":{"resources":null}}`,
+		`{"ociVersion":"1.0.0","root":{"path":"../rootfs"},"annotations":{"io.kubernetes.cri.container-type":"sandbox"}}`,
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	cfg := &config{
+		sandboxAnnotationKey: defaultSandboxAnnotationKey,
+		hookStage:            hookStageBoth,
+		hookArgs:             hookArgsStage,
+		maxHooks:             defaultMaxHooks,
+		maxEnvCount:          defaultMaxEnvCount,
+		maxEnvBytes:          defaultMaxEnvBytes,
+		skipPrivileged:       true,
+		injectDevices:        []string{"/dev/null"},
+		deviceCgroupRules:    deviceCgroupRulesDevice,
+		apparmorProfile:      "nvidia",
+		injectInit:           "/bin/sh",
+		envDenylist:          []string{"NVIDIA_REQUIRE_*"},
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		spec, err := parseSpec(data)
+		if err != nil {
+			if spec != nil {
+				t.Fatalf("parseSpec returned both a spec and an error: %v", err)
+			}
+			return
+		}
+
+		before, err := toGenericJSON(spec)
+		if err != nil {
+			t.Fatalf("error converting spec: %v", err)
+		}
+		resolveRootfs(spec, "/bundle")
+		if err := modifySpec(cfg, spec); err != nil {
+			return
+		}
+		after, err := toGenericJSON(spec)
+		if err != nil {
+			t.Fatalf("error converting modified spec: %v", err)
+		}
+		diffJSON(before, after)
+
+		// Modifying a spec again is expected to leave it unchanged.
+		if err := modifySpec(cfg, spec); err != nil {
+			t.Fatalf("error modifying spec again: %v", err)
+		}
+		again, err := toGenericJSON(spec)
+		if err != nil {
+			t.Fatalf("error converting spec: %v", err)
+		}
+		if changes := diffJSON(after, again); len(changes) > 0 {
+			t.Fatalf("modifying spec again made changes: %v", changes)
+		}
+	})
+}
@@ -0,0 +1,99 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// runGenerateConfig implements the generate-config command, which writes a
+// commented config listing all supported keys with their defaults:
+//
+//	nvidia-container-runtime generate-config [--output PATH]
+//
+// The config is written to stdout unless an output path is specified.
+func runGenerateConfig(cfg *config, argv []string) error {
+	_, _, commandArgs := splitRuntimeArgs(getRuntimeArgs(argv))
+
+	var output string
+	for i := 0; i < len(commandArgs); i++ {
+		parts := strings.SplitN(strings.TrimLeft(commandArgs[i], "-"), "=", 2)
+		if !strings.HasPrefix(commandArgs[i], "-") || (parts[0] != "output" && parts[0] != "o") {
+			return fmt.Errorf("unsupported generate-config argument %v", commandArgs[i])
+		}
+		if len(parts) == 2 {
+			output = parts[1]
+		} else if i+1 < len(commandArgs) {
+			output = commandArgs[i+1]
+			i++
+		} else {
+			return fmt.Errorf("%v option needs an argument", parts[0])
+		}
+	}
+
+	var buffer bytes.Buffer
+	writeDefaultConfig(&buffer)
+
+	if output == "" {
+		_, err := os.Stdout.Write(buffer.Bytes())
+		return err
+	}
+
+	err := ioutil.WriteFile(output, buffer.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing config to %v: %v", output, err)
+	}
+	return applyFileMode(output, cfg.fileMode)
+}
+
+// writeDefaultConfig writes a config with each of the keys in configKeys
+// commented out, set to its default or an example value.
+func writeDefaultConfig(w io.Writer) {
+	fmt.Fprintf(w, "# Default config of the nvidia-container-runtime, as generated by\n")
+	fmt.Fprintf(w, "# nvidia-container-runtime generate-config.\n\n")
+	fmt.Fprintf(w, "[%v]\n", configTable)
+
+	for _, key := range configKeys {
+		value := key.example
+		if key.defaultValue != nil {
+			value = formatTOMLValue(key.defaultValue)
+		}
+		fmt.Fprintf(w, "\n# %v\n#%v = %v\n", key.description, key.name, value)
+	}
+}
+
+// formatTOMLValue formats the specified default value in TOML syntax.
+func formatTOMLValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case []string:
+		var quoted []string
+		for _, s := range v {
+			quoted = append(quoted, strconv.Quote(s))
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateConfigRoundTrip(t *testing.T) {
+	testDir, err := writeTestConfig("")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	defaults, err := getConfig()
+	require.NoError(t, err)
+
+	var generated bytes.Buffer
+	writeDefaultConfig(&generated)
+
+	testDir, err = writeTestConfig(generated.String())
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Equal(t, defaults, cfg)
+
+	// Setting each key to its generated default must not change the config.
+	uncommented := regexp.MustCompile(`(?m)^#([a-z-]+ = )`).ReplaceAllString(generated.String(), "$1")
+	for _, key := range configKeys {
+		if key.defaultValue == nil {
+			uncommented = regexp.MustCompile(`(?m)^`+key.name+` = .*$`).ReplaceAllString(uncommented, "")
+		}
+	}
+
+	testDir, err = writeTestConfig(uncommented)
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	cfg, err = getConfig()
+	require.NoError(t, err)
+	require.Equal(t, defaults, cfg)
+
+	// The example values must be valid.
+	examples := regexp.MustCompile(`(?m)^#([a-z-]+ = )`).ReplaceAllString(generated.String(), "$1")
+	examples = regexp.MustCompile(`(?m)^config-url = .*$`).ReplaceAllString(examples, "")
+
+	testDir, err = writeTestConfig(examples)
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	_, err = getConfig()
+	require.NoError(t, err)
+}
+
+// TestConfigKeysInSync checks that all keys read from the config are listed in
+// configKeys, which the generated config is based on.
+func TestConfigKeysInSync(t *testing.T) {
+	names := make(map[string]bool)
+	for _, key := range configKeys {
+		names[key.name] = true
+	}
+
+	sources, err := filepath.Glob("*.go")
+	require.NoError(t, err)
+
+	read := regexp.MustCompile(`"nvidia-container-runtime\.([a-z-]+)"`)
+	for _, source := range sources {
+		if strings.HasSuffix(source, "_test.go") {
+			continue
+		}
+		contents, err := ioutil.ReadFile(source)
+		require.NoError(t, err)
+		for _, match := range read.FindAllStringSubmatch(string(contents), -1) {
+			require.True(t, names[match[1]], "%v: key %v missing from configKeys", source, match[1])
+		}
+	}
+}
+
+func TestGenerateConfigOutput(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	output := filepath.Join(testDir, "config.toml")
+	cmdGenerate := exec.Command(nvidiaRuntime, "generate-config", "--output", output)
+	cmdGenerate.Env = append(os.Environ(), configOverride+"=/etc/")
+	stdout, err := cmdGenerate.Output()
+	require.NoError(t, err, "runtime should not return an error")
+	require.Empty(t, stdout)
+
+	var expected bytes.Buffer
+	writeDefaultConfig(&expected)
+
+	generated, err := ioutil.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, expected.String(), string(generated))
+}
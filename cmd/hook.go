@@ -0,0 +1,628 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	hookBinary          = "nvidia-container-runtime-hook"
+	hookDefaultFilePath = "/usr/bin/nvidia-container-runtime-hook"
+
+	// hookWorkdirShell is used to change the working directory before
+	// executing the hook when hook-workdir is configured, since OCI hooks
+	// have no notion of a working directory.
+	hookWorkdirShell  = "/bin/sh"
+	hookWorkdirScript = `cd "$1" && shift && exec "$@"`
+
+	hookStagePrestart        = "prestart"
+	hookStageCreateRuntime   = "createRuntime"
+	hookStageCreateContainer = "createContainer"
+	hookStageBoth            = "both"
+
+	// The hook-stage-fallback values determine the handling of a hook-stage
+	// that is not supported by the version of the OCI specification: the
+	// NVIDIA hook is inserted as a prestart hook instead, or the spec is
+	// rejected.
+	hookStageFallbackPrestart = "prestart"
+	hookStageFallbackError    = "error"
+
+	// hookContainerPath is the path at which the NVIDIA hook is bind-mounted
+	// into containers for the createContainer stage, whose hooks are run in
+	// the mount namespace of the container.
+	hookContainerPath = "/dev/" + hookBinary
+
+	// hookArgsPrestart passes "prestart" to the hook regardless of the hook
+	// stage, as expected by existing hook binaries. hookArgsStage passes the
+	// name of the hook stage instead, e.g. "createRuntime".
+	hookArgsPrestart = "prestart"
+	hookArgsStage    = "stage"
+
+	// The hook-position values place the NVIDIA hook at the start or the end
+	// of a hook list, or right after the first hook whose path contains the
+	// name following hookPositionAfterPrefix.
+	hookPositionFirst       = "first"
+	hookPositionLast        = "last"
+	hookPositionAfterPrefix = "after:"
+
+	// hookOrderAnnotation overrides the hook-position of a container.
+	hookOrderAnnotation = "nvidia.com/hook-order"
+
+	// defaultMaxHooks is the default limit on the number of hooks in an
+	// incoming spec, above which the spec is rejected.
+	defaultMaxHooks = 64
+
+	// defaultHookResolveBackoff is the default delay in milliseconds before
+	// the first retry of resolving the hook path.
+	defaultHookResolveBackoff = 100
+)
+
+// createRuntimeRuncVersion is the first runc release that runs createRuntime
+// hooks.
+var createRuntimeRuncVersion = runtimeVersion{1, 0, 0}
+
+// createHooksOCIVersion is the first version of the OCI runtime specification
+// defining the createRuntime, createContainer and startContainer hooks.
+var createHooksOCIVersion = runtimeVersion{1, 0, 2}
+
+// lookupHookPath resolves the path of the NVIDIA hook on the host.
+var lookupHookPath = getHookPath
+
+// proxyEnvvars are the variables copied from the environment of the runtime to
+// the environment of the hook by propagate-proxy-env.
+var proxyEnvvars = []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+
+// runcBinaries are the executable names of runc, for which prestart hooks are
+// reported as deprecated.
+var runcBinaries = map[string]bool{
+	"runc":        true,
+	"docker-runc": true,
+}
+
+// addNVIDIAHook inserts the NVIDIA Container Runtime hook into the hook lists
+// selected by the hook-stage config. A list that already contains the hook is
+// left unchanged.
+func addNVIDIAHook(spec *specs.Spec, cfg *config) error {
+	path, err := resolveHookPath(getNVIDIAHookLookup(cfg), cfg.hookResolveRetries, cfg.hookResolveBackoff)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("prestart hook path: %s\n", path)
+
+	if spec.Hooks == nil {
+		spec.Hooks = &specs.Hooks{}
+	}
+
+	env, err := getNVIDIAHookEnv(spec, cfg)
+	if err != nil {
+		return err
+	}
+
+	templateArgs, err := expandHookArgTemplates(cfg.hookArgTemplates, spec, cfg)
+	if err != nil {
+		return err
+	}
+
+	position, err := getHookPosition(spec, cfg)
+	if err != nil {
+		return err
+	}
+
+	stages, err := getSupportedHookStages(spec, cfg)
+	if err != nil {
+		return err
+	}
+	if stage := getOtherNVIDIAHookStage(spec, stages); stage != "" {
+		logger.Printf("existing nvidia %v hook in OCI spec file, not inserting it into %v", stage, strings.Join(stages, ", "))
+		return nil
+	}
+
+	for _, stage := range stages {
+		hooks := getHookList(spec.Hooks, stage)
+		if containsNVIDIAHook(*hooks) {
+			logger.Printf("existing nvidia %v hook in OCI spec file", stage)
+			continue
+		}
+
+		hookPath := path
+		if stage == hookStageCreateContainer {
+			hookPath = mountHookIntoContainer(spec, path)
+		}
+
+		hook := newNVIDIAHook(hookPath, stage, templateArgs, env, cfg)
+		*hooks = insertHook(*hooks, hook, position)
+
+		if stage == hookStagePrestart && cfg.hookStage != hookStageBoth {
+			warnPrestartDeprecation(cfg)
+		}
+	}
+
+	return nil
+}
+
+// newNVIDIAHook returns the NVIDIA hook at the specified path for the
+// specified stage, with the specified templated args and environment.
+func newNVIDIAHook(path string, stage string, templateArgs []string, env []string, cfg *config) specs.Hook {
+	// The templated args precede the stage argument, as flags of the hook.
+	args := getHookArgs(path, stage, cfg.hookArgs)
+	args = append(append([]string{args[0]}, templateArgs...), args[1:]...)
+
+	hook := specs.Hook{
+		Path: path,
+		Args: args,
+		Env:  env,
+	}
+	if cfg.hookWorkdir != "" {
+		logger.Printf("Running %v hook in directory %v", stage, cfg.hookWorkdir)
+		hook = wrapHookWorkdir(hook, cfg.hookWorkdir)
+	}
+	return hook
+}
+
+// getNVIDIAHookEnv returns the environment of the NVIDIA hook inserted into
+// the specified spec: the environment configured by getHookEnv, and the
+// devices requested by the container if resolved-devices-env is set.
+func getNVIDIAHookEnv(spec *specs.Spec, cfg *config) ([]string, error) {
+	env, err := getHookEnv(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.resolvedDevicesEnv != "" {
+		if devices := getResolvedDevices(spec, cfg.getVisibleDevicesEnvvar()); devices != "" {
+			env = mergeEnv(env, cfg.resolvedDevicesEnv+"="+devices)
+		}
+	}
+	return env, nil
+}
+
+// getNVIDIAHookLookup returns the function resolving the path of the NVIDIA
+// hook: the configured hook-path if any, or the hook looked up on the host.
+func getNVIDIAHookLookup(cfg *config) func() (string, error) {
+	if cfg.hookPath == "" {
+		return lookupHookPath
+	}
+	return func() (string, error) {
+		return getConfiguredHookPath(cfg.hookPath)
+	}
+}
+
+// getHookPosition returns the position at which the NVIDIA hook is inserted
+// into the hook lists of the specified spec. The hook-order annotation takes
+// precedence over the hook-after config, which in turn takes precedence over
+// the hook-position config.
+func getHookPosition(spec *specs.Spec, cfg *config) (string, error) {
+	if position, ok := spec.Annotations[hookOrderAnnotation]; ok {
+		err := validateHookPosition(position)
+		if err != nil {
+			return "", fmt.Errorf("invalid %v annotation %q: %v", hookOrderAnnotation, position, err)
+		}
+		return position, nil
+	}
+	if cfg.hookAfter != "" {
+		return hookPositionAfterPrefix + cfg.hookAfter, nil
+	}
+	if cfg.hookPosition != "" {
+		return cfg.hookPosition, nil
+	}
+	return hookPositionLast, nil
+}
+
+// validateHookPosition checks that the specified value is a valid hook
+// position.
+func validateHookPosition(position string) error {
+	switch {
+	case position == hookPositionFirst, position == hookPositionLast:
+		return nil
+	case strings.HasPrefix(position, hookPositionAfterPrefix) && len(position) > len(hookPositionAfterPrefix):
+		return nil
+	}
+	return fmt.Errorf("expected %q, %q or %q followed by a hook name", hookPositionFirst, hookPositionLast, hookPositionAfterPrefix)
+}
+
+// insertHook inserts the specified hook into the specified hooks at the
+// specified position.
+func insertHook(hooks []specs.Hook, hook specs.Hook, position string) []specs.Hook {
+	switch {
+	case position == hookPositionFirst:
+		return append([]specs.Hook{hook}, hooks...)
+	case strings.HasPrefix(position, hookPositionAfterPrefix):
+		return insertHookAfter(hooks, hook, strings.TrimPrefix(position, hookPositionAfterPrefix))
+	}
+	return append(hooks, hook)
+}
+
+// insertHookAfter inserts the specified hook right after the first of the
+// specified hooks whose path contains after. The hook is appended if after is
+// empty or no hook matches.
+func insertHookAfter(hooks []specs.Hook, hook specs.Hook, after string) []specs.Hook {
+	if after != "" {
+		for i, h := range hooks {
+			if !strings.Contains(h.Path, after) {
+				continue
+			}
+			logger.Printf("Inserting NVIDIA hook after hook %v", h.Path)
+			result := append([]specs.Hook{}, hooks[:i+1]...)
+			result = append(result, hook)
+			return append(result, hooks[i+1:]...)
+		}
+		logger.Printf("No hook matching %q, appending NVIDIA hook", after)
+	}
+	return append(hooks, hook)
+}
+
+// resolveHookPath resolves the path of the NVIDIA hook, retrying up to the
+// specified number of times if it is not found. This covers the hook being
+// installed while containers are created. The delay between attempts starts
+// at the specified backoff and doubles with each retry.
+func resolveHookPath(lookup func() (string, error), retries int, backoff time.Duration) (string, error) {
+	path, err := lookup()
+	for retry := 1; err != nil && retry <= retries; retry++ {
+		logger.Printf("Could not find hook (%v), retrying in %v (%d/%d)", err, backoff, retry, retries)
+		time.Sleep(backoff)
+		backoff *= 2
+		path, err = lookup()
+	}
+	return path, err
+}
+
+// getConfiguredHookPath returns the configured hook-path, which is resolved
+// against the bundle directory by forBundle if relative.
+func getConfiguredHookPath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("relative hook path %q: OCI hook paths must be absolute", path)
+	}
+	_, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// forBundle returns the config applied to the bundle in the specified
+// directory. A relative hook-path, as allowed by allow-relative-hook-path, is
+// resolved against the bundle directory.
+func (c *config) forBundle(bundleDir string) *config {
+	bundleCfg := *c
+	bundleCfg.bundleDir = bundleDir
+	if c.hookPath == "" || filepath.IsAbs(c.hookPath) {
+		return &bundleCfg
+	}
+
+	bundleCfg.hookPath = filepath.Join(bundleDir, c.hookPath)
+	logger.Printf("Resolved relative hook path %v to %v", c.hookPath, bundleCfg.hookPath)
+	return &bundleCfg
+}
+
+// forContainer returns the config applied to the container with the specified
+// id.
+func (c *config) forContainer(id string) *config {
+	containerCfg := *c
+	containerCfg.containerID = id
+	return &containerCfg
+}
+
+// mountHookIntoContainer bind-mounts the NVIDIA hook at the specified host path
+// into the container and returns its path in the container.
+func mountHookIntoContainer(spec *specs.Spec, path string) string {
+	for _, mount := range spec.Mounts {
+		if mount.Destination == hookContainerPath {
+			return hookContainerPath
+		}
+	}
+
+	logger.Printf("Mounting %v into container at %v", path, hookContainerPath)
+	spec.Mounts = append(spec.Mounts, specs.Mount{
+		Destination: hookContainerPath,
+		Type:        "bind",
+		Source:      path,
+		Options:     []string{"bind", "ro"},
+	})
+	return hookContainerPath
+}
+
+// prestartDeprecationOnce limits the prestart deprecation warning to a single
+// entry per invocation, e.g. when modifying several bundles.
+var prestartDeprecationOnce sync.Once
+
+// warnPrestartDeprecation logs a warning if the NVIDIA hook is inserted as a
+// prestart hook although runc supports createRuntime hooks. Since this
+// requires running runc --version, the check is only made at the debug log
+// level, which also keeps the warning out of the logs of busy nodes.
+func warnPrestartDeprecation(cfg *config) {
+	if !logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+
+	prestartDeprecationOnce.Do(func() {
+		path, version, err := getLowLevelRuntimeVersion(cfg)
+		if err != nil {
+			logger.Debugf("Not checking support for createRuntime hooks: %v", err)
+			return
+		}
+		if !runcBinaries[filepath.Base(path)] || version.compare(createRuntimeRuncVersion) < 0 {
+			return
+		}
+		logger.Infof("Inserting the NVIDIA hook as a deprecated prestart hook although %v %v supports createRuntime hooks; consider setting hook-stage = %q", path, version, hookStageCreateRuntime)
+	})
+}
+
+// getHookPath returns the path of the NVIDIA hook, which is looked up in PATH
+// before falling back to the default location.
+func getHookPath() (string, error) {
+	path, err := exec.LookPath(hookBinary)
+	if err == nil {
+		return path, nil
+	}
+
+	_, err = os.Stat(hookDefaultFilePath)
+	if err != nil {
+		return "", err
+	}
+	return hookDefaultFilePath, nil
+}
+
+// getHookArgs returns the args of the NVIDIA hook inserted into the hook list
+// of the specified stage.
+func getHookArgs(path string, stage string, hookArgs string) []string {
+	if hookArgs == hookArgsStage {
+		return []string{path, stage}
+	}
+	return []string{path, hookStagePrestart}
+}
+
+// getHookEnv returns the environment of the NVIDIA hook. This consists of the
+// proxy settings of the runtime if propagate-proxy-env is set, and the entries
+// of hook-env-file, hook-env and cli-env, which are used to tune the
+// nvidia-container-cli invoked by the hook. References to ${VAR} in cli-env
+// values are expanded using the environment of the runtime. An entry of
+// cli-env takes precedence over a hook-env entry with the same name, which in
+// turn takes precedence over an entry of hook-env-file and the proxy settings.
+func getHookEnv(cfg *config) ([]string, error) {
+	env := make(map[string]string)
+	if cfg.propagateProxyEnv {
+		for _, name := range proxyEnvvars {
+			if value, ok := os.LookupEnv(name); ok {
+				env[name] = value
+			}
+		}
+	}
+	if cfg.hookEnvFile != "" {
+		fileEnv, err := readEnvFile(cfg.hookEnvFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading hook-env-file: %v", err)
+		}
+		for name, value := range fileEnv {
+			env[name] = value
+		}
+	}
+	for name, value := range cfg.hookEnv {
+		env[name] = value
+	}
+	for name, value := range cfg.cliEnv {
+		env[name] = os.ExpandEnv(value)
+	}
+	if len(env) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result []string
+	for _, name := range names {
+		result = append(result, name+"="+env[name])
+	}
+	return result, nil
+}
+
+// getHookSkipReason returns the reason for not inserting the NVIDIA hook into
+// the specified spec, or an empty string if the hook is to be inserted.
+func getHookSkipReason(spec *specs.Spec, cfg *config) string {
+	// Without any environment there is no GPU request for the hook to act on.
+	// This includes specs without a process, as produced by some flows such as
+	// checkpoint / restore.
+	if len(getProcessEnv(spec)) == 0 {
+		return "no process environment in OCI specification"
+	}
+	// The hook itself only reads NVIDIA_VISIBLE_DEVICES and handles a void
+	// value of it, so a void value of the variable configured by
+	// visible-devices-env instead is honored by not inserting the hook.
+	if name := cfg.getVisibleDevicesEnvvar(); name != visibleDevicesEnvvar {
+		if value, exists := getEnvValue(getProcessEnv(spec), name); exists && value == visibleDevicesVoid {
+			return name + " is set to void"
+		}
+	}
+	if cfg.skipPrivileged && isPrivilegedContainer(spec) {
+		return "privileged container detected and skip-privileged is set"
+	}
+	return ""
+}
+
+// getHookStages returns the hook lists that the NVIDIA hook is inserted into
+// for the specified hook-stage config. A createContainer hook is run in the
+// mount namespace of the container, so the hook binary is bind-mounted into
+// the container for it. With hookStageBoth the hook is
+// inserted into both the prestart and createRuntime lists. Since runc runs
+// both lists at the same point of the container lifecycle, runtimes honoring
+// both run the hook twice; this is only intended for the duration of a
+// migration between runtime versions and relies on repeated invocations of
+// the hook being safe.
+func getHookStages(hookStage string) []string {
+	switch hookStage {
+	case hookStageCreateRuntime:
+		return []string{hookStageCreateRuntime}
+	case hookStageCreateContainer:
+		return []string{hookStageCreateContainer}
+	case hookStageBoth:
+		return []string{hookStagePrestart, hookStageCreateRuntime}
+	default:
+		return []string{hookStagePrestart}
+	}
+}
+
+// getHookList returns the hook list of the specified spec hooks for the
+// specified stage.
+func getHookList(hooks *specs.Hooks, stage string) *[]specs.Hook {
+	switch stage {
+	case hookStageCreateRuntime:
+		return &hooks.CreateRuntime
+	case hookStageCreateContainer:
+		return &hooks.CreateContainer
+	}
+	return &hooks.Prestart
+}
+
+// checkHookCount returns an error if the specified spec contains more than max
+// hooks across all hook lists. A max of 0 disables the check.
+func checkHookCount(spec *specs.Spec, max int) error {
+	if max == 0 || spec.Hooks == nil {
+		return nil
+	}
+
+	count := len(spec.Hooks.Prestart) +
+		len(spec.Hooks.CreateRuntime) +
+		len(spec.Hooks.CreateContainer) +
+		len(spec.Hooks.StartContainer) +
+		len(spec.Hooks.Poststart) +
+		len(spec.Hooks.Poststop)
+	if count > max {
+		return fmt.Errorf("OCI specification contains %v hooks, exceeding the limit of %v set by max-hooks", count, max)
+	}
+	return nil
+}
+
+// getNVIDIAHookStages returns the hook stages of the specified spec that
+// contain the NVIDIA hook.
+func getNVIDIAHookStages(spec *specs.Spec) []string {
+	if spec.Hooks == nil {
+		return nil
+	}
+
+	var stages []string
+	for _, stage := range []string{hookStagePrestart, hookStageCreateRuntime, hookStageCreateContainer} {
+		if containsNVIDIAHook(*getHookList(spec.Hooks, stage)) {
+			stages = append(stages, stage)
+		}
+	}
+	return stages
+}
+
+// getSupportedHookStages returns the hook lists that the NVIDIA hook is inserted
+// into for the specified spec. Stages that the version of the spec predates
+// are replaced with the prestart stage, or rejected according to
+// hook-stage-fallback. Specs with a missing or invalid version are assumed to
+// support all stages.
+func getSupportedHookStages(spec *specs.Spec, cfg *config) ([]string, error) {
+	stages := getHookStages(cfg.hookStage)
+
+	version, err := getOCIVersion(spec)
+	if err != nil || version.compare(createHooksOCIVersion) >= 0 {
+		return stages, nil
+	}
+
+	var supported []string
+	for _, stage := range stages {
+		if stage == hookStagePrestart {
+			supported = append(supported, stage)
+			continue
+		}
+		if cfg.hookStageFallback == hookStageFallbackError {
+			return nil, fmt.Errorf("OCI specification version %v does not support %v hooks: hook-stage %q requires version %v", spec.Version, stage, cfg.hookStage, createHooksOCIVersion)
+		}
+		logger.Warnf("OCI specification version %v does not support %v hooks, inserting the NVIDIA hook as a %v hook instead", spec.Version, stage, hookStagePrestart)
+		if !containsString(supported, hookStagePrestart) {
+			supported = append(supported, hookStagePrestart)
+		}
+	}
+	return supported, nil
+}
+
+// getOCIVersion returns the version of the specified spec without its
+// pre-release and build suffixes, e.g. 1.0.2 for 1.0.2-dev.
+func getOCIVersion(spec *specs.Spec) (runtimeVersion, error) {
+	version := strings.SplitN(strings.SplitN(spec.Version, "+", 2)[0], "-", 2)[0]
+	return parseRuntimeVersion(version)
+}
+
+// getOtherNVIDIAHookStage returns a hook stage other than the specified
+// stages that contains the NVIDIA hook, or an empty string if there is none.
+// The hook only needs to run once, so a hook inserted into another stage, e.g.
+// by a previous invocation with a different hook-stage, is not duplicated.
+func getOtherNVIDIAHookStage(spec *specs.Spec, stages []string) string {
+	for _, stage := range getNVIDIAHookStages(spec) {
+		if !containsString(stages, stage) {
+			return stage
+		}
+	}
+	return ""
+}
+
+// containsNVIDIAHook checks whether the specified hook list contains the NVIDIA
+// Container Runtime hook.
+func containsNVIDIAHook(hooks []specs.Hook) bool {
+	for _, hook := range hooks {
+		if isNVIDIAHook(hook) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNVIDIAHook checks whether the specified hook invokes the NVIDIA Container
+// Runtime hook, either directly or through the hook-workdir wrapper.
+func isNVIDIAHook(hook specs.Hook) bool {
+	if strings.Contains(hook.Path, hookBinary) {
+		return true
+	}
+	for _, arg := range hook.Args {
+		if strings.Contains(arg, hookBinary) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrapHookWorkdir returns a hook that changes to the specified directory before
+// executing the specified hook.
+func wrapHookWorkdir(hook specs.Hook, dir string) specs.Hook {
+	args := []string{"sh", "-c", hookWorkdirScript, "sh", dir, hook.Path}
+	if len(hook.Args) > 1 {
+		args = append(args, hook.Args[1:]...)
+	}
+
+	return specs.Hook{
+		Path:    hookWorkdirShell,
+		Args:    args,
+		Env:     hook.Env,
+		Timeout: hook.Timeout,
+	}
+}
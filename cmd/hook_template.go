@@ -0,0 +1,94 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// The fields that hook-arg-templates entries may refer to.
+const (
+	hookArgFieldContainerID = "ContainerID"
+	hookArgFieldRootFS      = "RootFS"
+	hookArgFieldBundle      = "Bundle"
+)
+
+// hookArgPlaceholderPattern matches a placeholder such as {{.ContainerID}}.
+var hookArgPlaceholderPattern = regexp.MustCompile(`\{\{\s*\.([A-Za-z]+)\s*\}\}`)
+
+var hookArgFields = map[string]bool{
+	hookArgFieldContainerID: true,
+	hookArgFieldRootFS:      true,
+	hookArgFieldBundle:      true,
+}
+
+// validateHookArgTemplate checks that the specified hook-arg-templates entry
+// only contains placeholders for known fields. Other template actions are not
+// supported, so that no spec content is evaluated.
+func validateHookArgTemplate(template string) error {
+	for _, match := range hookArgPlaceholderPattern.FindAllStringSubmatch(template, -1) {
+		if !hookArgFields[match[1]] {
+			return fmt.Errorf("unknown placeholder %v: expected {{.%v}}, {{.%v}} or {{.%v}}", match[0], hookArgFieldContainerID, hookArgFieldRootFS, hookArgFieldBundle)
+		}
+	}
+
+	rest := hookArgPlaceholderPattern.ReplaceAllString(template, "")
+	if strings.Contains(rest, "{{") || strings.Contains(rest, "}}") {
+		return fmt.Errorf("invalid placeholder in %q: expected {{.FIELD}}", template)
+	}
+	return nil
+}
+
+// expandHookArgTemplates returns the specified hook-arg-templates entries with
+// their placeholders replaced by the values of the container of the specified
+// spec. Values that are unknown, such as the container id when modifying a
+// bundle outside of create, expand to an empty string.
+func expandHookArgTemplates(templates []string, spec *specs.Spec, cfg *config) ([]string, error) {
+	values := map[string]string{
+		hookArgFieldContainerID: cfg.containerID,
+	}
+	if cfg.bundleDir != "" {
+		// The hook does not run in the working directory of the runtime, so
+		// a relative bundle directory is made absolute.
+		bundleDir, err := filepath.Abs(cfg.bundleDir)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving bundle directory %v: %v", cfg.bundleDir, err)
+		}
+		values[hookArgFieldBundle] = bundleDir
+		if rootfs, err := resolveRootfs(spec, bundleDir); err == nil {
+			values[hookArgFieldRootFS] = rootfs
+		}
+	}
+
+	var args []string
+	for _, template := range templates {
+		err := validateHookArgTemplate(template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hook-arg-templates entry %q: %v", template, err)
+		}
+		arg := hookArgPlaceholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+			return values[hookArgPlaceholderPattern.FindStringSubmatch(placeholder)[1]]
+		})
+		args = append(args, arg)
+	}
+	return args, nil
+}
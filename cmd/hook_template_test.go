@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateHookArgTemplate(t *testing.T) {
+	for _, template := range []string{
+		"--debug",
+		"--container-id={{.ContainerID}}",
+		"--rootfs={{ .RootFS }}",
+		"{{.Bundle}}/{{.ContainerID}}",
+	} {
+		require.NoError(t, validateHookArgTemplate(template), template)
+	}
+
+	for _, template := range []string{
+		"--pid={{.Pid}}",
+		"--id={{.containerID}}",
+		"{{printf \"%v\" .ContainerID}}",
+		"{{.ContainerID}",
+		"}}",
+	} {
+		require.Error(t, validateHookArgTemplate(template), template)
+	}
+}
+
+func TestExpandHookArgTemplates(t *testing.T) {
+	spec := &specs.Spec{Root: &specs.Root{Path: "rootfs"}}
+	cfg := (&config{}).forBundle("/run/bundle").forContainer("ctr")
+
+	args, err := expandHookArgTemplates([]string{"--container-id={{.ContainerID}}", "--rootfs={{.RootFS}}", "--bundle={{ .Bundle }}", "--debug"}, spec, cfg)
+	require.NoError(t, err)
+	require.Equal(t, []string{"--container-id=ctr", "--rootfs=/run/bundle/rootfs", "--bundle=/run/bundle", "--debug"}, args)
+
+	// Unknown values expand to an empty string.
+	args, err = expandHookArgTemplates([]string{"--container-id={{.ContainerID}}", "--rootfs={{.RootFS}}"}, &specs.Spec{}, &config{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"--container-id=", "--rootfs="}, args)
+
+	_, err = expandHookArgTemplates([]string{"--pid={{.Pid}}"}, spec, cfg)
+	require.Error(t, err)
+}
+
+func TestHookArgTemplates(t *testing.T) {
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nhook-arg-templates = [\"--container-id={{.ContainerID}}\", \"--rootfs={{.RootFS}}\", \"--bundle={{.Bundle}}\"]\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	require.NoError(t, generateNewRuntimeSpec())
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+	require.NoError(t, cmdCreate.Run())
+
+	bundle, err := filepath.Abs(bundlePath)
+	require.NoError(t, err)
+
+	spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks))
+	hook := spec.Hooks.Prestart[0]
+	require.Equal(t, []string{hook.Path, "--container-id=testcontainer", "--rootfs=" + filepath.Join(bundle, "rootfs"), "--bundle=" + bundle, hookStagePrestart}, hook.Args)
+
+	invalidDir, err := writeTestConfig("[nvidia-container-runtime]\nhook-arg-templates = [\"--pid={{.Pid}}\"]\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(invalidDir)
+
+	require.NoError(t, generateNewRuntimeSpec())
+	cmdCreate = exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+invalidDir)
+	require.Error(t, cmdCreate.Run(), "an unknown placeholder should be rejected")
+
+	spec, err = getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Nil(t, spec.Hooks)
+}
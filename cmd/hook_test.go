@@ -0,0 +1,728 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddNVIDIAHookWorkdir(t *testing.T) {
+	spec := &specs.Spec{}
+	cfg := &config{hookWorkdir: "/var/lib/nvidia"}
+
+	require.NoError(t, addNVIDIAHook(spec, cfg))
+	require.Len(t, spec.Hooks.Prestart, 1)
+
+	hook := spec.Hooks.Prestart[0]
+	require.Equal(t, hookWorkdirShell, hook.Path)
+	require.Equal(t, []string{"sh", "-c", hookWorkdirScript, "sh", "/var/lib/nvidia"}, hook.Args[:5])
+	require.Contains(t, hook.Args[5], hookBinary)
+	require.Equal(t, "prestart", hook.Args[6])
+
+	// The wrapped hook is detected as an existing NVIDIA hook.
+	require.NoError(t, addNVIDIAHook(spec, cfg))
+	require.Len(t, spec.Hooks.Prestart, 1)
+}
+
+func TestIsNVIDIAHook(t *testing.T) {
+	testCases := []struct {
+		hook     specs.Hook
+		expected bool
+	}{
+		{
+			hook:     specs.Hook{Path: "/usr/bin/nvidia-container-runtime-hook", Args: []string{"/usr/bin/nvidia-container-runtime-hook", "prestart"}},
+			expected: true,
+		},
+		{
+			hook:     specs.Hook{Path: "/bin/sh", Args: []string{"sh", "-c", hookWorkdirScript, "sh", "/", "/usr/bin/nvidia-container-runtime-hook", "prestart"}},
+			expected: true,
+		},
+		{
+			hook:     specs.Hook{Path: "/usr/bin/other-hook", Args: []string{"/usr/bin/other-hook"}},
+			expected: false,
+		},
+	}
+
+	for i, tc := range testCases {
+		require.Equalf(t, tc.expected, isNVIDIAHook(tc.hook), "%d: %v", i, tc)
+	}
+}
+
+func TestAddNVIDIAHookStages(t *testing.T) {
+	testCases := []struct {
+		hookStage             string
+		expectedPrestart      int
+		expectedCreateRuntime int
+	}{
+		{
+			hookStage:             "",
+			expectedPrestart:      1,
+			expectedCreateRuntime: 0,
+		},
+		{
+			hookStage:             hookStagePrestart,
+			expectedPrestart:      1,
+			expectedCreateRuntime: 0,
+		},
+		{
+			hookStage:             hookStageCreateRuntime,
+			expectedPrestart:      0,
+			expectedCreateRuntime: 1,
+		},
+		{
+			hookStage:             hookStageBoth,
+			expectedPrestart:      1,
+			expectedCreateRuntime: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{}
+		cfg := &config{hookStage: tc.hookStage}
+
+		// Repeated insertion must not add further hooks.
+		for i := 0; i < 3; i++ {
+			require.NoError(t, addNVIDIAHook(spec, cfg), tc.hookStage)
+		}
+		require.Len(t, spec.Hooks.Prestart, tc.expectedPrestart, tc.hookStage)
+		require.Len(t, spec.Hooks.CreateRuntime, tc.expectedCreateRuntime, tc.hookStage)
+	}
+}
+
+func TestAddNVIDIAHookExistingInOtherStage(t *testing.T) {
+	existing := specs.Hook{Path: "/usr/bin/" + hookBinary, Args: []string{hookBinary, "prestart"}}
+
+	testCases := []struct {
+		description           string
+		hookStage             string
+		hooks                 specs.Hooks
+		expectedPrestart      int
+		expectedCreateRuntime int
+	}{
+		{
+			description:           "nil prestart with NVIDIA createRuntime hook",
+			hookStage:             hookStagePrestart,
+			hooks:                 specs.Hooks{CreateRuntime: []specs.Hook{existing}},
+			expectedPrestart:      0,
+			expectedCreateRuntime: 1,
+		},
+		{
+			description:           "nil createRuntime with NVIDIA prestart hook",
+			hookStage:             hookStageCreateRuntime,
+			hooks:                 specs.Hooks{Prestart: []specs.Hook{existing}},
+			expectedPrestart:      1,
+			expectedCreateRuntime: 0,
+		},
+		{
+			description:           "nil prestart with other createRuntime hook",
+			hookStage:             hookStagePrestart,
+			hooks:                 specs.Hooks{CreateRuntime: []specs.Hook{{Path: "/bin/true"}}},
+			expectedPrestart:      1,
+			expectedCreateRuntime: 1,
+		},
+		{
+			description:           "both stages with NVIDIA createRuntime hook",
+			hookStage:             hookStageBoth,
+			hooks:                 specs.Hooks{CreateRuntime: []specs.Hook{existing}},
+			expectedPrestart:      1,
+			expectedCreateRuntime: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		hooks := tc.hooks
+		spec := &specs.Spec{Hooks: &hooks}
+		cfg := &config{hookStage: tc.hookStage}
+
+		for i := 0; i < 2; i++ {
+			require.NoError(t, addNVIDIAHook(spec, cfg), tc.description)
+		}
+		require.Len(t, spec.Hooks.Prestart, tc.expectedPrestart, tc.description)
+		require.Len(t, spec.Hooks.CreateRuntime, tc.expectedCreateRuntime, tc.description)
+	}
+
+	// A createContainer hook is not duplicated into the prestart hooks.
+	spec := &specs.Spec{Hooks: &specs.Hooks{CreateContainer: []specs.Hook{{Path: hookContainerPath, Args: []string{hookContainerPath}}}}}
+	require.NoError(t, addNVIDIAHook(spec, &config{}))
+	require.Nil(t, spec.Hooks.Prestart)
+	require.Equal(t, "", getOtherNVIDIAHookStage(spec, []string{hookStageCreateContainer}))
+	require.Equal(t, "", getOtherNVIDIAHookStage(&specs.Spec{}, []string{hookStagePrestart}))
+}
+
+func TestCreateExistingCreateRuntimeHook(t *testing.T) {
+	require.NoError(t, generateNewRuntimeSpec())
+
+	configFilePath := filepath.Join(bundlePath, specFile)
+	spec, err := getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	spec.Hooks = &specs.Hooks{CreateRuntime: []specs.Hook{{Path: "/usr/bin/" + hookBinary, Args: []string{hookBinary, "prestart"}}}}
+	require.NoError(t, writeRuntimeSpec(configFilePath, &spec))
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	require.NoError(t, cmdCreate.Run())
+
+	spec, err = getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	require.Nil(t, spec.Hooks.Prestart, "the NVIDIA hook should not be duplicated into the prestart hooks")
+	require.Len(t, spec.Hooks.CreateRuntime, 1)
+}
+
+func TestGetSupportedHookStages(t *testing.T) {
+	testCases := []struct {
+		description    string
+		version        string
+		hookStage      string
+		fallback       string
+		isError        bool
+		expectedStages []string
+	}{
+		{
+			description:    "modern spec",
+			version:        "1.0.2",
+			hookStage:      hookStageCreateContainer,
+			fallback:       hookStageFallbackError,
+			expectedStages: []string{hookStageCreateContainer},
+		},
+		{
+			description:    "pre-release of the first supporting version",
+			version:        "1.0.2-dev",
+			hookStage:      hookStageCreateRuntime,
+			fallback:       hookStageFallbackError,
+			expectedStages: []string{hookStageCreateRuntime},
+		},
+		{
+			description:    "old spec with prestart",
+			version:        "1.0.1",
+			hookStage:      hookStagePrestart,
+			fallback:       hookStageFallbackError,
+			expectedStages: []string{hookStagePrestart},
+		},
+		{
+			description:    "old spec falling back",
+			version:        "1.0.1-dev",
+			hookStage:      hookStageCreateContainer,
+			fallback:       hookStageFallbackPrestart,
+			expectedStages: []string{hookStagePrestart},
+		},
+		{
+			description:    "old spec falling back from both",
+			version:        "1.0.0",
+			hookStage:      hookStageBoth,
+			fallback:       hookStageFallbackPrestart,
+			expectedStages: []string{hookStagePrestart},
+		},
+		{
+			description: "old spec in strict mode",
+			version:     "1.0.1",
+			hookStage:   hookStageCreateRuntime,
+			fallback:    hookStageFallbackError,
+			isError:     true,
+		},
+		{
+			description:    "missing version",
+			version:        "",
+			hookStage:      hookStageCreateRuntime,
+			fallback:       hookStageFallbackError,
+			expectedStages: []string{hookStageCreateRuntime},
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{Version: tc.version}
+		stages, err := getSupportedHookStages(spec, &config{hookStage: tc.hookStage, hookStageFallback: tc.fallback})
+		if tc.isError {
+			require.Error(t, err, tc.description)
+			continue
+		}
+		require.NoError(t, err, tc.description)
+		require.Equal(t, tc.expectedStages, stages, tc.description)
+	}
+}
+
+func TestHookStageFallback(t *testing.T) {
+	testCases := []struct {
+		description string
+		config      string
+		isError     bool
+	}{
+		{
+			description: "default fallback",
+			config:      "hook-stage = \"createContainer\"\n",
+		},
+		{
+			description: "strict",
+			config:      "hook-stage = \"createContainer\"\nhook-stage-fallback = \"error\"\n",
+			isError:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		configDir, err := writeTestConfig("[nvidia-container-runtime]\n" + tc.config)
+		require.NoError(t, err)
+		defer os.RemoveAll(configDir)
+
+		require.NoError(t, generateNewRuntimeSpec())
+		configFilePath := filepath.Join(bundlePath, specFile)
+		spec, err := getRuntimeSpec(configFilePath)
+		require.NoError(t, err)
+		spec.Version = "1.0.1"
+		require.NoError(t, writeRuntimeSpec(configFilePath, &spec))
+
+		var stderr bytes.Buffer
+		cmdCreate := exec.Command(nvidiaRuntime, "--log-to-stderr", "create", "--bundle", bundlePath, "testcontainer")
+		cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+		cmdCreate.Stderr = &stderr
+		err = cmdCreate.Run()
+
+		spec, specErr := getRuntimeSpec(configFilePath)
+		require.NoError(t, specErr)
+		if tc.isError {
+			require.Error(t, err, tc.description)
+			require.Contains(t, stderr.String(), "does not support createContainer hooks")
+			require.Nil(t, spec.Hooks, tc.description)
+			continue
+		}
+		require.NoError(t, err, tc.description)
+		require.Contains(t, stderr.String(), "inserting the NVIDIA hook as a prestart hook instead")
+		require.Equal(t, 1, nvidiaHookCount(spec.Hooks), tc.description)
+		require.Empty(t, spec.Hooks.CreateContainer, tc.description)
+		require.False(t, containsMount(spec.Mounts, hookContainerPath), "the hook should not be mounted into the container")
+	}
+}
+
+func TestAddNVIDIAHookCreateContainer(t *testing.T) {
+	path, err := getHookPath()
+	require.NoError(t, err)
+
+	spec := &specs.Spec{}
+	cfg := &config{hookStage: hookStageCreateContainer, hookArgs: hookArgsStage}
+
+	// Repeated insertion must not add further hooks or mounts.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, addNVIDIAHook(spec, cfg))
+	}
+	require.Empty(t, spec.Hooks.Prestart)
+	require.Len(t, spec.Hooks.CreateContainer, 1)
+
+	hook := spec.Hooks.CreateContainer[0]
+	require.Equal(t, hookContainerPath, hook.Path)
+	require.Equal(t, []string{hookContainerPath, hookStageCreateContainer}, hook.Args)
+	require.Equal(t, []specs.Mount{{Destination: hookContainerPath, Type: "bind", Source: path, Options: []string{"bind", "ro"}}}, spec.Mounts)
+}
+
+func TestGetConfigHookStageCreateContainer(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nhook-stage = \"createContainer\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Equal(t, hookStageCreateContainer, cfg.hookStage)
+
+	testDir, err = writeTestConfig("[nvidia-container-runtime]\nhook-stage = \"createContainer\"\nhook-workdir = \"/var/lib\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	_, err = getConfig()
+	require.Error(t, err)
+}
+
+func TestRelativeHookPath(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nhook-path = \"hooks/nvidia-hook\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	_, err = getConfig()
+	require.EqualError(t, err, `invalid hook-path "hooks/nvidia-hook": OCI hook paths must be absolute; set allow-relative-hook-path to resolve it against the bundle`)
+
+	testDir, err = writeTestConfig("[nvidia-container-runtime]\nhook-path = \"hooks/nvidia-hook\"\nallow-relative-hook-path = true")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	bundle, err := ioutil.TempDir("", "nvidia-container-runtime-bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(bundle)
+	spec, err := ioutil.ReadFile(unmodifiedSpecFile)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bundle, specFile), spec, 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(bundle, "hooks"), 0755))
+	_, err = writeTestScript(filepath.Join(bundle, "hooks"), "nvidia-hook", "exit 0")
+	require.NoError(t, err)
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundle, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+testDir)
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	modified, err := getRuntimeSpec(filepath.Join(bundle, specFile))
+	require.NoError(t, err)
+	require.Len(t, modified.Hooks.Prestart, 1)
+	require.Equal(t, filepath.Join(bundle, "hooks", "nvidia-hook"), modified.Hooks.Prestart[0].Path)
+
+	// A relative path is never inserted into the spec as is.
+	require.Error(t, addNVIDIAHook(&specs.Spec{}, &config{hookPath: "hooks/nvidia-hook", allowRelativeHookPath: true}))
+}
+
+func TestAddNVIDIAHookEnv(t *testing.T) {
+	os.Setenv("TEST_CLI_ENV_DIR", "/opt/nvidia")
+	defer os.Unsetenv("TEST_CLI_ENV_DIR")
+
+	spec := &specs.Spec{}
+	cfg := &config{
+		hookEnv: map[string]string{"FOO": "bar", "LD_LIBRARY_PATH": "/usr/lib"},
+		cliEnv:  map[string]string{"LD_LIBRARY_PATH": "${TEST_CLI_ENV_DIR}/lib", "NVIDIA_CTK_CONFIG": "/etc/cli.toml"},
+	}
+
+	require.NoError(t, addNVIDIAHook(spec, cfg))
+	require.Len(t, spec.Hooks.Prestart, 1)
+	require.Equal(t, []string{"FOO=bar", "LD_LIBRARY_PATH=/opt/nvidia/lib", "NVIDIA_CTK_CONFIG=/etc/cli.toml"}, spec.Hooks.Prestart[0].Env)
+
+	spec = &specs.Spec{}
+	require.NoError(t, addNVIDIAHook(spec, &config{}))
+	require.Nil(t, spec.Hooks.Prestart[0].Env)
+}
+
+func TestAddNVIDIAHookEnvFile(t *testing.T) {
+	envFile, err := ioutil.TempFile("", "hook.env")
+	require.NoError(t, err)
+	defer os.Remove(envFile.Name())
+	_, err = envFile.WriteString("# hook settings\nFOO=file\nFROM_FILE=1\n")
+	require.NoError(t, err)
+	envFile.Close()
+
+	spec := &specs.Spec{}
+	cfg := &config{
+		hookEnvFile: envFile.Name(),
+		hookEnv:     map[string]string{"FOO": "bar"},
+	}
+	require.NoError(t, addNVIDIAHook(spec, cfg))
+	require.Equal(t, []string{"FOO=bar", "FROM_FILE=1"}, spec.Hooks.Prestart[0].Env)
+
+	spec = &specs.Spec{}
+	cfg.hookEnvFile = envFile.Name() + ".missing"
+	require.Error(t, addNVIDIAHook(spec, cfg))
+}
+
+func TestAddNVIDIAHookProxyEnv(t *testing.T) {
+	for _, name := range proxyEnvvars {
+		if value, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, value)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Unsetenv(name)
+	}
+
+	spec := &specs.Spec{}
+	cfg := &config{propagateProxyEnv: true}
+	require.NoError(t, addNVIDIAHook(spec, cfg))
+	require.Nil(t, spec.Hooks.Prestart[0].Env, "unset proxy variables should not be copied")
+
+	os.Setenv("HTTPS_PROXY", "http://proxy.example.com:3128")
+	os.Setenv("NO_PROXY", "localhost")
+
+	spec = &specs.Spec{}
+	require.NoError(t, addNVIDIAHook(spec, cfg))
+	require.Equal(t, []string{"HTTPS_PROXY=http://proxy.example.com:3128", "NO_PROXY=localhost"}, spec.Hooks.Prestart[0].Env)
+
+	spec = &specs.Spec{}
+	cfg.hookEnv = map[string]string{"NO_PROXY": "*"}
+	require.NoError(t, addNVIDIAHook(spec, cfg))
+	require.Equal(t, []string{"HTTPS_PROXY=http://proxy.example.com:3128", "NO_PROXY=*"}, spec.Hooks.Prestart[0].Env)
+
+	spec = &specs.Spec{}
+	require.NoError(t, addNVIDIAHook(spec, &config{}))
+	require.Nil(t, spec.Hooks.Prestart[0].Env, "proxy variables should only be copied if enabled")
+}
+
+func TestAddNVIDIAHookAfter(t *testing.T) {
+	existing := func() []specs.Hook {
+		return []specs.Hook{
+			{Path: "/usr/local/bin/mount-hook"},
+			{Path: "/usr/local/bin/network-hook"},
+		}
+	}
+
+	testCases := []struct {
+		description string
+		hookAfter   string
+		expected    []string
+	}{
+		{
+			description: "match found",
+			hookAfter:   "mount-hook",
+			expected:    []string{"/usr/local/bin/mount-hook", hookBinary, "/usr/local/bin/network-hook"},
+		},
+		{
+			description: "match by path",
+			hookAfter:   "/usr/local/bin/network-hook",
+			expected:    []string{"/usr/local/bin/mount-hook", "/usr/local/bin/network-hook", hookBinary},
+		},
+		{
+			description: "match not found",
+			hookAfter:   "missing-hook",
+			expected:    []string{"/usr/local/bin/mount-hook", "/usr/local/bin/network-hook", hookBinary},
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{Hooks: &specs.Hooks{Prestart: existing()}}
+		cfg := &config{hookAfter: tc.hookAfter}
+
+		// Adding the hook again does not change the result.
+		for i := 0; i < 2; i++ {
+			require.NoError(t, addNVIDIAHook(spec, cfg), tc.description)
+			require.Len(t, spec.Hooks.Prestart, len(tc.expected), tc.description)
+			for j, hook := range spec.Hooks.Prestart {
+				require.Contains(t, hook.Path, tc.expected[j], tc.description)
+			}
+		}
+	}
+}
+
+func TestAddNVIDIAHookResolveRetries(t *testing.T) {
+	defer func(lookup func() (string, error)) { lookupHookPath = lookup }(lookupHookPath)
+
+	attempts := 0
+	lookupHookPath = func() (string, error) {
+		attempts++
+		if attempts == 1 {
+			return "", os.ErrNotExist
+		}
+		return hookDefaultFilePath, nil
+	}
+
+	// The hook appears after the first attempt.
+	spec := &specs.Spec{}
+	require.NoError(t, addNVIDIAHook(spec, &config{hookResolveRetries: 2, hookResolveBackoff: time.Millisecond}))
+	require.Equal(t, 2, attempts)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks))
+
+	// There are no retries by default.
+	attempts = 0
+	spec = &specs.Spec{}
+	require.Error(t, addNVIDIAHook(spec, &config{}))
+	require.Equal(t, 1, attempts)
+
+	// Resolution fails once the retries are exhausted.
+	lookupHookPath = func() (string, error) {
+		attempts++
+		return "", os.ErrNotExist
+	}
+	attempts = 0
+	require.Error(t, addNVIDIAHook(spec, &config{hookResolveRetries: 3, hookResolveBackoff: time.Millisecond}))
+	require.Equal(t, 4, attempts)
+}
+
+func TestAddNVIDIAHookOrderAnnotation(t *testing.T) {
+	existing := func() []specs.Hook {
+		return []specs.Hook{
+			{Path: "/usr/local/bin/mount-hook"},
+			{Path: "/usr/local/bin/network-hook"},
+		}
+	}
+
+	testCases := []struct {
+		description string
+		annotation  string
+		cfg         *config
+		expected    []string
+	}{
+		{
+			description: "first",
+			annotation:  "first",
+			cfg:         &config{},
+			expected:    []string{hookBinary, "/usr/local/bin/mount-hook", "/usr/local/bin/network-hook"},
+		},
+		{
+			description: "last overrides hook-position",
+			annotation:  "last",
+			cfg:         &config{hookPosition: hookPositionFirst},
+			expected:    []string{"/usr/local/bin/mount-hook", "/usr/local/bin/network-hook", hookBinary},
+		},
+		{
+			description: "after overrides hook-after",
+			annotation:  "after:mount-hook",
+			cfg:         &config{hookAfter: "network-hook"},
+			expected:    []string{"/usr/local/bin/mount-hook", hookBinary, "/usr/local/bin/network-hook"},
+		},
+		{
+			description: "hook-position without annotation",
+			cfg:         &config{hookPosition: hookPositionFirst},
+			expected:    []string{hookBinary, "/usr/local/bin/mount-hook", "/usr/local/bin/network-hook"},
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{Hooks: &specs.Hooks{Prestart: existing()}}
+		if tc.annotation != "" {
+			spec.Annotations = map[string]string{hookOrderAnnotation: tc.annotation}
+		}
+
+		require.NoError(t, addNVIDIAHook(spec, tc.cfg), tc.description)
+		require.Len(t, spec.Hooks.Prestart, len(tc.expected), tc.description)
+		for i, hook := range spec.Hooks.Prestart {
+			require.Contains(t, hook.Path, tc.expected[i], tc.description)
+		}
+	}
+
+	for _, value := range []string{"", "middle", "after:", "First"} {
+		spec := &specs.Spec{Annotations: map[string]string{hookOrderAnnotation: value}}
+		err := addNVIDIAHook(spec, &config{})
+		require.Error(t, err, value)
+		require.Contains(t, err.Error(), hookOrderAnnotation, value)
+	}
+}
+
+func TestGetConfigHookPosition(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		valid  bool
+	}{
+		{"hook-position = \"last\"", true},
+		{"hook-position = \"first\"", true},
+		{"hook-position = \"after:mount-hook\"", true},
+		{"hook-position = \"middle\"", false},
+	} {
+		testDir, err := writeTestConfig("[nvidia-container-runtime]\n" + tc.config)
+		require.NoError(t, err)
+		defer os.RemoveAll(testDir)
+		os.Setenv(configOverride, testDir)
+
+		_, err = getConfig()
+		if tc.valid {
+			require.NoError(t, err, tc.config)
+		} else {
+			require.Error(t, err, tc.config)
+		}
+	}
+}
+
+func TestCheckHookCount(t *testing.T) {
+	spec := &specs.Spec{
+		Hooks: &specs.Hooks{
+			Prestart:  make([]specs.Hook, 2),
+			Poststart: make([]specs.Hook, 1),
+			Poststop:  make([]specs.Hook, 1),
+		},
+	}
+
+	require.NoError(t, checkHookCount(&specs.Spec{}, 1))
+	require.NoError(t, checkHookCount(spec, 4))
+	require.NoError(t, checkHookCount(spec, 0))
+	require.Error(t, checkHookCount(spec, 3))
+}
+
+func TestAddNVIDIAHookArgs(t *testing.T) {
+	testCases := []struct {
+		hookArgs              string
+		expectedPrestart      string
+		expectedCreateRuntime string
+	}{
+		{
+			hookArgs:              "",
+			expectedPrestart:      "prestart",
+			expectedCreateRuntime: "prestart",
+		},
+		{
+			hookArgs:              hookArgsPrestart,
+			expectedPrestart:      "prestart",
+			expectedCreateRuntime: "prestart",
+		},
+		{
+			hookArgs:              hookArgsStage,
+			expectedPrestart:      "prestart",
+			expectedCreateRuntime: "createRuntime",
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{}
+		cfg := &config{hookStage: hookStageBoth, hookArgs: tc.hookArgs}
+
+		require.NoError(t, addNVIDIAHook(spec, cfg), tc.hookArgs)
+		require.Len(t, spec.Hooks.Prestart, 1, tc.hookArgs)
+		require.Len(t, spec.Hooks.CreateRuntime, 1, tc.hookArgs)
+
+		path := spec.Hooks.Prestart[0].Path
+		require.Equal(t, []string{path, tc.expectedPrestart}, spec.Hooks.Prestart[0].Args, tc.hookArgs)
+		require.Equal(t, []string{path, tc.expectedCreateRuntime}, spec.Hooks.CreateRuntime[0].Args, tc.hookArgs)
+	}
+}
+
+func TestPrestartDeprecationWarning(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	runc, err := writeTestScript(testDir, "runc", `echo "runc version 1.1.4"`)
+	require.NoError(t, err)
+
+	defer func(l *Logger) { logger = l }(logger)
+
+	testCases := []struct {
+		description string
+		level       logrus.Level
+		hookStage   string
+		version     string
+		expected    int
+	}{
+		{
+			description: "prestart on runc supporting createRuntime",
+			level:       logrus.DebugLevel,
+			hookStage:   hookStagePrestart,
+			version:     "1.1.4",
+			expected:    1,
+		},
+		{
+			description: "below the debug level",
+			level:       logrus.InfoLevel,
+			hookStage:   hookStagePrestart,
+			version:     "1.1.4",
+			expected:    0,
+		},
+		{
+			description: "runc without createRuntime support",
+			level:       logrus.DebugLevel,
+			hookStage:   hookStagePrestart,
+			version:     "0.1.1",
+			expected:    0,
+		},
+		{
+			description: "createRuntime stage",
+			level:       logrus.DebugLevel,
+			hookStage:   hookStageCreateRuntime,
+			version:     "1.1.4",
+			expected:    0,
+		},
+	}
+
+	for _, tc := range testCases {
+		_, err := writeTestScript(testDir, "runc", `echo "runc version `+tc.version+`"`)
+		require.NoError(t, err, tc.description)
+
+		var buf bytes.Buffer
+		logger = NewLogger()
+		logger.sinks = append(logger.sinks, &buf)
+		logger.SetLogLevel(tc.level)
+		prestartDeprecationOnce = sync.Once{}
+
+		cfg := &config{runtime: runc, hookStage: tc.hookStage}
+		for i := 0; i < 2; i++ {
+			require.NoError(t, addNVIDIAHook(&specs.Spec{}, cfg), tc.description)
+		}
+		require.Equal(t, tc.expected, strings.Count(buf.String(), "hook-stage = \"createRuntime\""), tc.description)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// criParents maps the name of the parent process of the runtime to the
+// container engine it belongs to. Engines usually invoke the runtime through a
+// shim or monitor process.
+var criParents = map[string]string{
+	"containerd":      "containerd",
+	"containerd-shim": "containerd",
+	"dockerd":         "docker",
+	"conmon":          "cri-o or podman",
+	"crio":            "cri-o",
+	"podman":          "podman",
+}
+
+// runInfo implements the info command, which prints the paths and versions
+// resolved by the runtime along with a guess of the calling container engine,
+// followed by the source of each config key that is not set to its default.
+// It does not require a bundle.
+func runInfo(cfg *config) error {
+	return writeInfo(os.Stdout, cfg)
+}
+
+func writeInfo(w io.Writer, cfg *config) error {
+	requireConfig, err := isConfigRequired()
+	if err != nil {
+		return err
+	}
+	configFilePath, content, err := readConfigFile(requireConfig)
+	if err != nil {
+		return err
+	}
+	if content == nil {
+		configFilePath = "none, using default config"
+	}
+	_, sources, err := getConfigWithSources()
+	if err != nil {
+		return err
+	}
+
+	runtimePath, runtimeVersion := "not found", "unknown"
+	if argv, err := getRuncCommand(cfg.runtime, nil); err == nil {
+		runtimePath = argv[0]
+		runtimeVersion = getVersionLine(runtimePath)
+	}
+
+	hookPath, hookVersion := "not found", "unknown"
+	if path, err := getHookPath(); err == nil {
+		hookPath = path
+		hookVersion = getVersionLine(hookPath)
+	}
+
+	for _, line := range [][2]string{
+		{"Config file", configFilePath},
+		{"Runtime path", runtimePath},
+		{"Runtime version", runtimeVersion},
+		{"Hook path", hookPath},
+		{"Hook version", hookVersion},
+		{"Container engine", detectCRI(getParentName(), os.Environ())},
+	} {
+		_, err := fmt.Fprintf(w, "%v: %v\n", line[0], line[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, configKey := range configKeys {
+		source := sources[configKey.name]
+		if source == configSourceDefault {
+			continue
+		}
+		_, err := fmt.Fprintf(w, "Config key %v: %v\n", configKey.name, source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getVersionLine returns the first line of the --version output of the
+// specified executable, or "unknown" if it cannot be determined.
+func getVersionLine(path string) string {
+	output, err := getVersionOutput(path)
+	if err != nil {
+		logger.Printf("%v", err)
+		return "unknown"
+	}
+	line := strings.TrimSpace(strings.SplitN(strings.TrimSpace(output), "\n", 2)[0])
+	if line == "" {
+		return "unknown"
+	}
+	return line
+}
+
+// getParentName returns the name of the parent process, or an empty string if
+// it cannot be determined.
+func getParentName() string {
+	comm, err := ioutil.ReadFile("/proc/" + strconv.Itoa(os.Getppid()) + "/comm")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// detectCRI makes a best-effort guess of the container engine invoking the
+// runtime from the name of the parent process and the environment. Since the
+// kernel truncates process names to 15 characters, all containerd shims such
+// as containerd-shim-runc-v2 are reported as containerd-shim.
+func detectCRI(parent string, env []string) string {
+	if engine, exists := criParents[parent]; exists {
+		return engine
+	}
+
+	// Shims started by containerd receive the addresses of its API.
+	if _, exists := getEnvValue(env, "TTRPC_ADDRESS"); exists {
+		return "containerd"
+	}
+
+	if parent == "" {
+		return "unknown"
+	}
+	return "unknown (parent process " + parent + ")"
+}
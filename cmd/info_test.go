@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectCRI(t *testing.T) {
+	testCases := []struct {
+		parent   string
+		env      []string
+		expected string
+	}{
+		{parent: "containerd-shim", expected: "containerd"},
+		{parent: "dockerd", expected: "docker"},
+		{parent: "conmon", expected: "cri-o or podman"},
+		{parent: "bash", env: []string{"TTRPC_ADDRESS=/run/containerd/containerd.sock.ttrpc"}, expected: "containerd"},
+		{parent: "bash", expected: "unknown (parent process bash)"},
+		{expected: "unknown"},
+	}
+
+	for _, tc := range testCases {
+		require.Equal(t, tc.expected, detectCRI(tc.parent, tc.env), tc.parent)
+	}
+}
+
+func TestWriteInfo(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	runtime, err := writeTestScript(testDir, "mock-runc", `echo "runc version 1.1.4"
+echo "spec: 1.0.2-dev"`)
+	require.NoError(t, err)
+
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nhook-stage = \"prestart\"\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+	os.Setenv(configOverride, configDir)
+
+	var output bytes.Buffer
+	require.NoError(t, writeInfo(&output, &config{runtime: runtime}))
+	require.Contains(t, output.String(), "Config file: "+filepath.Join(configDir, configFilePath)+"\n")
+	require.Contains(t, output.String(), "Runtime path: "+runtime+"\n")
+	require.Contains(t, output.String(), "Runtime version: runc version 1.1.4\n")
+	require.Contains(t, output.String(), "Hook path: /usr/bin/nvidia-container-runtime-hook\n")
+	require.Contains(t, output.String(), "Container engine: ")
+	require.Contains(t, output.String(), "Config key hook-stage: file:"+filepath.Join(configDir, configFilePath)+"\n")
+	require.NotContains(t, output.String(), "Config key runtime:")
+
+	output.Reset()
+	require.NoError(t, writeInfo(&output, &config{runtime: filepath.Join(testDir, "missing")}))
+	require.Contains(t, output.String(), "Runtime path: not found\nRuntime version: unknown\n")
+}
+
+func TestGetHookPath(t *testing.T) {
+	path, err := getHookPath()
+	require.NoError(t, err)
+	require.Equal(t, hookBinary, filepath.Base(path))
+}
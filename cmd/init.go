@@ -0,0 +1,90 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// initDestination is the path at which the init configured by inject-init is
+// bind-mounted into containers. Like the rest of /dev it is not part of the
+// container image.
+const initDestination = "/dev/init"
+
+// initBinaries are the executable names of init processes that reap orphaned
+// processes. An entrypoint with one of these names is not wrapped in the
+// configured init.
+var initBinaries = map[string]bool{
+	"catatonit":   true,
+	"docker-init": true,
+	"dumb-init":   true,
+	"init":        true,
+	"tini":        true,
+	"tini-static": true,
+}
+
+// checkProcessArgs returns an error if the process of the specified spec has
+// no args to be rewritten by the specified feature. A spec may omit the args,
+// e.g. if the entrypoint is resolved later, in which case features rewriting
+// them are skipped unless require-process-args is set.
+func checkProcessArgs(spec *specs.Spec, feature string) error {
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		return fmt.Errorf("no process args in OCI specification for %v to rewrite, and require-process-args is set", feature)
+	}
+	return nil
+}
+
+// injectInit runs the process of the specified spec under the init at the
+// specified path, which is bind-mounted into the container. Processes that
+// already run under an init, including the injected one, are left unchanged.
+func injectInit(spec *specs.Spec, path string) error {
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		logger.Printf("No process args in OCI specification, not injecting init")
+		return nil
+	}
+
+	entrypoint := spec.Process.Args[0]
+	if entrypoint == initDestination || initBinaries[filepath.Base(entrypoint)] || filepath.Base(entrypoint) == filepath.Base(path) {
+		logger.Printf("Not injecting init: entrypoint %v is an init", entrypoint)
+		return nil
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("error injecting init: %v", err)
+	}
+
+	logger.Printf("Injecting init %v", path)
+	spec.Process.Args = append([]string{initDestination, "--"}, spec.Process.Args...)
+
+	for _, mount := range spec.Mounts {
+		if mount.Destination == initDestination {
+			return nil
+		}
+	}
+	spec.Mounts = append(spec.Mounts, specs.Mount{
+		Destination: initDestination,
+		Type:        "bind",
+		Source:      path,
+		Options:     []string{"bind", "ro"},
+	})
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInjectInit(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	tini, err := writeTestScript(testDir, "tini", `exec "$@"`)
+	require.NoError(t, err)
+
+	spec := &specs.Spec{Process: &specs.Process{Args: []string{"/usr/bin/python3", "train.py"}}}
+	require.NoError(t, injectInit(spec, tini))
+	require.Equal(t, []string{initDestination, "--", "/usr/bin/python3", "train.py"}, spec.Process.Args)
+	require.Equal(t, []specs.Mount{{Destination: initDestination, Type: "bind", Source: tini, Options: []string{"bind", "ro"}}}, spec.Mounts)
+
+	// Injecting the init again leaves the spec unchanged.
+	require.NoError(t, injectInit(spec, tini))
+	require.Equal(t, []string{initDestination, "--", "/usr/bin/python3", "train.py"}, spec.Process.Args)
+	require.Len(t, spec.Mounts, 1)
+
+	require.Error(t, injectInit(&specs.Spec{Process: &specs.Process{Args: []string{"sh"}}}, filepath.Join(testDir, "missing")))
+}
+
+func TestInjectInitSkipsInit(t *testing.T) {
+	for _, entrypoint := range []string{"/sbin/tini", "/usr/bin/dumb-init", "/sbin/docker-init", "/sbin/init"} {
+		spec := &specs.Spec{Process: &specs.Process{Args: []string{entrypoint, "--", "sleep", "1"}}}
+		require.NoError(t, injectInit(spec, "/usr/bin/tini"), entrypoint)
+		require.Equal(t, []string{entrypoint, "--", "sleep", "1"}, spec.Process.Args, entrypoint)
+		require.Empty(t, spec.Mounts, entrypoint)
+	}
+
+	spec := &specs.Spec{Process: &specs.Process{}}
+	require.NoError(t, injectInit(spec, "/usr/bin/tini"))
+	require.Empty(t, spec.Process.Args)
+}
+
+func TestInjectInitRequireProcessArgs(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	tini, err := writeTestScript(testDir, "tini", `exec "$@"`)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		description        string
+		requireProcessArgs bool
+		env                []string
+		expectedError      bool
+	}{
+		{
+			description: "skipped by default",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=all"},
+		},
+		{
+			description:        "rejected for a GPU container",
+			requireProcessArgs: true,
+			env:                []string{"NVIDIA_VISIBLE_DEVICES=all"},
+			expectedError:      true,
+		},
+		{
+			description:        "skipped for a container not requesting GPUs",
+			requireProcessArgs: true,
+			env:                []string{"NVIDIA_VISIBLE_DEVICES=void"},
+		},
+	}
+
+	for _, tc := range testCases {
+		cfg := &config{injectInit: tini, requireProcessArgs: tc.requireProcessArgs}
+		spec := &specs.Spec{Process: &specs.Process{Env: tc.env}}
+
+		var err error
+		for _, modify := range getSpecModifiers(cfg) {
+			if err = modify(spec); err != nil {
+				break
+			}
+		}
+		if tc.expectedError {
+			require.Error(t, err, tc.description)
+			require.Contains(t, err.Error(), "require-process-args", tc.description)
+			continue
+		}
+		require.NoError(t, err, tc.description)
+		require.Empty(t, spec.Process.Args, tc.description)
+		require.Empty(t, spec.Mounts, tc.description)
+	}
+
+	// Process args are rewritten in either mode.
+	cfg := &config{injectInit: tini, requireProcessArgs: true}
+	spec := &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}, Args: []string{"sh"}}}
+	for _, modify := range getSpecModifiers(cfg) {
+		require.NoError(t, modify(spec))
+	}
+	require.Equal(t, []string{initDestination, "--", "sh"}, spec.Process.Args)
+}
+
+func TestGetConfigInjectInit(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\ninject-init = \"tini\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	_, err = getConfig()
+	require.Error(t, err)
+}
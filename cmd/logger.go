@@ -18,7 +18,13 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
 	"os"
+	"strings"
+	"syscall"
+	"unsafe"
 
 	"github.com/sirupsen/logrus"
 	"github.com/tsaikd/KDGoLib/logrusutil"
@@ -26,7 +32,42 @@ import (
 
 type Logger struct {
 	*logrus.Logger
-	logFile *os.File
+	logFile   *os.File
+	syslog    *syslog.Writer
+	sinks     []io.Writer
+	level     logrus.Level
+	formatter *colorFormatter
+}
+
+// levelColors are the ANSI color codes of entries with a level of warning or
+// higher, which are colorized when logging to a terminal.
+var levelColors = map[logrus.Level]string{
+	logrus.PanicLevel: "\x1b[31m",
+	logrus.FatalLevel: "\x1b[31m",
+	logrus.ErrorLevel: "\x1b[31m",
+	logrus.WarnLevel:  "\x1b[33m",
+}
+
+const colorReset = "\x1b[0m"
+
+// colorFormatter colorizes the entries formatted by the wrapped formatter
+// according to their level if enabled.
+type colorFormatter struct {
+	logrus.Formatter
+	enabled bool
+}
+
+func (f *colorFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data, err := f.Formatter.Format(entry)
+	if err != nil || !f.enabled {
+		return data, err
+	}
+	color, exists := levelColors[entry.Level]
+	if !exists {
+		return data, nil
+	}
+	line := strings.TrimSuffix(string(data), "\n")
+	return []byte(color + line + colorReset + "\n"), nil
 }
 
 func NewLogger() *Logger {
@@ -38,28 +79,115 @@ func NewLogger() *Logger {
 	}
 
 	logger := &Logger{
-		Logger: logrusLogger,
+		Logger:    logrusLogger,
+		level:     logrus.InfoLevel,
+		formatter: &colorFormatter{Formatter: formatter},
 	}
-	logger.SetFormatter(formatter)
+	logger.SetFormatter(logger.formatter)
 
 	return logger
 }
 
-func (l *Logger) LogToFile(filename string) error {
+// LogToFile adds the specified file as a sink, created if needed. If a mode is
+// specified, it is applied to the file.
+func (l *Logger) LogToFile(filename string, mode *os.FileMode) error {
+	// Logging is disabled by default. In this case entries are discarded
+	// before being formatted, since this is the hot path.
+	if filename == os.DevNull {
+		l.updateOutput()
+		return nil
+	}
+
 	logFile, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("error opening debug log file: %v", err)
 	}
+	err = applyFileMode(filename, mode)
+	if err != nil {
+		logFile.Close()
+		return err
+	}
 
 	l.logFile = logFile
-	l.SetOutput(logFile)
+	l.sinks = append(l.sinks, logFile)
+	l.updateOutput()
 
 	return nil
 }
 
+// LogToStderr adds stderr as a sink in addition to the debug log file.
+func (l *Logger) LogToStderr() {
+	l.sinks = append(l.sinks, os.Stderr)
+	l.updateOutput()
+}
+
+// SetLogLevel sets the level of entries written to the configured sinks.
+func (l *Logger) SetLogLevel(level logrus.Level) {
+	l.level = level
+	l.updateOutput()
+}
+
+// updateOutput directs entries to the configured sinks. If there are none,
+// entries are discarded without being formatted. Entries for syslog are
+// written by its hook.
+func (l *Logger) updateOutput() {
+	if len(l.sinks) == 0 {
+		l.SetOutput(ioutil.Discard)
+		l.SetLevel(logrus.PanicLevel)
+		if l.syslog != nil {
+			l.SetLevel(l.level)
+		}
+		return
+	}
+
+	l.SetOutput(io.MultiWriter(l.sinks...))
+	l.SetLevel(l.level)
+	l.formatter.enabled = useColor(l.sinks, os.Getenv("NO_COLOR"))
+}
+
+// useColor checks whether entries written to the specified sinks are
+// colorized. Since all sinks receive the same bytes, this requires every sink
+// to be a terminal, so that the debug log file never contains ANSI codes.
+// Colors are also disabled if NO_COLOR is set to any value.
+func useColor(sinks []io.Writer, noColor string) bool {
+	if noColor != "" || len(sinks) == 0 {
+		return false
+	}
+	for _, sink := range sinks {
+		if !isTerminal(sink) {
+			return false
+		}
+	}
+	return true
+}
+
+// isTerminal checks whether the specified writer is a terminal, i.e. a file
+// for which the terminal attributes can be queried.
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
+
 func (l *Logger) CloseFile() error {
 	if l.logFile == nil {
 		return nil
 	}
-	return l.logFile.Close()
+
+	var sinks []io.Writer
+	for _, sink := range l.sinks {
+		if sink != l.logFile {
+			sinks = append(sinks, sink)
+		}
+	}
+	l.sinks = sinks
+	l.updateOutput()
+
+	err := l.logFile.Close()
+	l.logFile = nil
+	return err
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggerNoColorForNonTerminal(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger()
+	l.sinks = append(l.sinks, &buf)
+	l.SetLogLevel(logrus.DebugLevel)
+
+	l.Errorf("error entry")
+	l.Warnf("warning entry")
+	l.Infof("info entry")
+
+	require.Contains(t, buf.String(), "error entry")
+	require.NotContains(t, buf.String(), "\x1b[")
+}
+
+func TestUseColor(t *testing.T) {
+	file, err := ioutil.TempFile("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	require.False(t, useColor(nil, ""))
+	require.False(t, useColor([]io.Writer{&bytes.Buffer{}}, ""))
+	require.False(t, useColor([]io.Writer{file}, ""))
+	require.False(t, isTerminal(file))
+	require.False(t, useColor([]io.Writer{os.Stderr}, "1"))
+
+	f := &colorFormatter{Formatter: &logrus.TextFormatter{DisableTimestamp: true}, enabled: true}
+	data, err := f.Format(&logrus.Entry{Level: logrus.ErrorLevel, Message: "failed"})
+	require.NoError(t, err)
+	require.Equal(t, levelColors[logrus.ErrorLevel]+"level=error msg=failed"+colorReset+"\n", string(data))
+}
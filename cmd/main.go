@@ -1,25 +1,44 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/syslog"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pelletier/go-toml"
+	"github.com/sirupsen/logrus"
 )
 
 const (
 	configOverride = "XDG_CONFIG_HOME"
 	configFilePath = "nvidia-container-runtime/config.toml"
 
-	hookDefaultFilePath = "/usr/bin/nvidia-container-runtime-hook"
+	// defaultSpecFile is the name of the OCI specification in a bundle,
+	// which can be overridden with --spec-file for diff and modify.
+	defaultSpecFile = "config.json"
+
+	// requireConfigEnvvar makes a missing config file fatal instead of
+	// falling back to the default config.
+	requireConfigEnvvar = "NVIDIA_CONTAINER_RUNTIME_REQUIRE_CONFIG"
+
+	// defaultSandboxAnnotationKey is the annotation used by containerd to mark
+	// the container type of a pod's containers.
+	defaultSandboxAnnotationKey = "io.kubernetes.cri.container-type"
+	sandboxContainerType        = "sandbox"
 )
 
 var (
@@ -31,34 +50,705 @@ var logger = NewLogger()
 type args struct {
 	bundleDirPath string
 	cmd           string
+	printExec     bool
+	cwd           string
+	logToStderr   bool
+	logLevel      string
+	specFile      string
+	traceFile     string
+	resultFile    string
+}
+
+// shimFlags lists the command line flags that are consumed by the
+// nvidia-container-runtime itself and are not forwarded to runc. The value
+// indicates whether the flag takes an argument.
+var shimFlags = map[string]bool{
+	"print-exec":    false,
+	"cwd":           true,
+	"log-to-stderr": false,
+	"log-level":     true,
+	"spec-file":     true,
+	"trace":         true,
+	"result-file":   true,
+}
+
+// shimCommands lists the commands implemented by the nvidia-container-runtime
+// itself. These are not forwarded to runc.
+var shimCommands = map[string]bool{
+	"canonicalize":    true,
+	"diff":            true,
+	"explain":         true,
+	"modify":          true,
+	"generate-config": true,
+	"info":            true,
+	"verify-hook":     true,
+}
+
+// defaultMutateOn lists the runtime subcommands for which the OCI
+// specification is modified by default.
+var defaultMutateOn = []string{"create"}
+
+// runtimeSubcommands lists the subcommands of runc. Other subcommands are
+// passed to the low-level runtime unchanged as well, unless
+// strict-subcommands is set.
+var runtimeSubcommands = map[string]bool{
+	"checkpoint": true,
+	"create":     true,
+	"delete":     true,
+	"events":     true,
+	"exec":       true,
+	"features":   true,
+	"help":       true,
+	"init":       true,
+	"kill":       true,
+	"list":       true,
+	"pause":      true,
+	"ps":         true,
+	"restore":    true,
+	"resume":     true,
+	"run":        true,
+	"spec":       true,
+	"start":      true,
+	"state":      true,
+	"update":     true,
+}
+
+// runtimeGlobalFlagsWithValue lists the global runc flags that take a value.
+// These are needed to determine the position of the subcommand.
+var runtimeGlobalFlagsWithValue = map[string]bool{
+	"root":       true,
+	"log":        true,
+	"log-format": true,
+	"criu":       true,
+	"rootless":   true,
+}
+
+// runtimeCommandFlagsWithValue lists the flags of the runc subcommands
+// handled by the nvidia-container-runtime that take a value.
+var runtimeCommandFlagsWithValue = map[string]bool{
+	"console-socket": true,
+	"pid-file":       true,
+	"preserve-fds":   true,
+}
+
+// isRuntimeFlagWithValue checks whether the specified runc flag takes a value,
+// given the subcommand seen so far.
+func isRuntimeFlagWithValue(subcommand string, flag string) bool {
+	if subcommand == "" {
+		return runtimeGlobalFlagsWithValue[flag]
+	}
+	return runtimeCommandFlagsWithValue[flag]
 }
 
 type config struct {
-	debugFilePath string
+	debugFilePath          string
+	logDestination         string
+	syslogFacility         syslog.Priority
+	syslogTag              string
+	otel                   bool
+	resultFile             string
+	verboseErrors          bool
+	verboseErrorsInError   bool
+	fileMode               *os.FileMode
+	allowedBundlePrefixes  []string
+	tempDir                string
+	runtime                string
+	sandboxAnnotationKey   string
+	mode                   string
+	cdiSpecDirs            []string
+	cdiDefaultKind         string
+	envAllowlist           []string
+	envDenylist            []string
+	maxEnvCount            int
+	maxEnvBytes            int
+	runtimeEnvAllowlist    []string
+	visibleDevicesEnv      string
+	forceVisibleDevices    *string
+	visibleDevicesPolicy   string
+	visibleDevicesRewrite  []string
+	annotationCapabilities map[string][]string
+
+	resolvedDevicesEnv          string
+	resolvedDevicesEnvContainer bool
+
+	hookPath              string
+	allowRelativeHookPath bool
+	hookWorkdir           string
+	hookStage             string
+	hookStageFallback     string
+	hookArgs              string
+	hookArgTemplates      []string
+	hookPosition          string
+	hookAfter             string
+	hookSHA256            string
+	hookEnv               map[string]string
+	hookEnvFile           string
+	propagateProxyEnv     bool
+	cliEnv                map[string]string
+	maxHooks              int
+
+	hookResolveRetries int
+	hookResolveBackoff time.Duration
+
+	skipPrivileged          bool
+	skipIfEntrypointMatches []string
+	stampAnnotations        bool
+	stampProvenance         bool
+
+	injectDevices         []string
+	deviceCgroupRules     string
+	deviceCgroupConflicts string
+	deviceUUIDMap         string
+
+	apparmorProfile string
+	forceApparmor   bool
+
+	injectInit         string
+	requireProcessArgs bool
+
+	externalModifier        string
+	externalModifierOrder   string
+	externalModifierTimeout time.Duration
+
+	specPatches       []specPatch
+	specSchema        string
+	warnDuplicateKeys bool
+
+	postProcessors       []string
+	postProcessorTimeout time.Duration
+
+	runAsCreateStart   bool
+	runtimeOOMScoreAdj *int
+	runtimeCredential  *syscall.Credential
+	runtimeRlimits     []runtimeRlimit
+	runtimeArgs        map[string][]string
+	modifyOnRestore    bool
+	mutateOn           []string
+	strictSubcommands  bool
+	onExisting         string
+
+	dumpSpecDir      string
+	dumpSpecMaxFiles int
+
+	cleanupOnDelete bool
+	cleanupCommand  string
+	cleanupOrder    string
+
+	minRuntimeVersion    runtimeVersion
+	maxRuntimeVersion    runtimeVersion
+	strictRuntimeVersion bool
+
+	// The bundle and the container that the config is applied to, as set by
+	// forBundle and forContainer.
+	bundleDir   string
+	containerID string
 }
 
 func getConfig() (*config, error) {
+	cfg, _, err := loadConfig(false)
+	return cfg, err
+}
+
+// getConfigWithSources loads the config, returning the source of each config
+// key along with the parsed config.
+func getConfigWithSources() (*config, configSources, error) {
+	return loadConfig(true)
+}
+
+// loadConfig loads the config. The source of each config key is only
+// determined if requested, since it is not needed to run a container.
+func loadConfig(withSources bool) (*config, configSources, error) {
 	cfg := &config{}
 
-	if XDGConfigDir := os.Getenv(configOverride); len(XDGConfigDir) != 0 {
-		configDir = XDGConfigDir
+	requireConfig, err := isConfigRequired()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	configFilePath := path.Join(configDir, configFilePath)
-
-	tomlContent, err := ioutil.ReadFile(configFilePath)
+	configFilePath, tomlContent, err := readConfigFile(requireConfig)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	toml, err := toml.Load(string(tomlContent))
+	// The remote config is nil unless a config-url is set.
+	var remote *toml.Tree
+	toml, err := toml.LoadBytes(tomlContent)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	local := toml
+	if local.Has("nvidia-container-runtime.config-url") {
+		remote, err = loadRemoteConfig(local)
+		if err != nil {
+			return nil, nil, err
+		}
+		toml = remote
 	}
 
 	cfg.debugFilePath = toml.GetDefault("nvidia-container-runtime.debug", "/dev/null").(string)
+	cfg.logDestination = toml.GetDefault("nvidia-container-runtime.log-destination", logDestinationFile).(string)
+	switch cfg.logDestination {
+	case logDestinationFile, logDestinationStderr, logDestinationSyslog:
+	default:
+		return nil, nil, fmt.Errorf("invalid log-destination %q: expected %q, %q or %q", cfg.logDestination, logDestinationFile, logDestinationStderr, logDestinationSyslog)
+	}
+	cfg.syslogFacility, err = getSyslogFacility(toml.GetDefault("nvidia-container-runtime.syslog-facility", defaultSyslogFacility).(string))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid syslog-facility: %v", err)
+	}
+	cfg.syslogTag = toml.GetDefault("nvidia-container-runtime.syslog-tag", defaultSyslogTag).(string)
+	cfg.otel = toml.GetDefault("nvidia-container-runtime.otel", false).(bool)
+	cfg.resultFile = toml.GetDefault("nvidia-container-runtime.result-file", "").(string)
+	cfg.verboseErrors = toml.GetDefault("nvidia-container-runtime.verbose-errors", false).(bool)
+	cfg.verboseErrorsInError = toml.GetDefault("nvidia-container-runtime.verbose-errors-in-error", false).(bool)
+	cfg.fileMode, err = getFileMode(toml, "nvidia-container-runtime.file-mode")
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.allowedBundlePrefixes, err = getStringSlice(toml, "nvidia-container-runtime.allowed-bundle-prefixes")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, prefix := range cfg.allowedBundlePrefixes {
+		if !filepath.IsAbs(prefix) {
+			return nil, nil, fmt.Errorf("invalid allowed-bundle-prefixes entry %q: expected an absolute path", prefix)
+		}
+	}
+	cfg.tempDir = toml.GetDefault("nvidia-container-runtime.temp-dir", "").(string)
+	if cfg.tempDir != "" && !filepath.IsAbs(cfg.tempDir) {
+		return nil, nil, fmt.Errorf("invalid temp-dir %q: expected an absolute path", cfg.tempDir)
+	}
+	cfg.runtime = toml.GetDefault("nvidia-container-runtime.runtime", "").(string)
+	cfg.sandboxAnnotationKey = toml.GetDefault("nvidia-container-runtime.sandbox-annotation-key", defaultSandboxAnnotationKey).(string)
+
+	cfg.mode = toml.GetDefault("nvidia-container-runtime.mode", modeLegacy).(string)
+	if cfg.mode != modeLegacy && cfg.mode != modeCDI {
+		return nil, nil, fmt.Errorf("invalid mode %q: expected %q or %q", cfg.mode, modeLegacy, modeCDI)
+	}
+	cfg.cdiSpecDirs = defaultCDISpecDirs
+	if toml.Has("nvidia-container-runtime.cdi-spec-dirs") {
+		cfg.cdiSpecDirs, err = getStringSlice(toml, "nvidia-container-runtime.cdi-spec-dirs")
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	cfg.cdiDefaultKind = toml.GetDefault("nvidia-container-runtime.cdi-default-kind", defaultCDIKind).(string)
+	if !strings.Contains(cfg.cdiDefaultKind, "/") {
+		return nil, nil, fmt.Errorf("invalid cdi-default-kind %q: expected VENDOR/CLASS", cfg.cdiDefaultKind)
+	}
+
+	cfg.envAllowlist, err = getStringSlice(toml, "nvidia-container-runtime.env-allowlist")
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.envDenylist, err = getStringSlice(toml, "nvidia-container-runtime.env-denylist")
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.maxEnvCount = int(toml.GetDefault("nvidia-container-runtime.max-env-count", int64(defaultMaxEnvCount)).(int64))
+	if cfg.maxEnvCount < 0 {
+		return nil, nil, fmt.Errorf("invalid max-env-count %v: expected a non-negative value", cfg.maxEnvCount)
+	}
+	cfg.maxEnvBytes = int(toml.GetDefault("nvidia-container-runtime.max-env-bytes", int64(defaultMaxEnvBytes)).(int64))
+	if cfg.maxEnvBytes < 0 {
+		return nil, nil, fmt.Errorf("invalid max-env-bytes %v: expected a non-negative value", cfg.maxEnvBytes)
+	}
+	cfg.runtimeEnvAllowlist, err = getStringSlice(toml, "nvidia-container-runtime.runtime-env-allowlist")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg.visibleDevicesEnv = toml.GetDefault("nvidia-container-runtime.visible-devices-env", visibleDevicesEnvvar).(string)
+	if cfg.visibleDevicesEnv == "" || strings.ContainsAny(cfg.visibleDevicesEnv, "= \t") {
+		return nil, nil, fmt.Errorf("invalid visible-devices-env %q: expected an environment variable name", cfg.visibleDevicesEnv)
+	}
+	if toml.Has("nvidia-container-runtime.force-visible-devices") {
+		forceVisibleDevices := toml.Get("nvidia-container-runtime.force-visible-devices").(string)
+		cfg.forceVisibleDevices = &forceVisibleDevices
+	}
+	cfg.visibleDevicesPolicy = toml.GetDefault("nvidia-container-runtime.visible-devices-policy", visibleDevicesPolicyAllow).(string)
+	switch cfg.visibleDevicesPolicy {
+	case visibleDevicesPolicyAllow, visibleDevicesPolicyDeny, visibleDevicesPolicyRewrite:
+	default:
+		return nil, nil, fmt.Errorf("invalid visible-devices-policy %q: expected %q, %q or %q", cfg.visibleDevicesPolicy, visibleDevicesPolicyAllow, visibleDevicesPolicyDeny, visibleDevicesPolicyRewrite)
+	}
+	cfg.visibleDevicesRewrite, err = getStringSlice(toml, "nvidia-container-runtime.visible-devices-rewrite")
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.visibleDevicesPolicy == visibleDevicesPolicyRewrite && len(cfg.visibleDevicesRewrite) == 0 {
+		return nil, nil, fmt.Errorf("invalid visible-devices-policy %q: visible-devices-rewrite must list the devices to rewrite %v=%v to", visibleDevicesPolicyRewrite, cfg.visibleDevicesEnv, visibleDevicesAll)
+	}
+	for _, device := range cfg.visibleDevicesRewrite {
+		if device == "" || device == visibleDevicesAll || strings.Contains(device, ",") {
+			return nil, nil, fmt.Errorf("invalid visible-devices-rewrite entry %q: expected a single device", device)
+		}
+	}
+	cfg.annotationCapabilities, err = getStringSliceMap(toml, "nvidia-container-runtime.annotation-capabilities")
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.resolvedDevicesEnv = toml.GetDefault("nvidia-container-runtime.resolved-devices-env", "").(string)
+	if strings.ContainsAny(cfg.resolvedDevicesEnv, "= \t") {
+		return nil, nil, fmt.Errorf("invalid resolved-devices-env %q: expected an environment variable name", cfg.resolvedDevicesEnv)
+	}
+	cfg.resolvedDevicesEnvContainer = toml.GetDefault("nvidia-container-runtime.resolved-devices-env-container", false).(bool)
+
+	cfg.hookPath = toml.GetDefault("nvidia-container-runtime.hook-path", "").(string)
+	cfg.allowRelativeHookPath = toml.GetDefault("nvidia-container-runtime.allow-relative-hook-path", false).(bool)
+	if cfg.hookPath != "" && !filepath.IsAbs(cfg.hookPath) && !cfg.allowRelativeHookPath {
+		return nil, nil, fmt.Errorf("invalid hook-path %q: OCI hook paths must be absolute; set allow-relative-hook-path to resolve it against the bundle", cfg.hookPath)
+	}
+	cfg.hookWorkdir = toml.GetDefault("nvidia-container-runtime.hook-workdir", "").(string)
+	cfg.hookStage = toml.GetDefault("nvidia-container-runtime.hook-stage", hookStagePrestart).(string)
+	switch cfg.hookStage {
+	case hookStagePrestart, hookStageCreateRuntime, hookStageCreateContainer, hookStageBoth:
+	default:
+		return nil, nil, fmt.Errorf("invalid hook-stage %q: expected %q, %q, %q or %q", cfg.hookStage, hookStagePrestart, hookStageCreateRuntime, hookStageCreateContainer, hookStageBoth)
+	}
+	cfg.hookStageFallback = toml.GetDefault("nvidia-container-runtime.hook-stage-fallback", hookStageFallbackPrestart).(string)
+	if cfg.hookStageFallback != hookStageFallbackPrestart && cfg.hookStageFallback != hookStageFallbackError {
+		return nil, nil, fmt.Errorf("invalid hook-stage-fallback %q: expected %q or %q", cfg.hookStageFallback, hookStageFallbackPrestart, hookStageFallbackError)
+	}
+	// The hook-workdir wrapper is run by the host shell, which is not
+	// available in the mount namespace of the container.
+	if cfg.hookStage == hookStageCreateContainer && cfg.hookWorkdir != "" {
+		return nil, nil, fmt.Errorf("hook-workdir is not supported with hook-stage %q", hookStageCreateContainer)
+	}
+	cfg.hookArgs = toml.GetDefault("nvidia-container-runtime.hook-args", hookArgsPrestart).(string)
+	if cfg.hookArgs != hookArgsPrestart && cfg.hookArgs != hookArgsStage {
+		return nil, nil, fmt.Errorf("invalid hook-args %q: expected %q or %q", cfg.hookArgs, hookArgsPrestart, hookArgsStage)
+	}
+	cfg.hookArgTemplates, err = getStringSlice(toml, "nvidia-container-runtime.hook-arg-templates")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, template := range cfg.hookArgTemplates {
+		err = validateHookArgTemplate(template)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid hook-arg-templates entry %q: %v", template, err)
+		}
+	}
+	cfg.hookPosition = toml.GetDefault("nvidia-container-runtime.hook-position", hookPositionLast).(string)
+	if err := validateHookPosition(cfg.hookPosition); err != nil {
+		return nil, nil, fmt.Errorf("invalid hook-position %q: %v", cfg.hookPosition, err)
+	}
+	cfg.hookAfter = toml.GetDefault("nvidia-container-runtime.hook-after", "").(string)
+	cfg.hookSHA256 = toml.GetDefault("nvidia-container-runtime.hook-sha256", "").(string)
+	if decoded, err := hex.DecodeString(cfg.hookSHA256); err != nil || (cfg.hookSHA256 != "" && len(decoded) != sha256.Size) {
+		return nil, nil, fmt.Errorf("invalid hook-sha256 %q: expected a hex encoded SHA-256 checksum", cfg.hookSHA256)
+	}
+	cfg.hookEnv, err = getStringMap(toml, "nvidia-container-runtime.hook-env")
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.hookEnvFile = toml.GetDefault("nvidia-container-runtime.hook-env-file", "").(string)
+	cfg.propagateProxyEnv = toml.GetDefault("nvidia-container-runtime.propagate-proxy-env", false).(bool)
+	cfg.cliEnv, err = getStringMap(toml, "nvidia-container-runtime.cli-env")
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.maxHooks = int(toml.GetDefault("nvidia-container-runtime.max-hooks", int64(defaultMaxHooks)).(int64))
+	if cfg.maxHooks < 0 {
+		return nil, nil, fmt.Errorf("invalid max-hooks %v: expected a non-negative value", cfg.maxHooks)
+	}
+	cfg.hookResolveRetries = int(toml.GetDefault("nvidia-container-runtime.hook-resolve-retries", int64(0)).(int64))
+	if cfg.hookResolveRetries < 0 {
+		return nil, nil, fmt.Errorf("invalid hook-resolve-retries %v: expected a non-negative value", cfg.hookResolveRetries)
+	}
+	cfg.hookResolveBackoff = time.Duration(toml.GetDefault("nvidia-container-runtime.hook-resolve-backoff", int64(defaultHookResolveBackoff)).(int64)) * time.Millisecond
+	if cfg.hookResolveBackoff < 0 {
+		return nil, nil, fmt.Errorf("invalid hook-resolve-backoff %v: expected a non-negative value", cfg.hookResolveBackoff)
+	}
+	cfg.skipPrivileged = toml.GetDefault("nvidia-container-runtime.skip-privileged", false).(bool)
+	cfg.skipIfEntrypointMatches, err = getStringSlice(toml, "nvidia-container-runtime.skip-if-entrypoint-matches")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, pattern := range cfg.skipIfEntrypointMatches {
+		_, err := filepath.Match(pattern, "")
+		if pattern == "" || err != nil {
+			return nil, nil, fmt.Errorf("invalid skip-if-entrypoint-matches entry %q: expected a path prefix or glob", pattern)
+		}
+	}
+	cfg.stampAnnotations = toml.GetDefault("nvidia-container-runtime.stamp-annotations", false).(bool)
+	cfg.stampProvenance = toml.GetDefault("nvidia-container-runtime.stamp-provenance", false).(bool)
+
+	cfg.injectDevices, err = getStringSlice(toml, "nvidia-container-runtime.inject-devices")
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.deviceCgroupRules = toml.GetDefault("nvidia-container-runtime.device-cgroup-rules", deviceCgroupRulesDevice).(string)
+	if cfg.deviceCgroupRules != deviceCgroupRulesDevice && cfg.deviceCgroupRules != deviceCgroupRulesWildcard {
+		return nil, nil, fmt.Errorf("invalid device-cgroup-rules %q: expected %q or %q", cfg.deviceCgroupRules, deviceCgroupRulesDevice, deviceCgroupRulesWildcard)
+	}
+	cfg.deviceCgroupConflicts = toml.GetDefault("nvidia-container-runtime.device-cgroup-conflicts", deviceCgroupConflictsReorder).(string)
+	if cfg.deviceCgroupConflicts != deviceCgroupConflictsReorder && cfg.deviceCgroupConflicts != deviceCgroupConflictsError {
+		return nil, nil, fmt.Errorf("invalid device-cgroup-conflicts %q: expected %q or %q", cfg.deviceCgroupConflicts, deviceCgroupConflictsReorder, deviceCgroupConflictsError)
+	}
+	cfg.deviceUUIDMap = toml.GetDefault("nvidia-container-runtime.device-uuid-map", "").(string)
+	if cfg.deviceUUIDMap != "" && !filepath.IsAbs(cfg.deviceUUIDMap) {
+		return nil, nil, fmt.Errorf("invalid device-uuid-map %q: expected an absolute path", cfg.deviceUUIDMap)
+	}
+
+	cfg.apparmorProfile = toml.GetDefault("nvidia-container-runtime.apparmor-profile", "").(string)
+	cfg.forceApparmor = toml.GetDefault("nvidia-container-runtime.force-apparmor", false).(bool)
+
+	cfg.injectInit = toml.GetDefault("nvidia-container-runtime.inject-init", "").(string)
+	if cfg.injectInit != "" && !filepath.IsAbs(cfg.injectInit) {
+		return nil, nil, fmt.Errorf("invalid inject-init %q: expected an absolute path", cfg.injectInit)
+	}
+	cfg.requireProcessArgs = toml.GetDefault("nvidia-container-runtime.require-process-args", false).(bool)
+
+	cfg.externalModifier = toml.GetDefault("nvidia-container-runtime.external-modifier", "").(string)
+	cfg.externalModifierOrder = toml.GetDefault("nvidia-container-runtime.external-modifier-order", externalModifierAfter).(string)
+	if cfg.externalModifierOrder != externalModifierBefore && cfg.externalModifierOrder != externalModifierAfter {
+		return nil, nil, fmt.Errorf("invalid external-modifier-order %q: expected %q or %q", cfg.externalModifierOrder, externalModifierBefore, externalModifierAfter)
+	}
+	cfg.externalModifierTimeout = time.Duration(toml.GetDefault("nvidia-container-runtime.external-modifier-timeout", int64(defaultExternalModifierTimeout)).(int64)) * time.Second
+	if cfg.externalModifierTimeout <= 0 {
+		return nil, nil, fmt.Errorf("invalid external-modifier-timeout %v: expected a positive value", cfg.externalModifierTimeout)
+	}
+
+	cfg.specPatches, err = getSpecPatches(toml, "nvidia-container-runtime.spec-patches")
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.specSchema = toml.GetDefault("nvidia-container-runtime.spec-schema", "").(string)
+	cfg.warnDuplicateKeys = toml.GetDefault("nvidia-container-runtime.warn-duplicate-keys", false).(bool)
+
+	cfg.postProcessors, err = getStringSlice(toml, "nvidia-container-runtime.post-processors")
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.postProcessorTimeout = time.Duration(toml.GetDefault("nvidia-container-runtime.post-processor-timeout", int64(defaultPostProcessorTimeout)).(int64)) * time.Second
+	if cfg.postProcessorTimeout <= 0 {
+		return nil, nil, fmt.Errorf("invalid post-processor-timeout %v: expected a positive value", cfg.postProcessorTimeout)
+	}
+
+	cfg.runAsCreateStart = toml.GetDefault("nvidia-container-runtime.run-as-create-start", false).(bool)
+	if toml.Has("nvidia-container-runtime.runtime-oom-score-adj") {
+		oomScoreAdj, ok := toml.Get("nvidia-container-runtime.runtime-oom-score-adj").(int64)
+		if !ok || oomScoreAdj < -1000 || oomScoreAdj > 1000 {
+			return nil, nil, fmt.Errorf("invalid runtime-oom-score-adj: expected an integer between -1000 and 1000")
+		}
+		runtimeOOMScoreAdj := int(oomScoreAdj)
+		cfg.runtimeOOMScoreAdj = &runtimeOOMScoreAdj
+	}
+	runtimeUser, err := getNameOrID(toml, "nvidia-container-runtime.runtime-user")
+	if err != nil {
+		return nil, nil, err
+	}
+	runtimeGroup, err := getNameOrID(toml, "nvidia-container-runtime.runtime-group")
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.runtimeCredential, err = getRuntimeCredential(runtimeUser, runtimeGroup)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.runtimeRlimits, err = getRuntimeRlimits(toml)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.runtimeArgs, err = getStringSliceMap(toml, "nvidia-container-runtime.runtime-args")
+	if err != nil {
+		return nil, nil, err
+	}
+	for subcommand, runtimeArgs := range cfg.runtimeArgs {
+		for _, arg := range runtimeArgs {
+			if !strings.HasPrefix(arg, "-") {
+				return nil, nil, fmt.Errorf("invalid runtime-args for %v: %q is not a flag", subcommand, arg)
+			}
+		}
+	}
+	cfg.modifyOnRestore = toml.GetDefault("nvidia-container-runtime.modify-on-restore", false).(bool)
+	cfg.mutateOn = defaultMutateOn
+	if toml.Has("nvidia-container-runtime.mutate-on") {
+		cfg.mutateOn, err = getStringSlice(toml, "nvidia-container-runtime.mutate-on")
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, subcommand := range cfg.mutateOn {
+		if subcommand == "" || strings.HasPrefix(subcommand, "-") || shimCommands[subcommand] {
+			return nil, nil, fmt.Errorf("invalid mutate-on entry %q: expected a runtime subcommand", subcommand)
+		}
+	}
+	cfg.strictSubcommands = toml.GetDefault("nvidia-container-runtime.strict-subcommands", false).(bool)
+	cfg.onExisting = toml.GetDefault("nvidia-container-runtime.on-existing", onExistingError).(string)
+	if cfg.onExisting != onExistingError && cfg.onExisting != onExistingIgnore && cfg.onExisting != onExistingRecreate {
+		return nil, nil, fmt.Errorf("invalid on-existing %q: expected %q, %q or %q", cfg.onExisting, onExistingError, onExistingIgnore, onExistingRecreate)
+	}
+
+	cfg.dumpSpecDir = toml.GetDefault("nvidia-container-runtime.dump-spec-dir", "").(string)
+	cfg.dumpSpecMaxFiles = int(toml.GetDefault("nvidia-container-runtime.dump-spec-max-files", int64(defaultDumpSpecMaxFiles)).(int64))
+	if cfg.dumpSpecMaxFiles < 0 {
+		return nil, nil, fmt.Errorf("invalid dump-spec-max-files %v: expected a non-negative value", cfg.dumpSpecMaxFiles)
+	}
+
+	cfg.cleanupOnDelete = toml.GetDefault("nvidia-container-runtime.cleanup-on-delete", false).(bool)
+	cfg.cleanupCommand = toml.GetDefault("nvidia-container-runtime.cleanup-command", "").(string)
+	cfg.cleanupOrder = toml.GetDefault("nvidia-container-runtime.cleanup-order", cleanupAfter).(string)
+	if cfg.cleanupOrder != cleanupBefore && cfg.cleanupOrder != cleanupAfter {
+		return nil, nil, fmt.Errorf("invalid cleanup-order %q: expected %q or %q", cfg.cleanupOrder, cleanupBefore, cleanupAfter)
+	}
+
+	cfg.minRuntimeVersion, err = getRuntimeVersion(toml, "nvidia-container-runtime.min-runtime-version")
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.maxRuntimeVersion, err = getRuntimeVersion(toml, "nvidia-container-runtime.max-runtime-version")
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.strictRuntimeVersion = toml.GetDefault("nvidia-container-runtime.strict-runtime-version", false).(bool)
+
+	if !withSources {
+		return cfg, nil, nil
+	}
+	return cfg, getConfigSources(local, configFilePath, remote), nil
+}
+
+// readConfigFile reads the first config file found in the paths returned by
+// getConfigFilePaths, returning its path along with its contents. If no config
+// file is found, the contents are empty unless a config is required.
+func readConfigFile(requireConfig bool) (string, []byte, error) {
+	var err error
+	var configFilePath string
+	var tomlContent []byte
+	for _, candidate := range getConfigFilePaths() {
+		configFilePath = candidate
+		tomlContent, err = ioutil.ReadFile(configFilePath)
+		if !os.IsNotExist(err) {
+			break
+		}
+		logger.Printf("Config file %v not found", configFilePath)
+	}
+	if os.IsNotExist(err) && !requireConfig {
+		logger.Printf("No config file found, using default config")
+		return configFilePath, nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return configFilePath, tomlContent, nil
+}
+
+// getConfigFilePaths returns the paths searched for the config file, in order.
+// The user config under $XDG_CONFIG_HOME, or $HOME/.config if that is not set,
+// takes precedence over the system config. This allows rootless users to
+// configure the runtime.
+func getConfigFilePaths() []string {
+	var userConfigDir string
+	if XDGConfigDir := os.Getenv(configOverride); len(XDGConfigDir) != 0 {
+		userConfigDir = XDGConfigDir
+	} else if home := os.Getenv("HOME"); len(home) != 0 {
+		userConfigDir = path.Join(home, ".config")
+	}
+
+	systemConfigFilePath := path.Join(configDir, configFilePath)
+	if userConfigDir == "" || path.Clean(userConfigDir) == path.Clean(configDir) {
+		return []string{systemConfigFilePath}
+	}
+	return []string{path.Join(userConfigDir, configFilePath), systemConfigFilePath}
+}
+
+// isConfigRequired checks whether a missing config file is fatal.
+func isConfigRequired() (bool, error) {
+	value := os.Getenv(requireConfigEnvvar)
+	if value == "" {
+		return false, nil
+	}
+
+	requireConfig, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %v: %v", requireConfigEnvvar, err)
+	}
+
+	return requireConfig, nil
+}
+
+// getStringSlice returns the array of strings stored at the specified key of
+// the config. A missing key results in a nil slice.
+func getStringSlice(tree *toml.Tree, key string) ([]string, error) {
+	return toStringSlice(tree.Get(key), key)
+}
+
+// toStringSlice converts the specified config value to an array of strings.
+func toStringSlice(value interface{}, key string) ([]string, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid value for %v: expected an array of strings", key)
+	}
+
+	var result []string
+	for _, v := range values {
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid value for %v: expected an array of strings", key)
+		}
+		result = append(result, str)
+	}
+
+	return result, nil
+}
+
+// getStringMap returns the table of strings stored at the specified key of the
+// config. A missing key results in a nil map.
+func getStringMap(tree *toml.Tree, key string) (map[string]string, error) {
+	value := tree.Get(key)
+	if value == nil {
+		return nil, nil
+	}
+
+	table, ok := value.(*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("invalid value for %v: expected a table of strings", key)
+	}
+
+	result := make(map[string]string)
+	for k, v := range table.ToMap() {
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid value for %v.%v: expected a string", key, k)
+		}
+		result[k] = str
+	}
+
+	return result, nil
+}
+
+// getStringSliceMap returns the table of string arrays stored at the specified
+// key of the config. A missing key results in a nil map.
+func getStringSliceMap(tree *toml.Tree, key string) (map[string][]string, error) {
+	value := tree.Get(key)
+	if value == nil {
+		return nil, nil
+	}
+
+	table, ok := value.(*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("invalid value for %v: expected a table of string arrays", key)
+	}
+
+	result := make(map[string][]string)
+	for _, k := range table.Keys() {
+		// The key is looked up as a single path element, since quoted keys
+		// may contain dots.
+		values, err := toStringSlice(table.GetPath([]string{k}), k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %v.%v: expected an array of strings", key, k)
+		}
+		result[k] = values
+	}
 
-	return cfg, nil
+	return result, nil
 }
 
 // getArgs checks the specified slice of strings (argv) for a 'bundle' flag and a 'create'
@@ -68,51 +758,190 @@ func getConfig() (*config, error) {
 // -bundle{{SEP}}BUNDLE_PATH
 // -b{{SEP}}BUNDLE_PATH
 // where {{SEP}} is either ' ' or '='
+// The flags in shimFlags are also consumed:
+// --print-exec indicates that the runc command line should be printed instead of executed.
+// --cwd{{SEP}}DIR sets the directory that a relative bundle path is resolved
+// against and that runc is executed in.
+// --log-to-stderr adds stderr as a log sink in addition to the debug file.
+// --log-level{{SEP}}LEVEL sets the level of the logged entries.
+// --spec-file{{SEP}}NAME sets the name of the OCI specification in the bundle
+// for the diff and modify commands.
+// --trace{{SEP}}FILE writes a Go execution trace of the invocation to FILE.
+// --result-file{{SEP}}FILE writes the result of the invocation to FILE as JSON.
+// Ambiguities are resolved as follows:
+// The value following a bundle flag is always the bundle path, even if it
+// matches a command. A value starting with '-' is rejected, since it is most
+// likely a flag following a bundle flag with a missing value; such a path has
+// to be specified as --bundle=BUNDLE_PATH.
+// The command is the first positional argument that is not the value of a
+// flag, so 'create' anywhere else (e.g. as a container id) is not the command.
+// Specifying different bundle paths is rejected.
+// The create and run commands reject more than one container id.
 func getArgs(argv []string) (*args, error) {
+	args, _, err := parseArgs(argv)
+	return args, err
+}
+
+// getRuntimeArgs returns the specified command line arguments (excluding argv[0])
+// with the flags in shimFlags removed. The result is forwarded to runc.
+func getRuntimeArgs(argv []string) []string {
+	_, runtimeArgs, _ := parseArgs(argv)
+	return runtimeArgs
+}
+
+// parseArgs processes the specified command line arguments, returning the
+// parsed args along with the arguments that are to be forwarded to runc.
+func parseArgs(argv []string) (*args, []string, error) {
 	args := &args{}
+	var runtimeArgs []string
+
+	// The subcommand is the first positional argument that is not the value
+	// of a global runc flag. Commands implemented by the
+	// nvidia-container-runtime itself are only recognized in this position.
+	var subcommand string
+	var positionals []string
+	bundleSet := false
+
+	// runc exec accepts its own --cwd flag for the process being executed, so
+	// --cwd is only consumed if it appears before the exec command.
+	isExec := false
 
 	for i := 0; i < len(argv); i++ {
 		param := argv[i]
-		if param == "create" {
-			args.cmd = param
-			continue
+		if param == "exec" {
+			isExec = true
 		}
 
 		if !strings.HasPrefix(param, "-") {
+			if subcommand == "" {
+				subcommand = param
+			} else {
+				positionals = append(positionals, param)
+			}
+			runtimeArgs = append(runtimeArgs, param)
 			continue
 		}
 
 		trimmed := strings.TrimLeft(param, "-")
 		if len(trimmed) == 0 {
+			runtimeArgs = append(runtimeArgs, param)
 			continue
 		}
 
 		parts := strings.SplitN(trimmed, "=", 2)
-		if parts[0] != "bundle" && parts[0] != "b" {
+		if parts[0] == "bundle" || parts[0] == "b" {
+			runtimeArgs = append(runtimeArgs, param)
+
+			var bundle string
+			if len(parts) == 2 {
+				bundle = parts[1]
+			} else if len(argv)-i <= 1 {
+				return nil, nil, fmt.Errorf("bundle option needs an argument")
+			} else if strings.HasPrefix(argv[i+1], "-") {
+				return nil, nil, fmt.Errorf("ambiguous bundle %q: use %v=%v if this is the bundle path", argv[i+1], param, argv[i+1])
+			} else {
+				// The bundle value is never interpreted as a command.
+				bundle = argv[i+1]
+				runtimeArgs = append(runtimeArgs, argv[i+1])
+				i++
+			}
+
+			if bundleSet && bundle != args.bundleDirPath {
+				return nil, nil, fmt.Errorf("ambiguous bundle: both %q and %q specified", args.bundleDirPath, bundle)
+			}
+			args.bundleDirPath = bundle
+			bundleSet = true
 			continue
 		}
 
-		if len(parts) == 2 {
-			args.bundleDirPath = parts[1]
+		hasValue, isShimFlag := shimFlags[parts[0]]
+		if !isShimFlag || (parts[0] == "cwd" && isExec) {
+			runtimeArgs = append(runtimeArgs, param)
+			if len(parts) == 1 && isRuntimeFlagWithValue(subcommand, parts[0]) && i+1 < len(argv) {
+				// The value is forwarded verbatim and never interpreted as a
+				// command, e.g. for --console-socket create.
+				runtimeArgs = append(runtimeArgs, argv[i+1])
+				i++
+			}
 			continue
 		}
 
-		if len(argv)-i <= 1 {
-			return nil, fmt.Errorf("bundle option needs an argument")
+		var value string
+		if hasValue {
+			if len(parts) == 2 {
+				value = parts[1]
+			} else if len(argv)-i <= 1 {
+				return nil, nil, fmt.Errorf("%v option needs an argument", parts[0])
+			} else {
+				value = argv[i+1]
+				i++
+			}
+		}
+
+		switch parts[0] {
+		case "print-exec":
+			args.printExec = true
+		case "cwd":
+			args.cwd = value
+		case "log-to-stderr":
+			args.logToStderr = true
+		case "log-level":
+			args.logLevel = value
+		case "spec-file":
+			args.specFile = value
+		case "trace":
+			args.traceFile = value
+		case "result-file":
+			args.resultFile = value
 		}
-		args.bundleDirPath = argv[i+1]
-		i++
 	}
 
-	return args, nil
+	if subcommand == "create" || shimCommands[subcommand] {
+		args.cmd = subcommand
+	}
+
+	// The spec file is only read and written by the commands of the
+	// nvidia-container-runtime, since runc always uses config.json.
+	if args.specFile != "" && subcommand != "canonicalize" && subcommand != "diff" && subcommand != "explain" && subcommand != "modify" {
+		return nil, nil, fmt.Errorf("spec-file option is only supported by the canonicalize, diff, explain and modify commands")
+	}
+	if args.specFile != "" && filepath.Base(args.specFile) != args.specFile {
+		return nil, nil, fmt.Errorf("invalid spec-file %q: expected a file name in the bundle directory", args.specFile)
+	}
+
+	// create and run take a single container id.
+	if (subcommand == "create" || subcommand == "run") && len(positionals) > 1 {
+		return nil, nil, fmt.Errorf("unexpected arguments %v for %v: expected a single container id", strings.Join(positionals[1:], " "), subcommand)
+	}
+
+	return args, runtimeArgs, nil
+}
+
+// formatCommandLine renders the specified argv as a single line, quoting
+// arguments that would otherwise be ambiguous.
+func formatCommandLine(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\$`") {
+			arg = strconv.Quote(arg)
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
 }
 
-// execRunc discovers the runc binary and issues an exec syscall.
-func execRunc() error {
+// getRuncCommand discovers the low-level runtime binary and returns the command
+// line used to forward the specified arguments (excluding argv[0]) to it. If a
+// runtime is specified it is used instead of searching for runc. The arguments
+// are translated for runtimes with a registered runtimeAdapter.
+func getRuncCommand(runtime string, argv []string) ([]string, error) {
 	runcCandidates := []string{
 		"docker-runc",
 		"runc",
 	}
+	if runtime != "" {
+		runcCandidates = []string{runtime}
+	}
 
 	var err error
 	var runcPath string
@@ -125,13 +954,94 @@ func execRunc() error {
 		logger.Printf("\"%v\" binary not found: %v", candidate, err)
 	}
 	if err != nil {
-		return fmt.Errorf("error locating runc: %v", err)
+		return nil, fmt.Errorf("error locating runc: %v", err)
 	}
 
 	logger.Printf("Runc path: %s\n", runcPath)
 
-	err = syscall.Exec(runcPath, append([]string{runcPath}, os.Args[1:]...), os.Environ())
+	// The runtime may be another shim forwarding to runc, but forwarding to
+	// the nvidia-container-runtime itself would never reach runc.
+	if isCurrentExecutable(runcPath) {
+		return nil, fmt.Errorf("error locating runc: %v is the nvidia-container-runtime itself", runcPath)
+	}
+
+	runtimeArgs := getRuntimeArgs(argv)
+	if adapter, exists := runtimeAdapters[filepath.Base(runcPath)]; exists {
+		runtimeArgs = adapter(runtimeArgs)
+	}
+
+	return append([]string{runcPath}, runtimeArgs...), nil
+}
+
+// isCurrentExecutable checks whether the specified path refers to the
+// executable of the current process.
+func isCurrentExecutable(path string) bool {
+	executable, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	executableInfo, err := os.Stat(executable)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(executableInfo, info)
+}
+
+// execRunc discovers the runc binary and issues an exec syscall. If the
+// --print-exec flag was specified, the command line is printed to stdout
+// instead. If the --cwd flag was specified, runc is executed in that directory.
+// Since runc replaces the current process, it inherits its stdio unchanged,
+// which is required for containers using a terminal or --console-socket.
+func execRunc(cfg *config, args *args) error {
+	// The timeout no longer applies once runc replaces the current process.
+	err := checkInvocationTimeout()
+	if err != nil {
+		return err
+	}
+
+	argv, err := getRuncCommand(cfg.runtime, os.Args[1:])
 	if err != nil {
+		return err
+	}
+	runcPath := argv[0]
+	argv = append([]string{runcPath}, addConfiguredRuntimeArgs(argv[1:], cfg.runtimeArgs)...)
+
+	if args.printExec {
+		logger.Printf("Printing runc command line instead of executing it")
+		fmt.Println(formatCommandLine(argv))
+		return nil
+	}
+
+	if args.cwd != "" {
+		logger.Printf("Executing runc in directory %v", args.cwd)
+		err = os.Chdir(args.cwd)
+		if err != nil {
+			return fmt.Errorf("error changing to directory %v: %v", args.cwd, err)
+		}
+	}
+
+	// runc replaces the current process unless the result of the delegation
+	// is to be written to a result file, or its stderr is to be captured to
+	// diagnose a failure.
+	if invocationResultFile != "" || invocationDiagnostics != nil {
+		logger.Printf("Running runc as a child process to record its result")
+		return runRuntimeCommand(cfg, argv)
+	}
+
+	env := getRuntimeEnv(os.Environ(), cfg.runtimeEnvAllowlist)
+
+	restoreRlimits, err := setRuntimeRlimits(getDelegationRlimits(cfg, argv))
+	if err != nil {
+		return err
+	}
+	stopInvocationTrace()
+	err = syscall.Exec(runcPath, argv, env)
+	if err != nil {
+		restoreRlimits()
 		return fmt.Errorf("could not exec '%v': %v", runcPath, err)
 	}
 
@@ -140,73 +1050,275 @@ func execRunc() error {
 	return fmt.Errorf("unexpected return from exec '%v'", runcPath)
 }
 
-func addNVIDIAHook(spec *specs.Spec) error {
-	path, err := exec.LookPath("nvidia-container-runtime-hook")
-	if err != nil {
-		path = hookDefaultFilePath
-		_, err = os.Stat(path)
-		if err != nil {
-			return err
-		}
+// isSandboxContainer checks whether the specified spec describes a pod sandbox
+// (pause) container. These never require GPU access and are detected by the
+// value of the container-type annotation set by the CRI.
+func isSandboxContainer(spec *specs.Spec, annotationKey string) bool {
+	if annotationKey == "" {
+		return false
 	}
+	return spec.Annotations[annotationKey] == sandboxContainerType
+}
 
-	logger.Printf("prestart hook path: %s\n", path)
+// getMatchingEntrypointPattern returns the first of the specified patterns
+// matching the entrypoint of the specified spec, the first of its process args,
+// or an empty string if there is none. A pattern containing any of the
+// characters *?[ matches the entrypoint as a glob, otherwise as a prefix.
+func getMatchingEntrypointPattern(spec *specs.Spec, patterns []string) string {
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		return ""
+	}
 
-	args := []string{path}
-	if spec.Hooks == nil {
-		spec.Hooks = &specs.Hooks{}
-	} else if len(spec.Hooks.Prestart) != 0 {
-		for _, hook := range spec.Hooks.Prestart {
-			if !strings.Contains(hook.Path, "nvidia-container-runtime-hook") {
-				continue
+	entrypoint := spec.Process.Args[0]
+	for _, pattern := range patterns {
+		if strings.ContainsAny(pattern, "*?[") {
+			if matched, _ := filepath.Match(pattern, entrypoint); matched {
+				return pattern
 			}
-			logger.Println("existing nvidia prestart hook in OCI spec file")
-			return nil
+			continue
+		}
+		if strings.HasPrefix(entrypoint, pattern) {
+			return pattern
 		}
 	}
-
-	spec.Hooks.Prestart = append(spec.Hooks.Prestart, specs.Hook{
-		Path: path,
-		Args: append(args, "prestart"),
-	})
-
-	return nil
+	return ""
 }
 
 func main() {
 	err := run()
+	if invocationResultFile != "" {
+		resultErr := writeResultFile(invocationResultFile, invocationFileMode, err, invocationStart, time.Now())
+		if resultErr != nil {
+			logger.Warnf("%v", resultErr)
+		}
+	}
 	if err != nil {
 		logger.Errorf("Error running %v: %v", os.Args, err)
-		os.Exit(1)
+		// The error is also written to stderr in JSON log mode, so that it is
+		// parsed along with the logs of the low-level runtime.
+		if getLogFormat(os.Args[1:]) == logFormatJSON {
+			writeJSONError(os.Stderr, err)
+		}
+		os.Exit(getExitCode(err))
 	}
 }
 
+// run runs the invocation of the runtime, bounded by the timeout set through
+// NVIDIA_CONTAINER_RUNTIME_TIMEOUT if any.
 func run() error {
+	invocationResultFile = getResultFile(os.Args[1:])
+
+	if traceFile := getTraceFile(os.Args[1:]); traceFile != "" {
+		startInvocationTrace(traceFile)
+		defer stopInvocationTrace()
+	}
+
+	cancel, err := startInvocationTimeout(os.Getenv(invocationTimeoutEnvvar))
+	if err != nil {
+		return withCategory(errorCategoryConfig, err)
+	}
+	defer cancel()
+
+	err = runInvocation()
+	if timeoutErr := checkInvocationTimeout(); err != nil && timeoutErr != nil {
+		return withCategory(errorCategoryTimeout, fmt.Errorf("%v: %v", timeoutErr, err))
+	}
+	return err
+}
+
+func runInvocation() error {
+	configSpan := invocationTracer.startSpan("config.load")
 	cfg, err := getConfig()
 	if err != nil {
-		return fmt.Errorf("error loading config: %v", err)
+		return withCategory(errorCategoryConfig, fmt.Errorf("error loading config: %v", err))
+	}
+	configSpan.finish()
+	if invocationResultFile == "" {
+		invocationResultFile = cfg.resultFile
+	}
+	invocationFileMode = cfg.fileMode
+	invocationTracer.enabled = cfg.otel
+	err = checkInvocationTimeout()
+	if err != nil {
+		return err
 	}
 
-	err = logger.LogToFile(cfg.debugFilePath)
+	err = startLogging(cfg)
 	if err != nil {
-		return fmt.Errorf("error opening debug log file: %v", err)
+		return withCategory(errorCategoryConfig, err)
 	}
 	defer logger.CloseFile()
+	defer logger.CloseSyslog()
 
-	logger.Printf("Running %s\n", os.Args[0])
-	args, err := getArgs(os.Args)
+	// The trace is started before the config is loaded, so the file-mode is
+	// only applied to its file now.
+	if traceFile := getTraceFile(os.Args[1:]); traceFile != "" {
+		err = applyFileMode(traceFile, cfg.fileMode)
+		if err != nil {
+			logger.Warnf("%v", err)
+		}
+	}
+
+	args, err := getArgs(os.Args[1:])
 	if err != nil {
-		return fmt.Errorf("error getting processing command line arguments: %v", err)
+		return withCategory(errorCategoryArgs, fmt.Errorf("error getting processing command line arguments: %v", err))
+	}
+
+	if args.logToStderr && cfg.logDestination != logDestinationStderr {
+		logger.LogToStderr()
+	}
+	if args.logLevel != "" {
+		level, err := logrus.ParseLevel(args.logLevel)
+		if err != nil {
+			return withCategory(errorCategoryArgs, fmt.Errorf("invalid log level %q: %v", args.logLevel, err))
+		}
+		logger.SetLogLevel(level)
 	}
 
-	if args.cmd != "create" {
-		logger.Println("Command is not \"create\", executing runc doing nothing")
-		err = execRunc()
+	logger.Printf("Running %s\n", os.Args[0])
+	configSpan.emit(nil)
+
+	// The modify command operates on the bundles passed as arguments rather
+	// than on the working directory, and checks each of them instead.
+	if args.cmd != "modify" {
+		err = checkAllowedBundle(cfg, args)
 		if err != nil {
-			return fmt.Errorf("error forwarding command to runc: %v", err)
+			return withCategory(errorCategoryArgs, err)
 		}
 	}
 
+	if cfg.verboseErrors && collectsDiagnostics(cfg, getRuntimeSubcommand(os.Args[1:])) {
+		invocationDiagnostics = newDelegationDiagnostics(cfg, args)
+	}
+
+	switch args.cmd {
+	case "canonicalize":
+		return runCanonicalize(cfg, args, os.Args[1:])
+	case "diff":
+		return runDiff(cfg, args, os.Args[1:])
+	case "explain":
+		return runExplain(cfg, args)
+	case "modify":
+		return runModify(cfg, args, os.Args[1:])
+	case "generate-config":
+		return runGenerateConfig(cfg, os.Args[1:])
+	case "info":
+		return runInfo(cfg)
+	case "verify-hook":
+		return runVerifyHook(cfg)
+	}
+
+	subcommand := getRuntimeSubcommand(os.Args[1:])
+	if cfg.strictSubcommands && subcommand != "" && !runtimeSubcommands[subcommand] {
+		return withCategory(errorCategoryArgs, fmt.Errorf("unknown runtime subcommand %q: not passing it to the runtime since strict-subcommands is set", subcommand))
+	}
+
+	if cfg.cleanupOnDelete && subcommand == "delete" {
+		err = runDelete(cfg, args)
+		if err != nil {
+			return withCategory(errorCategoryRuntime, fmt.Errorf("error deleting container: %w", err))
+		}
+		return nil
+	}
+
+	if cfg.runAsCreateStart && subcommand == "run" {
+		logger.Println("Running container as \"create\" followed by \"start\"")
+		return runAsCreateStart(cfg, args)
+	}
+
+	if subcommand == "create" {
+		done, err := handleExistingContainer(cfg, args)
+		if err != nil {
+			return withCategory(errorCategoryRuntime, err)
+		}
+		if done {
+			return nil
+		}
+	}
+
+	// Only the bundles of the subcommands listed in mutate-on are modified.
+	// The bundle of a restored container already carries the modifications
+	// made on create, so it is only modified again if explicitly configured.
+	mutate := containsString(cfg.mutateOn, subcommand) || (subcommand == "restore" && cfg.modifyOnRestore)
+	if !mutate {
+		if subcommand == "restore" {
+			logger.Println("Command is \"restore\", assuming OCI specification was modified on create")
+		} else {
+			logger.Printf("Command %q is not listed in mutate-on, executing runc doing nothing", subcommand)
+		}
+		invocationTracer.startSpan("delegate", "runtime.subcommand", subcommand, "nvidia.mutated", "false").emit(nil)
+		err = execRunc(cfg, args)
+		if err != nil {
+			return withCategory(errorCategoryRuntime, fmt.Errorf("error forwarding command to runc: %w", err))
+		}
+		return nil
+	}
+
+	mutateSpan := invocationTracer.startSpan("mutate", "runtime.subcommand", subcommand)
+	err = checkRuntimeVersion(cfg)
+	if err != nil {
+		mutateSpan.emit(err)
+		return withCategory(errorCategoryRuntime, err)
+	}
+
+	// The container id is only known to be an id on create and run; restore
+	// and other subcommands listed in mutate-on leave it empty.
+	var id string
+	if subcommand == "create" || subcommand == "run" {
+		_, _, subcommandArgs := splitRuntimeArgs(getRuntimeArgs(os.Args[1:]))
+		id = getContainerID(subcommandArgs)
+	}
+	err = modifyBundle(cfg, args, id)
+	mutateSpan.emit(err)
+	if err != nil {
+		return withCategory(errorCategorySpec, err)
+	}
+
+	// The summary is logged before runc replaces the current process.
+	if subcommand == "create" {
+		logCreateSummary(cfg, args)
+	}
+
+	logger.Print("Executing runc")
+	// The delegate span ends when runc takes over, since runc replaces the
+	// current process.
+	invocationTracer.startSpan("delegate", "runtime.subcommand", subcommand, "nvidia.mutated", "true").emit(nil)
+	err = execRunc(cfg, args)
+	if err != nil {
+		return withCategory(errorCategoryRuntime, fmt.Errorf("error forwarding '%v' command to runc: %w", subcommand, err))
+	}
+
+	return nil
+}
+
+// startLogging directs the log to the destination selected by the
+// log-destination config. If syslog is unavailable, the debug file is used
+// instead.
+func startLogging(cfg *config) error {
+	switch cfg.logDestination {
+	case logDestinationStderr:
+		logger.LogToStderr()
+		return nil
+	case logDestinationSyslog:
+		syslogErr := logger.LogToSyslog(syslogNetwork, syslogAddress, cfg.syslogFacility, cfg.syslogTag)
+		if syslogErr == nil {
+			return nil
+		}
+		defer logger.Warnf("Logging to debug file %v instead of syslog: %v", cfg.debugFilePath, syslogErr)
+	}
+
+	err := logger.LogToFile(cfg.debugFilePath, cfg.fileMode)
+	if err != nil {
+		return fmt.Errorf("error opening debug log file: %v", err)
+	}
+	return nil
+}
+
+// modifyBundle reads the OCI specification of the bundle referenced by the
+// specified args, applies the modifications required for the container with
+// the specified id and writes the specification back if it was changed. The
+// id is empty if it is not known, e.g. for the modify command.
+func modifyBundle(cfg *config, args *args, id string) error {
 	configFilePath, err := args.getConfigFilePath()
 	if err != nil {
 		return fmt.Errorf("error getting config file path: %v", err)
@@ -214,43 +1326,103 @@ func run() error {
 
 	logger.Printf("Using OCI specification file path: %v", configFilePath)
 
-	jsonFile, err := os.OpenFile(configFilePath, os.O_RDWR, 0644)
+	spec, err := readBundleSpec(cfg, configFilePath)
 	if err != nil {
-		return fmt.Errorf("error opening OCI specification file: %v", err)
+		return err
 	}
 
-	defer jsonFile.Close()
-
-	jsonContent, err := ioutil.ReadAll(jsonFile)
+	rootfs, err := resolveRootfs(spec, filepath.Dir(configFilePath))
 	if err != nil {
-		return fmt.Errorf("error reading OCI specificaiton: %v", err)
+		logger.Printf("Could not determine root filesystem: %v", err)
+	} else {
+		logger.Printf("Using root filesystem: %v", rootfs)
 	}
 
-	var spec specs.Spec
-	err = json.Unmarshal(jsonContent, &spec)
+	// The unmodified spec is marshalled so that the file is only rewritten if
+	// it was actually changed.
+	jsonOriginal, err := json.Marshal(spec)
 	if err != nil {
-		return fmt.Errorf("error unmarshalling OCI specification: %v", err)
+		return fmt.Errorf("error marshalling OCI specification: %v", err)
 	}
 
-	err = addNVIDIAHook(&spec)
+	err = modifySpec(cfg.forBundle(filepath.Dir(configFilePath)).forContainer(id), spec)
 	if err != nil {
-		return fmt.Errorf("error injecting NVIDIA Container Runtime hook: %v", err)
+		return err
 	}
 
 	jsonOutput, err := json.Marshal(spec)
 	if err != nil {
 		return fmt.Errorf("error marshalling modified OCI specification: %v", err)
 	}
+	unchanged := bytes.Equal(jsonOriginal, jsonOutput)
+
+	// The provenance is only stamped once the spec is known to be modified so
+	// that unchanged specs are still not rewritten. It is stamped before the
+	// spec is dumped for the dump to match the spec written.
+	if cfg.stampProvenance && !unchanged {
+		stampProvenance(spec, time.Now())
+		jsonOutput, err = json.Marshal(spec)
+		if err != nil {
+			return fmt.Errorf("error marshalling modified OCI specification: %v", err)
+		}
+	}
+
+	if cfg.dumpSpecDir != "" && id != "" {
+		dumpSpec(spec, cfg.dumpSpecDir, id, cfg.dumpSpecMaxFiles, cfg.fileMode)
+	}
+
+	if unchanged {
+		logger.Print("OCI specification unchanged, not rewriting file")
+		return nil
+	}
 
-	_, err = jsonFile.WriteAt(jsonOutput, 0)
+	err = writeSpecFile(configFilePath, jsonOutput, cfg.tempDir, cfg.fileMode)
 	if err != nil {
 		return fmt.Errorf("error writing modifed OCI specification to file: %v", err)
 	}
 
-	logger.Print("Prestart hook added, executing runc")
-	err = execRunc()
+	logger.Print("Prestart hook added")
+
+	return nil
+}
+
+// modifySpec applies the modifications required for the container to the
+// specified spec.
+func modifySpec(cfg *config, spec *specs.Spec) error {
+	err := checkHookCount(spec, cfg.maxHooks)
+	if err != nil {
+		return err
+	}
+	err = checkEnvLimits(spec, cfg.maxEnvCount, cfg.maxEnvBytes)
+	if err != nil {
+		return err
+	}
+
+	// The limits are pinned for the containers that are otherwise left
+	// unmodified as well, since these inherit the runtime limits all the same.
+	err = pinContainerRlimits(spec, cfg.runtimeRlimits)
+	if err != nil {
+		return err
+	}
+	err = pinContainerOOMScoreAdj(spec, cfg.runtimeOOMScoreAdj)
 	if err != nil {
-		return fmt.Errorf("error forwarding 'create' command to runc: %v", err)
+		return err
+	}
+
+	if isSandboxContainer(spec, cfg.sandboxAnnotationKey) {
+		logger.Printf("Sandbox container detected using annotation %q, not modifying OCI specification", cfg.sandboxAnnotationKey)
+		return nil
+	}
+	if pattern := getMatchingEntrypointPattern(spec, cfg.skipIfEntrypointMatches); pattern != "" {
+		logger.Printf("Entrypoint %v matches skip-if-entrypoint-matches entry %q, not modifying OCI specification", spec.Process.Args[0], pattern)
+		return nil
+	}
+
+	for _, modify := range getSpecModifiers(cfg) {
+		err = modify(spec)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -260,16 +1432,105 @@ func (a args) getConfigFilePath() (string, error) {
 	configRoot := a.bundleDirPath
 	if configRoot == "" {
 		logger.Printf("Bundle directory path is empty, using working directory.")
-		workingDirectory, err := os.Getwd()
+		workingDirectory, err := a.getWorkingDirectory()
 		if err != nil {
 			return "", fmt.Errorf("error getting working directory: %v", err)
 		}
 		configRoot = workingDirectory
+	} else if !filepath.IsAbs(configRoot) && a.cwd != "" {
+		configRoot = filepath.Join(a.cwd, configRoot)
+	}
+
+	resolved, err := filepath.EvalSymlinks(configRoot)
+	switch {
+	case err == nil:
+		configRoot = resolved
+	case isSymlinkLoop(err):
+		return "", fmt.Errorf("bundle path resolution failed (possible symlink loop): %v", configRoot)
+	case !os.IsNotExist(err):
+		return "", fmt.Errorf("error resolving bundle path %v: %v", configRoot, err)
+	}
+
+	// runc requires the bundle to be a directory, so a bundle path referring
+	// to the spec itself is rejected rather than corrected.
+	if info, err := os.Stat(configRoot); err == nil && info.Mode().IsRegular() {
+		if filepath.Base(configRoot) == defaultSpecFile {
+			return "", fmt.Errorf("bundle path %v is the OCI specification: --bundle must be the directory containing it, %v", configRoot, filepath.Dir(configRoot))
+		}
+		return "", fmt.Errorf("bundle path %v is not a directory", configRoot)
 	}
 
 	logger.Printf("Using bundle directory: %v", configRoot)
 
-	configFilePath := filepath.Join(configRoot, "config.json")
+	name := defaultSpecFile
+	if a.specFile != "" {
+		name = a.specFile
+	}
+	configFilePath := filepath.Join(configRoot, name)
 
 	return configFilePath, nil
 }
+
+// bundleSubcommands lists the commands operating on a bundle, which default to
+// the working directory if no bundle is specified.
+var bundleSubcommands = map[string]bool{
+	"create":       true,
+	"run":          true,
+	"restore":      true,
+	"canonicalize": true,
+	"diff":         true,
+	"explain":      true,
+	"modify":       true,
+}
+
+// checkAllowedBundle returns an error if allowed-bundle-prefixes is set and
+// the command operates on a bundle outside of the listed directories. The
+// absolute bundle path is compared with symlinks resolved, so that a symlink
+// cannot be used to point to a bundle elsewhere.
+func checkAllowedBundle(cfg *config, a *args) error {
+	if len(cfg.allowedBundlePrefixes) == 0 {
+		return nil
+	}
+	if a.bundleDirPath == "" && !bundleSubcommands[getRuntimeSubcommand(os.Args[1:])] {
+		return nil
+	}
+
+	configFilePath, err := a.getConfigFilePath()
+	if err != nil {
+		return fmt.Errorf("error getting config file path: %v", err)
+	}
+	bundle, err := filepath.Abs(filepath.Dir(configFilePath))
+	if err != nil {
+		return fmt.Errorf("error getting absolute bundle path: %v", err)
+	}
+
+	for _, prefix := range cfg.allowedBundlePrefixes {
+		if resolved, err := filepath.EvalSymlinks(prefix); err == nil {
+			prefix = resolved
+		}
+		prefix = filepath.Clean(prefix)
+		if bundle == prefix || strings.HasPrefix(bundle, strings.TrimSuffix(prefix, "/")+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("bundle %v is not under any of allowed-bundle-prefixes %v", bundle, strings.Join(cfg.allowedBundlePrefixes, ", "))
+}
+
+// getWorkingDirectory returns the directory specified using --cwd, falling
+// back to the working directory of the process.
+func (a args) getWorkingDirectory() (string, error) {
+	if a.cwd != "" {
+		return a.cwd, nil
+	}
+	return os.Getwd()
+}
+
+// isSymlinkLoop checks whether the specified error was caused by a symlink
+// cycle. filepath.EvalSymlinks reports a cycle as "too many links" instead of
+// returning ELOOP.
+func isSymlinkLoop(err error) bool {
+	if errors.Is(err, syscall.ELOOP) {
+		return true
+	}
+	return strings.Contains(err.Error(), "too many links")
+}
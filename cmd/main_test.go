@@ -13,6 +13,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/stretchr/testify/require"
@@ -118,7 +119,7 @@ func TestDuplicateHook(t *testing.T) {
 	}
 
 	t.Logf("inserting nvidia prestart hook to config.json")
-	if err = addNVIDIAHook(&spec); err != nil {
+	if err = addNVIDIAHook(&spec, &config{}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -150,29 +151,11 @@ func TestDuplicateHook(t *testing.T) {
 }
 
 func getRuntimeSpec(filePath string) (specs.Spec, error) {
-	var spec specs.Spec
-	jsonFile, err := os.OpenFile(filePath, os.O_RDWR, 0644)
-	if err != nil {
-		return spec, err
-	}
-	defer jsonFile.Close()
-
-	jsonContent, err := ioutil.ReadAll(jsonFile)
+	spec, err := readSpec(filePath)
 	if err != nil {
-		return spec, err
-	} else if json.Valid(jsonContent) {
-		err = json.Unmarshal(jsonContent, &spec)
-		if err != nil {
-			return spec, err
-		}
-	} else {
-		err = json.NewDecoder(bytes.NewReader(jsonContent)).Decode(&spec)
-		if err != nil {
-			return spec, err
-		}
+		return specs.Spec{}, err
 	}
-
-	return spec, err
+	return *spec, nil
 }
 
 func generateNewRuntimeSpec() error {
@@ -193,6 +176,9 @@ func generateNewRuntimeSpec() error {
 
 // Return number of valid NVIDIA prestart hooks in runtime spec
 func nvidiaHookCount(hooks *specs.Hooks) int {
+	if hooks == nil {
+		return 0
+	}
 	prestartHooks := hooks.Prestart
 	count := 0
 
@@ -245,6 +231,22 @@ func TestArgsGetConfigFilePath(t *testing.T) {
 			args:       args{bundleDirPath: "/foo/bar/"},
 			configPath: "/foo/bar/config.json",
 		},
+		{
+			args:       args{bundleDirPath: "bar", cwd: "/foo"},
+			configPath: "/foo/bar/config.json",
+		},
+		{
+			args:       args{bundleDirPath: "../bar", cwd: "/foo/baz"},
+			configPath: "/foo/bar/config.json",
+		},
+		{
+			args:       args{bundleDirPath: "/foo/bar", cwd: "/baz"},
+			configPath: "/foo/bar/config.json",
+		},
+		{
+			args:       args{cwd: "/foo/bar"},
+			configPath: "/foo/bar/config.json",
+		},
 	}
 
 	for i, tc := range testCases {
@@ -332,6 +334,136 @@ func TestGetArgs(t *testing.T) {
 				bundleDirPath: "create",
 			},
 		},
+		{
+			argv: []string{"--print-exec", "create", "-b", "/foo/bar"},
+			expected: &args{
+				cmd:           "create",
+				bundleDirPath: "/foo/bar",
+				printExec:     true,
+			},
+		},
+		{
+			argv: []string{"--cwd", "/foo", "create", "-b", "bar"},
+			expected: &args{
+				cmd:           "create",
+				bundleDirPath: "bar",
+				cwd:           "/foo",
+			},
+		},
+		{
+			argv: []string{"--cwd=/foo", "create"},
+			expected: &args{
+				cmd: "create",
+				cwd: "/foo",
+			},
+		},
+		{
+			argv:     []string{"create", "--cwd"},
+			expected: nil,
+			isError:  true,
+		},
+		{
+			argv:     []string{"exec", "--cwd", "/foo", "id"},
+			expected: &args{},
+		},
+		{
+			argv: []string{"--log-to-stderr", "--log-level", "debug", "create"},
+			expected: &args{
+				cmd:         "create",
+				logToStderr: true,
+				logLevel:    "debug",
+			},
+		},
+		{
+			argv:     []string{"-b", "--print-exec", "create"},
+			expected: nil,
+			isError:  true,
+		},
+		{
+			argv: []string{"-b=--print-exec", "create"},
+			expected: &args{
+				cmd:           "create",
+				bundleDirPath: "--print-exec",
+			},
+		},
+		{
+			argv: []string{"create", "-b", "create", "create"},
+			expected: &args{
+				cmd:           "create",
+				bundleDirPath: "create",
+			},
+		},
+		{
+			argv:     []string{"start", "create"},
+			expected: &args{},
+		},
+		{
+			argv:     []string{"--root", "create", "state", "create"},
+			expected: &args{},
+		},
+		{
+			argv: []string{"create", "-b", "/foo/bar", "--bundle=/foo/bar"},
+			expected: &args{
+				cmd:           "create",
+				bundleDirPath: "/foo/bar",
+			},
+		},
+		{
+			argv:     []string{"create", "-b", "/foo/bar", "--bundle", "create"},
+			expected: nil,
+			isError:  true,
+		},
+		{
+			argv: []string{"diff", "--bundle", "/foo/bar"},
+			expected: &args{
+				cmd:           "diff",
+				bundleDirPath: "/foo/bar",
+			},
+		},
+		{
+			argv: []string{"--root", "/run/runc", "diff", "-b", "/foo/bar"},
+			expected: &args{
+				cmd:           "diff",
+				bundleDirPath: "/foo/bar",
+			},
+		},
+		{
+			argv:     []string{"--root", "diff", "state", "id"},
+			expected: &args{},
+		},
+		{
+			argv:     []string{"exec", "id", "diff"},
+			expected: &args{},
+		},
+		{
+			argv:     []string{"run", "--console-socket", "create", "id"},
+			expected: &args{},
+		},
+		{
+			argv:     []string{"create", "id1", "id2"},
+			expected: nil,
+			isError:  true,
+		},
+		{
+			argv:     []string{"run", "-b", "/foo/bar", "id1", "--detach", "id2"},
+			expected: nil,
+			isError:  true,
+		},
+		{
+			argv: []string{"create", "--bundle", "/foo/bar", "--pid-file", "/run/pid", "--console-socket", "/run/sock", "id"},
+			expected: &args{
+				cmd:           "create",
+				bundleDirPath: "/foo/bar",
+			},
+		},
+		{
+			argv:     []string{"--root", "/run/runc", "run", "--preserve-fds", "3", "id"},
+			expected: &args{},
+		},
+		{
+			argv:     []string{"exec", "id", "ls", "-l"},
+			expected: &args{},
+		},
 	}
 
 	for i, tc := range testCases {
@@ -345,3 +477,1192 @@ func TestGetArgs(t *testing.T) {
 		require.EqualValuesf(t, tc.expected, args, "%d: %v", i, tc)
 	}
 }
+
+func TestGetConfigSandboxAnnotationKey(t *testing.T) {
+	testCases := []struct {
+		contents string
+		expected string
+	}{
+		{
+			contents: "",
+			expected: defaultSandboxAnnotationKey,
+		},
+		{
+			contents: "[nvidia-container-runtime]\nsandbox-annotation-key = \"io.kubernetes.cri-o.ContainerType\"",
+			expected: "io.kubernetes.cri-o.ContainerType",
+		},
+	}
+
+	for i, tc := range testCases {
+		testDir, err := writeTestConfig(tc.contents)
+		require.NoErrorf(t, err, "%d: %v", i, tc)
+		defer os.RemoveAll(testDir)
+
+		os.Setenv(configOverride, testDir)
+
+		cfg, err := getConfig()
+		require.NoErrorf(t, err, "%d: %v", i, tc)
+		require.Equalf(t, tc.expected, cfg.sandboxAnnotationKey, "%d: %v", i, tc)
+	}
+}
+
+func TestIsSandboxContainer(t *testing.T) {
+	testCases := []struct {
+		annotations   map[string]string
+		annotationKey string
+		expected      bool
+	}{
+		{
+			annotations:   nil,
+			annotationKey: defaultSandboxAnnotationKey,
+			expected:      false,
+		},
+		{
+			annotations:   map[string]string{defaultSandboxAnnotationKey: "sandbox"},
+			annotationKey: defaultSandboxAnnotationKey,
+			expected:      true,
+		},
+		{
+			annotations:   map[string]string{defaultSandboxAnnotationKey: "container"},
+			annotationKey: defaultSandboxAnnotationKey,
+			expected:      false,
+		},
+		{
+			annotations:   map[string]string{"io.kubernetes.cri-o.ContainerType": "sandbox"},
+			annotationKey: "io.kubernetes.cri-o.ContainerType",
+			expected:      true,
+		},
+		{
+			annotations:   map[string]string{defaultSandboxAnnotationKey: "sandbox"},
+			annotationKey: "io.kubernetes.cri-o.ContainerType",
+			expected:      false,
+		},
+		{
+			annotations:   map[string]string{defaultSandboxAnnotationKey: "sandbox"},
+			annotationKey: "",
+			expected:      false,
+		},
+	}
+
+	for i, tc := range testCases {
+		spec := &specs.Spec{Annotations: tc.annotations}
+		require.Equalf(t, tc.expected, isSandboxContainer(spec, tc.annotationKey), "%d: %v", i, tc)
+	}
+}
+
+// A sandbox container identified by a custom annotation key must not get the
+// NVIDIA prestart hook.
+func TestSandboxContainerCustomAnnotationKey(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nsandbox-annotation-key = \"io.kubernetes.cri-o.ContainerType\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	err = generateNewRuntimeSpec()
+	require.NoError(t, err)
+
+	spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	spec.Annotations = map[string]string{"io.kubernetes.cri-o.ContainerType": "sandbox"}
+	require.NoError(t, writeRuntimeSpec(filepath.Join(bundlePath, specFile), &spec))
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+testDir)
+	t.Logf("executing: %s\n", strings.Join(cmdCreate.Args, " "))
+	err = cmdCreate.Run()
+	require.NoError(t, err, "runtime should not return an error")
+
+	spec, err = getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Empty(t, spec.Hooks, "there should be no hooks in config.json")
+}
+
+func TestGetMatchingEntrypointPattern(t *testing.T) {
+	patterns := []string{"/fluent-bit", "/usr/bin/*-agent"}
+	testCases := []struct {
+		description string
+		args        []string
+		expected    string
+	}{
+		{
+			description: "exact path",
+			args:        []string{"/fluent-bit", "-c", "/fluent-bit/etc/fluent-bit.conf"},
+			expected:    "/fluent-bit",
+		},
+		{
+			description: "prefix",
+			args:        []string{"/fluent-bit/bin/fluent-bit"},
+			expected:    "/fluent-bit",
+		},
+		{
+			description: "glob",
+			args:        []string{"/usr/bin/datadog-agent", "run"},
+			expected:    "/usr/bin/*-agent",
+		},
+		{
+			description: "glob does not match a prefix",
+			args:        []string{"/usr/bin/datadog-agent-wrapper"},
+		},
+		{
+			description: "only the entrypoint is matched",
+			args:        []string{"/bin/sh", "-c", "/fluent-bit"},
+		},
+		{
+			description: "no args",
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{Process: &specs.Process{Args: tc.args}}
+		require.Equal(t, tc.expected, getMatchingEntrypointPattern(spec, patterns), tc.description)
+	}
+
+	require.Empty(t, getMatchingEntrypointPattern(&specs.Spec{}, patterns))
+}
+
+// A container whose entrypoint matches skip-if-entrypoint-matches must not
+// get the NVIDIA hook, even if it requests GPUs.
+func TestSkipIfEntrypointMatches(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nskip-if-entrypoint-matches = [\"/fluent-bit\", \"/usr/bin/*-agent\"]\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	testCases := []struct {
+		description  string
+		args         []string
+		expectedHook bool
+	}{
+		{
+			description: "prefix match",
+			args:        []string{"/fluent-bit/bin/fluent-bit"},
+		},
+		{
+			description: "glob match",
+			args:        []string{"/usr/bin/logging-agent"},
+		},
+		{
+			description:  "no match",
+			args:         []string{"/usr/bin/python3", "train.py"},
+			expectedHook: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		require.NoError(t, generateNewRuntimeSpec())
+		specPath := filepath.Join(bundlePath, specFile)
+		spec, err := getRuntimeSpec(specPath)
+		require.NoError(t, err)
+		spec.Process.Args = tc.args
+		spec.Process.Env = append(spec.Process.Env, visibleDevicesEnvvar+"=all")
+		require.NoError(t, writeRuntimeSpec(specPath, &spec))
+
+		cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+		cmdCreate.Env = append(os.Environ(), configOverride+"="+testDir)
+		output, err := cmdCreate.CombinedOutput()
+		require.NoError(t, err, "%v: %s", tc.description, output)
+
+		spec, err = getRuntimeSpec(specPath)
+		require.NoError(t, err)
+		if tc.expectedHook {
+			require.Equal(t, 1, nvidiaHookCount(spec.Hooks), tc.description)
+		} else {
+			require.Empty(t, spec.Hooks, tc.description)
+		}
+	}
+
+	for _, pattern := range []string{"", "/usr/bin/[-agent"} {
+		configDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\nskip-if-entrypoint-matches = [%q]\n", pattern))
+		require.NoError(t, err)
+		defer os.RemoveAll(configDir)
+
+		os.Setenv(configOverride, configDir)
+		_, err = getConfig()
+		os.Unsetenv(configOverride)
+		require.Error(t, err, pattern)
+	}
+}
+
+// writeTestConfig writes the specified contents to a config.toml in a new
+// temporary directory suitable for use as the config override.
+func writeTestConfig(contents string) (string, error) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	if err != nil {
+		return "", err
+	}
+
+	filename := path.Join(testDir, configFilePath)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+		return "", err
+	}
+
+	return testDir, nil
+}
+
+func writeRuntimeSpec(filePath string, spec *specs.Spec) error {
+	jsonOutput, err := json.MarshalIndent(spec, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath, jsonOutput, 0644)
+}
+
+func TestGetRuntimeArgs(t *testing.T) {
+	testCases := []struct {
+		argv     []string
+		expected []string
+	}{
+		{
+			argv:     []string{},
+			expected: nil,
+		},
+		{
+			argv:     []string{"create", "--bundle", "/foo/bar", "id"},
+			expected: []string{"create", "--bundle", "/foo/bar", "id"},
+		},
+		{
+			argv:     []string{"--print-exec", "create", "--bundle", "/foo/bar", "id"},
+			expected: []string{"create", "--bundle", "/foo/bar", "id"},
+		},
+		{
+			argv:     []string{"create", "-print-exec", "-b=/foo/bar", "id"},
+			expected: []string{"create", "-b=/foo/bar", "id"},
+		},
+		{
+			argv:     []string{"create", "-b=--print-exec", "id"},
+			expected: []string{"create", "-b=--print-exec", "id"},
+		},
+		{
+			argv:     []string{"--cwd", "/foo", "create", "-b", "bar", "id"},
+			expected: []string{"create", "-b", "bar", "id"},
+		},
+		{
+			argv:     []string{"--log-to-stderr", "--log-level", "debug", "create", "id"},
+			expected: []string{"create", "id"},
+		},
+		{
+			argv:     []string{"--cwd=/foo", "exec", "--cwd", "/bar", "id", "sh"},
+			expected: []string{"exec", "--cwd", "/bar", "id", "sh"},
+		},
+	}
+
+	for i, tc := range testCases {
+		require.Equalf(t, tc.expected, getRuntimeArgs(tc.argv), "%d: %v", i, tc)
+	}
+}
+
+// The --print-exec flag prints the runc command line instead of executing it.
+func TestPrintExec(t *testing.T) {
+	err := generateNewRuntimeSpec()
+	require.NoError(t, err)
+
+	runcPath, err := exec.LookPath("runc")
+	require.NoError(t, err)
+
+	var stdout bytes.Buffer
+	cmdCreate := exec.Command(nvidiaRuntime, "--print-exec", "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"=/etc/")
+	cmdCreate.Stdout = &stdout
+	t.Logf("executing: %s\n", strings.Join(cmdCreate.Args, " "))
+	err = cmdCreate.Run()
+	require.NoError(t, err, "runtime should not return an error")
+
+	expected := strings.Join([]string{runcPath, "create", "--bundle", bundlePath, "testcontainer"}, " ")
+	require.Equal(t, expected+"\n", stdout.String())
+	require.NotContains(t, stdout.String(), "mock runc", "runc should not be executed")
+
+	spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks), "the nvidia prestart hook should still be inserted")
+}
+
+func TestFormatCommandLine(t *testing.T) {
+	testCases := []struct {
+		argv     []string
+		expected string
+	}{
+		{
+			argv:     []string{"/usr/bin/runc", "create", "id"},
+			expected: "/usr/bin/runc create id",
+		},
+		{
+			argv:     []string{"/usr/bin/runc", "create", "--bundle", "/foo bar", ""},
+			expected: `/usr/bin/runc create --bundle "/foo bar" ""`,
+		},
+	}
+
+	for i, tc := range testCases {
+		require.Equalf(t, tc.expected, formatCommandLine(tc.argv), "%d: %v", i, tc)
+	}
+}
+
+func TestGetConfigEnvFilters(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nenv-allowlist = [\"NVIDIA_VISIBLE_DEVICES\"]\nenv-denylist = [\"NVIDIA_REQUIRE_*\"]")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Equal(t, []string{"NVIDIA_VISIBLE_DEVICES"}, cfg.envAllowlist)
+	require.Equal(t, []string{"NVIDIA_REQUIRE_*"}, cfg.envDenylist)
+
+	testDir, err = writeTestConfig("[nvidia-container-runtime]\nenv-denylist = \"NVIDIA_REQUIRE_*\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	os.Setenv(configOverride, testDir)
+
+	_, err = getConfig()
+	require.Error(t, err)
+}
+
+func TestGetConfigForceVisibleDevices(t *testing.T) {
+	testDir, err := writeTestConfig("")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Nil(t, cfg.forceVisibleDevices)
+
+	testDir, err = writeTestConfig("[nvidia-container-runtime]\nforce-visible-devices = \"\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	cfg, err = getConfig()
+	require.NoError(t, err)
+	require.NotNil(t, cfg.forceVisibleDevices)
+	require.Equal(t, "", *cfg.forceVisibleDevices)
+}
+
+// A relative bundle path is resolved against the directory specified by --cwd.
+func TestCwdRelativeBundle(t *testing.T) {
+	err := generateNewRuntimeSpec()
+	require.NoError(t, err)
+
+	cmdCreate := exec.Command(nvidiaRuntime, "--cwd", filepath.Dir(filepath.Clean(bundlePath)), "create", "--bundle", filepath.Base(filepath.Clean(bundlePath)), "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"=/etc/")
+	t.Logf("executing: %s\n", strings.Join(cmdCreate.Args, " "))
+	err = cmdCreate.Run()
+	require.NoError(t, err, "runtime should not return an error")
+
+	spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks), "exactly one nvidia prestart hook should be inserted correctly into config.json")
+}
+
+func TestArgsGetConfigFilePathSymlinkLoop(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	require.NoError(t, os.Symlink(filepath.Join(testDir, "a"), filepath.Join(testDir, "b")))
+	require.NoError(t, os.Symlink(filepath.Join(testDir, "b"), filepath.Join(testDir, "a")))
+
+	a := args{bundleDirPath: filepath.Join(testDir, "a")}
+	_, err = a.getConfigFilePath()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bundle path resolution failed (possible symlink loop): "+filepath.Join(testDir, "a"))
+}
+
+func TestArgsGetConfigFilePathSymlink(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	bundleDir := filepath.Join(testDir, "bundle")
+	require.NoError(t, os.Mkdir(bundleDir, 0755))
+	require.NoError(t, os.Symlink(bundleDir, filepath.Join(testDir, "link")))
+
+	a := args{bundleDirPath: filepath.Join(testDir, "link")}
+	configFilePath, err := a.getConfigFilePath()
+	require.NoError(t, err)
+
+	resolved, err := filepath.EvalSymlinks(bundleDir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(resolved, "config.json"), configFilePath)
+}
+
+func TestArgsGetConfigFilePathSpecFile(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	configFilePath := filepath.Join(testDir, "config.json")
+	require.NoError(t, ioutil.WriteFile(configFilePath, []byte("{}"), 0644))
+
+	a := args{bundleDirPath: testDir}
+	path, err := a.getConfigFilePath()
+	require.NoError(t, err)
+	require.Equal(t, configFilePath, path)
+
+	a = args{bundleDirPath: configFilePath}
+	_, err = a.getConfigFilePath()
+	require.EqualError(t, err, fmt.Sprintf("bundle path %v is the OCI specification: --bundle must be the directory containing it, %v", configFilePath, testDir))
+
+	otherFile := filepath.Join(testDir, "spec.json")
+	require.NoError(t, ioutil.WriteFile(otherFile, []byte("{}"), 0644))
+	a = args{bundleDirPath: otherFile}
+	_, err = a.getConfigFilePath()
+	require.EqualError(t, err, fmt.Sprintf("bundle path %v is not a directory", otherFile))
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", configFilePath, "testcontainer")
+	require.Error(t, cmdCreate.Run(), "runtime should return an error")
+}
+
+// Running create on a spec that already contains the hook must not rewrite
+// config.json.
+func TestUnchangedSpecNotRewritten(t *testing.T) {
+	err := generateNewRuntimeSpec()
+	require.NoError(t, err)
+
+	configFilePath := filepath.Join(bundlePath, specFile)
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"=/etc/")
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	before, err := os.Stat(configFilePath)
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+
+	cmdCreate = exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"=/etc/")
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	after, err := os.Stat(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, before.ModTime(), after.ModTime(), "config.json should not be rewritten")
+
+	spec, err := getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks), "exactly one nvidia prestart hook should be present in config.json")
+}
+
+// BenchmarkCreate covers the full create flow up to the point where runc
+// would be executed.
+func BenchmarkCreate(b *testing.B) {
+	defer logger.SetOutput(os.Stderr)
+	defer logger.SetLevel(logger.GetLevel())
+
+	original, err := ioutil.ReadFile(unmodifiedSpecFile)
+	require.NoError(b, err)
+
+	testDir, err := writeTestConfig("")
+	require.NoError(b, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	bundleDir := filepath.Join(testDir, "bundle")
+	require.NoError(b, os.Mkdir(bundleDir, 0755))
+
+	argv := []string{nvidiaRuntime, "create", "--bundle", bundleDir, "testcontainer"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		require.NoError(b, ioutil.WriteFile(filepath.Join(bundleDir, specFile), original, 0644))
+		b.StartTimer()
+
+		args, err := getArgs(argv)
+		if err != nil {
+			b.Fatal(err)
+		}
+		cfg, err := getConfig()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := logger.LogToFile(cfg.debugFilePath, cfg.fileMode); err != nil {
+			b.Fatal(err)
+		}
+		if err := modifyBundle(cfg, args, "testcontainer"); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := getRuncCommand(cfg.runtime, argv[1:]); err != nil {
+			b.Fatal(err)
+		}
+		logger.CloseFile()
+	}
+}
+
+func TestGetConfigExternalModifier(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nexternal-modifier = \"/opt/site/modifier\"\nexternal-modifier-order = \"before\"\nexternal-modifier-timeout = 2")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Equal(t, "/opt/site/modifier", cfg.externalModifier)
+	require.Equal(t, externalModifierBefore, cfg.externalModifierOrder)
+	require.Equal(t, 2*time.Second, cfg.externalModifierTimeout)
+
+	for _, config := range []string{"external-modifier-order = \"during\"", "external-modifier-timeout = 0", "external-modifier-timeout = -1"} {
+		testDir, err = writeTestConfig("[nvidia-container-runtime]\n" + config)
+		require.NoError(t, err)
+		defer os.RemoveAll(testDir)
+		os.Setenv(configOverride, testDir)
+
+		_, err = getConfig()
+		require.Error(t, err, config)
+	}
+}
+
+func TestGetConfigRequireConfig(t *testing.T) {
+	presentDir, err := writeTestConfig("[nvidia-container-runtime]\ndebug = \"/nvidia-container-toolkit.log\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(presentDir)
+
+	missingDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(missingDir)
+
+	defer os.Unsetenv(requireConfigEnvvar)
+
+	// The system config must not be found either for the config to be missing.
+	defer func(dir string) { configDir = dir }(configDir)
+	configDir = missingDir
+
+	testCases := []struct {
+		configDir     string
+		requireConfig string
+		expectedDebug string
+		isError       bool
+	}{
+		{
+			configDir:     presentDir,
+			requireConfig: "",
+			expectedDebug: "/nvidia-container-toolkit.log",
+		},
+		{
+			configDir:     presentDir,
+			requireConfig: "true",
+			expectedDebug: "/nvidia-container-toolkit.log",
+		},
+		{
+			configDir:     missingDir,
+			requireConfig: "",
+			expectedDebug: "/dev/null",
+		},
+		{
+			configDir:     missingDir,
+			requireConfig: "false",
+			expectedDebug: "/dev/null",
+		},
+		{
+			configDir:     missingDir,
+			requireConfig: "true",
+			isError:       true,
+		},
+		{
+			configDir:     presentDir,
+			requireConfig: "maybe",
+			isError:       true,
+		},
+	}
+
+	for i, tc := range testCases {
+		os.Setenv(configOverride, tc.configDir)
+		os.Setenv(requireConfigEnvvar, tc.requireConfig)
+
+		cfg, err := getConfig()
+		if tc.isError {
+			require.Errorf(t, err, "%d: %v", i, tc)
+			continue
+		}
+		require.NoErrorf(t, err, "%d: %v", i, tc)
+		require.Equalf(t, tc.expectedDebug, cfg.debugFilePath, "%d: %v", i, tc)
+	}
+}
+
+// The --log-to-stderr flag writes log entries to stderr and composes with
+// --log-level.
+func TestLogToStderr(t *testing.T) {
+	testCases := []struct {
+		flags       []string
+		expectLines bool
+	}{
+		{
+			flags:       nil,
+			expectLines: false,
+		},
+		{
+			flags:       []string{"--log-to-stderr"},
+			expectLines: true,
+		},
+		{
+			flags:       []string{"--log-to-stderr", "--log-level=info"},
+			expectLines: true,
+		},
+		{
+			flags:       []string{"--log-to-stderr", "--log-level", "error"},
+			expectLines: false,
+		},
+	}
+
+	for i, tc := range testCases {
+		require.NoError(t, generateNewRuntimeSpec())
+
+		var stderr bytes.Buffer
+		argv := append(tc.flags, "create", "--bundle", bundlePath, "testcontainer")
+		cmdCreate := exec.Command(nvidiaRuntime, argv...)
+		cmdCreate.Env = append(os.Environ(), configOverride+"=/etc/")
+		cmdCreate.Stderr = &stderr
+		t.Logf("executing: %s\n", strings.Join(cmdCreate.Args, " "))
+		require.NoErrorf(t, cmdCreate.Run(), "%d: %v", i, tc)
+
+		if tc.expectLines {
+			require.Containsf(t, stderr.String(), "Using bundle directory", "%d: %v", i, tc)
+		} else {
+			require.NotContainsf(t, stderr.String(), "Using bundle directory", "%d: %v", i, tc)
+		}
+	}
+}
+
+// With hook-stage = "both" repeated creates result in exactly one hook in each
+// of the prestart and createRuntime lists of a spec supporting both.
+func TestHookStageBoth(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nhook-stage = \"both\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	require.NoError(t, generateNewRuntimeSpec())
+	configFilePath := filepath.Join(bundlePath, specFile)
+	spec, err := getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	spec.Version = "1.0.2"
+	require.NoError(t, writeRuntimeSpec(configFilePath, &spec))
+
+	for i := 0; i < 2; i++ {
+		cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+		cmdCreate.Env = append(os.Environ(), configOverride+"="+testDir)
+		require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+	}
+
+	spec, err = getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks), "exactly one nvidia prestart hook should be present")
+	require.Len(t, spec.Hooks.CreateRuntime, 1, "exactly one nvidia createRuntime hook should be present")
+	require.True(t, isNVIDIAHook(spec.Hooks.CreateRuntime[0]))
+}
+
+// A spec without a process requests no GPUs, so no hook is inserted.
+func TestNilProcess(t *testing.T) {
+	require.NoError(t, generateNewRuntimeSpec())
+
+	spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	spec.Process = nil
+	require.NoError(t, writeRuntimeSpec(filepath.Join(bundlePath, specFile), &spec))
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"=/etc/")
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	spec, err = getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Nil(t, spec.Process)
+	require.Empty(t, spec.Hooks, "there should be no hooks in config.json")
+}
+
+func TestDiff(t *testing.T) {
+	require.NoError(t, generateNewRuntimeSpec())
+
+	configFilePath := filepath.Join(bundlePath, specFile)
+	original, err := ioutil.ReadFile(configFilePath)
+	require.NoError(t, err)
+
+	cmdDiff := exec.Command(nvidiaRuntime, "diff", "--bundle", bundlePath)
+	cmdDiff.Env = append(os.Environ(), configOverride+"=/etc/")
+	output, err := cmdDiff.Output()
+	require.NoError(t, err, "runtime should not return an error")
+	require.Contains(t, string(output), "+ /hooks")
+	require.Contains(t, string(output), hookBinary)
+
+	current, err := ioutil.ReadFile(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, original, current, "config.json should not be modified")
+}
+
+func TestGetConfigHookEnv(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nhook-env = { FOO = \"bar\" }\n\n[nvidia-container-runtime.cli-env]\nLD_LIBRARY_PATH = \"${TEST_CLI_ENV_DIR}/lib\"\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"FOO": "bar"}, cfg.hookEnv)
+	require.Equal(t, map[string]string{"LD_LIBRARY_PATH": "${TEST_CLI_ENV_DIR}/lib"}, cfg.cliEnv)
+
+	testDir, err = writeTestConfig("[nvidia-container-runtime]\ncli-env = { LD_LIBRARY_PATH = 1 }")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	os.Setenv(configOverride, testDir)
+
+	_, err = getConfig()
+	require.Error(t, err)
+}
+
+func TestConsoleSocket(t *testing.T) {
+	require.NoError(t, generateNewRuntimeSpec())
+
+	configFilePath := filepath.Join(bundlePath, specFile)
+	spec, err := getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	spec.Process.Terminal = true
+	require.NoError(t, writeRuntimeSpec(configFilePath, &spec))
+
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	argsFile := filepath.Join(testDir, "args")
+	_, err = writeTestScript(testDir, "runc", `printf '%s\n' "$@" > `+argsFile)
+	require.NoError(t, err)
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "--console-socket", "create", "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"=/etc/", "PATH="+testDir+":"+os.Getenv("PATH"))
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	forwarded, err := ioutil.ReadFile(argsFile)
+	require.NoError(t, err)
+	require.Equal(t, "create\n--bundle\n"+bundlePath+"\n--console-socket\ncreate\ntestcontainer\n", string(forwarded))
+
+	spec, err = getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	require.True(t, spec.Process.Terminal)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks), "exactly one nvidia prestart hook should be present in config.json")
+}
+
+func TestMaxHooks(t *testing.T) {
+	require.NoError(t, generateNewRuntimeSpec())
+
+	configFilePath := filepath.Join(bundlePath, specFile)
+	spec, err := getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	spec.Hooks = &specs.Hooks{}
+	for i := 0; i < defaultMaxHooks+1; i++ {
+		spec.Hooks.Poststop = append(spec.Hooks.Poststop, specs.Hook{Path: "/bin/true"})
+	}
+	require.NoError(t, writeRuntimeSpec(configFilePath, &spec))
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"=/etc/")
+	require.Error(t, cmdCreate.Run(), "runtime should reject a spec exceeding max-hooks")
+
+	spec, err = getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, 0, nvidiaHookCount(spec.Hooks), "no nvidia prestart hook should be present in config.json")
+
+	testDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\nmax-hooks = %v", defaultMaxHooks+1))
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	cmdCreate = exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+testDir)
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+}
+
+func TestGetConfigSources(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\ndebug = \"/dev/null\"\nhook-stage = \"prestart\"\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	os.Setenv(configOverride, testDir)
+
+	_, sources, err := getConfigWithSources()
+	require.NoError(t, err)
+	require.Len(t, sources, len(configKeys))
+
+	file := "file:" + filepath.Join(testDir, configFilePath)
+	require.Equal(t, file, sources["debug"])
+	require.Equal(t, file, sources["hook-stage"])
+	require.Equal(t, configSourceDefault, sources["runtime"])
+	require.Equal(t, configSourceDefault, sources["config-url"])
+}
+
+func TestGetConfigHookArgs(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nhook-args = \"stage\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Equal(t, hookArgsStage, cfg.hookArgs)
+
+	testDir, err = writeTestConfig("[nvidia-container-runtime]\nhook-args = \"configure\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	os.Setenv(configOverride, testDir)
+
+	_, err = getConfig()
+	require.Error(t, err)
+}
+
+func TestGetConfigFilePaths(t *testing.T) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+
+	os.Setenv(configOverride, "/run/user/1000/config")
+	os.Setenv("HOME", "/home/user")
+	require.Equal(t, []string{"/run/user/1000/config/" + configFilePath, "/etc/" + configFilePath}, getConfigFilePaths())
+
+	os.Setenv(configOverride, "")
+	require.Equal(t, []string{"/home/user/.config/" + configFilePath, "/etc/" + configFilePath}, getConfigFilePaths())
+
+	os.Setenv("HOME", "")
+	require.Equal(t, []string{"/etc/" + configFilePath}, getConfigFilePaths())
+
+	os.Setenv(configOverride, "/etc")
+	require.Equal(t, []string{"/etc/" + configFilePath}, getConfigFilePaths())
+}
+
+func TestGetConfigDiscovery(t *testing.T) {
+	defer func(dir string) { configDir = dir }(configDir)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+
+	systemDir, err := writeTestConfig("[nvidia-container-runtime]\ndebug = \"/system.log\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(systemDir)
+	configDir = systemDir
+
+	userDir, err := writeTestConfig("[nvidia-container-runtime]\ndebug = \"/user.log\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(userDir)
+
+	missingDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(missingDir)
+
+	os.Setenv(configOverride, userDir)
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Equal(t, "/user.log", cfg.debugFilePath)
+
+	// Without a user config the system config is used.
+	os.Setenv(configOverride, missingDir)
+	cfg, err = getConfig()
+	require.NoError(t, err)
+	require.Equal(t, "/system.log", cfg.debugFilePath)
+
+	// Without XDG_CONFIG_HOME the user config is looked up in $HOME/.config.
+	homeDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(homeDir)
+	require.NoError(t, os.Rename(userDir, filepath.Join(homeDir, ".config")))
+
+	os.Setenv(configOverride, "")
+	os.Setenv("HOME", homeDir)
+	cfg, err = getConfig()
+	require.NoError(t, err)
+	require.Equal(t, "/user.log", cfg.debugFilePath)
+}
+
+func TestRestore(t *testing.T) {
+	require.NoError(t, generateNewRuntimeSpec())
+
+	configFilePath := filepath.Join(bundlePath, specFile)
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"=/etc/")
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	created, err := ioutil.ReadFile(configFilePath)
+	require.NoError(t, err)
+
+	cmdRestore := exec.Command(nvidiaRuntime, "restore", "--image-path", "/checkpoint", "--bundle", bundlePath, "testcontainer")
+	cmdRestore.Env = append(os.Environ(), configOverride+"=/etc/")
+	require.NoError(t, cmdRestore.Run(), "runtime should not return an error")
+
+	restored, err := ioutil.ReadFile(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, created, restored, "config.json should not be modified on restore")
+
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nmodify-on-restore = true")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	cmdRestore = exec.Command(nvidiaRuntime, "restore", "--bundle", bundlePath, "testcontainer")
+	cmdRestore.Env = append(os.Environ(), configOverride+"="+testDir)
+	require.NoError(t, cmdRestore.Run(), "runtime should not return an error")
+
+	spec, err := getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks), "exactly one nvidia prestart hook should be present in config.json")
+
+	// With modify-on-restore a spec without the hook is modified.
+	require.NoError(t, generateNewRuntimeSpec())
+	cmdRestore = exec.Command(nvidiaRuntime, "restore", "--bundle", bundlePath, "testcontainer")
+	cmdRestore.Env = append(os.Environ(), configOverride+"="+testDir)
+	require.NoError(t, cmdRestore.Run(), "runtime should not return an error")
+
+	spec, err = getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks), "exactly one nvidia prestart hook should be present in config.json")
+}
+
+func TestMutateOn(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nmutate-on = [\"run\"]")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	require.NoError(t, generateNewRuntimeSpec())
+	configFilePath := filepath.Join(bundlePath, specFile)
+	original, err := ioutil.ReadFile(configFilePath)
+	require.NoError(t, err)
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+testDir)
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	created, err := ioutil.ReadFile(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, original, created, "config.json should not be modified for a command not listed in mutate-on")
+
+	cmdRun := exec.Command(nvidiaRuntime, "run", "--bundle", bundlePath, "testcontainer")
+	cmdRun.Env = append(os.Environ(), configOverride+"="+testDir)
+	require.NoError(t, cmdRun.Run(), "runtime should not return an error")
+
+	spec, err := getRuntimeSpec(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks), "exactly one nvidia prestart hook should be present in config.json")
+
+	invalidDir, err := writeTestConfig("[nvidia-container-runtime]\nmutate-on = [\"create\", \"diff\"]")
+	require.NoError(t, err)
+	defer os.RemoveAll(invalidDir)
+
+	cmdCreate = exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+invalidDir)
+	require.Error(t, cmdCreate.Run(), "shim commands cannot be listed in mutate-on")
+}
+
+func TestGetArgsMultipleContainerIDs(t *testing.T) {
+	_, err := getArgs([]string{"create", "--bundle", "/foo/bar", "id1", "id2", "id3"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "id2 id3")
+	require.NotContains(t, err.Error(), "id1")
+}
+
+func TestShimChain(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	// The mock runc prints its arguments one per line followed by its stdin,
+	// and reports on stderr.
+	runc, err := writeTestScript(testDir, "chained-runc", `for arg in "$@"; do printf '[%s]\n' "$arg"; done; cat; echo "runc stderr" >&2`)
+	require.NoError(t, err)
+	// The second shim records its arguments and execs the mock runc with
+	// them unchanged.
+	shimArgs := filepath.Join(testDir, "shim-args")
+	shim, err := writeTestScript(testDir, "audit-shim", `for arg in "$@"; do printf '[%s]\n' "$arg"; done > `+shimArgs+`
+exec `+runc+` "$@"`)
+	require.NoError(t, err)
+
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nruntime = \"" + shim + "\"\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	testCases := []struct {
+		description string
+		argv        []string
+		expected    []string
+	}{
+		{
+			description: "exec with process arguments",
+			argv:        []string{"--root", "/run/test root", "exec", "--tty=false", "--cwd", "/", "testcontainer", "sh", "-c", "echo 'a b'", ""},
+			expected:    []string{"--root", "/run/test root", "exec", "--tty=false", "--cwd", "/", "testcontainer", "sh", "-c", "echo 'a b'", ""},
+		},
+		{
+			description: "create",
+			argv:        []string{"--log-format", "json", "create", "--bundle", bundlePath, "--pid-file", "/run/pid", "testcontainer"},
+			expected:    []string{"--log-format", "json", "create", "--bundle", bundlePath, "--pid-file", "/run/pid", "testcontainer"},
+		},
+		{
+			description: "shim flags are not forwarded",
+			argv:        []string{"--log-to-stderr", "--log-level", "debug", "state", "testcontainer"},
+			expected:    []string{"state", "testcontainer"},
+		},
+	}
+
+	for _, tc := range testCases {
+		require.NoError(t, generateNewRuntimeSpec())
+
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(nvidiaRuntime, tc.argv...)
+		cmd.Env = append(os.Environ(), configOverride+"="+configDir)
+		cmd.Stdin = strings.NewReader("container stdin\n")
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		require.NoError(t, cmd.Run(), "%v: %v", tc.description, stderr.String())
+
+		var expected string
+		for _, arg := range tc.expected {
+			expected += "[" + arg + "]\n"
+		}
+		recorded, err := ioutil.ReadFile(shimArgs)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(recorded), tc.description)
+		require.Equal(t, expected+"container stdin\n", stdout.String(), tc.description)
+		require.Contains(t, stderr.String(), "runc stderr", tc.description)
+	}
+}
+
+func TestShimChainSelf(t *testing.T) {
+	self, err := exec.LookPath(nvidiaRuntime)
+	require.NoError(t, err)
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nruntime = \"" + self + "\"\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(nvidiaRuntime, "--log-to-stderr", "state", "testcontainer")
+	cmd.Env = append(os.Environ(), configOverride+"="+configDir)
+	cmd.Stderr = &stderr
+	require.Error(t, cmd.Run(), "forwarding to the runtime itself should be rejected")
+	require.Contains(t, stderr.String(), "is the nvidia-container-runtime itself")
+}
+
+func TestAllowedBundlePrefixes(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	allowedDir := filepath.Join(testDir, "allowed")
+	otherDir := filepath.Join(testDir, "allowed-other")
+	for _, bundle := range []string{filepath.Join(allowedDir, "bundle"), filepath.Join(otherDir, "bundle")} {
+		require.NoError(t, os.MkdirAll(bundle, 0755))
+		require.NoError(t, exec.Command("cp", unmodifiedSpecFile, filepath.Join(bundle, specFile)).Run())
+	}
+	require.NoError(t, os.Symlink(filepath.Join(otherDir, "bundle"), filepath.Join(allowedDir, "link")))
+
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nallowed-bundle-prefixes = [\"" + allowedDir + "\"]\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	testCases := []struct {
+		description string
+		argv        []string
+		bundle      string
+		isError     bool
+	}{
+		{
+			description: "allowed bundle",
+			argv:        []string{"create", "--bundle", filepath.Join(allowedDir, "bundle"), "testcontainer"},
+			bundle:      filepath.Join(allowedDir, "bundle"),
+		},
+		{
+			description: "bundle sharing the prefix of an allowed directory",
+			argv:        []string{"create", "--bundle", filepath.Join(otherDir, "bundle"), "testcontainer"},
+			bundle:      filepath.Join(otherDir, "bundle"),
+			isError:     true,
+		},
+		{
+			description: "symlink to a disallowed bundle",
+			argv:        []string{"create", "--bundle", filepath.Join(allowedDir, "link"), "testcontainer"},
+			bundle:      filepath.Join(otherDir, "bundle"),
+			isError:     true,
+		},
+		{
+			description: "modify of an allowed bundle",
+			argv:        []string{"modify", filepath.Join(allowedDir, "bundle")},
+			bundle:      filepath.Join(allowedDir, "bundle"),
+		},
+		{
+			description: "modify of a disallowed bundle from an allowed working directory",
+			argv:        []string{"--cwd", filepath.Join(allowedDir, "bundle"), "modify", filepath.Join(otherDir, "bundle")},
+			bundle:      filepath.Join(otherDir, "bundle"),
+			isError:     true,
+		},
+		{
+			description: "modify of a disallowed bundle among allowed ones",
+			argv:        []string{"modify", "--dry-run", filepath.Join(allowedDir, "bundle"), filepath.Join(otherDir, "bundle")},
+			bundle:      filepath.Join(otherDir, "bundle"),
+			isError:     true,
+		},
+		{
+			description: "disallowed working directory",
+			argv:        []string{"--cwd", filepath.Join(otherDir, "bundle"), "create", "testcontainer"},
+			bundle:      filepath.Join(otherDir, "bundle"),
+			isError:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		cmd := exec.Command(nvidiaRuntime, tc.argv...)
+		cmd.Env = append(os.Environ(), configOverride+"="+configDir)
+		err := cmd.Run()
+
+		spec, specErr := getRuntimeSpec(filepath.Join(tc.bundle, specFile))
+		require.NoError(t, specErr)
+		if tc.isError {
+			require.Error(t, err, tc.description)
+			require.Nil(t, spec.Hooks, tc.description)
+		} else {
+			require.NoError(t, err, tc.description)
+			require.Equal(t, 1, nvidiaHookCount(spec.Hooks), tc.description)
+		}
+	}
+
+	// Commands without a bundle are not restricted.
+	cmd := exec.Command(nvidiaRuntime, "state", "testcontainer")
+	cmd.Env = append(os.Environ(), configOverride+"="+configDir)
+	require.NoError(t, cmd.Run())
+
+	invalidDir, err := writeTestConfig("[nvidia-container-runtime]\nallowed-bundle-prefixes = [\"run/containerd\"]\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(invalidDir)
+	os.Setenv(configOverride, invalidDir)
+	_, err = getConfig()
+	os.Unsetenv(configOverride)
+	require.Error(t, err)
+}
+
+func TestUnknownSubcommand(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	_, err = writeTestScript(testDir, "runc", `echo "$@"`)
+	require.NoError(t, err)
+	strictDir, err := writeTestConfig("[nvidia-container-runtime]\nstrict-subcommands = true\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(strictDir)
+
+	env := append(os.Environ(), "PATH="+testDir+":"+os.Getenv("PATH"))
+	argv := []string{"--root", "/run/runc", "frobnicate", "--bundle", bundlePath, "--all", "create"}
+
+	// An unknown subcommand is passed to the runtime verbatim by default.
+	cmd := exec.Command(nvidiaRuntime, argv...)
+	cmd.Env = env
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	require.Equal(t, strings.Join(argv, " ")+"\n", string(output))
+
+	cmd = exec.Command(nvidiaRuntime, argv...)
+	cmd.Env = append(env, configOverride+"="+strictDir)
+	output, err = cmd.Output()
+	require.Error(t, err, "an unknown subcommand should be rejected with strict-subcommands")
+	require.Empty(t, string(output), "the runtime should not be run")
+
+	// Known subcommands and global flags are still passed to the runtime.
+	for _, argv := range [][]string{{"state", "testcontainer"}, {"--version"}} {
+		cmd = exec.Command(nvidiaRuntime, argv...)
+		cmd.Env = append(env, configOverride+"="+strictDir)
+		output, err = cmd.Output()
+		require.NoError(t, err, argv)
+		require.Equal(t, strings.Join(argv, " ")+"\n", string(output))
+	}
+}
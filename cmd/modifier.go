@@ -0,0 +1,272 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	externalModifierBefore = "before"
+	externalModifierAfter  = "after"
+
+	defaultExternalModifierTimeout = 10
+	defaultPostProcessorTimeout    = 10
+)
+
+// specModifier modifies an OCI specification in place.
+type specModifier func(*specs.Spec) error
+
+// getSpecModifiers returns the chain of modifiers applied to the OCI
+// specification of a container on create, in the order in which they are
+// applied. All modifiers operate on the same spec, and the decisions based on
+// the process environment (device injection and the NVIDIA hook) are made
+// after every modifier that may change it, so that these decisions see the
+// environment of the container as it will be run.
+func getSpecModifiers(cfg *config) []specModifier {
+	var modifiers []specModifier
+
+	var external specModifier
+	if cfg.externalModifier != "" {
+		external = func(spec *specs.Spec) error {
+			err := runExternalModifier(cfg.externalModifier, cfg.externalModifierTimeout, spec)
+			if err != nil {
+				return fmt.Errorf("error running external modifier %v: %v", cfg.externalModifier, err)
+			}
+			return nil
+		}
+	}
+
+	// An external modifier that runs before the hook may change the
+	// environment, so it runs ahead of the environment filters.
+	if external != nil && cfg.externalModifierOrder == externalModifierBefore {
+		modifiers = append(modifiers, external)
+	}
+
+	modifiers = append(modifiers, func(spec *specs.Spec) error {
+		filterEnv(spec, cfg.envAllowlist, cfg.envDenylist)
+		return nil
+	})
+
+	if cfg.forceVisibleDevices != nil {
+		modifiers = append(modifiers, func(spec *specs.Spec) error {
+			forceVisibleDevices(spec, cfg.getVisibleDevicesEnvvar(), *cfg.forceVisibleDevices)
+			return nil
+		})
+	}
+
+	if cfg.visibleDevicesPolicy == visibleDevicesPolicyDeny || cfg.visibleDevicesPolicy == visibleDevicesPolicyRewrite {
+		modifiers = append(modifiers, func(spec *specs.Spec) error {
+			return applyVisibleDevicesPolicy(spec, cfg.getVisibleDevicesEnvvar(), cfg.visibleDevicesPolicy, cfg.visibleDevicesRewrite)
+		})
+	}
+
+	if len(cfg.annotationCapabilities) > 0 {
+		modifiers = append(modifiers, func(spec *specs.Spec) error {
+			applyAnnotationCapabilities(spec, cfg.annotationCapabilities)
+			return nil
+		})
+	}
+
+	// The resolved devices are set after the policy has been applied, so that
+	// they reflect the devices the container is given.
+	if cfg.resolvedDevicesEnv != "" && cfg.resolvedDevicesEnvContainer {
+		modifiers = append(modifiers, func(spec *specs.Spec) error {
+			setResolvedDevicesEnv(spec, cfg.getVisibleDevicesEnvvar(), cfg.resolvedDevicesEnv)
+			return nil
+		})
+	}
+
+	if len(cfg.injectDevices) > 0 {
+		modifiers = append(modifiers, func(spec *specs.Spec) error {
+			if !requestsVisibleDevices(spec, cfg.getVisibleDevicesEnvvar()) {
+				return nil
+			}
+			paths := cfg.injectDevices
+			if cfg.deviceUUIDMap != "" {
+				visibleDevices, _ := getEnvValue(getProcessEnv(spec), cfg.getVisibleDevicesEnvvar())
+				var err error
+				paths, err = selectGPUDevices(paths, visibleDevices, cfg.deviceUUIDMap)
+				if err != nil {
+					return fmt.Errorf("error injecting devices: %v", err)
+				}
+			}
+			err := injectDevices(spec, paths, cfg.deviceCgroupRules, cfg.deviceCgroupConflicts)
+			if err != nil {
+				return fmt.Errorf("error injecting devices: %v", err)
+			}
+			return nil
+		})
+	}
+
+	if cfg.apparmorProfile != "" {
+		modifiers = append(modifiers, func(spec *specs.Spec) error {
+			setApparmorProfile(spec, cfg.apparmorProfile, cfg.forceApparmor)
+			return nil
+		})
+	}
+
+	if cfg.injectInit != "" {
+		modifiers = append(modifiers, func(spec *specs.Spec) error {
+			if cfg.requireProcessArgs && requestsVisibleDevices(spec, cfg.getVisibleDevicesEnvvar()) {
+				err := checkProcessArgs(spec, "inject-init")
+				if err != nil {
+					return err
+				}
+			}
+			return injectInit(spec, cfg.injectInit)
+		})
+	}
+
+	nvidiaHook := func(spec *specs.Spec) error {
+		if reason := getHookSkipReason(spec, cfg); reason != "" {
+			logger.Printf("Not inserting NVIDIA hook: %v", reason)
+			return nil
+		}
+		err := addNVIDIAHook(spec, cfg)
+		if err != nil {
+			return fmt.Errorf("error injecting NVIDIA Container Runtime hook: %v", err)
+		}
+		return nil
+	}
+
+	if cfg.mode == modeCDI {
+		modifiers = append(modifiers, func(spec *specs.Spec) error {
+			return applyCDIDevices(spec, cfg.getVisibleDevicesEnvvar(), cfg.cdiSpecDirs, cfg.cdiDefaultKind)
+		})
+	} else {
+		modifiers = append(modifiers, nvidiaHook)
+	}
+
+	if cfg.stampAnnotations {
+		modifiers = append(modifiers, func(spec *specs.Spec) error {
+			stampAnnotations(spec, cfg)
+			return nil
+		})
+	}
+
+	if external != nil && cfg.externalModifierOrder != externalModifierBefore {
+		modifiers = append(modifiers, external)
+	}
+
+	// Spec patches are applied last so that they can adjust the result of
+	// all other modifications, including the NVIDIA hook.
+	if len(cfg.specPatches) > 0 {
+		modifiers = append(modifiers, func(spec *specs.Spec) error {
+			return applySpecPatches(spec, cfg.specPatches)
+		})
+	}
+
+	// Post-processors see the final spec, so that they can veto it.
+	for _, path := range cfg.postProcessors {
+		path := path
+		modifiers = append(modifiers, func(spec *specs.Spec) error {
+			err := runPostProcessor(path, cfg.postProcessorTimeout, spec)
+			if err != nil {
+				return fmt.Errorf("error running post-processor %v: %w", path, err)
+			}
+			return nil
+		})
+	}
+
+	return modifiers
+}
+
+// runExternalModifier invokes the specified executable with the marshalled
+// spec on stdin. The executable is expected to write the modified spec to
+// stdout, which then replaces the specified spec.
+func runExternalModifier(path string, timeout time.Duration, spec *specs.Spec) error {
+	logger.Printf("Running external modifier %v", path)
+	output, err := runSpecCommand(path, timeout, spec)
+	if err != nil {
+		return err
+	}
+
+	return replaceSpec(spec, output)
+}
+
+// runPostProcessor invokes the specified post-processor with the marshalled
+// spec on stdin. A post-processor exiting with a non-zero code vetoes the
+// spec, while a spec written to stdout replaces the specified spec. An empty
+// output leaves the spec unchanged. The returned error wraps the exit status
+// of a vetoing post-processor, so that the invocation exits with its code.
+func runPostProcessor(path string, timeout time.Duration, spec *specs.Spec) error {
+	logger.Printf("Running post-processor %v", path)
+	output, err := runSpecCommand(path, timeout, spec)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(output)) == 0 {
+		return nil
+	}
+
+	return replaceSpec(spec, output)
+}
+
+// runSpecCommand runs the specified executable with the marshalled spec on
+// stdin and returns its stdout. The executable is killed after the specified
+// timeout.
+func runSpecCommand(path string, timeout time.Duration, spec *specs.Spec) ([]byte, error) {
+	input, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling OCI specification: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(invocationCtx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timed out after %v", timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// replaceSpec replaces the specified spec with the spec returned by an
+// external command.
+func replaceSpec(spec *specs.Spec, output []byte) error {
+	var modified specs.Spec
+	err := json.Unmarshal(output, &modified)
+	if err != nil {
+		return fmt.Errorf("invalid OCI specification returned: %v", err)
+	}
+	if modified.Version == "" {
+		return fmt.Errorf("invalid OCI specification returned: missing ociVersion")
+	}
+
+	*spec = modified
+
+	return nil
+}
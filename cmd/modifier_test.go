@@ -0,0 +1,343 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestScript writes an executable shell script with the specified body to
+// the specified directory.
+func writeTestScript(dir string, name string, body string) (string, error) {
+	filename := filepath.Join(dir, name)
+	err := ioutil.WriteFile(filename, []byte("#!/bin/sh\n"+body+"\n"), 0755)
+	return filename, err
+}
+
+func TestExternalModifier(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	appendMount, err := writeTestScript(testDir, "append-mount",
+		`sed 's;"mounts":\[;"mounts":[{"destination":"/site","type":"bind","source":"/opt/site"},;'`)
+	require.NoError(t, err)
+	invalid, err := writeTestScript(testDir, "invalid", `cat >/dev/null; echo "not json"`)
+	require.NoError(t, err)
+	failing, err := writeTestScript(testDir, "failing", `cat >/dev/null; echo "modifier failed" >&2; exit 1`)
+	require.NoError(t, err)
+	slow, err := writeTestScript(testDir, "slow", `exec sleep 10`)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		description string
+		modifier    string
+		isError     bool
+	}{
+		{
+			description: "modifier appends a mount",
+			modifier:    appendMount,
+		},
+		{
+			description: "modifier returns invalid JSON",
+			modifier:    invalid,
+			isError:     true,
+		},
+		{
+			description: "modifier fails",
+			modifier:    failing,
+			isError:     true,
+		},
+		{
+			description: "modifier times out",
+			modifier:    slow,
+			isError:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		spec, err := getRuntimeSpec(unmodifiedSpecFile)
+		require.NoError(t, err, tc.description)
+		numMounts := len(spec.Mounts)
+
+		err = runExternalModifier(tc.modifier, 500*time.Millisecond, &spec)
+		if tc.isError {
+			require.Error(t, err, tc.description)
+			require.Len(t, spec.Mounts, numMounts, tc.description)
+			continue
+		}
+		require.NoError(t, err, tc.description)
+		require.Len(t, spec.Mounts, numMounts+1, tc.description)
+		require.Equal(t, specs.Mount{Destination: "/site", Type: "bind", Source: "/opt/site"}, spec.Mounts[0], tc.description)
+	}
+}
+
+func TestExternalModifierOrder(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	// The modifier records the spec it receives, which shows whether the
+	// NVIDIA hook was already inserted.
+	input := filepath.Join(testDir, "input.json")
+	recorder, err := writeTestScript(testDir, "recorder", "tee "+input)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		order                string
+		expectedInputHookCnt int
+	}{
+		{
+			order:                externalModifierBefore,
+			expectedInputHookCnt: 0,
+		},
+		{
+			order:                externalModifierAfter,
+			expectedInputHookCnt: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		cfg := &config{
+			externalModifier:        recorder,
+			externalModifierOrder:   tc.order,
+			externalModifierTimeout: 10 * time.Second,
+		}
+
+		spec, err := getRuntimeSpec(unmodifiedSpecFile)
+		require.NoError(t, err, tc.order)
+
+		for _, modify := range getSpecModifiers(cfg) {
+			require.NoError(t, modify(&spec), tc.order)
+		}
+		require.Equal(t, 1, nvidiaHookCount(spec.Hooks), tc.order)
+
+		received, err := getRuntimeSpec(input)
+		require.NoError(t, err, tc.order)
+		hookCount := 0
+		if received.Hooks != nil {
+			hookCount = nvidiaHookCount(received.Hooks)
+		}
+		require.Equal(t, tc.expectedInputHookCnt, hookCount, tc.order)
+	}
+}
+
+func TestPostProcessors(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	// The mutating post-processor records the spec it receives, which shows
+	// whether the NVIDIA hook was already inserted.
+	input := filepath.Join(testDir, "input.json")
+	mutating, err := writeTestScript(testDir, "mutating",
+		`tee `+input+` | sed 's;"mounts":\[;"mounts":[{"destination":"/site","type":"bind","source":"/opt/site"},;'`)
+	require.NoError(t, err)
+	checking, err := writeTestScript(testDir, "checking", `cat >/dev/null`)
+	require.NoError(t, err)
+	vetoing, err := writeTestScript(testDir, "vetoing", `cat >/dev/null; echo "spec rejected" >&2; exit 3`)
+	require.NoError(t, err)
+	slow, err := writeTestScript(testDir, "slow", `exec sleep 10`)
+	require.NoError(t, err)
+
+	modify := func(cfg *config) (specs.Spec, error) {
+		spec, err := getRuntimeSpec(unmodifiedSpecFile)
+		require.NoError(t, err)
+		for _, modify := range getSpecModifiers(cfg) {
+			err := modify(&spec)
+			if err != nil {
+				return spec, err
+			}
+		}
+		return spec, nil
+	}
+
+	original, err := getRuntimeSpec(unmodifiedSpecFile)
+	require.NoError(t, err)
+
+	spec, err := modify(&config{postProcessors: []string{checking, mutating}, postProcessorTimeout: 10 * time.Second})
+	require.NoError(t, err)
+	require.Len(t, spec.Mounts, len(original.Mounts)+1)
+	require.Equal(t, specs.Mount{Destination: "/site", Type: "bind", Source: "/opt/site"}, spec.Mounts[0])
+	received, err := getRuntimeSpec(input)
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(received.Hooks), "post-processors should see the NVIDIA hook")
+
+	_, err = modify(&config{postProcessors: []string{vetoing, mutating}, postProcessorTimeout: 10 * time.Second})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "spec rejected")
+	require.Equal(t, 3, getExitCode(err), "the exit code of a vetoing post-processor should be preserved")
+
+	_, err = modify(&config{postProcessors: []string{slow}, postProcessorTimeout: 500 * time.Millisecond})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out")
+}
+
+func TestPostProcessorVetoesCreate(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	vetoing, err := writeTestScript(testDir, "vetoing", `cat >/dev/null; exit 3`)
+	require.NoError(t, err)
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\npost-processors = [\"" + vetoing + "\"]\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	require.NoError(t, generateNewRuntimeSpec())
+	original, err := ioutil.ReadFile(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+	err = cmdCreate.Run()
+	exitErr, ok := err.(*exec.ExitError)
+	require.True(t, ok, "runtime should fail: %v", err)
+	require.Equal(t, 3, exitErr.ExitCode())
+
+	unmodified, err := ioutil.ReadFile(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Equal(t, original, unmodified, "a vetoed spec should not be written")
+}
+
+func TestSpecModifiersNilProcess(t *testing.T) {
+	forced := "all"
+	testCases := []struct {
+		description string
+		cfg         *config
+		spec        *specs.Spec
+	}{
+		{
+			description: "defaults with nil process",
+			cfg:         &config{},
+			spec:        &specs.Spec{},
+		},
+		{
+			description: "env filters with nil process",
+			cfg:         &config{envAllowlist: []string{"NVIDIA_VISIBLE_DEVICES"}, envDenylist: []string{"NVIDIA_REQUIRE_*"}},
+			spec:        &specs.Spec{},
+		},
+		{
+			description: "forced visible devices with nil process",
+			cfg:         &config{forceVisibleDevices: &forced},
+			spec:        &specs.Spec{},
+		},
+		{
+			description: "apparmor profile with nil process",
+			cfg:         &config{apparmorProfile: "nvidia-gpu", forceApparmor: true},
+			spec:        &specs.Spec{},
+		},
+		{
+			description: "hook stage both with nil process env",
+			cfg:         &config{hookStage: hookStageBoth, envDenylist: []string{"PATH"}},
+			spec:        &specs.Spec{Process: &specs.Process{}},
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, modify := range getSpecModifiers(tc.cfg) {
+			require.NoError(t, modify(tc.spec), tc.description)
+		}
+		require.Nil(t, tc.spec.Hooks, tc.description)
+	}
+}
+
+func TestSpecModifiersSkipPrivileged(t *testing.T) {
+	newSpec := func() *specs.Spec {
+		return &specs.Spec{
+			Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}},
+			Linux: &specs.Linux{
+				Resources: &specs.LinuxResources{
+					Devices: []specs.LinuxDeviceCgroup{{Allow: true, Access: "rwm"}},
+				},
+			},
+		}
+	}
+
+	testCases := []struct {
+		description  string
+		cfg          *config
+		spec         *specs.Spec
+		expectedHook bool
+	}{
+		{
+			description:  "privileged container without skip-privileged",
+			cfg:          &config{},
+			spec:         newSpec(),
+			expectedHook: true,
+		},
+		{
+			description: "privileged container with skip-privileged",
+			cfg:         &config{skipPrivileged: true},
+			spec:        newSpec(),
+		},
+		{
+			description:  "non-privileged container with skip-privileged",
+			cfg:          &config{skipPrivileged: true},
+			spec:         &specs.Spec{Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}}},
+			expectedHook: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, modify := range getSpecModifiers(tc.cfg) {
+			require.NoError(t, modify(tc.spec), tc.description)
+		}
+		require.Equal(t, tc.expectedHook, tc.spec.Hooks != nil && containsNVIDIAHook(tc.spec.Hooks.Prestart), tc.description)
+	}
+}
+
+func TestSpecModifiersSpecPatchesAfterHook(t *testing.T) {
+	spec := &specs.Spec{
+		Version: "1.0.2",
+		Process: &specs.Process{Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}},
+	}
+	cfg := &config{
+		specPatches: []specPatch{{Op: patchOpTest, Path: "/hooks/prestart/0/args/1", Value: "prestart"}},
+	}
+
+	for _, modify := range getSpecModifiers(cfg) {
+		require.NoError(t, modify(spec))
+	}
+	require.Len(t, spec.Hooks.Prestart, 1)
+}
+
+func TestExternalModifierEnvIsHonored(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	setVisibleDevices, err := writeTestScript(testDir, "set-visible-devices",
+		`sed 's;"process":{;"process":{"env":["NVIDIA_VISIBLE_DEVICES=all"],;'`)
+	require.NoError(t, err)
+
+	cfg := &config{
+		injectDevices:           []string{"/dev/null"},
+		deviceCgroupRules:       deviceCgroupRulesDevice,
+		externalModifier:        setVisibleDevices,
+		externalModifierOrder:   externalModifierBefore,
+		externalModifierTimeout: 10 * time.Second,
+	}
+
+	// Without a process environment the hook would not be inserted, so the
+	// hook and the injected device are only present if the environment set
+	// by the external modifier is seen by the later modifiers.
+	spec := specs.Spec{
+		Version: "1.0.0",
+		Process: &specs.Process{},
+		Linux:   &specs.Linux{},
+	}
+
+	for _, modify := range getSpecModifiers(cfg) {
+		require.NoError(t, modify(&spec))
+	}
+	require.Equal(t, []string{"NVIDIA_VISIBLE_DEVICES=all"}, spec.Process.Env)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks))
+	require.True(t, containsDevice(spec.Linux.Devices, "/dev/null"))
+}
@@ -0,0 +1,161 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// modifyOptions holds the options of the modify command.
+type modifyOptions struct {
+	dryRun   bool
+	selects  []string
+	bundles  []string
+	specFile string
+}
+
+// runModify implements the modify command, which applies the modifications
+// made on create to each of the specified bundles:
+//
+//	nvidia-container-runtime modify [--dry-run] [--spec-file NAME] [--select ID]... BUNDLE...
+//
+// With --dry-run the changes are printed instead of written. With --spec-file
+// the OCI specification of each bundle is read from NAME instead of
+// config.json. With --select
+// only the bundles of the specified containers are processed. The id of the
+// container of a bundle is the name of the bundle directory, following the
+// layout used by containerd and docker.
+func runModify(cfg *config, args *args, argv []string) error {
+	_, _, modifyArgs := splitRuntimeArgs(getRuntimeArgs(argv))
+
+	opts, err := parseModifyArgs(modifyArgs)
+	if err != nil {
+		return err
+	}
+	opts.specFile = args.specFile
+
+	return modifyBundles(cfg, opts, os.Stdout)
+}
+
+// parseModifyArgs parses the arguments of the modify command.
+func parseModifyArgs(modifyArgs []string) (*modifyOptions, error) {
+	opts := &modifyOptions{}
+	for i := 0; i < len(modifyArgs); i++ {
+		arg := modifyArgs[i]
+		if !strings.HasPrefix(arg, "-") {
+			opts.bundles = append(opts.bundles, arg)
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)
+		switch parts[0] {
+		case "dry-run":
+			opts.dryRun = true
+		case "select", "bundle", "b":
+			value := ""
+			if len(parts) == 2 {
+				value = parts[1]
+			} else if i+1 < len(modifyArgs) {
+				value = modifyArgs[i+1]
+				i++
+			} else {
+				return nil, fmt.Errorf("%v option needs an argument", parts[0])
+			}
+			if parts[0] == "select" {
+				opts.selects = append(opts.selects, value)
+			} else {
+				opts.bundles = append(opts.bundles, value)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported modify option %v", arg)
+		}
+	}
+
+	if len(opts.bundles) == 0 {
+		return nil, fmt.Errorf("no bundles specified")
+	}
+
+	return opts, nil
+}
+
+// modifyBundles modifies the bundles selected by the specified options. In
+// dry-run mode the changes for each bundle are written to w instead.
+func modifyBundles(cfg *config, opts *modifyOptions, w io.Writer) error {
+	matched := make(map[string]bool)
+	for _, bundle := range opts.bundles {
+		id := getBundleContainerID(bundle)
+		if len(opts.selects) > 0 && !containsString(opts.selects, id) {
+			logger.Printf("Skipping bundle %v of unselected container %v", bundle, id)
+			continue
+		}
+		matched[id] = true
+
+		bundleArgs := &args{bundleDirPath: bundle, specFile: opts.specFile}
+		err := checkAllowedBundle(cfg, bundleArgs)
+		if err != nil {
+			return withCategory(errorCategoryArgs, err)
+		}
+
+		if !opts.dryRun {
+			err := modifyBundle(cfg, bundleArgs, id)
+			if err != nil {
+				return fmt.Errorf("error modifying bundle %v: %v", bundle, err)
+			}
+			continue
+		}
+
+		changes, err := diffBundle(cfg, bundleArgs, id)
+		if err != nil {
+			return fmt.Errorf("error modifying bundle %v: %v", bundle, err)
+		}
+		_, err = fmt.Fprintf(w, "==> %v (%v)\n", bundle, id)
+		if err != nil {
+			return err
+		}
+		err = writeSpecChanges(w, changes)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range opts.selects {
+		if !matched[id] {
+			return fmt.Errorf("no bundle found for selected container %v", id)
+		}
+	}
+
+	return nil
+}
+
+// getBundleContainerID returns the id of the container of the specified
+// bundle.
+func getBundleContainerID(bundle string) string {
+	return filepath.Base(filepath.Clean(bundle))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
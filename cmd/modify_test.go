@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseModifyArgs(t *testing.T) {
+	opts, err := parseModifyArgs([]string{"--dry-run", "--select", "a", "--select=b", "/bundles/a", "-b", "/bundles/b"})
+	require.NoError(t, err)
+	require.Equal(t, &modifyOptions{dryRun: true, selects: []string{"a", "b"}, bundles: []string{"/bundles/a", "/bundles/b"}}, opts)
+
+	_, err = parseModifyArgs([]string{"--dry-run"})
+	require.Error(t, err)
+
+	_, err = parseModifyArgs([]string{"/bundles/a", "--select"})
+	require.Error(t, err)
+
+	_, err = parseModifyArgs([]string{"--force", "/bundles/a"})
+	require.Error(t, err)
+}
+
+func TestModifyDryRunSelect(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	original, err := ioutil.ReadFile(unmodifiedSpecFile)
+	require.NoError(t, err)
+
+	var bundles []string
+	for _, id := range []string{"selected", "other"} {
+		bundle := filepath.Join(testDir, id)
+		require.NoError(t, os.Mkdir(bundle, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(bundle, specFile), original, 0644))
+		bundles = append(bundles, bundle)
+	}
+
+	cmdModify := exec.Command(nvidiaRuntime, append([]string{"modify", "--dry-run", "--select", "selected"}, bundles...)...)
+	cmdModify.Env = append(os.Environ(), configOverride+"=/etc/")
+	output, err := cmdModify.Output()
+	require.NoError(t, err, "runtime should not return an error")
+	require.Contains(t, string(output), "==> "+bundles[0]+" (selected)\n+ /hooks")
+	require.NotContains(t, string(output), bundles[1])
+
+	for _, bundle := range bundles {
+		current, err := ioutil.ReadFile(filepath.Join(bundle, specFile))
+		require.NoError(t, err)
+		require.Equal(t, original, current, "config.json should not be modified")
+	}
+
+	cmdModify = exec.Command(nvidiaRuntime, "modify", "--select", "selected", bundles[0])
+	cmdModify.Env = append(os.Environ(), configOverride+"=/etc/")
+	require.NoError(t, cmdModify.Run(), "runtime should not return an error")
+
+	spec, err := getRuntimeSpec(filepath.Join(bundles[0], specFile))
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks), "exactly one nvidia prestart hook should be present in config.json")
+
+	cmdModify = exec.Command(nvidiaRuntime, "modify", "--dry-run", "--select", "missing", bundles[1])
+	cmdModify.Env = append(os.Environ(), configOverride+"=/etc/")
+	require.Error(t, cmdModify.Run(), "runtime should fail for an unmatched selection")
+}
+
+// {{.ContainerID}} expands to the id of the container of each bundle rather
+// than to an argument of the command line.
+func TestModifyHookArgTemplates(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nhook-arg-templates = [\"--id={{.ContainerID}}\", \"--bundle={{.Bundle}}\"]\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	original, err := ioutil.ReadFile(unmodifiedSpecFile)
+	require.NoError(t, err)
+
+	var bundles []string
+	for _, name := range []string{"b1", "b2"} {
+		bundle := filepath.Join(testDir, name)
+		require.NoError(t, os.Mkdir(bundle, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(bundle, specFile), original, 0644))
+		bundles = append(bundles, bundle)
+	}
+
+	cmdModify := exec.Command(nvidiaRuntime, append([]string{"modify"}, bundles...)...)
+	cmdModify.Env = append(os.Environ(), configOverride+"="+configDir)
+	output, err := cmdModify.CombinedOutput()
+	require.NoError(t, err, "%s", output)
+
+	for _, bundle := range bundles {
+		spec, err := getRuntimeSpec(filepath.Join(bundle, specFile))
+		require.NoError(t, err)
+		require.Equal(t, 1, nvidiaHookCount(spec.Hooks), bundle)
+		require.Equal(t, []string{"--id=" + filepath.Base(bundle), "--bundle=" + bundle}, spec.Hooks.Prestart[0].Args[1:3], bundle)
+	}
+}
+
+func TestModifyMatchesCanonicalize(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nhook-arg-templates = [\"--id={{.ContainerID}}\"]\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	original, err := ioutil.ReadFile(unmodifiedSpecFile)
+	require.NoError(t, err)
+
+	// The bundles of the same container in different directories.
+	modified := filepath.Join(testDir, "modify", "ctr")
+	canonicalized := filepath.Join(testDir, "canonicalize", "ctr")
+	for _, bundle := range []string{modified, canonicalized} {
+		require.NoError(t, os.MkdirAll(bundle, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(bundle, specFile), original, 0644))
+	}
+
+	cmdModify := exec.Command(nvidiaRuntime, "modify", modified)
+	cmdModify.Env = append(os.Environ(), configOverride+"="+configDir)
+	output, err := cmdModify.CombinedOutput()
+	require.NoError(t, err, "%s", output)
+
+	cmdCanonicalize := exec.Command(nvidiaRuntime, "canonicalize", "--modify", "--bundle", canonicalized)
+	cmdCanonicalize.Env = append(os.Environ(), configOverride+"="+configDir)
+	output, err = cmdCanonicalize.CombinedOutput()
+	require.NoError(t, err, "%s", output)
+
+	modifiedSpec, err := getRuntimeSpec(filepath.Join(modified, specFile))
+	require.NoError(t, err)
+	canonicalizedSpec, err := getRuntimeSpec(filepath.Join(canonicalized, specFile))
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(modifiedSpec.Hooks))
+	require.Equal(t, "--id=ctr", modifiedSpec.Hooks.Prestart[0].Args[1])
+	require.Equal(t, canonicalizedSpec, modifiedSpec)
+}
+
+func TestModifySpecFile(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	original, err := ioutil.ReadFile(unmodifiedSpecFile)
+	require.NoError(t, err)
+
+	bundle := filepath.Join(testDir, "custom")
+	require.NoError(t, os.Mkdir(bundle, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bundle, "spec.json"), original, 0644))
+
+	cmdModify := exec.Command(nvidiaRuntime, "modify", "--dry-run", "--spec-file", "spec.json", bundle)
+	cmdModify.Env = append(os.Environ(), configOverride+"=/etc/")
+	output, err := cmdModify.Output()
+	require.NoError(t, err, "runtime should not return an error")
+	require.Contains(t, string(output), "==> "+bundle+" (custom)\n+ /hooks")
+
+	cmdModify = exec.Command(nvidiaRuntime, "modify", "--spec-file=spec.json", bundle)
+	cmdModify.Env = append(os.Environ(), configOverride+"=/etc/")
+	require.NoError(t, cmdModify.Run(), "runtime should not return an error")
+
+	spec, err := getRuntimeSpec(filepath.Join(bundle, "spec.json"))
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks), "exactly one nvidia prestart hook should be present in spec.json")
+	_, err = os.Stat(filepath.Join(bundle, specFile))
+	require.True(t, os.IsNotExist(err), "config.json should not be created")
+
+	cmdModify = exec.Command(nvidiaRuntime, "modify", bundle)
+	cmdModify.Env = append(os.Environ(), configOverride+"=/etc/")
+	require.Error(t, cmdModify.Run(), "runtime should fail without config.json")
+}
+
+func TestGetArgsSpecFile(t *testing.T) {
+	args, err := getArgs([]string{"--spec-file", "spec.json", "diff", "--bundle", "/b"})
+	require.NoError(t, err)
+	require.Equal(t, "spec.json", args.specFile)
+
+	configFilePath, err := args.getConfigFilePath()
+	require.NoError(t, err)
+	require.Equal(t, "/b/spec.json", configFilePath)
+
+	_, err = getArgs([]string{"--spec-file", "spec.json", "create", "--bundle", "/b", "id"})
+	require.Error(t, err, "spec-file is not supported for create")
+
+	_, err = getArgs([]string{"--spec-file", "../spec.json", "diff", "--bundle", "/b"})
+	require.Error(t, err, "spec-file must be a file name")
+}
+
+func TestModifyGzipSpecFile(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	original, err := ioutil.ReadFile(unmodifiedSpecFile)
+	require.NoError(t, err)
+	compressed, err := gzipContent(original)
+	require.NoError(t, err)
+
+	bundle := filepath.Join(testDir, "gzipped")
+	require.NoError(t, os.Mkdir(bundle, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bundle, "config.json.gz"), compressed, 0644))
+
+	cmdModify := exec.Command(nvidiaRuntime, "modify", "--dry-run", "--spec-file", "config.json.gz", bundle)
+	cmdModify.Env = append(os.Environ(), configOverride+"=/etc/")
+	output, err := cmdModify.Output()
+	require.NoError(t, err, "runtime should not return an error")
+	require.Contains(t, string(output), "+ /hooks")
+
+	cmdModify = exec.Command(nvidiaRuntime, "modify", "--spec-file", "config.json.gz", bundle)
+	cmdModify.Env = append(os.Environ(), configOverride+"=/etc/")
+	require.NoError(t, cmdModify.Run(), "runtime should not return an error")
+
+	spec, err := readSpec(filepath.Join(bundle, "config.json.gz"))
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks), "exactly one nvidia prestart hook should be present in config.json.gz")
+}
@@ -0,0 +1,161 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"regexp"
+	"time"
+)
+
+// traceparentEnvvar is the environment variable carrying the W3C trace
+// context of the caller. If set, the events of the invocation are part of the
+// trace of the caller.
+const traceparentEnvvar = "TRACEPARENT"
+
+// otelEventPrefix prefixes the log entries of OpenTelemetry events, so that
+// they can be picked up by log-based collectors.
+const otelEventPrefix = "OTel event: "
+
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// otelTracer identifies the trace of an invocation. The events of all spans of
+// an invocation carry the same trace id.
+type otelTracer struct {
+	enabled      bool
+	traceID      string
+	parentSpanID string
+}
+
+// otelSpan is an operation of an invocation, such as loading the config.
+type otelSpan struct {
+	tracer     *otelTracer
+	name       string
+	spanID     string
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+}
+
+// otelEvent is the log representation of a span, using the field names of the
+// OTLP JSON encoding.
+type otelEvent struct {
+	TraceID           string            `json:"traceId"`
+	SpanID            string            `json:"spanId"`
+	ParentSpanID      string            `json:"parentSpanId,omitempty"`
+	Name              string            `json:"name"`
+	StartTimeUnixNano int64             `json:"startTimeUnixNano"`
+	EndTimeUnixNano   int64             `json:"endTimeUnixNano"`
+	Attributes        map[string]string `json:"attributes,omitempty"`
+	Status            otelStatus        `json:"status"`
+}
+
+type otelStatus struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// invocationTracer is the tracer of the current invocation. Its events are
+// only logged once enabled by the otel config.
+var invocationTracer = newOTelTracer(os.Getenv(traceparentEnvvar))
+
+// newOTelTracer returns a tracer for a new trace, or for the trace of the
+// specified W3C traceparent if valid.
+func newOTelTracer(traceparent string) *otelTracer {
+	if match := traceparentPattern.FindStringSubmatch(traceparent); match != nil {
+		return &otelTracer{traceID: match[1], parentSpanID: match[2]}
+	}
+	return &otelTracer{traceID: newOTelID(16)}
+}
+
+// newOTelID returns a random hex-encoded id of the specified number of bytes.
+func newOTelID(size int) string {
+	id := make([]byte, size)
+	_, err := rand.Read(id)
+	if err != nil {
+		// The time is unique enough to correlate the events of an
+		// invocation.
+		now := time.Now().UnixNano()
+		for i := range id {
+			id[i] = byte(now >> (8 * (i % 8)))
+		}
+	}
+	return hex.EncodeToString(id)
+}
+
+// startSpan starts a span with the specified name and alternating attribute
+// keys and values.
+func (t *otelTracer) startSpan(name string, attributes ...string) *otelSpan {
+	span := &otelSpan{
+		tracer:     t,
+		name:       name,
+		spanID:     newOTelID(8),
+		start:      time.Now(),
+		attributes: map[string]string{},
+	}
+	span.setAttributes(attributes...)
+	return span
+}
+
+func (s *otelSpan) setAttributes(attributes ...string) {
+	for i := 0; i+1 < len(attributes); i += 2 {
+		s.attributes[attributes[i]] = attributes[i+1]
+	}
+}
+
+// finish records the end of the span, which may be emitted later, e.g. once
+// logging is set up.
+func (s *otelSpan) finish() {
+	if s.end.IsZero() {
+		s.end = time.Now()
+	}
+}
+
+// emit finishes the span and logs it as an event if the tracer is enabled. The
+// span fails if err is not nil.
+func (s *otelSpan) emit(err error) {
+	s.finish()
+	if !s.tracer.enabled {
+		return
+	}
+
+	event := otelEvent{
+		TraceID:           s.tracer.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.tracer.parentSpanID,
+		Name:              s.name,
+		StartTimeUnixNano: s.start.UnixNano(),
+		EndTimeUnixNano:   s.end.UnixNano(),
+		Status:            otelStatus{Code: "STATUS_CODE_OK"},
+	}
+	if len(s.attributes) > 0 {
+		event.Attributes = s.attributes
+	}
+	if err != nil {
+		event.Status = otelStatus{Code: "STATUS_CODE_ERROR", Message: err.Error()}
+	}
+
+	data, marshalErr := json.Marshal(event)
+	if marshalErr != nil {
+		logger.Warnf("Error encoding OpenTelemetry event: %v", marshalErr)
+		return
+	}
+	logger.Infof("%v%s", otelEventPrefix, data)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// getOTelEvents returns the OpenTelemetry events in the specified log.
+func getOTelEvents(t *testing.T, log string) []otelEvent {
+	var events []otelEvent
+	for _, line := range strings.Split(log, "\n") {
+		index := strings.Index(line, otelEventPrefix)
+		if index < 0 {
+			continue
+		}
+		var event otelEvent
+		require.NoError(t, json.Unmarshal([]byte(line[index+len(otelEventPrefix):]), &event), line)
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestNewOTelTracer(t *testing.T) {
+	tracer := newOTelTracer("")
+	require.Regexp(t, `^[0-9a-f]{32}$`, tracer.traceID)
+	require.Empty(t, tracer.parentSpanID)
+	require.NotEqual(t, tracer.traceID, newOTelTracer("").traceID)
+
+	tracer = newOTelTracer("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", tracer.traceID)
+	require.Equal(t, "00f067aa0ba902b7", tracer.parentSpanID)
+
+	tracer = newOTelTracer("invalid")
+	require.Regexp(t, `^[0-9a-f]{32}$`, tracer.traceID)
+	require.Empty(t, tracer.parentSpanID)
+}
+
+func TestOTelSpanEmit(t *testing.T) {
+	defer func(l *Logger) { logger = l }(logger)
+	var buffer bytes.Buffer
+	logger = NewLogger()
+	logger.sinks = append(logger.sinks, &buffer)
+	logger.SetLogLevel(logrus.InfoLevel)
+
+	tracer := newOTelTracer("")
+	tracer.startSpan("disabled").emit(nil)
+	require.Empty(t, buffer.String())
+
+	tracer.enabled = true
+	span := tracer.startSpan("mutate", "runtime.subcommand", "create")
+	span.emit(errors.New("failed"))
+	tracer.startSpan("delegate").emit(nil)
+
+	events := getOTelEvents(t, buffer.String())
+	require.Len(t, events, 2)
+	require.Equal(t, "mutate", events[0].Name)
+	require.Equal(t, map[string]string{"runtime.subcommand": "create"}, events[0].Attributes)
+	require.Equal(t, otelStatus{Code: "STATUS_CODE_ERROR", Message: "failed"}, events[0].Status)
+	require.LessOrEqual(t, events[0].StartTimeUnixNano, events[0].EndTimeUnixNano)
+	require.Equal(t, "delegate", events[1].Name)
+	require.Equal(t, "STATUS_CODE_OK", events[1].Status.Code)
+	for _, event := range events {
+		require.Equal(t, tracer.traceID, event.TraceID)
+	}
+	require.NotEqual(t, events[0].SpanID, events[1].SpanID)
+}
+
+func TestOTelEvents(t *testing.T) {
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\notel = true\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	runCreate := func(env ...string) []otelEvent {
+		require.NoError(t, generateNewRuntimeSpec())
+		var stderr bytes.Buffer
+		cmdCreate := exec.Command(nvidiaRuntime, "--log-to-stderr", "create", "--bundle", bundlePath, "testcontainer")
+		cmdCreate.Env = append(append(os.Environ(), configOverride+"="+configDir), env...)
+		cmdCreate.Stderr = &stderr
+		require.NoError(t, cmdCreate.Run(), stderr.String())
+		return getOTelEvents(t, stderr.String())
+	}
+
+	events := runCreate()
+	require.Len(t, events, 3)
+	spanIDs := map[string]bool{}
+	for i, name := range []string{"config.load", "mutate", "delegate"} {
+		require.Equal(t, name, events[i].Name)
+		require.Equal(t, events[0].TraceID, events[i].TraceID, "events of an invocation should share the trace id")
+		require.Empty(t, events[i].ParentSpanID)
+		spanIDs[events[i].SpanID] = true
+	}
+	require.Len(t, spanIDs, 3)
+	require.Equal(t, "true", events[2].Attributes["nvidia.mutated"])
+
+	// Each invocation is a separate trace unless a trace context is passed.
+	require.NotEqual(t, events[0].TraceID, runCreate()[0].TraceID)
+
+	events = runCreate(traceparentEnvvar + "=00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.Len(t, events, 3)
+	for _, event := range events {
+		require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", event.TraceID)
+		require.Equal(t, "00f067aa0ba902b7", event.ParentSpanID)
+	}
+
+	// No events are logged by default.
+	require.NoError(t, generateNewRuntimeSpec())
+	var stderr bytes.Buffer
+	cmdCreate := exec.Command(nvidiaRuntime, "--log-to-stderr", "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Stderr = &stderr
+	require.NoError(t, cmdCreate.Run())
+	require.NotContains(t, stderr.String(), otelEventPrefix)
+}
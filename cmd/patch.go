@@ -0,0 +1,296 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	patchOpAdd     = "add"
+	patchOpRemove  = "remove"
+	patchOpReplace = "replace"
+	patchOpMove    = "move"
+	patchOpCopy    = "copy"
+	patchOpTest    = "test"
+)
+
+// specPatch is a single JSON Patch (RFC 6902) operation applied to the OCI
+// specification.
+type specPatch struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+func (p specPatch) String() string {
+	if p.Op == patchOpMove || p.Op == patchOpCopy {
+		return fmt.Sprintf("%v from %q to %q", p.Op, p.From, p.Path)
+	}
+	return fmt.Sprintf("%v %q", p.Op, p.Path)
+}
+
+// getSpecPatches returns the patches stored as an array of tables at the
+// specified key of the config. A missing key results in a nil slice.
+func getSpecPatches(tree *toml.Tree, key string) ([]specPatch, error) {
+	value := tree.Get(key)
+	if value == nil {
+		return nil, nil
+	}
+
+	tables, ok := value.([]*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("invalid value for %v: expected an array of tables", key)
+	}
+
+	var patches []specPatch
+	for i, table := range tables {
+		// The table is converted through JSON so that values have the same
+		// types as those of the unmarshalled spec.
+		data, err := json.Marshal(table.ToMap())
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %v[%v]: %v", key, i, err)
+		}
+		var patch specPatch
+		err = json.Unmarshal(data, &patch)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %v[%v]: %v", key, i, err)
+		}
+
+		switch patch.Op {
+		case patchOpAdd, patchOpReplace, patchOpTest:
+			if !table.Has("value") {
+				return nil, fmt.Errorf("invalid value for %v[%v]: %v requires a value", key, i, patch.Op)
+			}
+		case patchOpMove, patchOpCopy:
+			if !table.Has("from") {
+				return nil, fmt.Errorf("invalid value for %v[%v]: %v requires from", key, i, patch.Op)
+			}
+		case patchOpRemove:
+		default:
+			return nil, fmt.Errorf("invalid value for %v[%v]: unsupported op %q", key, i, patch.Op)
+		}
+		if !table.Has("path") {
+			return nil, fmt.Errorf("invalid value for %v[%v]: missing path", key, i)
+		}
+
+		patches = append(patches, patch)
+	}
+
+	return patches, nil
+}
+
+// applySpecPatches applies the specified patches to the spec in order. If a
+// patch fails, the spec is left unchanged.
+func applySpecPatches(spec *specs.Spec, patches []specPatch) error {
+	doc, err := toGenericJSON(spec)
+	if err != nil {
+		return fmt.Errorf("error marshalling OCI specification: %v", err)
+	}
+
+	for i, patch := range patches {
+		doc, err = applySpecPatch(doc, patch)
+		if err != nil {
+			return fmt.Errorf("error applying spec patch %v (%v): %v", i, patch, err)
+		}
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("error marshalling patched OCI specification: %v", err)
+	}
+	var patched specs.Spec
+	err = json.Unmarshal(data, &patched)
+	if err != nil {
+		return fmt.Errorf("invalid patched OCI specification: %v", err)
+	}
+
+	*spec = patched
+
+	return nil
+}
+
+// applySpecPatch applies a single patch to the specified generic JSON
+// document, returning the patched document.
+func applySpecPatch(doc interface{}, patch specPatch) (interface{}, error) {
+	path, err := parseJSONPointer(patch.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch patch.Op {
+	case patchOpAdd, patchOpRemove, patchOpReplace:
+		return patchJSONValue(doc, path, patch.Op, patch.Value)
+	case patchOpTest:
+		value, err := getJSONValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, patch.Value) {
+			return nil, fmt.Errorf("test failed: value is %v", formatJSONValue(value))
+		}
+		return doc, nil
+	}
+
+	from, err := parseJSONPointer(patch.From)
+	if err != nil {
+		return nil, err
+	}
+	value, err := getJSONValue(doc, from)
+	if err != nil {
+		return nil, err
+	}
+	switch patch.Op {
+	case patchOpMove:
+		doc, err = patchJSONValue(doc, from, patchOpRemove, nil)
+	case patchOpCopy:
+		// The copy must not share the maps and slices of the original, which
+		// would otherwise be changed along with it by later patches.
+		value, err = toGenericJSON(value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return patchJSONValue(doc, path, patchOpAdd, value)
+}
+
+// parseJSONPointer splits the specified JSON pointer (RFC 6901) into its
+// unescaped reference tokens.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q: must start with /", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// getJSONValue returns the value at the specified path of the document.
+func getJSONValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			value, exists := container[token]
+			if !exists {
+				return nil, fmt.Errorf("key %q does not exist", token)
+			}
+			doc = value
+		case []interface{}:
+			index, err := getArrayIndex(token, len(container)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = container[index]
+		default:
+			return nil, fmt.Errorf("cannot reference %q in a scalar value", token)
+		}
+	}
+	return doc, nil
+}
+
+// patchJSONValue adds, removes or replaces the value at the specified path of
+// the document, returning the patched document.
+func patchJSONValue(doc interface{}, path []string, op string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		if op == patchOpRemove {
+			return nil, fmt.Errorf("cannot remove the whole document")
+		}
+		return value, nil
+	}
+
+	token, last := path[0], len(path) == 1
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		current, exists := container[token]
+		if !exists && (op != patchOpAdd || !last) {
+			return nil, fmt.Errorf("key %q does not exist", token)
+		}
+		if !last {
+			patched, err := patchJSONValue(current, path[1:], op, value)
+			if err != nil {
+				return nil, err
+			}
+			container[token] = patched
+		} else if op == patchOpRemove {
+			delete(container, token)
+		} else {
+			container[token] = value
+		}
+		return container, nil
+	case []interface{}:
+		if last && op == patchOpAdd {
+			index := len(container)
+			if token != "-" {
+				var err error
+				index, err = getArrayIndex(token, len(container))
+				if err != nil {
+					return nil, err
+				}
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		}
+
+		index, err := getArrayIndex(token, len(container)-1)
+		if err != nil {
+			return nil, err
+		}
+		if !last {
+			patched, err := patchJSONValue(container[index], path[1:], op, value)
+			if err != nil {
+				return nil, err
+			}
+			container[index] = patched
+		} else if op == patchOpRemove {
+			container = append(container[:index], container[index+1:]...)
+		} else {
+			container[index] = value
+		}
+		return container, nil
+	}
+
+	return nil, fmt.Errorf("cannot reference %q in a scalar value", token)
+}
+
+// getArrayIndex parses the specified reference token as an array index no
+// larger than max.
+func getArrayIndex(token string, max int) (int, error) {
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index > max {
+		return 0, fmt.Errorf("array index %v out of range", index)
+	}
+	return index, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplySpecPatches(t *testing.T) {
+	spec := &specs.Spec{
+		Version:     "1.0.2",
+		Annotations: map[string]string{"remove": "me", "replace": "old"},
+		Process:     &specs.Process{Env: []string{"A=1", "B=2"}},
+	}
+	patches := []specPatch{
+		{Op: patchOpAdd, Path: "/annotations/foo~1bar", Value: "baz"},
+		{Op: patchOpReplace, Path: "/annotations/replace", Value: "new"},
+		{Op: patchOpRemove, Path: "/annotations/remove"},
+		{Op: patchOpAdd, Path: "/process/env/1", Value: "C=3"},
+		{Op: patchOpAdd, Path: "/process/env/-", Value: "D=4"},
+		{Op: patchOpRemove, Path: "/process/env/0"},
+		{Op: patchOpTest, Path: "/process/env/0", Value: "C=3"},
+		{Op: patchOpCopy, From: "/annotations/replace", Path: "/annotations/copied"},
+		{Op: patchOpMove, From: "/annotations/copied", Path: "/annotations/moved"},
+	}
+
+	require.NoError(t, applySpecPatches(spec, patches))
+	require.Equal(t, map[string]string{"foo/bar": "baz", "replace": "new", "moved": "new"}, spec.Annotations)
+	require.Equal(t, []string{"C=3", "B=2", "D=4"}, spec.Process.Env)
+
+	// A copy is independent of the original.
+	patches = []specPatch{
+		{Op: patchOpCopy, From: "/process/env", Path: "/process/args"},
+		{Op: patchOpReplace, Path: "/process/args/0", Value: "/bin/true"},
+	}
+	require.NoError(t, applySpecPatches(spec, patches))
+	require.Equal(t, []string{"/bin/true", "B=2", "D=4"}, spec.Process.Args)
+	require.Equal(t, []string{"C=3", "B=2", "D=4"}, spec.Process.Env)
+}
+
+func TestApplySpecPatchesErrors(t *testing.T) {
+	testCases := []struct {
+		description string
+		patch       specPatch
+	}{
+		{
+			description: "replace missing key",
+			patch:       specPatch{Op: patchOpReplace, Path: "/annotations/missing", Value: "x"},
+		},
+		{
+			description: "remove out of range index",
+			patch:       specPatch{Op: patchOpRemove, Path: "/process/env/5"},
+		},
+		{
+			description: "add below missing key",
+			patch:       specPatch{Op: patchOpAdd, Path: "/linux/sysctl/foo", Value: "x"},
+		},
+		{
+			description: "relative path",
+			patch:       specPatch{Op: patchOpAdd, Path: "annotations/foo", Value: "x"},
+		},
+		{
+			description: "failed test",
+			patch:       specPatch{Op: patchOpTest, Path: "/ociVersion", Value: "0.0.1"},
+		},
+	}
+
+	for _, tc := range testCases {
+		spec := &specs.Spec{
+			Version:     "1.0.2",
+			Annotations: map[string]string{"foo": "bar"},
+			Process:     &specs.Process{Env: []string{"A=1"}},
+		}
+		err := applySpecPatches(spec, []specPatch{{Op: patchOpAdd, Path: "/annotations/added", Value: "x"}, tc.patch})
+		require.Error(t, err, tc.description)
+		require.Contains(t, err.Error(), tc.patch.String(), tc.description)
+		require.Equal(t, map[string]string{"foo": "bar"}, spec.Annotations, tc.description)
+	}
+
+	// A patch producing an invalid spec is only detected once all patches are
+	// applied.
+	spec := &specs.Spec{Process: &specs.Process{Env: []string{"A=1"}}}
+	require.Error(t, applySpecPatches(spec, []specPatch{{Op: patchOpReplace, Path: "/process/env", Value: "A=1"}}))
+	require.Equal(t, []string{"A=1"}, spec.Process.Env)
+}
+
+func TestGetConfigSpecPatches(t *testing.T) {
+	testDir, err := writeTestConfig(`[[nvidia-container-runtime.spec-patches]]
+op = "add"
+path = "/annotations/foo"
+value = "bar"
+
+[[nvidia-container-runtime.spec-patches]]
+op = "remove"
+path = "/process/env/0"
+`)
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Equal(t, []specPatch{
+		{Op: patchOpAdd, Path: "/annotations/foo", Value: "bar"},
+		{Op: patchOpRemove, Path: "/process/env/0"},
+	}, cfg.specPatches)
+
+	for _, contents := range []string{
+		"[[nvidia-container-runtime.spec-patches]]\nop = \"invalid\"\npath = \"/foo\"\n",
+		"[[nvidia-container-runtime.spec-patches]]\nop = \"add\"\npath = \"/foo\"\n",
+		"[[nvidia-container-runtime.spec-patches]]\nop = \"remove\"\n",
+		"[nvidia-container-runtime]\nspec-patches = \"/foo\"\n",
+	} {
+		testDir, err := writeTestConfig(contents)
+		require.NoError(t, err)
+		defer os.RemoveAll(testDir)
+
+		os.Setenv(configOverride, testDir)
+
+		_, err = getConfig()
+		require.Error(t, err, contents)
+	}
+}
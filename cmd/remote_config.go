@@ -0,0 +1,171 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	defaultConfigURLTimeout  = 5
+	defaultConfigURLCache    = "/var/cache/nvidia-container-runtime/config.toml"
+	defaultConfigURLCacheTTL = 60
+)
+
+// remoteConfig describes where a centrally-managed config is fetched from and
+// how it is cached locally.
+type remoteConfig struct {
+	url       string
+	timeout   time.Duration
+	cachePath string
+	cacheTTL  time.Duration
+	// allowInsecure allows the config to be fetched over plain http. Since
+	// the fetched config controls the commands run for each container, this
+	// is only intended for testing.
+	allowInsecure bool
+}
+
+// loadRemoteConfig fetches the config referenced by the config-url key of the
+// specified local config. The fetched config replaces the local one. A cached
+// copy younger than the configured TTL is used without contacting the server,
+// and the last cached copy is used if the fetch fails.
+func loadRemoteConfig(local *toml.Tree) (*toml.Tree, error) {
+	rc := remoteConfig{
+		url:           local.Get("nvidia-container-runtime.config-url").(string),
+		timeout:       time.Duration(local.GetDefault("nvidia-container-runtime.config-url-timeout", int64(defaultConfigURLTimeout)).(int64)) * time.Second,
+		cachePath:     local.GetDefault("nvidia-container-runtime.config-url-cache", defaultConfigURLCache).(string),
+		cacheTTL:      time.Duration(local.GetDefault("nvidia-container-runtime.config-url-cache-ttl", int64(defaultConfigURLCacheTTL)).(int64)) * time.Second,
+		allowInsecure: local.GetDefault("nvidia-container-runtime.config-url-allow-insecure", false).(bool),
+	}
+
+	switch {
+	case strings.HasPrefix(rc.url, "https://"):
+	case strings.HasPrefix(rc.url, "http://"):
+		if !rc.allowInsecure {
+			return nil, fmt.Errorf("invalid config-url %q: http:// is only supported if config-url-allow-insecure is set", rc.url)
+		}
+	default:
+		return nil, fmt.Errorf("invalid config-url %q: only https:// is supported", rc.url)
+	}
+
+	content, err := rc.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return toml.Load(string(content))
+}
+
+// load returns the contents of the remote config, using the on-disk cache
+// where possible.
+func (rc remoteConfig) load() ([]byte, error) {
+	if info, err := os.Stat(rc.cachePath); err == nil && time.Since(info.ModTime()) < rc.cacheTTL {
+		return ioutil.ReadFile(rc.cachePath)
+	}
+
+	content, err := rc.fetch()
+	if err != nil {
+		cached, cacheErr := ioutil.ReadFile(rc.cachePath)
+		if cacheErr != nil {
+			return nil, fmt.Errorf("error fetching config from %v: %v", rc.url, err)
+		}
+		logger.Warnf("Error fetching config from %v, using cached copy %v: %v", rc.url, rc.cachePath, err)
+		return cached, nil
+	}
+
+	if err := rc.updateCache(content); err != nil {
+		logger.Warnf("Error caching config from %v: %v", rc.url, err)
+	}
+
+	return content, nil
+}
+
+// fetch downloads the remote config. TLS certificates are always verified,
+// and redirects to plain http are refused unless config-url-allow-insecure is
+// set.
+func (rc remoteConfig) fetch() ([]byte, error) {
+	client := &http.Client{
+		Timeout: rc.timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" && !rc.allowInsecure {
+				return fmt.Errorf("refusing redirect to insecure URL %v", req.URL)
+			}
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			return nil
+		},
+	}
+
+	req, err := http.NewRequestWithContext(invocationCtx, http.MethodGet, rc.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %v", resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := toml.Load(string(content)); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+
+	return content, nil
+}
+
+// updateCache replaces the cached copy of the remote config. The content is
+// written to a temporary file first so that readers never see a partial file.
+func (rc remoteConfig) updateCache(content []byte) error {
+	cacheDir := filepath.Dir(rc.cachePath)
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(cacheDir, filepath.Base(rc.cachePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), rc.cachePath)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetConfigFromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "[nvidia-container-runtime]\ndebug = \"/remote.log\"\n")
+	}))
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "nvidia-container-runtime-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+	cachePath := filepath.Join(cacheDir, "config.toml")
+
+	testDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\ndebug = \"/local.log\"\nconfig-url = %q\nconfig-url-allow-insecure = true\nconfig-url-cache = %q\n", server.URL, cachePath))
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Equal(t, "/remote.log", cfg.debugFilePath)
+
+	cached, err := ioutil.ReadFile(cachePath)
+	require.NoError(t, err)
+	require.Contains(t, string(cached), "/remote.log")
+}
+
+func TestGetConfigFromURLFallbackToCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "[nvidia-container-runtime]\ndebug = \"/remote.log\"\n")
+	}))
+
+	cacheDir, err := ioutil.TempDir("", "nvidia-container-runtime-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+	cachePath := filepath.Join(cacheDir, "config.toml")
+
+	// A TTL of 0 forces the config to be fetched on every call.
+	testDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\nconfig-url = %q\nconfig-url-allow-insecure = true\nconfig-url-cache = %q\nconfig-url-cache-ttl = 0\n", server.URL, cachePath))
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Equal(t, "/remote.log", cfg.debugFilePath)
+
+	server.Close()
+	cfg, err = getConfig()
+	require.NoError(t, err)
+	require.Equal(t, "/remote.log", cfg.debugFilePath)
+
+	// Without a cached copy the fetch failure is an error.
+	require.NoError(t, os.Remove(cachePath))
+	_, err = getConfig()
+	require.Error(t, err)
+}
+
+func TestGetConfigSourcesFromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "[nvidia-container-runtime]\nruntime = \"runc\"\n")
+	}))
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "nvidia-container-runtime-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+	cachePath := filepath.Join(cacheDir, "config.toml")
+
+	testDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\ndebug = \"/local.log\"\nconfig-url = %q\nconfig-url-allow-insecure = true\nconfig-url-cache = %q\n", server.URL, cachePath))
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	_, sources, err := getConfigWithSources()
+	require.NoError(t, err)
+
+	file := "file:" + filepath.Join(testDir, configFilePath)
+	require.Equal(t, "url:"+server.URL, sources["runtime"])
+	// The local config is replaced by the remote one.
+	require.Equal(t, configSourceDefault, sources["debug"])
+	require.Equal(t, file, sources["config-url"])
+	require.Equal(t, file, sources["config-url-cache"])
+	require.Equal(t, configSourceDefault, sources["config-url-timeout"])
+}
+
+func TestGetConfigFromURLInsecure(t *testing.T) {
+	fetched := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+		fmt.Fprint(w, "[nvidia-container-runtime]\ndebug = \"/remote.log\"\n")
+	}))
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "nvidia-container-runtime-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+	cachePath := filepath.Join(cacheDir, "config.toml")
+
+	testDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\nconfig-url = %q\nconfig-url-cache = %q\n", server.URL, cachePath))
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+	defer os.Unsetenv(configOverride)
+
+	_, err = getConfig()
+	require.Error(t, err, "http should be rejected by default")
+	require.Contains(t, err.Error(), "config-url-allow-insecure")
+	require.False(t, fetched)
+}
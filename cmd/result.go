@@ -0,0 +1,105 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// invocationResultFile is the file that the result of the current invocation
+// is written to, if any. It is set from the --result-file flag, or from the
+// result-file config once loaded.
+var invocationResultFile string
+
+// invocationFileMode is the file-mode of the current invocation, applied to its
+// result file. It is set once the config is loaded.
+var invocationFileMode *os.FileMode
+
+// invocationResult is the content of the result file.
+type invocationResult struct {
+	ExitCode        int     `json:"exitCode"`
+	ErrorCategory   string  `json:"errorCategory,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	StartTime       string  `json:"startTime"`
+	EndTime         string  `json:"endTime"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// writeResultFile writes the result of an invocation that started at the
+// specified time and returned the specified error to the specified file, with
+// the specified mode if any and 0644 otherwise. The file is replaced
+// atomically through a uniquely named temporary file, so that it is never read
+// partially written, including by concurrent invocations.
+func writeResultFile(path string, mode *os.FileMode, err error, start time.Time, end time.Time) error {
+	result := invocationResult{
+		ExitCode:        getExitCode(err),
+		ErrorCategory:   getErrorCategory(err),
+		StartTime:       start.UTC().Format(time.RFC3339Nano),
+		EndTime:         end.UTC().Format(time.RFC3339Nano),
+		DurationSeconds: end.Sub(start).Seconds(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	content, marshalErr := json.MarshalIndent(result, "", "  ")
+	if marshalErr != nil {
+		return fmt.Errorf("error encoding result: %v", marshalErr)
+	}
+
+	tmpFile, writeErr := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if writeErr != nil {
+		return fmt.Errorf("error writing result file: %v", writeErr)
+	}
+	// Removing the temporary file fails once it has been renamed.
+	defer os.Remove(tmpFile.Name())
+
+	perm := os.FileMode(0644)
+	if mode != nil {
+		perm = *mode
+	}
+	_, writeErr = tmpFile.Write(append(content, '\n'))
+	if writeErr == nil {
+		writeErr = tmpFile.Chmod(perm)
+	}
+	if closeErr := tmpFile.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(tmpFile.Name(), path)
+	}
+	if writeErr != nil {
+		return fmt.Errorf("error writing result file: %v", writeErr)
+	}
+	return nil
+}
+
+// getResultFile returns the value of the --result-file flag in the specified
+// argv. The result is also written if the invocation fails before the command
+// line is processed, so the flag is looked up ahead of it.
+func getResultFile(argv []string) string {
+	args, _, err := parseArgs(argv)
+	if err != nil {
+		return ""
+	}
+	return args.resultFile
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readResultFile(t *testing.T, path string) invocationResult {
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var result invocationResult
+	require.NoError(t, json.Unmarshal(content, &result), string(content))
+	return result
+}
+
+func TestWriteResultFile(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	path := filepath.Join(testDir, "result.json")
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, writeResultFile(path, nil, nil, start, start.Add(1500*time.Millisecond)))
+	require.Equal(t, invocationResult{
+		ExitCode:        0,
+		StartTime:       "2021-06-01T12:00:00Z",
+		EndTime:         "2021-06-01T12:00:01.5Z",
+		DurationSeconds: 1.5,
+	}, readResultFile(t, path))
+
+	require.NoError(t, writeResultFile(path, nil, withCategory(errorCategorySpec, errors.New("invalid spec")), start, start))
+	result := readResultFile(t, path)
+	require.Equal(t, exitCodeError, result.ExitCode)
+	require.Equal(t, errorCategorySpec, result.ErrorCategory)
+	require.Equal(t, "invalid spec", result.Error)
+
+	files, err := ioutil.ReadDir(testDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1, "no temporary file should be left behind")
+
+	// A stale temporary file of another writer does not get in the way.
+	require.NoError(t, os.Mkdir(path+".tmp", 0755))
+	require.NoError(t, writeResultFile(path, nil, nil, start, start))
+	require.Equal(t, 0, readResultFile(t, path).ExitCode)
+
+	require.Error(t, writeResultFile(filepath.Join(testDir, "missing", "result.json"), nil, nil, start, start))
+}
+
+func TestResultFile(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	failingRuntime, err := writeTestScript(testDir, "failing-runc", `echo "runc output"; exit 7`)
+	require.NoError(t, err)
+	resultPath := filepath.Join(testDir, "result.json")
+
+	configDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\nresult-file = %q\n", resultPath))
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+	failingDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\nresult-file = %q\nruntime = %q\n", resultPath, failingRuntime))
+	require.NoError(t, err)
+	defer os.RemoveAll(failingDir)
+	invalidDir, err := writeTestConfig("[nvidia-container-runtime]\nhook-stage = \"invalid\"\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(invalidDir)
+
+	testCases := []struct {
+		description      string
+		configDir        string
+		argv             []string
+		expectedExitCode int
+		expectedCategory string
+		expectedOutput   string
+	}{
+		{
+			description:    "successful create",
+			configDir:      configDir,
+			argv:           []string{"create", "--bundle", bundlePath, "testcontainer"},
+			expectedOutput: "mock runc",
+		},
+		{
+			description:    "successful passthrough",
+			configDir:      configDir,
+			argv:           []string{"state", "testcontainer"},
+			expectedOutput: "mock runc",
+		},
+		{
+			description:      "failed create",
+			configDir:        failingDir,
+			argv:             []string{"create", "--bundle", bundlePath, "testcontainer"},
+			expectedExitCode: 7,
+			expectedCategory: errorCategoryRuntime,
+			expectedOutput:   "runc output",
+		},
+		{
+			description:      "missing bundle",
+			configDir:        configDir,
+			argv:             []string{"create", "--bundle", filepath.Join(testDir, "missing"), "testcontainer"},
+			expectedExitCode: exitCodeError,
+			expectedCategory: errorCategorySpec,
+		},
+		{
+			description:      "invalid config with flag",
+			configDir:        invalidDir,
+			argv:             []string{"--result-file", resultPath, "state", "testcontainer"},
+			expectedExitCode: exitCodeError,
+			expectedCategory: errorCategoryConfig,
+		},
+	}
+
+	for _, tc := range testCases {
+		require.NoError(t, generateNewRuntimeSpec())
+		os.Remove(resultPath)
+
+		cmd := exec.Command(nvidiaRuntime, tc.argv...)
+		cmd.Env = append(os.Environ(), configOverride+"="+tc.configDir)
+		output, err := cmd.Output()
+		require.Equal(t, tc.expectedExitCode, cmd.ProcessState.ExitCode(), "%v: %v", tc.description, err)
+		require.Contains(t, string(output), tc.expectedOutput, tc.description)
+
+		result := readResultFile(t, resultPath)
+		require.Equal(t, tc.expectedExitCode, result.ExitCode, tc.description)
+		require.Equal(t, tc.expectedCategory, result.ErrorCategory, tc.description)
+		if tc.expectedExitCode == 0 {
+			require.Empty(t, result.Error, tc.description)
+		} else {
+			require.NotEmpty(t, result.Error, tc.description)
+		}
+		start, err := time.Parse(time.RFC3339Nano, result.StartTime)
+		require.NoError(t, err)
+		end, err := time.Parse(time.RFC3339Nano, result.EndTime)
+		require.NoError(t, err)
+		require.False(t, end.Before(start), tc.description)
+		require.GreaterOrEqual(t, result.DurationSeconds, 0.0, tc.description)
+	}
+
+	// A result file is written by the other commands of the runtime too.
+	os.Remove(resultPath)
+	cmd := exec.Command(nvidiaRuntime, "--result-file", resultPath, "modify", "--dry-run", "--bundle", bundlePath)
+	require.NoError(t, cmd.Run())
+	require.Equal(t, 0, readResultFile(t, resultPath).ExitCode)
+}
+
+func TestResultFileRuntimeSettings(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("oom_score_adj is only supported on Linux")
+	}
+
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	scoresFile := filepath.Join(testDir, "scores")
+	scoreRuntime, err := writeTestScript(testDir, "score-runc", `cat /proc/self/oom_score_adj >> `+scoresFile)
+	require.NoError(t, err)
+	resultPath := filepath.Join(testDir, "result.json")
+
+	// The low-level runtime running as a child process to record its result
+	// gets the same settings as any other delegation.
+	configDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\nresult-file = %q\nruntime = %q\nruntime-oom-score-adj = 500\n", resultPath, scoreRuntime))
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	cmd := exec.Command(nvidiaRuntime, "state", "testcontainer")
+	cmd.Env = append(os.Environ(), configOverride+"="+configDir)
+	require.NoError(t, cmd.Run())
+	require.Equal(t, 0, readResultFile(t, resultPath).ExitCode)
+
+	scores, err := ioutil.ReadFile(scoresFile)
+	require.NoError(t, err)
+	require.Equal(t, []string{"500"}, strings.Fields(string(scores)))
+}
@@ -0,0 +1,153 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pelletier/go-toml"
+)
+
+// runtimeRlimitResources are the resource limits that can be configured for
+// the low-level runtime, along with their config key.
+var runtimeRlimitResources = []struct {
+	name     string
+	key      string
+	resource int
+}{
+	{"as", "nvidia-container-runtime.runtime-rlimit-as", syscall.RLIMIT_AS},
+	{"data", "nvidia-container-runtime.runtime-rlimit-data", syscall.RLIMIT_DATA},
+	{"nofile", "nvidia-container-runtime.runtime-rlimit-nofile", syscall.RLIMIT_NOFILE},
+}
+
+// runtimeRlimit is the soft limit of a resource of the low-level runtime.
+type runtimeRlimit struct {
+	name     string
+	resource int
+	value    uint64
+}
+
+// getRuntimeRlimits returns the runtime-rlimit-* keys set in the config, in
+// the order of runtimeRlimitResources.
+func getRuntimeRlimits(tree *toml.Tree) ([]runtimeRlimit, error) {
+	var limits []runtimeRlimit
+	for _, r := range runtimeRlimitResources {
+		if !tree.Has(r.key) {
+			continue
+		}
+		value, ok := tree.Get(r.key).(int64)
+		if !ok || value <= 0 {
+			return nil, fmt.Errorf("invalid runtime-rlimit-%v: expected a positive integer", r.name)
+		}
+		limits = append(limits, runtimeRlimit{name: r.name, resource: r.resource, value: uint64(value)})
+	}
+	return limits, nil
+}
+
+// pinContainerRlimits sets the limits of the process of the specified spec for
+// the resources of the specified runtime limits that it does not list to those
+// of the current process. runc only sets the limits listed in the spec, so the
+// container would otherwise inherit the runtime limits from the low-level
+// runtime rather than the limits of the caller.
+func pinContainerRlimits(spec *specs.Spec, limits []runtimeRlimit) error {
+	if spec.Process == nil {
+		return nil
+	}
+
+	for _, limit := range limits {
+		rlimitType := "RLIMIT_" + strings.ToUpper(limit.name)
+		listed := false
+		for _, r := range spec.Process.Rlimits {
+			listed = listed || r.Type == rlimitType
+		}
+		if listed {
+			continue
+		}
+
+		var rlimit syscall.Rlimit
+		err := syscall.Getrlimit(limit.resource, &rlimit)
+		if err != nil {
+			return fmt.Errorf("error getting runtime-rlimit-%v: %v", limit.name, err)
+		}
+		logger.Printf("Pinning %v of the container to %v", rlimitType, rlimit.Cur)
+		spec.Process.Rlimits = append(spec.Process.Rlimits, specs.POSIXRlimit{Type: rlimitType, Hard: rlimit.Max, Soft: rlimit.Cur})
+	}
+	return nil
+}
+
+// getDelegationRlimits returns the runtime limits applied to the low-level
+// runtime run with the specified argv. The processes started by exec inherit
+// the limits of the low-level runtime, and unlike those of the container their
+// limits are not pinned, so no limits are applied to exec.
+func getDelegationRlimits(cfg *config, argv []string) []runtimeRlimit {
+	if _, subcommand, _ := splitRuntimeArgs(argv[1:]); subcommand == "exec" {
+		return nil
+	}
+	return cfg.runtimeRlimits
+}
+
+// setRuntimeRlimits sets the soft limits of the current process to the
+// specified limits, so that they are inherited by the low-level runtime when
+// it is started or replaces the current process. There is no process
+// attribute for this, so the returned function restores the previous limits
+// once the runtime has been started. The hard limits are left unchanged, both
+// to allow restoring the soft limits and because lowering them requires no
+// privilege while raising them back does. A limit exceeding the hard limit is
+// an error. This is only supported on Linux.
+func setRuntimeRlimits(limits []runtimeRlimit) (func(), error) {
+	var previous []runtimeRlimit
+	restore := func() {
+		for i := len(previous) - 1; i >= 0; i-- {
+			var rlimit syscall.Rlimit
+			err := syscall.Getrlimit(previous[i].resource, &rlimit)
+			if err == nil {
+				rlimit.Cur = previous[i].value
+				err = syscall.Setrlimit(previous[i].resource, &rlimit)
+			}
+			if err != nil {
+				logger.Warnf("Error restoring runtime-rlimit-%v: %v", previous[i].name, err)
+			}
+		}
+	}
+
+	for _, limit := range limits {
+		var rlimit syscall.Rlimit
+		err := syscall.Getrlimit(limit.resource, &rlimit)
+		if err != nil {
+			restore()
+			return nil, fmt.Errorf("error getting runtime-rlimit-%v: %v", limit.name, err)
+		}
+		if limit.value > rlimit.Max {
+			restore()
+			return nil, fmt.Errorf("invalid runtime-rlimit-%v %v: exceeds the hard limit %v", limit.name, limit.value, rlimit.Max)
+		}
+
+		logger.Printf("Setting runtime-rlimit-%v of the runtime to %v", limit.name, limit.value)
+		current := rlimit.Cur
+		rlimit.Cur = limit.value
+		err = syscall.Setrlimit(limit.resource, &rlimit)
+		if err != nil {
+			restore()
+			return nil, fmt.Errorf("error setting runtime-rlimit-%v: %v", limit.name, err)
+		}
+		previous = append(previous, runtimeRlimit{name: limit.name, resource: limit.resource, value: current})
+	}
+	return restore, nil
+}
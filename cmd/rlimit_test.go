@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pelletier/go-toml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRuntimeRlimits(t *testing.T) {
+	tree, err := toml.Load("[nvidia-container-runtime]\nruntime-rlimit-nofile = 512\nruntime-rlimit-as = 4294967296\n")
+	require.NoError(t, err)
+	limits, err := getRuntimeRlimits(tree)
+	require.NoError(t, err)
+	require.Equal(t, []runtimeRlimit{
+		{name: "as", resource: syscall.RLIMIT_AS, value: 4294967296},
+		{name: "nofile", resource: syscall.RLIMIT_NOFILE, value: 512},
+	}, limits)
+
+	tree, err = toml.Load("[nvidia-container-runtime]\n")
+	require.NoError(t, err)
+	limits, err = getRuntimeRlimits(tree)
+	require.NoError(t, err)
+	require.Empty(t, limits)
+
+	for _, contents := range []string{
+		"[nvidia-container-runtime]\nruntime-rlimit-nofile = 0\n",
+		"[nvidia-container-runtime]\nruntime-rlimit-data = -1\n",
+		"[nvidia-container-runtime]\nruntime-rlimit-as = \"4G\"\n",
+	} {
+		tree, err = toml.Load(contents)
+		require.NoError(t, err)
+		_, err = getRuntimeRlimits(tree)
+		require.Error(t, err, contents)
+	}
+}
+
+func TestSetRuntimeRlimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("runtime-rlimit-* is only supported on Linux")
+	}
+
+	var original syscall.Rlimit
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &original))
+	if original.Cur <= 64 {
+		t.Skip("the soft limit of open files is too low")
+	}
+
+	restore, err := setRuntimeRlimits([]runtimeRlimit{{name: "nofile", resource: syscall.RLIMIT_NOFILE, value: 64}})
+	require.NoError(t, err)
+	var rlimit syscall.Rlimit
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit))
+	require.Equal(t, syscall.Rlimit{Cur: 64, Max: original.Max}, rlimit)
+
+	restore()
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit))
+	require.Equal(t, original, rlimit)
+
+	if original.Max != ^uint64(0) {
+		_, err = setRuntimeRlimits([]runtimeRlimit{{name: "nofile", resource: syscall.RLIMIT_NOFILE, value: original.Max + 1}})
+		require.Error(t, err, "a limit exceeding the hard limit should be rejected")
+		require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit))
+		require.Equal(t, original, rlimit)
+	}
+}
+
+func TestRuntimeRlimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("runtime-rlimit-* is only supported on Linux")
+	}
+
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	limitsFile := filepath.Join(testDir, "limits")
+	_, err = writeTestScript(testDir, "runc", `echo "$(ulimit -n):$(ulimit -v)" >> `+limitsFile)
+	require.NoError(t, err)
+
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nruntime-rlimit-nofile = 64\nruntime-rlimit-as = 4294967296\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+	createStartDir, err := writeTestConfig("[nvidia-container-runtime]\nrun-as-create-start = true\nruntime-rlimit-nofile = 64\nruntime-rlimit-as = 4294967296\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(createStartDir)
+
+	env := append(os.Environ(), "PATH="+testDir+":"+os.Getenv("PATH"))
+
+	// runc replaces the current process.
+	cmdState := exec.Command(nvidiaRuntime, "state", "testcontainer")
+	cmdState.Env = append(env, configOverride+"="+configDir)
+	require.NoError(t, cmdState.Run(), "runtime should not return an error")
+
+	// runc is run as a child process.
+	require.NoError(t, generateNewRuntimeSpec())
+	cmdRun := exec.Command(nvidiaRuntime, "run", "--bundle", bundlePath, "testcontainer")
+	cmdRun.Env = append(env, configOverride+"="+createStartDir)
+	require.NoError(t, cmdRun.Run(), "runtime should not return an error")
+
+	limits, err := ioutil.ReadFile(limitsFile)
+	require.NoError(t, err)
+	require.Equal(t, []string{"64:4194304", "64:4194304", "64:4194304"}, strings.Fields(string(limits)))
+
+	// The limits of the container that its spec does not set are pinned to
+	// those of the caller, since the container would otherwise inherit them
+	// from runc. The limits set by the spec are left unchanged.
+	var nofile, as syscall.Rlimit
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &nofile))
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_AS, &as))
+	require.NotEqual(t, uint64(128), nofile.Cur)
+
+	require.NoError(t, generateNewRuntimeSpec())
+	spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	spec.Process.Rlimits = []specs.POSIXRlimit{{Type: "RLIMIT_NOFILE", Hard: 128, Soft: 128}}
+	require.NoError(t, writeRuntimeSpec(filepath.Join(bundlePath, specFile), &spec))
+	cmdRun = exec.Command(nvidiaRuntime, "run", "--bundle", bundlePath, "testcontainer")
+	cmdRun.Env = append(env, configOverride+"="+createStartDir)
+	require.NoError(t, cmdRun.Run(), "runtime should not return an error")
+	spec, err = getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Equal(t, []specs.POSIXRlimit{
+		{Type: "RLIMIT_NOFILE", Hard: 128, Soft: 128},
+		{Type: "RLIMIT_AS", Hard: as.Max, Soft: as.Cur},
+	}, spec.Process.Rlimits)
+
+	// The processes started by exec are not limited either.
+	require.NoError(t, os.Remove(limitsFile))
+	cmdExec := exec.Command(nvidiaRuntime, "exec", "testcontainer", "true")
+	cmdExec.Env = append(env, configOverride+"="+configDir)
+	require.NoError(t, cmdExec.Run(), "runtime should not return an error")
+	limits, err = ioutil.ReadFile(limitsFile)
+	require.NoError(t, err)
+	require.NotEqual(t, "64:4194304", strings.TrimSpace(string(limits)))
+}
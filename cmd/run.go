@@ -0,0 +1,289 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const oomScoreAdjPath = "/proc/self/oom_score_adj"
+
+// forwardedSignals are the signals forwarded to the low-level runtime when it
+// runs as a child process, so that it can be interrupted as if it replaced the
+// current process.
+var forwardedSignals = []os.Signal{
+	syscall.SIGHUP,
+	syscall.SIGINT,
+	syscall.SIGQUIT,
+	syscall.SIGTERM,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+	syscall.SIGWINCH,
+}
+
+// runOnlyFlags lists the flags of runc run that are not accepted by runc
+// create. These are dropped when a run is split into a create and a start.
+var runOnlyFlags = map[string]bool{
+	"detach":       true,
+	"d":            true,
+	"keep":         true,
+	"no-subreaper": true,
+}
+
+// runAsCreateStart implements runc run as a runc create of the modified
+// bundle followed by a runc start, both delegated to the low-level runtime.
+// If either call fails, the container is deleted and the exit code of the
+// failed call is preserved. Since runc start does not wait for the container
+// process to exit, the container is always detached.
+func runAsCreateStart(cfg *config, args *args) error {
+	globalArgs, _, runArgs := splitRuntimeArgs(getRuntimeArgs(os.Args[1:]))
+
+	id := getContainerID(runArgs)
+	if id == "" {
+		return fmt.Errorf("container id cannot be empty")
+	}
+
+	var createArgs []string
+	for _, arg := range runArgs {
+		flag := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		if strings.HasPrefix(arg, "-") && runOnlyFlags[flag] {
+			logger.Printf("Dropping %v from runc create", arg)
+			continue
+		}
+		createArgs = append(createArgs, arg)
+	}
+
+	err := checkRuntimeVersion(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = modifyBundle(cfg, args, id)
+	if err != nil {
+		return err
+	}
+
+	if args.cwd != "" {
+		logger.Printf("Executing runc in directory %v", args.cwd)
+		err = os.Chdir(args.cwd)
+		if err != nil {
+			return fmt.Errorf("error changing to directory %v: %v", args.cwd, err)
+		}
+	}
+
+	err = runRuntime(cfg, args, globalArgs, "create", createArgs...)
+	if err != nil {
+		deleteContainer(cfg, args, globalArgs, id)
+		return fmt.Errorf("error creating container %v: %w", id, err)
+	}
+
+	err = runRuntime(cfg, args, globalArgs, "start", id)
+	if err != nil {
+		deleteContainer(cfg, args, globalArgs, id)
+		return fmt.Errorf("error starting container %v: %w", id, err)
+	}
+
+	return nil
+}
+
+// deleteContainer forcibly deletes the specified container after a failed run.
+// Errors are only logged since the original failure is reported instead.
+func deleteContainer(cfg *config, args *args, globalArgs []string, id string) {
+	err := runRuntime(cfg, args, globalArgs, "delete", "--force", id)
+	if err != nil {
+		logger.Warnf("Error deleting container %v: %v", id, err)
+	}
+}
+
+// runRuntime runs the specified runc subcommand as a child process, see
+// runRuntimeCommand. If the --print-exec flag was specified, the command line
+// is printed to stdout instead.
+func runRuntime(cfg *config, args *args, globalArgs []string, subcommand string, subcommandArgs ...string) error {
+	var runtimeArgs []string
+	runtimeArgs = append(runtimeArgs, globalArgs...)
+	runtimeArgs = append(runtimeArgs, subcommand)
+	runtimeArgs = append(runtimeArgs, subcommandArgs...)
+
+	argv, err := getRuncCommand(cfg.runtime, runtimeArgs)
+	if err != nil {
+		return err
+	}
+	argv = append([]string{argv[0]}, addConfiguredRuntimeArgs(argv[1:], cfg.runtimeArgs)...)
+
+	if args.printExec {
+		fmt.Println(formatCommandLine(argv))
+		return nil
+	}
+
+	logger.Printf("Running %v", formatCommandLine(argv))
+	return runRuntimeCommand(cfg, argv)
+}
+
+// runRuntimeCommand runs the low-level runtime with the specified argv as a
+// child process sharing the stdio of the current process. If
+// runtime-oom-score-adj is set, it is applied to the child process, as are
+// runtime-user, runtime-group and the runtime-rlimit-* keys. The signals in
+// forwardedSignals are forwarded to the child, which is killed once the
+// invocation times out. A failure is diagnosed as configured by
+// verbose-errors. The returned error wraps the exit status of the child.
+func runRuntimeCommand(cfg *config, argv []string) error {
+	cmd := exec.CommandContext(invocationCtx, argv[0], argv[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = invocationDiagnostics.getStderr()
+	cmd.Env = getRuntimeEnv(os.Environ(), cfg.runtimeEnvAllowlist)
+	if cfg.runtimeCredential != nil {
+		logger.Printf("Running %v as uid %d, gid %d", argv[0], cfg.runtimeCredential.Uid, cfg.runtimeCredential.Gid)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cfg.runtimeCredential}
+	}
+
+	signals := make(chan os.Signal, len(forwardedSignals))
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	restoreRlimits, err := setRuntimeRlimits(getDelegationRlimits(cfg, argv))
+	if err != nil {
+		return err
+	}
+	// As with the runtime limits, the processes started by exec would inherit
+	// the oom_score_adj of the low-level runtime.
+	if _, subcommand, _ := splitRuntimeArgs(argv[1:]); cfg.runtimeOOMScoreAdj != nil && subcommand != "exec" {
+		err = startWithOOMScoreAdj(cmd, *cfg.runtimeOOMScoreAdj)
+	} else {
+		err = cmd.Start()
+	}
+	restoreRlimits()
+	if err != nil {
+		return fmt.Errorf("could not start '%v': %v", argv[0], err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	if err != nil {
+		return invocationDiagnostics.report(argv, err)
+	}
+	return nil
+}
+
+// startWithOOMScoreAdj starts the specified command with the specified
+// oom_score_adj. There is no process attribute for this, so the value of the
+// current process, which is inherited by the child, is changed around starting
+// it. This is only supported on Linux.
+func startWithOOMScoreAdj(cmd *exec.Cmd, oomScoreAdj int) error {
+	current, err := ioutil.ReadFile(oomScoreAdjPath)
+	if err != nil {
+		return fmt.Errorf("error reading oom_score_adj: %v", err)
+	}
+
+	logger.Printf("Setting oom_score_adj of %v to %v", cmd.Path, oomScoreAdj)
+	err = ioutil.WriteFile(oomScoreAdjPath, []byte(strconv.Itoa(oomScoreAdj)), 0644)
+	if err != nil {
+		return fmt.Errorf("error setting oom_score_adj: %v", err)
+	}
+	defer func() {
+		err := ioutil.WriteFile(oomScoreAdjPath, current, 0644)
+		if err != nil {
+			logger.Warnf("Error restoring oom_score_adj: %v", err)
+		}
+	}()
+
+	return cmd.Start()
+}
+
+// pinContainerOOMScoreAdj sets the oom_score_adj of the process of the
+// specified spec to that of the current process if runtime-oom-score-adj is
+// set and the spec does not set it. The container would otherwise inherit the
+// oom_score_adj of the low-level runtime rather than that of the caller.
+func pinContainerOOMScoreAdj(spec *specs.Spec, runtimeOOMScoreAdj *int) error {
+	if runtimeOOMScoreAdj == nil || spec.Process == nil || spec.Process.OOMScoreAdj != nil {
+		return nil
+	}
+
+	current, err := ioutil.ReadFile(oomScoreAdjPath)
+	if err != nil {
+		return fmt.Errorf("error reading oom_score_adj: %v", err)
+	}
+	oomScoreAdj, err := strconv.Atoi(strings.TrimSpace(string(current)))
+	if err != nil {
+		return fmt.Errorf("error reading oom_score_adj: %v", err)
+	}
+	logger.Printf("Pinning oom_score_adj of the container to %v", oomScoreAdj)
+	spec.Process.OOMScoreAdj = &oomScoreAdj
+	return nil
+}
+
+// getRuntimeSubcommand returns the runc subcommand of the specified command
+// line arguments.
+func getRuntimeSubcommand(argv []string) string {
+	_, subcommand, _ := splitRuntimeArgs(getRuntimeArgs(argv))
+	return subcommand
+}
+
+// splitRuntimeArgs splits the specified runc arguments into the global flags,
+// the subcommand and the arguments of the subcommand.
+func splitRuntimeArgs(runtimeArgs []string) ([]string, string, []string) {
+	for i := 0; i < len(runtimeArgs); i++ {
+		arg := runtimeArgs[i]
+		if !strings.HasPrefix(arg, "-") {
+			return runtimeArgs[:i], arg, runtimeArgs[i+1:]
+		}
+		flag := strings.TrimLeft(arg, "-")
+		if runtimeGlobalFlagsWithValue[flag] {
+			i++
+		}
+	}
+	return runtimeArgs, "", nil
+}
+
+// getContainerID returns the container id from the specified arguments of a
+// runc subcommand. This is the last positional argument.
+func getContainerID(subcommandArgs []string) string {
+	var id string
+	for i := 0; i < len(subcommandArgs); i++ {
+		arg := subcommandArgs[i]
+		if !strings.HasPrefix(arg, "-") {
+			id = arg
+			continue
+		}
+		flag := strings.TrimLeft(arg, "-")
+		if flag == "bundle" || flag == "b" || runtimeCommandFlagsWithValue[flag] {
+			i++
+		}
+	}
+	return id
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitRuntimeArgs(t *testing.T) {
+	globalArgs, subcommand, subcommandArgs := splitRuntimeArgs([]string{"--root", "/run/runc", "--debug", "run", "-b", "bundle", "id"})
+	require.Equal(t, []string{"--root", "/run/runc", "--debug"}, globalArgs)
+	require.Equal(t, "run", subcommand)
+	require.Equal(t, []string{"-b", "bundle", "id"}, subcommandArgs)
+
+	globalArgs, subcommand, subcommandArgs = splitRuntimeArgs([]string{"--version"})
+	require.Equal(t, []string{"--version"}, globalArgs)
+	require.Empty(t, subcommand)
+	require.Empty(t, subcommandArgs)
+}
+
+func TestGetContainerID(t *testing.T) {
+	require.Equal(t, "id", getContainerID([]string{"--bundle", "bundle", "id"}))
+	require.Equal(t, "id", getContainerID([]string{"-d", "--pid-file", "pid", "id", "--console-socket", "sock"}))
+	require.Empty(t, getContainerID([]string{"--bundle", "bundle"}))
+}
+
+func TestRunAsCreateStart(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	callsFile := filepath.Join(testDir, "calls")
+	_, err = writeTestScript(testDir, "runc", `echo "$@" >> `+callsFile+`
+[ "$1" != start ] || [ -z "$FAIL_START" ]`)
+	require.NoError(t, err)
+
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nrun-as-create-start = true\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	env := append(os.Environ(), configOverride+"="+configDir, "PATH="+testDir+":"+os.Getenv("PATH"))
+
+	require.NoError(t, generateNewRuntimeSpec())
+	cmdRun := exec.Command(nvidiaRuntime, "--root", "/run/test", "run", "--detach", "--bundle", bundlePath, "testcontainer")
+	cmdRun.Env = env
+	require.NoError(t, cmdRun.Run(), "runtime should not return an error")
+
+	calls, err := ioutil.ReadFile(callsFile)
+	require.NoError(t, err)
+	require.Equal(t, "--root /run/test create --bundle "+bundlePath+" testcontainer\n--root /run/test start testcontainer\n", string(calls))
+
+	spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks), "exactly one nvidia prestart hook should be present in config.json")
+
+	require.NoError(t, os.Remove(callsFile))
+	cmdRun = exec.Command(nvidiaRuntime, "run", "--bundle", bundlePath, "testcontainer")
+	cmdRun.Env = append(env, "FAIL_START=1")
+	require.Error(t, cmdRun.Run(), "runtime should return an error if start fails")
+
+	calls, err = ioutil.ReadFile(callsFile)
+	require.NoError(t, err)
+	require.Equal(t, "create --bundle "+bundlePath+" testcontainer\nstart testcontainer\ndelete --force testcontainer\n", string(calls))
+}
+
+func TestRunAsCreateStartOOMScoreAdj(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("oom_score_adj is only supported on Linux")
+	}
+
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	scoresFile := filepath.Join(testDir, "scores")
+	_, err = writeTestScript(testDir, "runc", `cat /proc/self/oom_score_adj >> `+scoresFile)
+	require.NoError(t, err)
+
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nrun-as-create-start = true\nruntime-oom-score-adj = 500\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	require.NoError(t, generateNewRuntimeSpec())
+	cmdRun := exec.Command(nvidiaRuntime, "run", "--bundle", bundlePath, "testcontainer")
+	cmdRun.Env = append(os.Environ(), configOverride+"="+configDir, "PATH="+testDir+":"+os.Getenv("PATH"))
+	require.NoError(t, cmdRun.Run(), "runtime should not return an error")
+
+	scores, err := ioutil.ReadFile(scoresFile)
+	require.NoError(t, err)
+	require.Equal(t, []string{"500", "500"}, strings.Fields(string(scores)))
+
+	// The container keeps the oom_score_adj of the caller rather than
+	// inheriting that of runc.
+	current, err := ioutil.ReadFile(oomScoreAdjPath)
+	require.NoError(t, err)
+	spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.NotNil(t, spec.Process.OOMScoreAdj)
+	require.Equal(t, strings.TrimSpace(string(current)), strconv.Itoa(*spec.Process.OOMScoreAdj))
+
+	// An oom_score_adj set by the spec is left unchanged.
+	require.NoError(t, generateNewRuntimeSpec())
+	oomScoreAdj := 100
+	spec, err = getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	spec.Process.OOMScoreAdj = &oomScoreAdj
+	require.NoError(t, writeRuntimeSpec(filepath.Join(bundlePath, specFile), &spec))
+	cmdRun = exec.Command(nvidiaRuntime, "run", "--bundle", bundlePath, "testcontainer")
+	cmdRun.Env = append(os.Environ(), configOverride+"="+configDir, "PATH="+testDir+":"+os.Getenv("PATH"))
+	require.NoError(t, cmdRun.Run(), "runtime should not return an error")
+	spec, err = getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Equal(t, 100, *spec.Process.OOMScoreAdj)
+
+	// The processes started by exec are not affected either.
+	resultDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\nruntime-oom-score-adj = 500\nresult-file = %q\n", filepath.Join(testDir, "result.json")))
+	require.NoError(t, err)
+	defer os.RemoveAll(resultDir)
+	require.NoError(t, os.Remove(scoresFile))
+	cmdExec := exec.Command(nvidiaRuntime, "exec", "testcontainer", "true")
+	cmdExec.Env = append(os.Environ(), configOverride+"="+resultDir, "PATH="+testDir+":"+os.Getenv("PATH"))
+	require.NoError(t, cmdExec.Run(), "runtime should not return an error")
+	scores, err = ioutil.ReadFile(scoresFile)
+	require.NoError(t, err)
+	require.Equal(t, strings.Fields(string(current)), strings.Fields(string(scores)))
+}
+
+func TestRunAsCreateStartRuntimeUser(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("runtime-user is only supported on Linux")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("changing the credential of the runtime requires root")
+	}
+
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	// The runtime running as nobody writes to the test directory.
+	require.NoError(t, os.Chmod(testDir, 0777))
+
+	idsFile := filepath.Join(testDir, "ids")
+	_, err = writeTestScript(testDir, "runc", `echo "$(id -u):$(id -g):$(id -G)" >> `+idsFile)
+	require.NoError(t, err)
+
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nrun-as-create-start = true\nruntime-user = 65534\nruntime-group = 65534\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	require.NoError(t, generateNewRuntimeSpec())
+	cmdRun := exec.Command(nvidiaRuntime, "run", "--bundle", bundlePath, "testcontainer")
+	cmdRun.Env = append(os.Environ(), configOverride+"="+configDir, "PATH="+testDir+":"+os.Getenv("PATH"))
+	require.NoError(t, cmdRun.Run(), "runtime should not return an error")
+
+	ids, err := ioutil.ReadFile(idsFile)
+	require.NoError(t, err)
+	require.Equal(t, []string{"65534:65534:65534", "65534:65534:65534"}, strings.Fields(string(ids)))
+}
+
+func TestGetConfigRuntimeOOMScoreAdj(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nruntime-oom-score-adj = -500")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.NotNil(t, cfg.runtimeOOMScoreAdj)
+	require.Equal(t, -500, *cfg.runtimeOOMScoreAdj)
+
+	for _, value := range []string{"1001", "\"high\""} {
+		testDir, err := writeTestConfig("[nvidia-container-runtime]\nruntime-oom-score-adj = " + value)
+		require.NoError(t, err)
+		defer os.RemoveAll(testDir)
+		os.Setenv(configOverride, testDir)
+
+		_, err = getConfig()
+		require.Error(t, err, value)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+)
+
+// runtimeAdapter translates the arguments forwarded to a low-level runtime
+// whose command line differs from the one accepted by runc.
+type runtimeAdapter func(argv []string) []string
+
+// runtimeAdapters maps the executable name of a low-level runtime to its
+// adapter. Runtimes without an entry receive the arguments unchanged.
+var runtimeAdapters = map[string]runtimeAdapter{
+	"runsc": translateRunscArgs,
+}
+
+// translateRunscArgs translates runc arguments for gVisor's runsc. runsc
+// implements the same OCI command line for the create, start, run, state,
+// kill and delete commands and accepts the runc global flags we forward
+// (--root, --log, --log-format, --debug, --systemd-cgroup) as is. The
+// differences are:
+//   - runsc does not accept the -b shorthand for --bundle.
+//   - runsc does not support --criu since checkpointing does not use CRIU.
+func translateRunscArgs(argv []string) []string {
+	var translated []string
+	for i := 0; i < len(argv); i++ {
+		param := argv[i]
+		switch {
+		case param == "-b":
+			translated = append(translated, "--bundle")
+		case strings.HasPrefix(param, "-b="):
+			translated = append(translated, "--bundle="+strings.TrimPrefix(param, "-b="))
+		case param == "--criu" || param == "-criu":
+			logger.Printf("Dropping unsupported flag %v for runsc", param)
+			i++
+		case strings.HasPrefix(param, "--criu=") || strings.HasPrefix(param, "-criu="):
+			logger.Printf("Dropping unsupported flag %v for runsc", param)
+		default:
+			translated = append(translated, param)
+		}
+	}
+	return translated
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranslateRunscArgs(t *testing.T) {
+	testCases := []struct {
+		argv     []string
+		expected []string
+	}{
+		{
+			argv:     []string{"--root", "/run/runsc", "create", "--bundle", "/foo/bar", "id"},
+			expected: []string{"--root", "/run/runsc", "create", "--bundle", "/foo/bar", "id"},
+		},
+		{
+			argv:     []string{"create", "-b", "/foo/bar", "id"},
+			expected: []string{"create", "--bundle", "/foo/bar", "id"},
+		},
+		{
+			argv:     []string{"create", "-b=/foo/bar", "id"},
+			expected: []string{"create", "--bundle=/foo/bar", "id"},
+		},
+		{
+			argv:     []string{"--criu", "/usr/sbin/criu", "--criu=/usr/sbin/criu", "state", "id"},
+			expected: []string{"state", "id"},
+		},
+	}
+
+	for i, tc := range testCases {
+		require.Equalf(t, tc.expected, translateRunscArgs(tc.argv), "%d: %v", i, tc)
+	}
+}
+
+func TestGetRuncCommandRunsc(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	runsc, err := writeTestScript(testDir, "runsc", "echo mock runsc")
+	require.NoError(t, err)
+
+	argv, err := getRuncCommand(runsc, []string{"create", "-b", "/foo/bar", "id"})
+	require.NoError(t, err)
+	require.Equal(t, []string{runsc, "create", "--bundle", "/foo/bar", "id"}, argv)
+
+	// Other runtimes receive the arguments unchanged.
+	other, err := writeTestScript(testDir, "other-runtime", "echo mock runtime")
+	require.NoError(t, err)
+
+	argv, err = getRuncCommand(other, []string{"create", "-b", "/foo/bar", "id"})
+	require.NoError(t, err)
+	require.Equal(t, []string{other, "create", "-b", "/foo/bar", "id"}, argv)
+}
+
+func TestPrintExecRunsc(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	runsc, err := writeTestScript(testDir, "runsc", "echo mock runsc")
+	require.NoError(t, err)
+
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nruntime = \"" + runsc + "\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	require.NoError(t, generateNewRuntimeSpec())
+
+	var stdout bytes.Buffer
+	cmdCreate := exec.Command(nvidiaRuntime, "--print-exec", "create", "-b", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+	cmdCreate.Stdout = &stdout
+	t.Logf("executing: %s\n", strings.Join(cmdCreate.Args, " "))
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	expected := strings.Join([]string{filepath.Join(testDir, "runsc"), "create", "--bundle", bundlePath, "testcontainer"}, " ")
+	require.Equal(t, expected+"\n", stdout.String())
+}
@@ -0,0 +1,70 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+)
+
+// addConfiguredRuntimeArgs adds the runtime-args configured for the
+// subcommand of the specified runtime arguments. The configured arguments are
+// inserted ahead of the subcommand, where runc expects its global flags such
+// as --systemd-cgroup. A configured flag that is already present in the
+// arguments, with or without a value, is not added again.
+func addConfiguredRuntimeArgs(runtimeArgs []string, configured map[string][]string) []string {
+	globalArgs, subcommand, subcommandArgs := splitRuntimeArgs(runtimeArgs)
+	if subcommand == "" || len(configured[subcommand]) == 0 {
+		return runtimeArgs
+	}
+
+	var added []string
+	for _, arg := range configured[subcommand] {
+		if hasRuntimeFlag(runtimeArgs, arg) || hasRuntimeFlag(added, arg) {
+			logger.Printf("Not adding runtime argument %v: already specified", arg)
+			continue
+		}
+		added = append(added, arg)
+	}
+	if len(added) == 0 {
+		return runtimeArgs
+	}
+	logger.Printf("Adding runtime arguments %v for %v", added, subcommand)
+
+	var result []string
+	result = append(result, globalArgs...)
+	result = append(result, added...)
+	result = append(result, subcommand)
+	result = append(result, subcommandArgs...)
+	return result
+}
+
+// hasRuntimeFlag checks whether the flag of the specified argument is present
+// in argv. The flag is matched by name, so --log-format=json matches
+// --log-format text.
+func hasRuntimeFlag(argv []string, arg string) bool {
+	name := getRuntimeFlagName(arg)
+	for _, a := range argv {
+		if strings.HasPrefix(a, "-") && getRuntimeFlagName(a) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func getRuntimeFlagName(arg string) string {
+	return strings.TrimLeft(strings.SplitN(arg, "=", 2)[0], "-")
+}
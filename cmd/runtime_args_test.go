@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddConfiguredRuntimeArgs(t *testing.T) {
+	configured := map[string][]string{
+		"create": {"--systemd-cgroup", "--log-format=json"},
+	}
+
+	testCases := []struct {
+		description string
+		runtimeArgs []string
+		expected    []string
+	}{
+		{
+			description: "args are added for create",
+			runtimeArgs: []string{"--root", "/run/runc", "create", "--bundle", "/b", "id"},
+			expected:    []string{"--root", "/run/runc", "--systemd-cgroup", "--log-format=json", "create", "--bundle", "/b", "id"},
+		},
+		{
+			description: "args are not added for state",
+			runtimeArgs: []string{"--root", "/run/runc", "state", "id"},
+			expected:    []string{"--root", "/run/runc", "state", "id"},
+		},
+		{
+			description: "flags already specified are not duplicated",
+			runtimeArgs: []string{"--systemd-cgroup", "--log-format", "text", "create", "id"},
+			expected:    []string{"--systemd-cgroup", "--log-format", "text", "create", "id"},
+		},
+		{
+			description: "flags specified with a single dash are not duplicated",
+			runtimeArgs: []string{"-systemd-cgroup", "create", "id"},
+			expected:    []string{"-systemd-cgroup", "--log-format=json", "create", "id"},
+		},
+		{
+			description: "no subcommand",
+			runtimeArgs: []string{"--version"},
+			expected:    []string{"--version"},
+		},
+	}
+
+	for _, tc := range testCases {
+		require.Equal(t, tc.expected, addConfiguredRuntimeArgs(tc.runtimeArgs, configured), tc.description)
+	}
+}
+
+func TestGetConfigRuntimeArgs(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime.runtime-args]\ncreate = [\"--systemd-cgroup\"]\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{"create": {"--systemd-cgroup"}}, cfg.runtimeArgs)
+
+	for _, value := range []string{`["--systemd-cgroup"]`, `{ create = "--systemd-cgroup" }`, `{ create = ["systemd-cgroup"] }`} {
+		testDir, err := writeTestConfig("[nvidia-container-runtime]\nruntime-args = " + value)
+		require.NoError(t, err)
+		defer os.RemoveAll(testDir)
+		os.Setenv(configOverride, testDir)
+
+		_, err = getConfig()
+		require.Error(t, err, value)
+	}
+}
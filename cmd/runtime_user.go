@@ -0,0 +1,114 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/pelletier/go-toml"
+)
+
+// getRuntimeCredential returns the credential of the low-level runtime for the
+// specified runtime-user and runtime-group, which are names or numeric ids.
+// The primary group of the user is used if no group is specified, and the
+// current user if only a group is specified. A nil credential is returned if
+// neither is specified.
+//
+// The credential is applied to the low-level runtime when it is run as a
+// child process, e.g. with run-as-create-start. It is not applied when runc
+// replaces the current process. Setting the credential of a child process is
+// only supported on Linux.
+func getRuntimeCredential(userValue string, groupValue string) (*syscall.Credential, error) {
+	if userValue == "" && groupValue == "" {
+		return nil, nil
+	}
+
+	credential := &syscall.Credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+		// The supplementary groups of the current process are dropped.
+		Groups: []uint32{},
+	}
+
+	if userValue != "" {
+		u, err := lookupUser(userValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid runtime-user %q: %v", userValue, err)
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid runtime-user %q: unexpected uid %v", userValue, u.Uid)
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid runtime-user %q: unexpected gid %v", userValue, u.Gid)
+		}
+		credential.Uid = uint32(uid)
+		credential.Gid = uint32(gid)
+	}
+
+	if groupValue != "" {
+		g, err := lookupGroup(groupValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid runtime-group %q: %v", groupValue, err)
+		}
+		gid, err := strconv.ParseUint(g.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid runtime-group %q: unexpected gid %v", groupValue, g.Gid)
+		}
+		credential.Gid = uint32(gid)
+	}
+
+	return credential, nil
+}
+
+// lookupUser looks up the user with the specified numeric id or name.
+func lookupUser(value string) (*user.User, error) {
+	if _, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return user.LookupId(value)
+	}
+	return user.Lookup(value)
+}
+
+// lookupGroup looks up the group with the specified numeric id or name.
+func lookupGroup(value string) (*user.Group, error) {
+	if _, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return user.LookupGroupId(value)
+	}
+	return user.LookupGroup(value)
+}
+
+// getNameOrID returns the name or numeric id stored at the specified key of the
+// config as a string.
+func getNameOrID(tree *toml.Tree, key string) (string, error) {
+	switch value := tree.Get(key).(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case int64:
+		if value < 0 {
+			return "", fmt.Errorf("invalid value for %v: expected a non-negative id", key)
+		}
+		return strconv.FormatInt(value, 10), nil
+	}
+	return "", fmt.Errorf("invalid value for %v: expected a name or a numeric id", key)
+}
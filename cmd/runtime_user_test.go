@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRuntimeCredential(t *testing.T) {
+	credential, err := getRuntimeCredential("", "")
+	require.NoError(t, err)
+	require.Nil(t, credential)
+
+	current, err := user.Current()
+	require.NoError(t, err)
+
+	// The primary group of the user is used by default.
+	credential, err = getRuntimeCredential(current.Username, "")
+	require.NoError(t, err)
+	require.Equal(t, uint32(os.Getuid()), credential.Uid)
+	require.Equal(t, current.Gid, fmt.Sprint(credential.Gid))
+	require.Empty(t, credential.Groups)
+
+	credential, err = getRuntimeCredential(current.Uid, current.Gid)
+	require.NoError(t, err)
+	require.Equal(t, current.Uid, fmt.Sprint(credential.Uid))
+	require.Equal(t, current.Gid, fmt.Sprint(credential.Gid))
+
+	// The current user is used if only a group is specified.
+	credential, err = getRuntimeCredential("", current.Gid)
+	require.NoError(t, err)
+	require.Equal(t, uint32(os.Getuid()), credential.Uid)
+
+	_, err = getRuntimeCredential("no-such-user", "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid runtime-user "no-such-user"`)
+
+	_, err = getRuntimeCredential("", "no-such-group")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid runtime-group "no-such-group"`)
+}
+
+func TestGetConfigRuntimeUser(t *testing.T) {
+	for _, value := range []string{`"no-such-user"`, "-1", "true"} {
+		testDir, err := writeTestConfig("[nvidia-container-runtime]\nruntime-user = " + value)
+		require.NoError(t, err)
+		defer os.RemoveAll(testDir)
+		os.Setenv(configOverride, testDir)
+
+		_, err = getConfig()
+		require.Error(t, err, value)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// runtimeVersionTimeout limits the time taken by <runtime> --version.
+const runtimeVersionTimeout = 5 * time.Second
+
+// runtimeVersionPattern matches the version number in the output of
+// <runtime> --version, e.g. "runc version 1.1.4".
+var runtimeVersionPattern = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// runtimeVersion is a version number of a low-level runtime.
+type runtimeVersion []int
+
+// parseRuntimeVersion parses a dotted version number such as 1.0.2.
+func parseRuntimeVersion(version string) (runtimeVersion, error) {
+	var parsed runtimeVersion
+	for _, part := range strings.Split(strings.TrimPrefix(version, "v"), ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		parsed = append(parsed, n)
+	}
+	return parsed, nil
+}
+
+// getRuntimeVersion returns the version stored at the specified key of the
+// config. A missing key results in a nil version.
+func getRuntimeVersion(tree *toml.Tree, key string) (runtimeVersion, error) {
+	value := tree.GetDefault(key, "").(string)
+	if value == "" {
+		return nil, nil
+	}
+
+	version, err := parseRuntimeVersion(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %v: %v", key, err)
+	}
+	return version, nil
+}
+
+// compare returns -1, 0 or 1 if v is lower than, equal to or higher than
+// other. Missing components are treated as 0.
+func (v runtimeVersion) compare(other runtimeVersion) int {
+	for i := 0; i < len(v) || i < len(other); i++ {
+		var a, b int
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(other) {
+			b = other[i]
+		}
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func (v runtimeVersion) String() string {
+	var parts []string
+	for _, n := range v {
+		parts = append(parts, strconv.Itoa(n))
+	}
+	return strings.Join(parts, ".")
+}
+
+// checkRuntimeVersion checks whether the version of the low-level runtime is
+// within the range configured by min-runtime-version and max-runtime-version.
+// A version outside of the range, or one that cannot be determined, is only
+// logged unless strict-runtime-version is set.
+func checkRuntimeVersion(cfg *config) error {
+	if cfg.minRuntimeVersion == nil && cfg.maxRuntimeVersion == nil {
+		return nil
+	}
+
+	err := validateRuntimeVersion(cfg)
+	if err == nil {
+		return nil
+	}
+	if cfg.strictRuntimeVersion {
+		return err
+	}
+	logger.Infof("Ignoring runtime version check: %v", err)
+	return nil
+}
+
+func validateRuntimeVersion(cfg *config) error {
+	path, version, err := getLowLevelRuntimeVersion(cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.minRuntimeVersion != nil && version.compare(cfg.minRuntimeVersion) < 0 {
+		return fmt.Errorf("version %v of %v is lower than min-runtime-version %v", version, path, cfg.minRuntimeVersion)
+	}
+	if cfg.maxRuntimeVersion != nil && version.compare(cfg.maxRuntimeVersion) > 0 {
+		return fmt.Errorf("version %v of %v is higher than max-runtime-version %v", version, path, cfg.maxRuntimeVersion)
+	}
+	return nil
+}
+
+// getLowLevelRuntimeVersion returns the path and the version of the
+// low-level runtime.
+func getLowLevelRuntimeVersion(cfg *config) (string, runtimeVersion, error) {
+	argv, err := getRuncCommand(cfg.runtime, nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	output, err := getVersionOutput(argv[0])
+	if err != nil {
+		return "", nil, err
+	}
+
+	match := runtimeVersionPattern.FindString(output)
+	if match == "" {
+		return "", nil, fmt.Errorf("no version found in output of %v --version", argv[0])
+	}
+	version, err := parseRuntimeVersion(match)
+	if err != nil {
+		return "", nil, err
+	}
+
+	logger.Printf("Runtime version: %v", version)
+
+	return argv[0], version, nil
+}
+
+// getVersionOutput returns the output of running the specified executable with
+// the --version flag.
+func getVersionOutput(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(invocationCtx, runtimeVersionTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("error getting version of %v: %v", path, err)
+	}
+	return string(output), nil
+}
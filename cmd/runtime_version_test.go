@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRuntimeVersion(t *testing.T) {
+	version, err := parseRuntimeVersion("1.0.2")
+	require.NoError(t, err)
+	require.Equal(t, runtimeVersion{1, 0, 2}, version)
+
+	version, err = parseRuntimeVersion("v1.1")
+	require.NoError(t, err)
+	require.Equal(t, runtimeVersion{1, 1}, version)
+
+	_, err = parseRuntimeVersion("1.0.0-rc93")
+	require.Error(t, err)
+
+	require.Equal(t, 0, runtimeVersion{1, 1}.compare(runtimeVersion{1, 1, 0}))
+	require.Equal(t, -1, runtimeVersion{1, 0, 9}.compare(runtimeVersion{1, 1}))
+	require.Equal(t, 1, runtimeVersion{1, 10}.compare(runtimeVersion{1, 9, 9}))
+}
+
+func TestCheckRuntimeVersion(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	runtime, err := writeTestScript(testDir, "mock-runc", `echo "runc version 1.0.2"
+echo "spec: 1.0.2-dev"`)
+	require.NoError(t, err)
+
+	broken, err := writeTestScript(testDir, "broken-runc", `echo "unknown"`)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		description string
+		cfg         *config
+		isError     bool
+	}{
+		{
+			description: "no range",
+			cfg:         &config{runtime: broken, strictRuntimeVersion: true},
+		},
+		{
+			description: "inside the range",
+			cfg:         &config{runtime: runtime, minRuntimeVersion: runtimeVersion{1, 0}, maxRuntimeVersion: runtimeVersion{1, 1}, strictRuntimeVersion: true},
+		},
+		{
+			description: "below the range",
+			cfg:         &config{runtime: runtime, minRuntimeVersion: runtimeVersion{1, 1}},
+		},
+		{
+			description: "below the range with strict-runtime-version",
+			cfg:         &config{runtime: runtime, minRuntimeVersion: runtimeVersion{1, 1}, strictRuntimeVersion: true},
+			isError:     true,
+		},
+		{
+			description: "above the range with strict-runtime-version",
+			cfg:         &config{runtime: runtime, maxRuntimeVersion: runtimeVersion{1, 0, 1}, strictRuntimeVersion: true},
+			isError:     true,
+		},
+		{
+			description: "unknown version with strict-runtime-version",
+			cfg:         &config{runtime: broken, minRuntimeVersion: runtimeVersion{1, 0}, strictRuntimeVersion: true},
+			isError:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		err := checkRuntimeVersion(tc.cfg)
+		if tc.isError {
+			require.Error(t, err, tc.description)
+			continue
+		}
+		require.NoError(t, err, tc.description)
+	}
+}
+
+func TestGetConfigRuntimeVersion(t *testing.T) {
+	testDir, err := writeTestConfig("[nvidia-container-runtime]\nmin-runtime-version = \"1.0.0\"\nstrict-runtime-version = true")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	cfg, err := getConfig()
+	require.NoError(t, err)
+	require.Equal(t, runtimeVersion{1, 0, 0}, cfg.minRuntimeVersion)
+	require.Nil(t, cfg.maxRuntimeVersion)
+	require.True(t, cfg.strictRuntimeVersion)
+
+	testDir, err = writeTestConfig("[nvidia-container-runtime]\nmax-runtime-version = \"latest\"")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	os.Setenv(configOverride, testDir)
+
+	_, err = getConfig()
+	require.Error(t, err)
+}
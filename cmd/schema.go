@@ -0,0 +1,414 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxSchemaRefDepth bounds the number of $ref indirections followed while
+// validating a single value, which guards against self-referencing schemas.
+const maxSchemaRefDepth = 64
+
+// schemaAnnotationKeywords are the JSON Schema keywords that do not affect
+// validation.
+var schemaAnnotationKeywords = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"id":          true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+	"definitions": true,
+	"$defs":       true,
+}
+
+// schemaValidationKeywords are the JSON Schema keywords supported by
+// validateSchema. Schemas using other keywords are rejected rather than
+// silently accepting specs that the schema is meant to reject.
+var schemaValidationKeywords = map[string]bool{
+	"$ref":                 true,
+	"type":                 true,
+	"enum":                 true,
+	"const":                true,
+	"required":             true,
+	"properties":           true,
+	"additionalProperties": true,
+	"items":                true,
+	"minItems":             true,
+	"maxItems":             true,
+	"minLength":            true,
+	"maxLength":            true,
+	"pattern":              true,
+	"minimum":              true,
+	"maximum":              true,
+	"allOf":                true,
+	"anyOf":                true,
+	"not":                  true,
+}
+
+// jsonSchema is a JSON Schema loaded from a file. The supported subset covers
+// the keywords listed in schemaValidationKeywords, with $ref limited to JSON
+// pointers into the same document, e.g. "#/definitions/mount".
+type jsonSchema struct {
+	root interface{}
+}
+
+// loadJSONSchema loads the JSON Schema at the specified path, checking that it
+// only uses supported keywords.
+func loadJSONSchema(path string) (*jsonSchema, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JSON schema: %v", err)
+	}
+
+	var root interface{}
+	err = json.Unmarshal(content, &root)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JSON schema %v: %v", path, err)
+	}
+
+	schema := &jsonSchema{root: root}
+	err = schema.check(root, "#")
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON schema %v: %v", path, err)
+	}
+	return schema, nil
+}
+
+// check checks the specified subschema at the specified location of the
+// schema document.
+func (s *jsonSchema) check(subschema interface{}, location string) error {
+	if _, ok := subschema.(bool); ok {
+		return nil
+	}
+	object, ok := subschema.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%v: expected an object or boolean", location)
+	}
+
+	for _, keyword := range sortedKeys(object) {
+		value := object[keyword]
+		keywordLocation := location + "/" + keyword
+		if !schemaAnnotationKeywords[keyword] && !schemaValidationKeywords[keyword] {
+			return fmt.Errorf("%v: unsupported keyword", keywordLocation)
+		}
+
+		var err error
+		switch keyword {
+		case "properties", "definitions", "$defs":
+			properties, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%v: expected an object", keywordLocation)
+			}
+			for _, name := range sortedKeys(properties) {
+				err = s.check(properties[name], keywordLocation+"/"+name)
+				if err != nil {
+					return err
+				}
+			}
+		case "additionalProperties", "items", "not":
+			err = s.check(value, keywordLocation)
+		case "allOf", "anyOf":
+			subschemas, ok := value.([]interface{})
+			if !ok || len(subschemas) == 0 {
+				return fmt.Errorf("%v: expected a non-empty array", keywordLocation)
+			}
+			for i, subschema := range subschemas {
+				err = s.check(subschema, keywordLocation+"/"+strconv.Itoa(i))
+				if err != nil {
+					return err
+				}
+			}
+		case "$ref":
+			ref, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%v: expected a string", keywordLocation)
+			}
+			var referenced interface{}
+			referenced, err = s.resolve(ref)
+			if err == nil {
+				switch referenced.(type) {
+				case bool, map[string]interface{}:
+				default:
+					err = fmt.Errorf("reference %q does not refer to a schema", ref)
+				}
+			}
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%v: expected a string", keywordLocation)
+			}
+			_, err = regexp.Compile(pattern)
+		case "minItems", "maxItems", "minLength", "maxLength", "minimum", "maximum":
+			if _, ok := value.(float64); !ok {
+				return fmt.Errorf("%v: expected a number", keywordLocation)
+			}
+		case "required", "enum":
+			if _, ok := value.([]interface{}); !ok {
+				return fmt.Errorf("%v: expected an array", keywordLocation)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", keywordLocation, err)
+		}
+	}
+	return nil
+}
+
+// resolve returns the subschema referenced by the specified $ref value.
+func (s *jsonSchema) resolve(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported reference %q: expected a JSON pointer into the schema", ref)
+	}
+	path, err := parseJSONPointer(strings.TrimPrefix(ref, "#"))
+	if err != nil {
+		return nil, err
+	}
+	subschema, err := getJSONValue(s.root, path)
+	if err != nil {
+		return nil, fmt.Errorf("unresolvable reference %q: %v", ref, err)
+	}
+	return subschema, nil
+}
+
+// validate returns the violations of the schema by the specified generic JSON
+// value, as produced by json.Unmarshal. Each violation is prefixed with the
+// JSON pointer of the offending value.
+func (s *jsonSchema) validate(value interface{}) []string {
+	return s.validateValue(s.root, value, "", 0)
+}
+
+func (s *jsonSchema) validateValue(subschema interface{}, value interface{}, path string, depth int) []string {
+	violation := func(format string, a ...interface{}) []string {
+		location := path
+		if location == "" {
+			location = "/"
+		}
+		return []string{location + ": " + fmt.Sprintf(format, a...)}
+	}
+
+	if allowed, ok := subschema.(bool); ok {
+		if !allowed {
+			return violation("no value is allowed")
+		}
+		return nil
+	}
+	object := subschema.(map[string]interface{})
+
+	var violations []string
+	if ref, ok := object["$ref"].(string); ok {
+		if depth >= maxSchemaRefDepth {
+			return violation("too many nested schema references")
+		}
+		// The reference was resolved when the schema was loaded.
+		referenced, _ := s.resolve(ref)
+		violations = append(violations, s.validateValue(referenced, value, path, depth+1)...)
+	}
+
+	if types, ok := object["type"]; ok && !matchesSchemaType(types, value) {
+		return append(violations, violation("expected type %v, got %v", formatSchemaTypes(types), getSchemaType(value))...)
+	}
+	if enum, ok := object["enum"].([]interface{}); ok && !containsJSONValue(enum, value) {
+		violations = append(violations, violation("value %v is not one of %v", formatJSONValue(value), formatJSONValue(enum))...)
+	}
+	if constant, ok := object["const"]; ok && !reflect.DeepEqual(constant, value) {
+		violations = append(violations, violation("expected %v, got %v", formatJSONValue(constant), formatJSONValue(value))...)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if required, ok := object["required"].([]interface{}); ok {
+			for _, name := range required {
+				if name, ok := name.(string); ok {
+					if _, exists := v[name]; !exists {
+						violations = append(violations, violation("missing required property %q", name)...)
+					}
+				}
+			}
+		}
+		properties, _ := object["properties"].(map[string]interface{})
+		for _, name := range sortedKeys(v) {
+			propertyPath := path + "/" + escapeJSONPointer(name)
+			if property, ok := properties[name]; ok {
+				violations = append(violations, s.validateValue(property, v[name], propertyPath, depth)...)
+			} else if additional, ok := object["additionalProperties"]; ok {
+				if allowed, ok := additional.(bool); ok && !allowed {
+					violations = append(violations, violation("unexpected property %q", name)...)
+					continue
+				}
+				violations = append(violations, s.validateValue(additional, v[name], propertyPath, depth)...)
+			}
+		}
+	case []interface{}:
+		if min, ok := object["minItems"].(float64); ok && float64(len(v)) < min {
+			violations = append(violations, violation("expected at least %v items, got %v", min, len(v))...)
+		}
+		if max, ok := object["maxItems"].(float64); ok && float64(len(v)) > max {
+			violations = append(violations, violation("expected at most %v items, got %v", max, len(v))...)
+		}
+		if items, ok := object["items"]; ok {
+			for i, item := range v {
+				violations = append(violations, s.validateValue(items, item, path+"/"+strconv.Itoa(i), depth)...)
+			}
+		}
+	case string:
+		length := float64(len([]rune(v)))
+		if min, ok := object["minLength"].(float64); ok && length < min {
+			violations = append(violations, violation("expected at least %v characters, got %v", min, length)...)
+		}
+		if max, ok := object["maxLength"].(float64); ok && length > max {
+			violations = append(violations, violation("expected at most %v characters, got %v", max, length)...)
+		}
+		if pattern, ok := object["pattern"].(string); ok {
+			// The pattern was compiled when the schema was loaded.
+			if !regexp.MustCompile(pattern).MatchString(v) {
+				violations = append(violations, violation("value %q does not match pattern %q", v, pattern)...)
+			}
+		}
+	case float64:
+		if min, ok := object["minimum"].(float64); ok && v < min {
+			violations = append(violations, violation("expected a minimum of %v, got %v", min, v)...)
+		}
+		if max, ok := object["maximum"].(float64); ok && v > max {
+			violations = append(violations, violation("expected a maximum of %v, got %v", max, v)...)
+		}
+	}
+
+	if allOf, ok := object["allOf"].([]interface{}); ok {
+		for _, subschema := range allOf {
+			violations = append(violations, s.validateValue(subschema, value, path, depth)...)
+		}
+	}
+	if anyOf, ok := object["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, subschema := range anyOf {
+			if len(s.validateValue(subschema, value, path, depth)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			violations = append(violations, violation("value does not match any schema of anyOf")...)
+		}
+	}
+	if not, ok := object["not"]; ok && len(s.validateValue(not, value, path, depth)) == 0 {
+		violations = append(violations, violation("value must not match the schema of not")...)
+	}
+
+	return violations
+}
+
+// validateSpecSchema validates the specified marshalled OCI specification
+// against the JSON Schema at the specified path.
+func validateSpecSchema(jsonContent []byte, schemaPath string) error {
+	schema, err := loadJSONSchema(schemaPath)
+	if err != nil {
+		return err
+	}
+
+	var value interface{}
+	err = json.Unmarshal(jsonContent, &value)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling OCI specification: %v", err)
+	}
+
+	violations := schema.validate(value)
+	if len(violations) > 0 {
+		return fmt.Errorf("OCI specification does not conform to spec-schema %v: %v", schemaPath, strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// matchesSchemaType checks whether the specified value is of one of the
+// specified JSON Schema types, given as a single name or an array of names.
+func matchesSchemaType(types interface{}, value interface{}) bool {
+	names, ok := types.([]interface{})
+	if !ok {
+		names = []interface{}{types}
+	}
+
+	actual := getSchemaType(value)
+	for _, name := range names {
+		if name == actual || (name == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// getSchemaType returns the JSON Schema type of the specified generic JSON
+// value. Numbers without a fractional part are integers.
+func getSchemaType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+	}
+	return "number"
+}
+
+func formatSchemaTypes(types interface{}) string {
+	names, ok := types.([]interface{})
+	if !ok {
+		return fmt.Sprint(types)
+	}
+	var result []string
+	for _, name := range names {
+		result = append(result, fmt.Sprint(name))
+	}
+	return strings.Join(result, " or ")
+}
+
+func containsJSONValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testSpecSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "Bundle standard",
+	"type": "object",
+	"required": ["ociVersion", "process", "root"],
+	"properties": {
+		"ociVersion": {"type": "string", "pattern": "^1\\.0\\."},
+		"hostname": {"type": "string", "maxLength": 16},
+		"process": {
+			"type": "object",
+			"required": ["args"],
+			"properties": {
+				"args": {"type": "array", "minItems": 1, "items": {"type": "string"}},
+				"user": {"$ref": "#/definitions/user"}
+			}
+		},
+		"root": {
+			"type": "object",
+			"properties": {
+				"path": {"type": "string"},
+				"readonly": {"const": true}
+			}
+		},
+		"annotations": {
+			"type": "object",
+			"additionalProperties": {"enum": ["allowed", "also-allowed"]}
+		}
+	},
+	"definitions": {
+		"user": {
+			"type": "object",
+			"properties": {"uid": {"type": "integer", "minimum": 0, "maximum": 65535}}
+		}
+	}
+}`
+
+func writeTestSchema(t *testing.T, dir string, schema string) string {
+	path := filepath.Join(dir, "schema.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(schema), 0644))
+	return path
+}
+
+func TestValidateSpecSchema(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	schemaPath := writeTestSchema(t, testDir, testSpecSchema)
+
+	conforming, err := ioutil.ReadFile(unmodifiedSpecFile)
+	require.NoError(t, err)
+	require.NoError(t, validateSpecSchema(conforming, schemaPath))
+
+	testCases := []struct {
+		description string
+		spec        string
+		expected    string
+	}{
+		{
+			description: "missing required property",
+			spec:        `{"ociVersion": "1.0.2", "process": {"args": ["sh"]}}`,
+			expected:    `/: missing required property "root"`,
+		},
+		{
+			description: "wrong type",
+			spec:        `{"ociVersion": "1.0.2", "process": {"args": "sh"}, "root": {}}`,
+			expected:    "/process/args: expected type array, got string",
+		},
+		{
+			description: "too few items",
+			spec:        `{"ociVersion": "1.0.2", "process": {"args": []}, "root": {}}`,
+			expected:    "/process/args: expected at least 1 items, got 0",
+		},
+		{
+			description: "pattern mismatch",
+			spec:        `{"ociVersion": "2.0.0", "process": {"args": ["sh"]}, "root": {}}`,
+			expected:    `/ociVersion: value "2.0.0" does not match pattern "^1\\.0\\."`,
+		},
+		{
+			description: "string too long",
+			spec:        `{"ociVersion": "1.0.2", "hostname": "a-very-long-hostname", "process": {"args": ["sh"]}, "root": {}}`,
+			expected:    "/hostname: expected at most 16 characters, got 20",
+		},
+		{
+			description: "referenced definition",
+			spec:        `{"ociVersion": "1.0.2", "process": {"args": ["sh"], "user": {"uid": 70000}}, "root": {}}`,
+			expected:    "/process/user/uid: expected a maximum of 65535, got 70000",
+		},
+		{
+			description: "const mismatch",
+			spec:        `{"ociVersion": "1.0.2", "process": {"args": ["sh"]}, "root": {"readonly": false}}`,
+			expected:    "/root/readonly: expected true, got false",
+		},
+		{
+			description: "additional property not in enum",
+			spec:        `{"ociVersion": "1.0.2", "process": {"args": ["sh"]}, "root": {}, "annotations": {"a/b": "denied"}}`,
+			expected:    `/annotations/a~1b: value "denied" is not one of ["allowed","also-allowed"]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		err := validateSpecSchema([]byte(tc.spec), schemaPath)
+		require.Error(t, err, tc.description)
+		require.Contains(t, err.Error(), tc.expected, tc.description)
+	}
+
+	// All violations are reported.
+	err = validateSpecSchema([]byte(`{"ociVersion": "2.0.0", "process": {"args": []}}`), schemaPath)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `/: missing required property "root"; /ociVersion: value "2.0.0" does not match pattern "^1\\.0\\."; /process/args: expected at least 1 items, got 0`)
+}
+
+func TestLoadJSONSchemaInvalid(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	for _, schema := range []string{
+		`{"type": "object", "properties": {"a": {"uniqueItems": true}}}`,
+		`{"$ref": "#/definitions/missing"}`,
+		`{"$ref": "#/title", "title": "not a schema"}`,
+		`{"$ref": "other.json#/definitions/a"}`,
+		`{"pattern": "("}`,
+		`{"anyOf": []}`,
+		`not json`,
+	} {
+		_, err := loadJSONSchema(writeTestSchema(t, testDir, schema))
+		require.Error(t, err, schema)
+	}
+
+	_, err = loadJSONSchema(filepath.Join(testDir, "missing.json"))
+	require.Error(t, err)
+}
+
+func TestSpecSchemaCreate(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	schemaPath := writeTestSchema(t, testDir, `{"properties": {"hostname": {"enum": ["gpu"]}}}`)
+	configDir, err := writeTestConfig("[nvidia-container-runtime]\nspec-schema = \"" + schemaPath + "\"\n")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	require.NoError(t, generateNewRuntimeSpec())
+	original, err := ioutil.ReadFile(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+
+	cmdCreate := exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+	require.Error(t, cmdCreate.Run(), "runtime should reject a non-conforming spec")
+
+	unmodified, err := ioutil.ReadFile(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Equal(t, original, unmodified, "a non-conforming spec should not be modified")
+
+	writeTestSchema(t, testDir, `{"properties": {"hostname": {"enum": ["runc"]}}}`)
+	cmdCreate = exec.Command(nvidiaRuntime, "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Env = append(os.Environ(), configOverride+"="+configDir)
+	require.NoError(t, cmdCreate.Run(), "runtime should accept a conforming spec")
+
+	spec, err := getRuntimeSpec(filepath.Join(bundlePath, specFile))
+	require.NoError(t, err)
+	require.Equal(t, 1, nvidiaHookCount(spec.Hooks))
+}
@@ -0,0 +1,298 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// gzipMagic is the header identifying gzip-compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// readSpec reads and decodes the OCI specification stored at the specified
+// path. The file contents are decoded in a single pass. A gzip-compressed
+// file, identified by its header or a .gz extension, is decompressed first.
+func readSpec(path string) (*specs.Spec, error) {
+	jsonContent, err := readSpecContent(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSpec(jsonContent)
+}
+
+// readSpecContent returns the marshalled OCI specification stored at the
+// specified path, decompressing it if required.
+func readSpecContent(path string) ([]byte, error) {
+	jsonContent, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading OCI specification file: %v", err)
+	}
+
+	if isGzipSpec(path, jsonContent) {
+		jsonContent, err = gunzip(jsonContent)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing OCI specification file: %v", err)
+		}
+	}
+
+	return jsonContent, nil
+}
+
+// readBundleSpec reads the OCI specification of a bundle to be modified. If
+// spec-schema is set, the specification is validated against it first. If
+// warn-duplicate-keys is set, duplicate top-level keys are logged.
+func readBundleSpec(cfg *config, path string) (*specs.Spec, error) {
+	jsonContent, err := readSpecContent(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.warnDuplicateKeys {
+		for _, key := range getDuplicateKeys(jsonContent) {
+			logger.Infof("OCI specification has duplicate top-level key %q, using its last value", key)
+		}
+	}
+
+	if cfg.specSchema != "" {
+		err = validateSpecSchema(jsonContent, cfg.specSchema)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return parseSpec(jsonContent)
+}
+
+// isGzipSpec checks whether the OCI specification file at the specified path
+// with the specified contents is compressed.
+func isGzipSpec(path string, content []byte) bool {
+	return strings.HasSuffix(path, ".gz") || bytes.HasPrefix(content, gzipMagic)
+}
+
+func gunzip(content []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func gzipContent(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(content)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parseSpec parses the specified OCI specification.
+func parseSpec(jsonContent []byte) (*specs.Spec, error) {
+	spec := &specs.Spec{}
+	err := json.Unmarshal(jsonContent, spec)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling OCI specification: %v", err)
+	}
+
+	return spec, nil
+}
+
+// getDuplicateKeys returns the top-level keys occurring more than once in the
+// specified OCI specification, in the order of their first repetition. The
+// decoder keeps the last value of such a key. Malformed content yields no
+// keys, leaving the error to parseSpec.
+func getDuplicateKeys(jsonContent []byte) []string {
+	decoder := json.NewDecoder(bytes.NewReader(jsonContent))
+	token, err := decoder.Token()
+	if err != nil || token != json.Delim('{') {
+		return nil
+	}
+
+	seen := make(map[string]int)
+	var duplicates []string
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+		key, ok := token.(string)
+		if !ok {
+			return nil
+		}
+		var value json.RawMessage
+		err = decoder.Decode(&value)
+		if err != nil {
+			return nil
+		}
+
+		seen[key]++
+		if seen[key] == 2 {
+			duplicates = append(duplicates, key)
+		}
+	}
+	return duplicates
+}
+
+// writeSpecFile replaces the contents of the OCI specification file at the
+// specified path with the specified marshalled spec. The spec is written to a
+// uniquely named temporary file, which is then renamed, so that readers,
+// including concurrent writers, never see a partial file. The temporary file
+// is created in the specified temp-dir, or in the directory of the spec if
+// empty, see getSpecTempDir. The temporary file gets the specified mode if
+// any, and otherwise the mode of the existing file, whose ownership is
+// preserved as well, before it is renamed. A symlink is replaced by writing to
+// its target. The spec is compressed if the existing file is.
+func writeSpecFile(path string, jsonOutput []byte, tempDir string, fileMode *os.FileMode) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	mode := os.FileMode(0644)
+	var owner *syscall.Stat_t
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+		owner, _ = info.Sys().(*syscall.Stat_t)
+	}
+	if fileMode != nil {
+		mode = *fileMode
+	}
+
+	if isGzipSpec(path, readFileHeader(path, len(gzipMagic))) {
+		var err error
+		jsonOutput, err = gzipContent(jsonOutput)
+		if err != nil {
+			return fmt.Errorf("error compressing OCI specification: %v", err)
+		}
+	}
+
+	tmpFile, err := ioutil.TempFile(getSpecTempDir(path, tempDir), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// Removing the temporary file fails once it has been renamed.
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(jsonOutput)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if err == nil && owner != nil && (int(owner.Uid) != os.Geteuid() || int(owner.Gid) != os.Getegid()) {
+		err = tmpFile.Chown(int(owner.Uid), int(owner.Gid))
+	}
+	if err == nil {
+		// The mode is set after the ownership, since changing the owner
+		// clears the setuid and setgid bits.
+		err = tmpFile.Chmod(mode)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// getSpecTempDir returns the directory of the temporary file written before
+// the OCI specification file at the specified path is replaced. A rename is
+// only atomic within a filesystem, so the specified temp-dir is only used if
+// it is located on the same device as the spec. Otherwise, or if temp-dir is
+// empty, the directory of the spec is used.
+func getSpecTempDir(path string, tempDir string) string {
+	specDir := filepath.Dir(path)
+	if tempDir == "" {
+		return specDir
+	}
+
+	same, err := isSameDevice(tempDir, specDir)
+	if err != nil {
+		logger.Warnf("Error checking temp-dir %v, using %v: %v", tempDir, specDir, err)
+		return specDir
+	}
+	if !same {
+		logger.Warnf("temp-dir %v is not on the filesystem of %v, using %v for an atomic rename", tempDir, path, specDir)
+		return specDir
+	}
+	return tempDir
+}
+
+// isSameDevice checks whether the specified paths are located on the same
+// device.
+func isSameDevice(a string, b string) (bool, error) {
+	var statA, statB syscall.Stat_t
+	err := syscall.Stat(a, &statA)
+	if err != nil {
+		return false, err
+	}
+	err = syscall.Stat(b, &statB)
+	if err != nil {
+		return false, err
+	}
+	return statA.Dev == statB.Dev, nil
+}
+
+// readFileHeader returns up to size bytes from the start of the file at the
+// specified path. Errors result in an empty header.
+func readFileHeader(path string, size int) []byte {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	header := make([]byte, size)
+	n, _ := file.Read(header)
+	return header[:n]
+}
+
+// isLinuxSpec checks whether the specified spec targets Linux. Minimal specs
+// without any platform section are assumed to, while specs with a Windows or
+// Solaris section and no Linux section target another platform.
+func isLinuxSpec(spec *specs.Spec) bool {
+	return spec.Linux != nil || (spec.Windows == nil && spec.Solaris == nil)
+}
+
+// resolveRootfs returns the absolute path of the root filesystem of the
+// specified spec. A relative root path is relative to the specified bundle
+// directory, which is expected to be resolved already.
+func resolveRootfs(spec *specs.Spec, bundleDir string) (string, error) {
+	if spec.Root == nil || spec.Root.Path == "" {
+		return "", fmt.Errorf("no root filesystem in OCI specification")
+	}
+	if filepath.IsAbs(spec.Root.Path) {
+		return filepath.Clean(spec.Root.Path), nil
+	}
+	return filepath.Join(bundleDir, spec.Root.Path), nil
+}
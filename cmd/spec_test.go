@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveRootfs(t *testing.T) {
+	testCases := []struct {
+		description string
+		root        *specs.Root
+		expected    string
+		isError     bool
+	}{
+		{
+			description: "relative root path",
+			root:        &specs.Root{Path: "rootfs"},
+			expected:    "/run/bundle/rootfs",
+		},
+		{
+			description: "relative root path with parent reference",
+			root:        &specs.Root{Path: "../rootfs/"},
+			expected:    "/run/rootfs",
+		},
+		{
+			description: "absolute root path",
+			root:        &specs.Root{Path: "/var/lib/rootfs/"},
+			expected:    "/var/lib/rootfs",
+		},
+		{
+			description: "missing root",
+			isError:     true,
+		},
+		{
+			description: "empty root path",
+			root:        &specs.Root{},
+			isError:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		rootfs, err := resolveRootfs(&specs.Spec{Root: tc.root}, "/run/bundle")
+		if tc.isError {
+			require.Error(t, err, tc.description)
+			continue
+		}
+		require.NoError(t, err, tc.description)
+		require.Equal(t, tc.expected, rootfs, tc.description)
+	}
+}
+
+func TestWriteSpecFileConcurrent(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	shared := filepath.Join(testDir, specFile)
+	require.NoError(t, ioutil.WriteFile(shared, []byte("{}"), 0640))
+
+	const writers = 32
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			spec := &specs.Spec{Version: "1.0.2", Hostname: strings.Repeat(strconv.Itoa(i), 4096)}
+			jsonOutput, err := json.Marshal(spec)
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- writeSpecFile(shared, jsonOutput, "", nil)
+			errs <- writeSpecFile(filepath.Join(testDir, fmt.Sprintf("config-%v.json", i)), jsonOutput, "", nil)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	files, err := ioutil.ReadDir(testDir)
+	require.NoError(t, err)
+	require.Len(t, files, writers+1, "no temporary files should be left behind")
+
+	for _, file := range files {
+		spec, err := readSpec(filepath.Join(testDir, file.Name()))
+		require.NoError(t, err, file.Name())
+		require.Equal(t, "1.0.2", spec.Version, file.Name())
+	}
+
+	info, err := os.Stat(shared)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm(), "the mode of an existing file should be preserved")
+}
+
+func TestWriteSpecFileOwnership(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	uid, gid := os.Geteuid(), os.Getegid()
+	if uid == 0 {
+		// Only root can hand the spec to another owner.
+		uid, gid = 65534, 65534
+	}
+
+	path := filepath.Join(testDir, specFile)
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"ociVersion": "1.0.1"}`), 0640))
+	require.NoError(t, os.Chmod(path, 0640))
+	require.NoError(t, os.Chown(path, uid, gid))
+
+	checkFile := func(mode os.FileMode) {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, mode, info.Mode().Perm())
+		stat := info.Sys().(*syscall.Stat_t)
+		require.Equal(t, []int{uid, gid}, []int{int(stat.Uid), int(stat.Gid)}, "the owner of an existing file should be preserved")
+	}
+
+	require.NoError(t, writeSpecFile(path, []byte(`{"ociVersion": "1.0.2"}`), "", nil))
+	checkFile(0640)
+
+	// The file-mode replaces the mode of the existing file.
+	fileMode := os.FileMode(0600)
+	require.NoError(t, writeSpecFile(path, []byte(`{"ociVersion": "1.0.2"}`), "", &fileMode))
+	checkFile(0600)
+}
+
+func TestGzipSpecRoundTrip(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	original, err := ioutil.ReadFile(unmodifiedSpecFile)
+	require.NoError(t, err)
+	compressed, err := gzipContent(original)
+	require.NoError(t, err)
+
+	// A gzip-compressed spec is detected by its header as well as by its
+	// extension.
+	for _, name := range []string{"config.json.gz", specFile} {
+		path := filepath.Join(testDir, name)
+		require.NoError(t, ioutil.WriteFile(path, compressed, 0644))
+
+		spec, err := readSpec(path)
+		require.NoError(t, err, name)
+		spec.Hostname = "gzipped"
+		jsonOutput, err := json.Marshal(spec)
+		require.NoError(t, err)
+		require.NoError(t, writeSpecFile(path, jsonOutput, "", nil))
+
+		content, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.True(t, bytes.HasPrefix(content, gzipMagic), "%v should be written back compressed", name)
+
+		spec, err = readSpec(path)
+		require.NoError(t, err, name)
+		require.Equal(t, "gzipped", spec.Hostname)
+	}
+
+	path := filepath.Join(testDir, "plain.json")
+	require.NoError(t, writeSpecFile(path, original, "", nil))
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, original, content, "an uncompressed spec should be written uncompressed")
+
+	path = filepath.Join(testDir, "invalid.json.gz")
+	require.NoError(t, ioutil.WriteFile(path, original, 0644))
+	_, err = readSpec(path)
+	require.Error(t, err, "a .gz file must be compressed")
+}
+
+func TestGetDuplicateKeys(t *testing.T) {
+	require.Equal(t, []string{"hostname", "ociVersion"}, getDuplicateKeys([]byte(`{"ociVersion": "1.0.1", "hostname": "a", "process": {"env": [], "cwd": "/", "env": []}, "hostname": "b", "ociVersion": "1.0.2", "hostname": "c"}`)))
+	require.Empty(t, getDuplicateKeys([]byte(`{"ociVersion": "1.0.2", "process": {"cwd": "/", "cwd": "/tmp"}}`)), "only top-level keys should be checked")
+	require.Empty(t, getDuplicateKeys([]byte(`{"ociVersion": `)))
+	require.Empty(t, getDuplicateKeys([]byte(`[]`)))
+}
+
+func TestWarnDuplicateKeys(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	path := filepath.Join(testDir, specFile)
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"ociVersion": "1.0.2", "hostname": "first", "hostname": "last"}`), 0644))
+
+	defer func(l *Logger) { logger = l }(logger)
+	for _, warn := range []bool{false, true} {
+		var buf bytes.Buffer
+		logger = NewLogger()
+		logger.sinks = append(logger.sinks, &buf)
+		logger.SetLogLevel(logrus.InfoLevel)
+
+		spec, err := readBundleSpec(&config{warnDuplicateKeys: warn}, path)
+		require.NoError(t, err)
+		require.Equal(t, "last", spec.Hostname, "the last value of a duplicate key should be used")
+		require.Equal(t, warn, strings.Contains(buf.String(), `duplicate top-level key "hostname"`), buf.String())
+	}
+}
+
+func TestWriteSpecFileTempDir(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	bundleDir := filepath.Join(testDir, "bundle")
+	tempDir := filepath.Join(testDir, "tmp")
+	require.NoError(t, os.Mkdir(bundleDir, 0755))
+	require.NoError(t, os.Mkdir(tempDir, 0755))
+	path := filepath.Join(bundleDir, specFile)
+
+	require.Equal(t, bundleDir, getSpecTempDir(path, ""))
+	require.Equal(t, tempDir, getSpecTempDir(path, tempDir), "a temp-dir on the same filesystem should be used")
+	require.Equal(t, bundleDir, getSpecTempDir(path, filepath.Join(testDir, "missing")), "a missing temp-dir should not be used")
+
+	require.NoError(t, writeSpecFile(path, []byte(`{"ociVersion": "1.0.2"}`), tempDir, nil))
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, `{"ociVersion": "1.0.2"}`, string(content))
+	for dir, count := range map[string]int{bundleDir: 1, tempDir: 0} {
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, files, count, "no temporary file should be left in %v", dir)
+	}
+
+	// A temp-dir on another filesystem is not used, since the rename would
+	// fail or not be atomic.
+	var otherDevice string
+	for _, dir := range []string{"/dev/shm", "/dev", "/proc"} {
+		if same, err := isSameDevice(dir, bundleDir); err == nil && !same {
+			otherDevice = dir
+			break
+		}
+	}
+	if otherDevice == "" {
+		t.Skip("no directory on another filesystem")
+	}
+
+	defer func(l *Logger) { logger = l }(logger)
+	var buf bytes.Buffer
+	logger = NewLogger()
+	logger.sinks = append(logger.sinks, &buf)
+	logger.SetLogLevel(logrus.InfoLevel)
+
+	require.Equal(t, bundleDir, getSpecTempDir(path, otherDevice))
+	require.Contains(t, buf.String(), "is not on the filesystem of")
+	require.NoError(t, writeSpecFile(path, []byte(`{"ociVersion": "1.0.1"}`), otherDevice, nil))
+	content, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, `{"ociVersion": "1.0.1"}`, string(content))
+}
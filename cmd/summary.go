@@ -0,0 +1,83 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// invocationStart is the time at which the current invocation started.
+var invocationStart = time.Now()
+
+// logCreateSummary logs a single line summarizing a successful create, for
+// aggregation by log-based tooling. The fields are formatted as key=value
+// pairs: the container id, the bundle, the hook stages that the NVIDIA hook is
+// inserted into or "skipped", the low-level runtime and the elapsed time.
+func logCreateSummary(cfg *config, args *args) {
+	if !logger.IsLevelEnabled(logrus.InfoLevel) {
+		return
+	}
+
+	_, _, subcommandArgs := splitRuntimeArgs(getRuntimeArgs(os.Args[1:]))
+
+	var bundle string
+	hook := "skipped"
+	if configFilePath, err := args.getConfigFilePath(); err == nil {
+		bundle = filepath.Dir(configFilePath)
+		if abs, err := filepath.Abs(bundle); err == nil {
+			bundle = abs
+		}
+		if spec, err := readSpec(configFilePath); err == nil {
+			if stages := getNVIDIAHookStages(spec); len(stages) > 0 {
+				hook = strings.Join(stages, ",")
+			}
+		}
+	}
+
+	var runtime string
+	if argv, err := getRuncCommand(cfg.runtime, os.Args[1:]); err == nil {
+		runtime = argv[0]
+	}
+
+	logger.Infof("Create summary: %v", formatSummaryFields([]string{
+		"id", getContainerID(subcommandArgs),
+		"bundle", bundle,
+		"hook", hook,
+		"runtime", runtime,
+		"elapsed", time.Since(invocationStart).Round(time.Microsecond).String(),
+	}))
+}
+
+// formatSummaryFields formats the specified alternating keys and values as
+// key=value pairs, quoting values that are empty or contain spaces or quotes.
+func formatSummaryFields(fields []string) string {
+	var pairs []string
+	for i := 0; i+1 < len(fields); i += 2 {
+		value := fields[i+1]
+		if value == "" || strings.ContainsAny(value, " \t\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		pairs = append(pairs, fields[i]+"="+value)
+	}
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatSummaryFields(t *testing.T) {
+	require.Equal(t, `id=abc bundle="/my bundle" runtime=""`, formatSummaryFields([]string{"id", "abc", "bundle", "/my bundle", "runtime", ""}))
+}
+
+func TestCreateSummary(t *testing.T) {
+	err := generateNewRuntimeSpec()
+	require.NoError(t, err)
+
+	var stderr bytes.Buffer
+	cmdCreate := exec.Command(nvidiaRuntime, "--log-to-stderr", "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Stderr = &stderr
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	bundle, err := filepath.Abs(bundlePath)
+	require.NoError(t, err)
+	runc, err := exec.LookPath("runc")
+	require.NoError(t, err)
+
+	summary := regexp.MustCompile(`Create summary: (.*)`).FindStringSubmatch(stderr.String())
+	require.NotNil(t, summary, stderr.String())
+	require.Regexp(t, `^id=testcontainer bundle=`+regexp.QuoteMeta(bundle)+` hook=prestart runtime=`+regexp.QuoteMeta(runc)+` elapsed=[0-9.]+[µm]?s$`, summary[1])
+
+	// No summary is logged above the info level.
+	err = generateNewRuntimeSpec()
+	require.NoError(t, err)
+	stderr.Reset()
+	cmdCreate = exec.Command(nvidiaRuntime, "--log-to-stderr", "--log-level", "warn", "create", "--bundle", bundlePath, "testcontainer")
+	cmdCreate.Stderr = &stderr
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+	require.NotContains(t, stderr.String(), "Create summary")
+}
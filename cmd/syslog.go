@@ -0,0 +1,130 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The destinations of the log selected by log-destination. logDestinationFile
+// logs to the debug file, logDestinationStderr to stderr and
+// logDestinationSyslog to the local syslog.
+const (
+	logDestinationFile   = "file"
+	logDestinationStderr = "stderr"
+	logDestinationSyslog = "syslog"
+
+	defaultSyslogFacility = "user"
+	defaultSyslogTag      = "nvidia-container-runtime"
+)
+
+// syslogNetwork and syslogAddress select the syslog daemon logged to with
+// log-destination = "syslog". Empty values select the local daemon.
+var (
+	syslogNetwork = ""
+	syslogAddress = ""
+)
+
+// syslogFacilities maps the names of the syslog facilities to their values.
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// getSyslogFacility returns the syslog facility of the specified name.
+func getSyslogFacility(name string) (syslog.Priority, error) {
+	facility, ok := syslogFacilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility %q", name)
+	}
+	return facility, nil
+}
+
+// syslogHook writes log entries to syslog with the severity matching their
+// level.
+type syslogHook struct {
+	writer *syslog.Writer
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	message := strings.TrimSuffix(entry.Message, "\n")
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return h.writer.Crit(message)
+	case logrus.ErrorLevel:
+		return h.writer.Err(message)
+	case logrus.WarnLevel:
+		return h.writer.Warning(message)
+	case logrus.InfoLevel:
+		return h.writer.Info(message)
+	}
+	return h.writer.Debug(message)
+}
+
+// LogToSyslog adds syslog as a sink. An empty network and address select the
+// local syslog daemon.
+func (l *Logger) LogToSyslog(network string, address string, facility syslog.Priority, tag string) error {
+	writer, err := syslog.Dial(network, address, facility|syslog.LOG_INFO, tag)
+	if err != nil {
+		return fmt.Errorf("error connecting to syslog: %v", err)
+	}
+
+	l.syslog = writer
+	l.AddHook(&syslogHook{writer: writer})
+	l.updateOutput()
+
+	return nil
+}
+
+// CloseSyslog closes the connection to syslog if any.
+func (l *Logger) CloseSyslog() error {
+	if l.syslog == nil {
+		return nil
+	}
+
+	l.ReplaceHooks(make(logrus.LevelHooks))
+	err := l.syslog.Close()
+	l.syslog = nil
+	l.updateOutput()
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSyslogFacility(t *testing.T) {
+	facility, err := getSyslogFacility("daemon")
+	require.NoError(t, err)
+	require.Equal(t, syslog.LOG_DAEMON, facility)
+
+	facility, err = getSyslogFacility("LOCAL3")
+	require.NoError(t, err)
+	require.Equal(t, syslog.LOG_LOCAL3, facility)
+
+	_, err = getSyslogFacility("local8")
+	require.Error(t, err)
+}
+
+func TestLogToSyslog(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("syslog is only supported on Linux")
+	}
+
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	address := filepath.Join(testDir, "log")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: address, Net: "unixgram"})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	receive := func() string {
+		buf := make([]byte, 4096)
+		require.NoError(t, listener.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, err := listener.Read(buf)
+		require.NoError(t, err)
+		return string(buf[:n])
+	}
+
+	l := NewLogger()
+	require.NoError(t, l.LogToSyslog("unixgram", address, syslog.LOG_LOCAL3, "test-tag"))
+	defer l.CloseSyslog()
+
+	// Entries below the log level are not sent.
+	l.Debugf("debug entry")
+	l.Warnf("warning entry")
+	message := receive()
+	require.True(t, strings.HasPrefix(message, "<156>"), "local3.warning expected: %v", message)
+	require.Contains(t, message, "test-tag")
+	require.Contains(t, message, "warning entry")
+
+	l.Printf("info entry")
+	message = receive()
+	require.True(t, strings.HasPrefix(message, "<158>"), "local3.info expected: %v", message)
+	require.Contains(t, message, "info entry")
+
+	require.NoError(t, l.CloseSyslog())
+	require.Nil(t, l.syslog)
+}
+
+func TestStartLoggingSyslogFallback(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	defer func(network, address string) {
+		syslogNetwork, syslogAddress = network, address
+	}(syslogNetwork, syslogAddress)
+	syslogNetwork, syslogAddress = "unixgram", filepath.Join(testDir, "missing")
+
+	debugFile := filepath.Join(testDir, "debug.log")
+	cfg := &config{
+		debugFilePath:  debugFile,
+		logDestination: logDestinationSyslog,
+		syslogFacility: syslog.LOG_USER,
+		syslogTag:      defaultSyslogTag,
+	}
+	require.NoError(t, startLogging(cfg))
+	logger.CloseFile()
+
+	content, err := ioutil.ReadFile(debugFile)
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(content), "instead of syslog"), string(content))
+}
@@ -0,0 +1,82 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// invocationTimeoutEnvvar bounds the duration of an invocation of the runtime,
+// including loading the config, modifying the spec and running child
+// processes. Since it also covers loading the config, it is read from the
+// environment rather than from the config. The value is a duration such as
+// "30s", or a number of seconds.
+const invocationTimeoutEnvvar = "NVIDIA_CONTAINER_RUNTIME_TIMEOUT"
+
+var (
+	// invocationCtx is the context of the current invocation. Fetching the
+	// remote config and the child processes of the runtime are bound to it,
+	// so that they are canceled once the invocation timeout is exceeded.
+	invocationCtx     = context.Background()
+	invocationTimeout time.Duration
+)
+
+// startInvocationTimeout starts the invocation timeout specified by the value of
+// invocationTimeoutEnvvar. An empty value disables the timeout. The returned
+// function releases the resources of the timeout.
+func startInvocationTimeout(value string) (context.CancelFunc, error) {
+	if value == "" {
+		return func() {}, nil
+	}
+
+	timeout, err := parseInvocationTimeout(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v %q: %v", invocationTimeoutEnvvar, value, err)
+	}
+
+	var cancel context.CancelFunc
+	invocationTimeout = timeout
+	invocationCtx, cancel = context.WithTimeout(context.Background(), timeout)
+	return cancel, nil
+}
+
+func parseInvocationTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, atoiErr := strconv.Atoi(value)
+		if atoiErr != nil {
+			return 0, fmt.Errorf("expected a duration or a number of seconds")
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("expected a positive duration")
+	}
+	return timeout, nil
+}
+
+// checkInvocationTimeout returns an error if the invocation timeout has been
+// exceeded.
+func checkInvocationTimeout() error {
+	if invocationCtx.Err() == context.DeadlineExceeded {
+		return withCategory(errorCategoryTimeout, fmt.Errorf("invocation timed out after %v", invocationTimeout))
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInvocationTimeout(t *testing.T) {
+	timeout, err := parseInvocationTimeout("1m30s")
+	require.NoError(t, err)
+	require.Equal(t, 90*time.Second, timeout)
+
+	timeout, err = parseInvocationTimeout("20")
+	require.NoError(t, err)
+	require.Equal(t, 20*time.Second, timeout)
+
+	for _, value := range []string{"0", "-1s", "soon"} {
+		_, err := parseInvocationTimeout(value)
+		require.Error(t, err, value)
+	}
+}
+
+func TestInvocationTimeoutSlowConfigURL(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cacheDir, err := ioutil.TempDir("", "nvidia-container-runtime-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	// The fetch timeout of the config is well above the invocation timeout.
+	testDir, err := writeTestConfig(fmt.Sprintf("[nvidia-container-runtime]\nconfig-url = %q\nconfig-url-allow-insecure = true\nconfig-url-timeout = 30\nconfig-url-cache = %q\n", server.URL, filepath.Join(cacheDir, "config.toml")))
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	defer func(ctx context.Context) { invocationCtx = ctx }(invocationCtx)
+	os.Setenv(configOverride, testDir)
+	cancel, err := startInvocationTimeout("200ms")
+	require.NoError(t, err)
+	defer cancel()
+
+	start := time.Now()
+	_, err = getConfig()
+	require.Error(t, err)
+	require.Less(t, int64(time.Since(start)), int64(10*time.Second))
+	require.EqualError(t, checkInvocationTimeout(), "invocation timed out after 200ms")
+
+	cmd := exec.Command(nvidiaRuntime, "state", "testcontainer")
+	cmd.Env = append(os.Environ(), configOverride+"="+testDir, invocationTimeoutEnvvar+"=200ms")
+	start = time.Now()
+	require.Error(t, cmd.Run(), "runtime should fail once the invocation timeout is exceeded")
+	require.Less(t, int64(time.Since(start)), int64(10*time.Second))
+}
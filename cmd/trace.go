@@ -0,0 +1,68 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"runtime/trace"
+	"sync"
+)
+
+// stopInvocationTrace stops the execution trace of the current invocation, if
+// any. It is called before runc replaces the current process, since deferred
+// functions do not run in that case.
+var stopInvocationTrace = func() {}
+
+// startInvocationTrace writes a Go execution trace of the current invocation
+// to the specified file, for analysis with "go tool trace". Errors are logged
+// rather than returned, since tracing must not affect the invocation.
+func startInvocationTrace(path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		logger.Warnf("Error creating trace file: %v", err)
+		return
+	}
+
+	err = trace.Start(file)
+	if err != nil {
+		logger.Warnf("Error starting trace: %v", err)
+		file.Close()
+		return
+	}
+
+	var once sync.Once
+	stopInvocationTrace = func() {
+		once.Do(func() {
+			trace.Stop()
+			err := file.Close()
+			if err != nil {
+				logger.Warnf("Error closing trace file: %v", err)
+			}
+		})
+	}
+}
+
+// getTraceFile returns the value of the --trace flag in the specified argv.
+// The trace is started before the config is loaded, so the flag is looked up
+// ahead of the regular processing of the command line.
+func getTraceFile(argv []string) string {
+	args, _, err := parseArgs(argv)
+	if err != nil {
+		return ""
+	}
+	return args.traceFile
+}
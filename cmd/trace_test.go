@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetTraceFile(t *testing.T) {
+	require.Equal(t, "/tmp/trace.out", getTraceFile([]string{"--trace", "/tmp/trace.out", "create", "--bundle", "/b", "id"}))
+	require.Equal(t, "/tmp/trace.out", getTraceFile([]string{"--trace=/tmp/trace.out", "state", "id"}))
+	require.Equal(t, "", getTraceFile([]string{"create", "--bundle", "/b", "id"}))
+	require.Equal(t, []string{"state", "id"}, getRuntimeArgs([]string{"--trace", "/tmp/trace.out", "state", "id"}))
+}
+
+func TestTrace(t *testing.T) {
+	err := generateNewRuntimeSpec()
+	require.NoError(t, err)
+
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-trace")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	traceFile := filepath.Join(testDir, "trace.out")
+	cmdCreate := exec.Command(nvidiaRuntime, "--trace", traceFile, "create", "--bundle", bundlePath, "testcontainer")
+	require.NoError(t, cmdCreate.Run(), "runtime should not return an error")
+
+	info, err := os.Stat(traceFile)
+	require.NoError(t, err, "trace file should be created")
+	require.NotZero(t, info.Size(), "trace file should not be empty")
+
+	// The trace does not change the exit status of a failing invocation.
+	cmdCreate = exec.Command(nvidiaRuntime, "--trace", traceFile, "create", "--bundle")
+	require.Error(t, cmdCreate.Run(), "runtime should return an error")
+}
@@ -0,0 +1,80 @@
+/*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// runVerifyHook implements the verify-hook command, which checks that the
+// NVIDIA hook resolved by the runtime exists and is executable. If hook-sha256
+// is configured, the checksum of the hook has to match as well.
+func runVerifyHook(cfg *config) error {
+	path, err := getHookPath()
+	if err != nil {
+		return fmt.Errorf("error locating NVIDIA hook: %v", err)
+	}
+	return verifyHook(os.Stdout, path, cfg.hookSHA256)
+}
+
+// verifyHook verifies the hook at the specified path and writes the result of
+// the verification to w. An empty checksum is not checked.
+func verifyHook(w io.Writer, path string, expectedSHA256 string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error checking NVIDIA hook: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("NVIDIA hook %v is not a regular file", path)
+	}
+	if info.Mode()&0111 == 0 {
+		return fmt.Errorf("NVIDIA hook %v is not executable", path)
+	}
+
+	checksum, err := getFileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if expectedSHA256 != "" && !strings.EqualFold(checksum, expectedSHA256) {
+		return fmt.Errorf("checksum mismatch for NVIDIA hook %v: expected sha256 %v, got %v", path, strings.ToLower(expectedSHA256), checksum)
+	}
+
+	_, err = fmt.Fprintf(w, "Hook path: %v\nHook sha256: %v\n", path, checksum)
+	return err
+}
+
+// getFileSHA256 returns the hex encoded SHA-256 checksum of the specified
+// file.
+func getFileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("error opening %v: %v", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", fmt.Errorf("error reading %v: %v", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
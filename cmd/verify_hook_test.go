@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyHook(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "nvidia-container-runtime-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	hook := filepath.Join(testDir, hookBinary)
+	require.NoError(t, ioutil.WriteFile(hook, []byte("hook"), 0755))
+	// printf hook | sha256sum
+	checksum := "0648298b48be031996277ae472115a46e7964d2ac3882e61b84351f3c3f8a547"
+
+	var output bytes.Buffer
+	require.NoError(t, verifyHook(&output, hook, ""))
+	require.Equal(t, "Hook path: "+hook+"\nHook sha256: "+checksum+"\n", output.String())
+
+	require.NoError(t, verifyHook(&bytes.Buffer{}, hook, checksum))
+
+	err = verifyHook(&bytes.Buffer{}, hook, "0000000000000000000000000000000000000000000000000000000000000000")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "checksum mismatch")
+
+	require.Error(t, verifyHook(&bytes.Buffer{}, filepath.Join(testDir, "missing"), ""))
+
+	require.NoError(t, os.Chmod(hook, 0644))
+	require.Error(t, verifyHook(&bytes.Buffer{}, hook, ""))
+}
+
+func TestGetConfigHookSHA256(t *testing.T) {
+	for _, value := range []string{"abc", "not hex", "7e3ce52dba10949ea7ddd4ab63f4b145"} {
+		testDir, err := writeTestConfig("[nvidia-container-runtime]\nhook-sha256 = \"" + value + "\"")
+		require.NoError(t, err)
+		defer os.RemoveAll(testDir)
+		os.Setenv(configOverride, testDir)
+
+		_, err = getConfig()
+		require.Error(t, err, value)
+	}
+}
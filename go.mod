@@ -3,9 +3,10 @@ module github.com/nvidia/nvidia-container-runtime
 go 1.16
 
 require (
-	github.com/opencontainers/runtime-spec v1.0.1
+	github.com/opencontainers/runtime-spec v1.0.2
 	github.com/pelletier/go-toml v1.4.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.4.0
 	github.com/tsaikd/KDGoLib v0.0.0-20191001134900-7f3cf518e07d
+	gopkg.in/yaml.v2 v2.2.2
 )